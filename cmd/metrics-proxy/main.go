@@ -2,83 +2,1042 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
+	"math"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/canonical/metrics-k8s-proxy/internal/aggregate"
+	"github.com/canonical/metrics-k8s-proxy/internal/config"
 	"github.com/canonical/metrics-k8s-proxy/internal/handlers"
+	"github.com/canonical/metrics-k8s-proxy/internal/health"
 	"github.com/canonical/metrics-k8s-proxy/internal/k8s"
+	"github.com/canonical/metrics-k8s-proxy/internal/logging"
+	"github.com/canonical/metrics-k8s-proxy/internal/otlp"
+	"github.com/canonical/metrics-k8s-proxy/internal/relabel"
+	"github.com/canonical/metrics-k8s-proxy/internal/remotewrite"
+	"github.com/canonical/metrics-k8s-proxy/internal/selfmetrics"
+	"github.com/canonical/metrics-k8s-proxy/internal/tracing"
 	"github.com/canonical/metrics-k8s-proxy/internal/util"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/trace"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
 
 	"github.com/gorilla/mux"
 )
 
-const defaultScrapeTimeout = 9 * time.Second
+const (
+	defaultScrapeTimeout       = 9 * time.Second
+	defaultScrapeTimeoutOffset = 500 * time.Millisecond
+	defaultShutdownGracePeriod = 15 * time.Second
+	// Without BACKGROUND_SCRAPE_STALENESS, a pod is reported down after missing this many background scrapes.
+	defaultStalenessIntervals = 2
 
-// Parses the label selector, timeout, and port from environment variables.
-func ParseEnvVars() (map[string]string, time.Duration, string, error) {
+	connectBackoffInitial = time.Second
+	connectBackoffCap     = 30 * time.Second
+
+	defaultOTLPInterval       = 30 * time.Second
+	defaultOTLPTracesInterval = 5 * time.Second
+	defaultTracesSampleRatio  = 1.0
+
+	defaultRemoteWriteInterval    = 30 * time.Second
+	defaultRemoteWriteQueueSize   = 10
+	defaultRemoteWriteMaxAttempts = 5
+	remoteWriteBackoffInitial     = time.Second
+	remoteWriteBackoffCap         = 30 * time.Second
+
+	defaultMaxIdleConnsPerHost = 2
+	defaultKeepAlive           = 90 * time.Second
+	defaultDialTimeout         = 30 * time.Second
+	defaultTLSHandshakeTimeout = 10 * time.Second
+
+	defaultScrapeMaxAttempts  = 1
+	defaultScrapeRetryBackoff = 100 * time.Millisecond
+
+	defaultCircuitBreakerCooldown = time.Minute
+
+	defaultLogErrorInterval = time.Minute
+
+	// Readiness component for the Kubernetes client
+	kubernetesComponent = "kubernetes"
+
+	// Namespace of the proxy's own pod, as mounted with its service account token
+	serviceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+)
+
+// Process exit codes.
+const (
+	exitOK    = 0 // Clean shutdown, or --help
+	exitError = 1 // The proxy failed while running
+	exitUsage = 2 // Invalid configuration
+)
+
+// Parses the scrape jobs, timeout, and port from environment variables.
+// Jobs come either from the file named by SCRAPE_JOBS_FILE or, for a single job, from POD_LABEL_SELECTOR.
+func ParseEnvVars() (config.Config, error) {
 	labelSelector := os.Getenv("POD_LABEL_SELECTOR")
-	scrapeTimeoutEnv := os.Getenv("SCRAPE_TIMEOUT")
+	jobsFile := os.Getenv("SCRAPE_JOBS_FILE")
 	port := os.Getenv("PORT")
 
+	if port == "" {
+		port = "15090" // Default port value
+	}
+
+	cfg := config.Config{Port: port, SDFile: os.Getenv("SD_FILE")}
+	durations := []struct {
+		name     string
+		fallback time.Duration
+		target   *time.Duration
+	}{
+		{"SCRAPE_TIMEOUT", defaultScrapeTimeout, &cfg.ScrapeTimeout},
+		{"SCRAPE_TIMEOUT_OFFSET", defaultScrapeTimeoutOffset, &cfg.ScrapeTimeoutOffset},
+		{"SHUTDOWN_GRACE_PERIOD", defaultShutdownGracePeriod, &cfg.ShutdownGracePeriod},
+		{"COALESCE_WINDOW", 0, &cfg.CoalesceWindow},
+		{"CACHE_TTL", 0, &cfg.CacheTTL},
+		{"BACKGROUND_SCRAPE_INTERVAL", 0, &cfg.BackgroundScrapeInterval},
+		{"BACKGROUND_SCRAPE_STALENESS", 0, &cfg.BackgroundScrapeStaleness},
+	}
+	for _, d := range durations {
+		value, err := parseDurationEnv(d.name, d.fallback)
+		if err != nil {
+			return config.Config{}, err
+		}
+		*d.target = value
+	}
+	if cfg.BackgroundScrapeInterval < 0 {
+		return config.Config{}, errors.New("invalid value for BACKGROUND_SCRAPE_INTERVAL: must not be negative")
+	}
+	if cfg.BackgroundScrapeStaleness <= 0 {
+		cfg.BackgroundScrapeStaleness = defaultStalenessIntervals * cfg.BackgroundScrapeInterval
+	}
+	remoteWrite, err := parseRemoteWriteEnv()
+	if err != nil {
+		return config.Config{}, err
+	}
+	if debug := os.Getenv("DEBUG_ENDPOINTS"); debug != "" {
+		if cfg.DebugEndpoints, err = strconv.ParseBool(debug); err != nil {
+			return config.Config{}, fmt.Errorf("invalid value for DEBUG_ENDPOINTS: %w", err)
+		}
+	}
+	cfg.RemoteWrite = remoteWrite
+	if cfg.OTLP, err = parseOTLPEnv(); err != nil {
+		return config.Config{}, err
+	}
+	if cfg.Tracing, err = parseTracingEnv(); err != nil {
+		return config.Config{}, err
+	}
+	if cfg.Sharding, err = parseShardingEnv(); err != nil {
+		return config.Config{}, err
+	}
+	if cfg.LeaderElection, err = parseLeaderElectionEnv(); err != nil {
+		return config.Config{}, err
+	}
+	if cfg.Transport, err = parseTransportEnv(); err != nil {
+		return config.Config{}, err
+	}
+	if cfg.Retry, err = parseRetryEnv(); err != nil {
+		return config.Config{}, err
+	}
+	if cfg.CircuitBreaker.Threshold, err = parsePositiveIntEnv("CIRCUIT_BREAKER_THRESHOLD", 0); err != nil {
+		return config.Config{}, err
+	}
+	if cfg.CircuitBreaker.Cooldown, err = parsePositiveDurationEnv("CIRCUIT_BREAKER_COOLDOWN",
+		defaultCircuitBreakerCooldown); err != nil {
+		return config.Config{}, err
+	}
+	if cfg.Limits, err = parseLimitsEnv(); err != nil {
+		return config.Config{}, err
+	}
+	if cfg.Logging, err = parseLoggingEnv(); err != nil {
+		return config.Config{}, err
+	}
+	if cfg.CardinalityTopN, err = parsePositiveIntEnv("CARDINALITY_TOP_N", 0); err != nil {
+		return config.Config{}, err
+	}
+
+	if jobsFile != "" {
+		if labelSelector != "" {
+			return config.Config{}, errors.New("POD_LABEL_SELECTOR and SCRAPE_JOBS_FILE are mutually exclusive")
+		}
+		if cfg.Jobs, err = config.LoadJobs(jobsFile, cfg.ScrapeTimeout); err != nil {
+			return config.Config{}, err
+		}
+
+		return cfg, nil
+	}
+
 	// Parse the labels
 	if labelSelector == "" {
-		return nil, 0, "", errors.New("environment variable POD_LABEL_SELECTOR is required")
+		return config.Config{}, errors.New("environment variable POD_LABEL_SELECTOR is required")
 	}
 	labels := util.ParseLabels(labelSelector)
 	if len(labels) == 0 {
-		return nil, 0, "", errors.New("invalid or empty label selector provided, please ensure valid labels are set")
+		return config.Config{}, errors.New("invalid or empty label selector provided, please ensure valid labels are set")
 	}
-	if port == "" {
-		port = "15090" // Default port value
+	cfg.Jobs = []config.Job{{
+		Name:             config.DefaultJobName,
+		PodLabelSelector: labelSelector,
+		ScrapeTimeout:    config.Duration(cfg.ScrapeTimeout),
+		Labels:           labels,
+	}}
+
+	return cfg, nil
+}
+
+// Initializes the Kubernetes client, retrying with backoff until it succeeds or ctx is cancelled.
+func initK8sClient(ctx context.Context, readiness *health.Readiness) (kubernetes.Interface, error) {
+	backoff := wait.Backoff{
+		Duration: connectBackoffInitial,
+		Factor:   2,   //nolint:mnd // Double the delay after every failed attempt
+		Jitter:   0.1, //nolint:mnd // Spread retries of replicas restarted together
+		Steps:    math.MaxInt32,
+		Cap:      connectBackoffCap,
+	}
+
+	clientset, err := k8s.ConnectWithBackoff(ctx, backoff, k8s.DefaultBuildConfigFunc, k8s.DefaultNewClientsetFunc,
+		func(connectErr error, retryIn time.Duration) {
+			logging.FromContext(ctx).ErrorContext(ctx, "Error building Kubernetes config",
+				"error", connectErr, "retry_in", retryIn)
+			readiness.NotReady(kubernetesComponent, connectErr.Error())
+		})
+	if err != nil {
+		return nil, err
+	}
+	readiness.Ready(kubernetesComponent)
+
+	return clientset, nil
+}
+
+// Connects to Kubernetes and runs one pod informer per watch scope until ctx is cancelled, along with the shard
+// membership watch and leader election if enabled.
+// The proxy only becomes ready once every informer has synced, and stays ready through later API server
+// outages, serving the last-known pods while the informers reconnect.
+func watchPods(ctx context.Context, jobs []handlers.Job, membership *k8s.ShardMembership,
+	elector *k8s.LeaderElector, readiness *health.Readiness, watchErrors *selfmetrics.Counter) {
+	clientset, err := initK8sClient(ctx, readiness)
+	if err != nil {
+		// Only happens when shutting down
+		return
+	}
+
+	// Jobs watching the same namespace share one informer, which stops once ctx is cancelled
+	watchers := make([]*k8s.PodScrapeWatcher, 0, len(jobs))
+	for _, job := range jobs {
+		watchers = append(watchers, job.Watcher)
+	}
+
+	logger := logging.FromContext(ctx)
+	var wg sync.WaitGroup
+	for _, scope := range k8s.PlanWatchScopes(watchers) {
+		component := fmt.Sprintf("pod informer (namespace %q)", scope.Namespace)
+		readiness.NotReady(component, "waiting for the pod cache to sync")
+
+		var synced atomic.Bool
+		scope.OnSynced = func() {
+			logger.InfoContext(ctx, "Pod cache synced", "namespace", scope.Namespace)
+			synced.Store(true)
+			readiness.Ready(component)
+		}
+		scope.OnWatchError = func(watchErr error) {
+			watchErrors.Inc()
+			logger.ErrorContext(ctx, "Error watching pods", "namespace", scope.Namespace, "error", watchErr)
+			// Until the first sync the error is why the proxy isn't ready; afterwards the last-known pods are served
+			if !synced.Load() {
+				readiness.NotReady(component, watchErr.Error())
+			}
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if watchErr := k8s.WatchPodGroup(ctx, clientset, scope); watchErr != nil {
+				logger.ErrorContext(ctx, "Error starting pod informer", "namespace", scope.Namespace, "error", watchErr)
+				readiness.NotReady(component, watchErr.Error())
+			}
+		}()
+	}
+	if membership != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			watchShardMembers(ctx, clientset, *membership, readiness, watchErrors)
+		}()
+	}
+	// Standby replicas keep their informers warm, so that they can take over without a resync
+	if elector != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if electErr := elector.Run(ctx, clientset); electErr != nil {
+				logger.ErrorContext(ctx, "Error starting leader election", "error", electErr)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// Keeps the shard members in sync with the replicas behind the sharding Service.
+// Until the members are first known, the replica isn't ready, since it would claim every pod for itself.
+func watchShardMembers(ctx context.Context, clientset kubernetes.Interface, membership k8s.ShardMembership,
+	readiness *health.Readiness, watchErrors *selfmetrics.Counter) {
+	const component = "shard membership"
+	logger := logging.FromContext(ctx).With("service", membership.Service, "namespace", membership.Namespace)
+	readiness.NotReady(component, fmt.Sprintf("waiting for the endpoints of service %q", membership.Service))
+
+	var synced atomic.Bool
+	membership.OnSynced = func() {
+		logger.InfoContext(ctx, "Shard members synced", "members", membership.Sharder.Members())
+		synced.Store(true)
+		readiness.Ready(component)
+	}
+	membership.OnWatchError = func(watchErr error) {
+		watchErrors.Inc()
+		logger.ErrorContext(ctx, "Error watching the endpoints of the sharding service", "error", watchErr)
+		if !synced.Load() {
+			readiness.NotReady(component, watchErr.Error())
+		}
+	}
+	if err := membership.Watch(ctx, clientset); err != nil {
+		logger.ErrorContext(ctx, "Error starting endpoint informer", "error", err)
+		readiness.NotReady(component, err.Error())
+	}
+}
+
+// Parses the remote-write settings. Remote write stays disabled unless REMOTE_WRITE_URL is set.
+func parseRemoteWriteEnv() (config.RemoteWrite, error) {
+	remoteWrite := config.RemoteWrite{
+		URL:             os.Getenv("REMOTE_WRITE_URL"),
+		Headers:         util.ParseLabels(os.Getenv("REMOTE_WRITE_HEADERS")),
+		BearerTokenFile: os.Getenv("REMOTE_WRITE_BEARER_TOKEN_FILE"),
+	}
+	if remoteWrite.URL == "" {
+		return remoteWrite, nil
+	}
+	if err := validateHTTPURL("REMOTE_WRITE_URL", remoteWrite.URL); err != nil {
+		return config.RemoteWrite{}, err
+	}
+
+	interval, err := parsePositiveDurationEnv("REMOTE_WRITE_INTERVAL", defaultRemoteWriteInterval)
+	if err != nil {
+		return config.RemoteWrite{}, err
+	}
+	remoteWrite.Interval = interval
+
+	if remoteWrite.QueueSize, err = parsePositiveIntEnv("REMOTE_WRITE_QUEUE_SIZE",
+		defaultRemoteWriteQueueSize); err != nil {
+		return config.RemoteWrite{}, err
+	}
+	if remoteWrite.MaxAttempts, err = parsePositiveIntEnv("REMOTE_WRITE_MAX_ATTEMPTS",
+		defaultRemoteWriteMaxAttempts); err != nil {
+		return config.RemoteWrite{}, err
+	}
+
+	return remoteWrite, nil
+}
+
+// Parses the OTLP export settings. Export stays disabled unless OTLP_ENDPOINT is set.
+func parseOTLPEnv() (config.OTLP, error) {
+	otlpCfg := config.OTLP{
+		URL:     os.Getenv("OTLP_ENDPOINT"),
+		Headers: util.ParseLabels(os.Getenv("OTLP_HEADERS")),
+	}
+	if otlpCfg.URL == "" {
+		return otlpCfg, nil
+	}
+	if err := validateHTTPURL("OTLP_ENDPOINT", otlpCfg.URL); err != nil {
+		return config.OTLP{}, err
+	}
+
+	interval, err := parsePositiveDurationEnv("OTLP_INTERVAL", defaultOTLPInterval)
+	if err != nil {
+		return config.OTLP{}, err
+	}
+	otlpCfg.Interval = interval
+
+	return otlpCfg, nil
+}
+
+// Parses the tracing settings. Tracing stays disabled unless OTLP_TRACES_ENDPOINT is set.
+func parseTracingEnv() (config.Tracing, error) {
+	tracingCfg := config.Tracing{
+		URL:     os.Getenv("OTLP_TRACES_ENDPOINT"),
+		Headers: util.ParseLabels(os.Getenv("OTLP_TRACES_HEADERS")),
+	}
+	if tracingCfg.URL == "" {
+		return tracingCfg, nil
+	}
+	if err := validateHTTPURL("OTLP_TRACES_ENDPOINT", tracingCfg.URL); err != nil {
+		return config.Tracing{}, err
+	}
+
+	interval, err := parsePositiveDurationEnv("OTLP_TRACES_INTERVAL", defaultOTLPTracesInterval)
+	if err != nil {
+		return config.Tracing{}, err
+	}
+	tracingCfg.Interval = interval
+
+	ratio, err := parseRatioEnv("OTLP_TRACES_SAMPLE_RATIO", defaultTracesSampleRatio)
+	if err != nil {
+		return config.Tracing{}, err
 	}
+	tracingCfg.SampleRatio = ratio
 
-	// Default scrape timeout value
-	scrapeTimeout := defaultScrapeTimeout
-	if scrapeTimeoutEnv != "" {
-		parsedTimeout, err := time.ParseDuration(scrapeTimeoutEnv)
+	return tracingCfg, nil
+}
+
+// Parses the sharding settings. Sharding stays disabled unless SHARD_COUNT or SHARD_SERVICE is set.
+func parseShardingEnv() (config.Sharding, error) {
+	service := os.Getenv("SHARD_SERVICE")
+	countEnv := os.Getenv("SHARD_COUNT")
+	if service != "" {
+		if countEnv != "" {
+			return config.Sharding{}, errors.New("SHARD_COUNT and SHARD_SERVICE are mutually exclusive")
+		}
+		namespace, err := podNamespace("SHARD_SERVICE")
+		if err != nil {
+			return config.Sharding{}, err
+		}
+		self, err := podName()
 		if err != nil {
-			return nil, 0, "", fmt.Errorf("invalid value for SCRAPE_TIMEOUT: %w", err)
+			return config.Sharding{}, err
+		}
+
+		return config.Sharding{Service: service, Namespace: namespace, Self: self}, nil
+	}
+	if countEnv == "" {
+		return config.Sharding{}, nil
+	}
+
+	count, err := parsePositiveIntEnv("SHARD_COUNT", 1)
+	if err != nil {
+		return config.Sharding{}, err
+	}
+	var index int
+	if indexEnv := os.Getenv("SHARD_INDEX"); indexEnv != "" {
+		if index, err = strconv.Atoi(indexEnv); err != nil {
+			return config.Sharding{}, fmt.Errorf("invalid value for SHARD_INDEX: %w", err)
+		}
+	} else {
+		// A StatefulSet's pods are named after their ordinal, e.g. metrics-proxy-2
+		name, nameErr := podName()
+		if nameErr != nil {
+			return config.Sharding{}, nameErr
+		}
+		ordinal := name[strings.LastIndex(name, "-")+1:]
+		if index, err = strconv.Atoi(ordinal); err != nil {
+			return config.Sharding{}, fmt.Errorf("SHARD_INDEX is unset and pod name %q has no StatefulSet ordinal", name)
+		}
+	}
+	if index < 0 || index >= count {
+		return config.Sharding{}, fmt.Errorf("invalid value for SHARD_INDEX: %d is not in [0, %d)", index, count)
+	}
+
+	return config.Sharding{Count: count, Index: index}, nil
+}
+
+// Parses the leader election settings. Leader election stays disabled unless LEADER_ELECTION_LEASE is set.
+func parseLeaderElectionEnv() (config.LeaderElection, error) {
+	lease := os.Getenv("LEADER_ELECTION_LEASE")
+	if lease == "" {
+		return config.LeaderElection{}, nil
+	}
+
+	standby := os.Getenv("STANDBY_RESPONSE")
+	switch handlers.StandbyResponse(standby) {
+	case "":
+		standby = string(handlers.StandbyEmpty)
+	case handlers.StandbyEmpty, handlers.StandbyUnavailable:
+	default:
+		return config.LeaderElection{}, fmt.Errorf("invalid value for STANDBY_RESPONSE: %q is not %q or %q",
+			standby, handlers.StandbyEmpty, handlers.StandbyUnavailable)
+	}
+
+	namespace := os.Getenv("LEADER_ELECTION_NAMESPACE")
+	if namespace == "" {
+		var err error
+		if namespace, err = podNamespace("LEADER_ELECTION_LEASE"); err != nil {
+			return config.LeaderElection{}, err
 		}
-		scrapeTimeout = parsedTimeout
+	}
+	identity, err := podName()
+	if err != nil {
+		return config.LeaderElection{}, err
+	}
+
+	return config.LeaderElection{
+		Lease:           lease,
+		Namespace:       namespace,
+		Identity:        identity,
+		StandbyResponse: standby,
+	}, nil
+}
+
+// Returns the namespace of the proxy's pod, from POD_NAMESPACE or else its service account.
+// requiredBy names the setting that needs it, for the error.
+func podNamespace(requiredBy string) (string, error) {
+	if namespace := os.Getenv("POD_NAMESPACE"); namespace != "" {
+		return namespace, nil
+	}
+	data, err := os.ReadFile(serviceAccountNamespaceFile)
+	if err != nil {
+		return "", fmt.Errorf("%s requires POD_NAMESPACE: %w", requiredBy, err)
 	}
 
-	return labels, scrapeTimeout, port, nil
+	return strings.TrimSpace(string(data)), nil
 }
 
-// Initializes the Kubernetes client.
-func initK8sClient() kubernetes.Interface {
-	_, clientset, err := k8s.GetKubernetesClient(k8s.DefaultBuildConfigFunc, k8s.DefaultNewClientsetFunc)
+// Returns the name of the proxy's pod, from POD_NAME or else the hostname, which Kubernetes sets to it.
+func podName() (string, error) {
+	if name := os.Getenv("POD_NAME"); name != "" {
+		return name, nil
+	}
+	name, err := os.Hostname()
 	if err != nil {
-		log.Fatalf("Error building Kubernetes config: %v", err)
+		return "", fmt.Errorf("determining the pod name: %w", err)
+	}
+
+	return name, nil
+}
+
+// Checks that the value of the named environment variable is an http or https URL.
+func validateHTTPURL(name, value string) error {
+	parsed, err := url.Parse(value)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("invalid value for %s: %q is not an http(s) URL", name, value)
+	}
+
+	return nil
+}
+
+// Reads the settings of the HTTP client. The defaults are those of Go's default transport, except that idle
+// connections aren't capped overall, so that connections to hundreds of pods can all be reused.
+func parseTransportEnv() (config.Transport, error) {
+	transport := config.Transport{HTTP2: true}
+	var err error
+	if transport.MaxIdleConnsPerHost, err = parsePositiveIntEnv("UPSTREAM_MAX_IDLE_CONNS_PER_HOST",
+		defaultMaxIdleConnsPerHost); err != nil {
+		return config.Transport{}, err
+	}
+	if transport.KeepAlive, err = parseDurationEnv("UPSTREAM_KEEP_ALIVE", defaultKeepAlive); err != nil {
+		return config.Transport{}, err
+	}
+	if transport.KeepAlive < 0 {
+		return config.Transport{}, errors.New("invalid value for UPSTREAM_KEEP_ALIVE: must not be negative")
+	}
+	if transport.DialTimeout, err = parsePositiveDurationEnv("UPSTREAM_DIAL_TIMEOUT",
+		defaultDialTimeout); err != nil {
+		return config.Transport{}, err
+	}
+	if transport.TLSHandshakeTimeout, err = parsePositiveDurationEnv("UPSTREAM_TLS_HANDSHAKE_TIMEOUT",
+		defaultTLSHandshakeTimeout); err != nil {
+		return config.Transport{}, err
+	}
+	if value := os.Getenv("UPSTREAM_HTTP2"); value != "" {
+		if transport.HTTP2, err = strconv.ParseBool(value); err != nil {
+			return config.Transport{}, fmt.Errorf("invalid value for UPSTREAM_HTTP2: %w", err)
+		}
+	}
+
+	return transport, nil
+}
+
+// Builds the HTTP client used to scrape pods and push metrics. Responses are decompressed by the proxy itself,
+// which asks pods for gzip.
+func buildHTTPClient(cfg config.Transport) *handlers.RealHTTPClient {
+	transport, _ := http.DefaultTransport.(*http.Transport)
+	transport = transport.Clone()
+	transport.DialContext = (&net.Dialer{Timeout: cfg.DialTimeout}).DialContext
+	transport.TLSHandshakeTimeout = cfg.TLSHandshakeTimeout
+	transport.MaxIdleConns = 0
+	transport.MaxIdleConnsPerHost = cfg.MaxIdleConnsPerHost
+	transport.IdleConnTimeout = cfg.KeepAlive
+	transport.DisableKeepAlives = cfg.KeepAlive == 0
+	transport.ForceAttemptHTTP2 = cfg.HTTP2
+	if !cfg.HTTP2 {
+		// A non-nil empty map is how HTTP/2 is turned off
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
 	}
 
-	return clientset
+	return &handlers.RealHTTPClient{Client: &http.Client{Transport: transport}}
+}
+
+// Reads how scrapes failing with a transient error are retried. Retries are disabled by default.
+func parseRetryEnv() (config.Retry, error) {
+	var retry config.Retry
+	var err error
+	if retry.MaxAttempts, err = parsePositiveIntEnv("SCRAPE_MAX_ATTEMPTS", defaultScrapeMaxAttempts); err != nil {
+		return config.Retry{}, err
+	}
+	if retry.Backoff, err = parsePositiveDurationEnv("SCRAPE_RETRY_BACKOFF", defaultScrapeRetryBackoff); err != nil {
+		return config.Retry{}, err
+	}
+
+	return retry, nil
+}
+
+// Reads the scrape limits applying to every pod. Unset limits are zero, i.e. disabled.
+func parseLimitsEnv() (config.Limits, error) {
+	var limits config.Limits
+	if value := os.Getenv("SCRAPE_BODY_SIZE_LIMIT"); value != "" {
+		quantity, err := resource.ParseQuantity(value)
+		if err != nil {
+			return config.Limits{}, fmt.Errorf("invalid value for SCRAPE_BODY_SIZE_LIMIT: %w", err)
+		}
+		if quantity.Sign() <= 0 {
+			return config.Limits{}, errors.New("invalid value for SCRAPE_BODY_SIZE_LIMIT: must be positive")
+		}
+		limits.BodySize = quantity.Value()
+	}
+
+	var err error
+	if limits.Samples, err = parsePositiveIntEnv("SCRAPE_SAMPLE_LIMIT", 0); err != nil {
+		return config.Limits{}, err
+	}
+	if limits.Series, err = parsePositiveIntEnv("SCRAPE_SERIES_LIMIT", 0); err != nil {
+		return config.Limits{}, err
+	}
+
+	return limits, nil
+}
+
+// Reads the log level and format, and how often the errors of a pod failing every scrape are logged.
+func parseLoggingEnv() (config.Logging, error) {
+	cfg := config.Logging{Level: slog.LevelInfo, Format: logging.FormatText}
+	if value := os.Getenv("LOG_LEVEL"); value != "" {
+		if err := cfg.Level.UnmarshalText([]byte(value)); err != nil {
+			return config.Logging{}, fmt.Errorf("invalid value for LOG_LEVEL: %w", err)
+		}
+	}
+	if value := os.Getenv("LOG_FORMAT"); value != "" {
+		cfg.Format = value
+	}
+	if cfg.Format != logging.FormatText && cfg.Format != logging.FormatJSON {
+		return config.Logging{}, fmt.Errorf("invalid value for LOG_FORMAT: %q, must be %q or %q",
+			cfg.Format, logging.FormatText, logging.FormatJSON)
+	}
+	var err error
+	if cfg.ErrorInterval, err = parseDurationEnv("LOG_ERROR_INTERVAL", defaultLogErrorInterval); err != nil {
+		return config.Logging{}, err
+	}
+	if cfg.ErrorInterval < 0 {
+		return config.Logging{}, errors.New("invalid value for LOG_ERROR_INTERVAL: must not be negative")
+	}
+
+	return cfg, nil
+}
+
+// Reads a positive duration from the named environment variable, or returns fallback if it is unset.
+func parsePositiveDurationEnv(name string, fallback time.Duration) (time.Duration, error) {
+	value, err := parseDurationEnv(name, fallback)
+	if err != nil {
+		return 0, err
+	}
+	if value <= 0 {
+		return 0, fmt.Errorf("invalid value for %s: must be positive", name)
+	}
+
+	return value, nil
+}
+
+// Reads a ratio between 0 and 1 from the named environment variable, or returns fallback if it is unset.
+func parseRatioEnv(name string, fallback float64) (float64, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback, nil
+	}
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value for %s: %w", name, err)
+	}
+	if parsed < 0 || parsed > 1 {
+		return 0, fmt.Errorf("invalid value for %s: must be between 0 and 1", name)
+	}
+
+	return parsed, nil
+}
+
+// Reads a positive integer from the named environment variable, or returns fallback if it is unset.
+func parsePositiveIntEnv(name string, fallback int) (int, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback, nil
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value for %s: %w", name, err)
+	}
+	if parsed <= 0 {
+		return 0, fmt.Errorf("invalid value for %s: must be positive", name)
+	}
+
+	return parsed, nil
+}
+
+// Builds the remote-write pusher, which pushes what collect returns.
+func buildPusher(cfg config.RemoteWrite, collect func(ctx context.Context) []string, httpClient handlers.HTTPClient,
+	registry *selfmetrics.Registry) *remotewrite.Pusher {
+	batches := registry.NewCounterVec("metrics_proxy_remote_write_batches_total",
+		"Total number of remote-write batches by outcome: sent, failed or dropped.", "result")
+
+	headers := http.Header{}
+	for name, value := range cfg.Headers {
+		headers.Set(name, value)
+	}
+
+	return &remotewrite.Pusher{
+		URL:             cfg.URL,
+		Client:          httpClient,
+		Collect:         collect,
+		Interval:        cfg.Interval,
+		Headers:         headers,
+		BearerTokenFile: cfg.BearerTokenFile,
+		QueueSize:       cfg.QueueSize,
+		Backoff: wait.Backoff{
+			Duration: remoteWriteBackoffInitial,
+			Factor:   2,   //nolint:mnd // Double the delay after every failed attempt
+			Jitter:   0.1, //nolint:mnd // Spread retries by up to 10%
+			Steps:    cfg.MaxAttempts,
+			Cap:      remoteWriteBackoffCap,
+		},
+		Batches: func(result string) *selfmetrics.Counter {
+			return batches.WithLabelValues(result)
+		},
+	}
+}
+
+// Builds the OTLP exporter, which exports what collect returns.
+func buildExporter(cfg config.OTLP, collect func(ctx context.Context) []string, httpClient handlers.HTTPClient,
+	registry *selfmetrics.Registry) *otlp.Exporter {
+	exports := registry.NewCounterVec("metrics_proxy_otlp_exports_total",
+		"Total number of OTLP exports by outcome: success or failed.", "result")
+
+	headers := http.Header{}
+	for name, value := range cfg.Headers {
+		headers.Set(name, value)
+	}
+
+	return &otlp.Exporter{
+		URL:      cfg.URL,
+		Client:   httpClient,
+		Collect:  collect,
+		Interval: cfg.Interval,
+		Headers:  headers,
+		Exports: func(result string) *selfmetrics.Counter {
+			return exports.WithLabelValues(result)
+		},
+	}
+}
+
+// Builds the tracer provider of the scrapes of the proxy, exporting its spans over OTLP/HTTP, or returns nil if
+// tracing is disabled. Errors of the OpenTelemetry SDK, such as failed exports, are logged with logger.
+func buildTracer(ctx context.Context, cfg config.Tracing, registry *selfmetrics.Registry,
+	logger *slog.Logger) (*tracing.Provider, error) {
+	if cfg.URL == "" {
+		return nil, nil
+	}
+	exporter, err := otlptracehttp.New(ctx,
+		otlptracehttp.WithEndpointURL(cfg.URL),
+		otlptracehttp.WithHeaders(cfg.Headers),
+		otlptracehttp.WithTimeout(cfg.Interval),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("creating the OTLP span exporter: %w", err)
+	}
+	spans := registry.NewCounterVec("metrics_proxy_otlp_spans_total",
+		"Total number of spans by export outcome: exported or failed.", "outcome")
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		logger.Error("OpenTelemetry error", "error", err)
+	}))
+
+	return tracing.NewProvider(tracing.CountingExporter{
+		SpanExporter: exporter,
+		Spans: func(outcome string) *selfmetrics.Counter {
+			return spans.WithLabelValues(outcome)
+		},
+	}, cfg.Interval, cfg.SampleRatio), nil
+}
+
+// Reads a duration from the named environment variable, or returns fallback if it is unset.
+func parseDurationEnv(name string, fallback time.Duration) (time.Duration, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback, nil
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value for %s: %w", name, err)
+	}
+
+	return parsed, nil
+}
+
+// Builds the sharder shared by every job, and the membership watch keeping it up to date if the replicas are
+// discovered through a Service. Both are nil when sharding is disabled.
+func buildSharding(cfg config.Sharding, logger *slog.Logger) (*k8s.Sharder, *k8s.ShardMembership) {
+	switch {
+	case cfg.Service != "":
+		logger.Info("Sharding pods between the replicas behind a service",
+			"service", cfg.Service, "namespace", cfg.Namespace, "member", cfg.Self)
+		sharder := k8s.NewSharder(cfg.Self)
+
+		return sharder, &k8s.ShardMembership{Namespace: cfg.Namespace, Service: cfg.Service, Sharder: sharder}
+	case cfg.Count > 1:
+		logger.Info("Sharding pods between a fixed number of replicas", "index", cfg.Index, "count", cfg.Count)
+
+		return k8s.NewStaticSharder(cfg.Index, cfg.Count), nil
+	default:
+		return nil, nil
+	}
+}
+
+// Builds the leader elector, reporting leadership on the metrics_proxy_leader gauge, or returns nil when leader
+// election is disabled.
+func buildLeaderElector(cfg config.LeaderElection, registry *selfmetrics.Registry,
+	logger *slog.Logger) *k8s.LeaderElector {
+	if cfg.Lease == "" {
+		return nil
+	}
+	logger.Info("Electing the active replica through a lease", "lease", cfg.Lease, "namespace", cfg.Namespace,
+		"identity", cfg.Identity, "standby_response", cfg.StandbyResponse)
+	leader := registry.NewGauge("metrics_proxy_leader",
+		"Whether this replica is the elected leader (1) or a standby (0).")
+
+	return &k8s.LeaderElector{
+		Namespace:     cfg.Namespace,
+		Lease:         cfg.Lease,
+		Identity:      cfg.Identity,
+		LeaseDuration: k8s.DefaultLeaseDuration,
+		RenewDeadline: k8s.DefaultRenewDeadline,
+		RetryPeriod:   k8s.DefaultRetryPeriod,
+		OnChange: func(leading bool) {
+			if leading {
+				leader.Set(1)
+			} else {
+				leader.Set(0)
+			}
+		},
+	}
+}
+
+// Builds a scrape job, with its own pod watcher and handler, for every configured job.
+func buildJobs(cfg config.Config, sharder *k8s.Sharder, httpClient handlers.HTTPClient,
+	registry *selfmetrics.Registry, logger *slog.Logger) ([]handlers.Job, error) {
+	var cacheRequests *selfmetrics.CounterVec
+	// Background scraping answers from memory already, so there is nothing to share between scrapes
+	if (cfg.CoalesceWindow > 0 || cfg.CacheTTL > 0) && cfg.BackgroundScrapeInterval == 0 {
+		cacheRequests = registry.NewCounterVec("metrics_proxy_fanout_cache_requests_total",
+			"Total number of scrapes by how their fan-out was obtained: hit, coalesced or miss.", "job", "result")
+	}
+
+	var timestampedSamples *selfmetrics.CounterVec
+	if slices.ContainsFunc(cfg.Jobs, func(job config.Job) bool { return job.Timestamps != "" }) {
+		timestampedSamples = registry.NewCounterVec("metrics_proxy_timestamped_samples_total",
+			"Total number of samples scraped with an explicit timestamp, by outcome: kept, stripped or rejected.",
+			"job", "outcome")
+	}
+
+	jobs := make([]handlers.Job, 0, len(cfg.Jobs))
+	for _, jobCfg := range cfg.Jobs {
+		rules, err := relabel.Compile(jobCfg.MetricRelabelConfigs)
+		if err != nil {
+			return nil, fmt.Errorf("job %q: %w", jobCfg.Name, err)
+		}
+
+		aggregationRules, err := aggregate.Compile(jobCfg.AggregationRules)
+		if err != nil {
+			return nil, fmt.Errorf("job %q: %w", jobCfg.Name, err)
+		}
+
+		podWatcher := k8s.NewPodScrapeWatcher()
+		podWatcher.Namespace = jobCfg.Namespace
+		podWatcher.Labels = jobCfg.Labels
+		podWatcher.Shard = sharder
+		podWatcher.Logger = logger.With("job", jobCfg.Name)
+
+		metricsHandler := handlers.NewMetricsHandler(httpClient)
+		metricsHandler.RelabelRules = rules
+		metricsHandler.AggregationRules = aggregationRules
+		metricsHandler.Limits = k8s.ScrapeLimits(cfg.Limits)
+		metricsHandler.ErrorLogInterval = cfg.Logging.ErrorInterval
+		metricsHandler.CircuitBreaker = handlers.CircuitBreaker(cfg.CircuitBreaker)
+		metricsHandler.Retry = wait.Backoff{
+			Duration: cfg.Retry.Backoff,
+			Factor:   2,   //nolint:mnd // Double the delay after every failed attempt
+			Jitter:   0.1, //nolint:mnd // Spread retries by up to 10%
+			Steps:    cfg.Retry.MaxAttempts,
+		}
+		metricsHandler.AnalyzeCardinality = cfg.CardinalityTopN > 0
+		metricsHandler.Timestamps = jobCfg.TimestampPolicy()
+		if jobCfg.Timestamps != "" {
+			jobName := jobCfg.Name
+			metricsHandler.TimestampedSamples = func(outcome string) *selfmetrics.Counter {
+				return timestampedSamples.WithLabelValues(jobName, outcome)
+			}
+		}
+		if cacheRequests != nil {
+			jobName := jobCfg.Name
+			metricsHandler.Cache = &handlers.FanOutCache{
+				Window: cfg.CoalesceWindow,
+				TTL:    cfg.CacheTTL,
+				Requests: func(result string) *selfmetrics.Counter {
+					return cacheRequests.WithLabelValues(jobName, result)
+				},
+			}
+		}
+
+		if cfg.BackgroundScrapeInterval > 0 {
+			metricsHandler.Background = &handlers.BackgroundScraper{
+				Handler:   metricsHandler,
+				Watcher:   podWatcher,
+				Interval:  cfg.BackgroundScrapeInterval,
+				Timeout:   time.Duration(jobCfg.ScrapeTimeout),
+				Staleness: cfg.BackgroundScrapeStaleness,
+			}
+		}
+
+		jobs = append(jobs, handlers.Job{
+			Name:          jobCfg.Name,
+			Watcher:       podWatcher,
+			Handler:       metricsHandler,
+			ScrapeTimeout: time.Duration(jobCfg.ScrapeTimeout),
+		})
+	}
+
+	return jobs, nil
+}
+
+// Reports the top cardinality offenders of the jobs as self-metrics, computed on every scrape of /self-metrics.
+func registerCardinalityMetrics(registry *selfmetrics.Registry, jobs []handlers.Job, top int) {
+	registry.NewGaugeVecFunc("metrics_proxy_cardinality_metric_series",
+		"Series of the metric names with the most series in the latest scrapes.", func() []selfmetrics.GaugeSample {
+			samples := []selfmetrics.GaugeSample{}
+			for _, metric := range handlers.CardinalityReport(jobs, top).Metrics {
+				samples = append(samples, selfmetrics.GaugeSample{
+					LabelValues: []string{metric.Name}, Value: float64(metric.Series),
+				})
+			}
+
+			return samples
+		}, "metric")
+	registry.NewGaugeVecFunc("metrics_proxy_cardinality_label_values",
+		"Distinct values, summed over pods, of the label names with the most values in the latest scrapes.",
+		func() []selfmetrics.GaugeSample {
+			samples := []selfmetrics.GaugeSample{}
+			for _, label := range handlers.CardinalityReport(jobs, top).Labels {
+				samples = append(samples, selfmetrics.GaugeSample{
+					LabelValues: []string{label.Name}, Value: float64(label.Values),
+				})
+			}
+
+			return samples
+		}, "label")
+	registry.NewGaugeVecFunc("metrics_proxy_cardinality_target_series",
+		"Series of the pods with the most series in their latest scrape.", func() []selfmetrics.GaugeSample {
+			samples := []selfmetrics.GaugeSample{}
+			for _, target := range handlers.CardinalityReport(jobs, top).Targets {
+				samples = append(samples, selfmetrics.GaugeSample{
+					LabelValues: []string{target.Job, target.Namespace, target.Pod}, Value: float64(target.Series),
+				})
+			}
+
+			return samples
+		}, "job", "namespace", "pod")
 }
 
 // Starts the HTTP server.
-func startServer(scrapeTimeout time.Duration, port string, pw *k8s.PodScrapeWatcher) *http.Server {
+func startServer(cfg config.Config, jobs []handlers.Job, elector *k8s.LeaderElector, readiness *health.Readiness,
+	registry *selfmetrics.Registry, tracer trace.Tracer, logger *slog.Logger) *http.Server {
 	r := mux.NewRouter()
+	r.Use(handlers.RequestLogger(logger), handlers.Compress)
 
-	httpClient := &handlers.RealHTTPClient{Client: &http.Client{}}
-	metricsHandler := handlers.NewMetricsHandler(httpClient)
+	scrapeTimeout := cfg.ScrapeTimeout
+	jobsByName := make(map[string]handlers.Job, len(jobs))
+	for _, job := range jobs {
+		jobsByName[job.Name] = job
+		scrapeTimeout = max(scrapeTimeout, job.ScrapeTimeout)
+	}
+
+	// Standby replicas don't scrape pods on behalf of the leader
+	leaderOnly := func(handler http.HandlerFunc) http.Handler {
+		if elector == nil {
+			return handler
+		}
+
+		return handlers.LeaderOnly(elector.IsLeader, handlers.StandbyResponse(cfg.LeaderElection.StandbyResponse),
+			handler)
+	}
+	// Scrapes are traced on standby replicas too, so that their traces show why they are empty
+	handleScrape := func(route string, handler http.HandlerFunc) {
+		r.Handle(route, handlers.Trace(tracer, route, leaderOnly(handler))).Methods(http.MethodGet)
+	}
+
+	// Each job is scraped within its own timeout, further bounded by the scraper's own timeout if it sent one.
+	handleScrape("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(),
+			handlers.FanOutTimeout(r, scrapeTimeout, cfg.ScrapeTimeoutOffset))
+		defer cancel()
+
+		handlers.ProxyJobs(w, r.WithContext(ctx), jobs)
+	})
+
+	handleScrape("/metrics/{job}", func(w http.ResponseWriter, r *http.Request) {
+		job, exists := jobsByName[mux.Vars(r)["job"]]
+		if !exists {
+			http.NotFound(w, r)
+			return
+		}
 
-	r.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
-		// Create a new context with a timeout based on the scrapeTimeout
-		ctx, cancel := context.WithTimeout(r.Context(), scrapeTimeout)
+		// Create a new context with a timeout based on the job's and the scraper's scrape timeouts
+		ctx, cancel := context.WithTimeout(r.Context(),
+			handlers.FanOutTimeout(r, job.ScrapeTimeout, cfg.ScrapeTimeoutOffset))
 		defer cancel()
 
-		metricsHandler.ProxyMetrics(w, r.WithContext(ctx), pw)
-	}).Methods(http.MethodGet)
+		job.Handler.ProxyMetrics(w, r.WithContext(ctx), job.Watcher)
+	})
+
+	// A single pod, as scraped by every job that discovered it
+	handleScrape("/metrics/{namespace}/{pod}", func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(),
+			handlers.FanOutTimeout(r, scrapeTimeout, cfg.ScrapeTimeoutOffset))
+		defer cancel()
+
+		vars := mux.Vars(r)
+		handlers.ProxyPod(w, r.WithContext(ctx), jobs, vars["namespace"], vars["pod"])
+	})
+
+	r.Handle("/targets", handlers.TargetsHandler(jobs)).Methods(http.MethodGet)
+	r.Handle("/sd", handlers.ServiceDiscoveryHandler(jobs)).Methods(http.MethodGet)
+	if cfg.CardinalityTopN > 0 {
+		r.Handle("/cardinality", handlers.CardinalityHandler(jobs, cfg.CardinalityTopN)).Methods(http.MethodGet)
+	}
+	// Served by the same router as the metrics, so whatever guards the listener also guards them
+	if cfg.DebugEndpoints {
+		r.Handle("/debug/scrape", handlers.DebugScrapeHandler(jobs)).Methods(http.MethodGet)
+	}
+	r.Handle("/readyz", readiness).Methods(http.MethodGet)
+	r.Handle("/self-metrics", registry).Methods(http.MethodGet)
 
 	server := &http.Server{
 		Handler: r,
-		Addr:    fmt.Sprintf("0.0.0.0:%s", port),
+		Addr:    fmt.Sprintf("0.0.0.0:%s", cfg.Port),
 
 		// Below isn't tied to the context passed to the http server, but rather a global write timeout
 		// if we hit the below timeout we get an empty reply from server
@@ -92,15 +1051,236 @@ func startServer(scrapeTimeout time.Duration, port string, pw *k8s.PodScrapeWatc
 }
 
 func showHelp() {
-	log.Println(`Usage: metrics-proxy [--help]`)
+	fmt.Fprintln(os.Stderr, `Usage: metrics-proxy [--help]`)
 
-	log.Println(`
+	fmt.Fprintln(os.Stderr, `
 Environment Variables:
-  POD_LABEL_SELECTOR: Label selector for watching pods (e.g., "app=ztunnel"). Required.
+  POD_LABEL_SELECTOR: Label selector for watching pods (e.g., "app=ztunnel").
+                      Required unless SCRAPE_JOBS_FILE is set.
+  SCRAPE_JOBS_FILE: Path to a YAML file defining several named scrape jobs, each served on /metrics/<job>.
+                    Mutually exclusive with POD_LABEL_SELECTOR.
   SCRAPE_TIMEOUT: Maximum allowed time for any given scrape (e.g., "15s", "1m"). Default is "9s".
+                  Jobs from SCRAPE_JOBS_FILE inherit it unless they set their own scrape_timeout.
+  SCRAPE_TIMEOUT_OFFSET: When the scraper sends X-Prometheus-Scrape-Timeout-Seconds, the fan-out ends this
+                         much earlier than the scraper's timeout, still capped by SCRAPE_TIMEOUT. Default is "500ms".
+  COALESCE_WINDOW: Concurrent scrapes of a job arriving within this window of each other share one fan-out
+                   (e.g., "1s"). Default is "0s" (disabled).
+  CACHE_TTL: How long the result of a completed fan-out is reused by later scrapes (e.g., "2s").
+             Default is "0s" (disabled).
+  BACKGROUND_SCRAPE_INTERVAL: If set (e.g., "15s"), every pod is scraped on its own at this interval and
+                              scrapes of the proxy are answered instantly from the latest results.
+                              COALESCE_WINDOW and CACHE_TTL are ignored. Default is "0s" (disabled).
+  BACKGROUND_SCRAPE_STALENESS: How old a pod's latest successful background scrape may be before the pod is
+                               reported as up=0. Default is twice BACKGROUND_SCRAPE_INTERVAL.
+  REMOTE_WRITE_URL: If set, the combined metrics of all jobs are also pushed to this Prometheus remote-write
+                    endpoint. Default is unset (disabled).
+  REMOTE_WRITE_INTERVAL: How often metrics are pushed. Default is "30s".
+  REMOTE_WRITE_HEADERS: Extra headers for every push, as comma-separated Name=value pairs
+                        (e.g., "X-Scope-OrgID=tenant-1").
+  REMOTE_WRITE_BEARER_TOKEN_FILE: File holding a bearer token for the remote-write endpoint, re-read on every push.
+  REMOTE_WRITE_QUEUE_SIZE: How many batches may wait to be pushed before the oldest is dropped. Default is 10.
+  REMOTE_WRITE_MAX_ATTEMPTS: How many times a batch is pushed before it is given up on. Default is 5.
+  OTLP_ENDPOINT: If set, the combined metrics of all jobs are also exported over OTLP/HTTP (JSON) to this URL
+                 (e.g., "http://otel-collector:4318/v1/metrics"). Default is unset (disabled).
+  OTLP_INTERVAL: How often metrics are exported over OTLP. Default is "30s".
+  OTLP_HEADERS: Extra headers for every OTLP export, as comma-separated Name=value pairs.
+  OTLP_TRACES_ENDPOINT: If set, scrapes of /metrics are traced, with a span per pod scraped, and the spans
+                        are exported over OTLP/HTTP (protobuf) to this URL
+                        (e.g., "http://otel-collector:4318/v1/traces"). Default is unset (disabled).
+  OTLP_TRACES_INTERVAL: How often spans are exported. Default is "5s".
+  OTLP_TRACES_HEADERS: Extra headers for every span export, as comma-separated Name=value pairs.
+  OTLP_TRACES_SAMPLE_RATIO: Share of the scrapes traced, from 0 to 1, unless the scraper sends a traceparent
+                            header, whose sampling decision is followed. Default is 1 (every scrape).
+  SHARD_COUNT: Split the pods of every job between this many proxy replicas, each serving only its share.
+               Default is unset (every replica serves every pod).
+  SHARD_INDEX: Index of this replica, from 0 to SHARD_COUNT-1. Defaults to the StatefulSet ordinal of the pod.
+  SHARD_SERVICE: Instead of SHARD_COUNT, split pods between the ready replicas behind this headless Service
+                 in the proxy's namespace. Requires POD_NAME (or the hostname) and POD_NAMESPACE.
+  UPSTREAM_MAX_IDLE_CONNS_PER_HOST: How many idle connections to each pod are kept for reuse. Default is "2".
+  UPSTREAM_KEEP_ALIVE: How long idle connections to pods are kept open; "0s" opens a connection per request.
+                       Default is "90s".
+  UPSTREAM_DIAL_TIMEOUT: Maximum time to open a connection. Default is "30s".
+  UPSTREAM_TLS_HANDSHAKE_TIMEOUT: Maximum time for a TLS handshake. Default is "10s".
+  UPSTREAM_HTTP2: If "false", only speak HTTP/1.1, even to endpoints served over TLS. Default is "true".
+  SCRAPE_MAX_ATTEMPTS: How many times a pod is requested per scrape when it refuses or resets the connection,
+                       or answers 502 or 503. Retries stop when the scrape's deadline leaves no room for the
+                       next one. Default is "1" (no retries).
+  SCRAPE_RETRY_BACKOFF: Delay before the first retry, doubling with every retry. Default is "100ms".
+  CIRCUIT_BREAKER_THRESHOLD: If set, a pod failing this many scrapes in a row is reported as
+                             up{reason="circuit_open"} 0 without being scraped. Default is unset (disabled).
+  CIRCUIT_BREAKER_COOLDOWN: How long a pod's circuit stays open before a probe scrape. Default is "1m".
+  SCRAPE_BODY_SIZE_LIMIT: Largest response accepted from a pod, as a quantity (e.g., "10Mi"). Default is unset.
+  SCRAPE_SAMPLE_LIMIT: Most samples a pod may expose after relabeling. Default is unset.
+  SCRAPE_SERIES_LIMIT: Most unique series a pod may expose after relabeling. Default is unset.
+                       A pod going past any limit is dropped and reported as up{reason="limit_exceeded"} 0.
+                       Pods may tighten the limits through the prometheus.io/body-size-limit, sample-limit and
+                       series-limit annotations, but not loosen them.
+  CARDINALITY_TOP_N: If set, count the series of every scrape by metric name, label name and pod, and report
+                     this many top offenders on /cardinality and as self-metrics. Default is unset (disabled).
+  DEBUG_ENDPOINTS: If "true", serve /debug/scrape?pod=<namespace>/<name>, which shows a pod's raw response
+                   next to the proxy's output. Default is "false".
+  SD_FILE: If set, the discovered pods are also written to this file for Prometheus' file_sd_config, and kept
+           up to date. /sd serves the same targets for http_sd_config. Default is unset (disabled).
+  LEADER_ELECTION_LEASE: If set, replicas elect one active replica through the Lease of this name; the others
+                         stand by with their pod caches warm. Default is unset (every replica is active).
+  LEADER_ELECTION_NAMESPACE: Namespace of the lease. Defaults to POD_NAMESPACE, or the proxy's own namespace.
+  STANDBY_RESPONSE: How standby replicas answer scrapes of /metrics: "empty" (200 with no metrics) or
+                    "unavailable" (503). Default is "empty".
+  LOG_LEVEL: Minimum level of the logs: "debug", "info", "warn" or "error". Default is "info".
+  LOG_FORMAT: Format of the logs: "text" or "json". Default is "text".
+  LOG_ERROR_INTERVAL: How often the scrape errors of a pod failing every scrape are logged; "0s" logs every
+                      error. Default is "1m".
+  SHUTDOWN_GRACE_PERIOD: How long in-flight scrapes may run after SIGTERM before the proxy exits.
+                         Default is "15s".
   PORT: Port on which the metrics proxy will expose aggregated metrics collected from watched pods.
-        Default is "15090".`)
-	os.Exit(0)
+        Default is "15090".
+
+Exit codes:
+  0: Clean shutdown.
+  1: The proxy failed while running.
+  2: Invalid configuration.`)
+}
+
+// Returns the tasks that run alongside the HTTP server until shutdown: the pod and shard membership watchers,
+// leader election, background scrapers, the service discovery file, and the remote-write, OTLP and span exports
+// if enabled.
+func backgroundTasks(cfg config.Config, jobs []handlers.Job, membership *k8s.ShardMembership,
+	elector *k8s.LeaderElector, httpClient handlers.HTTPClient, registry *selfmetrics.Registry,
+	readiness *health.Readiness, watchErrors *selfmetrics.Counter, traces *tracing.Provider,
+	logger *slog.Logger) []func(ctx context.Context) {
+	tasks := []func(ctx context.Context){
+		func(ctx context.Context) { watchPods(ctx, jobs, membership, elector, readiness, watchErrors) },
+	}
+	// Only the leader pushes, so that standby replicas don't send the same series again
+	collect := func(ctx context.Context) []string {
+		if elector != nil && !elector.IsLeader() {
+			return nil
+		}
+
+		return handlers.AggregateJobs(ctx, jobs)
+	}
+	// Background scrapers pick up pods as the watchers discover them
+	for _, job := range jobs {
+		if job.Handler.Background != nil {
+			tasks = append(tasks, job.Handler.Background.Run)
+		}
+	}
+	if cfg.SDFile != "" {
+		logger.Info("Writing discovered pods to a service discovery file", "path", cfg.SDFile)
+		tasks = append(tasks, (&handlers.SDFileWriter{Path: cfg.SDFile, Jobs: jobs}).Run)
+	}
+	if cfg.RemoteWrite.URL != "" {
+		logger.Info("Pushing metrics over remote write", "url", cfg.RemoteWrite.URL, "interval", cfg.RemoteWrite.Interval)
+		tasks = append(tasks, buildPusher(cfg.RemoteWrite, collect, httpClient, registry).Run)
+	}
+	if cfg.OTLP.URL != "" {
+		logger.Info("Exporting metrics over OTLP", "url", cfg.OTLP.URL, "interval", cfg.OTLP.Interval)
+		tasks = append(tasks, buildExporter(cfg.OTLP, collect, httpClient, registry).Run)
+	}
+	if traces != nil {
+		logger.Info("Exporting spans over OTLP", "url", cfg.Tracing.URL, "interval", cfg.Tracing.Interval,
+			"sample_ratio", cfg.Tracing.SampleRatio)
+		tasks = append(tasks, traces.Run)
+	}
+
+	return tasks
+}
+
+// Serves until a termination signal arrives, then drains in-flight scrapes before stopping the pod watchers and
+// the exporters, and waits for their final exports. Returns the process exit code.
+func run(cfg config.Config) int {
+	logger := logging.New(os.Stderr, cfg.Logging.Level, cfg.Logging.Format)
+	// Log without a context, and from client-go, in the same format
+	slog.SetDefault(logger)
+	klog.SetSlogLogger(logger)
+	ctx, stop := signal.NotifyContext(logging.NewContext(context.Background(), logger), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	readiness := health.NewReadiness()
+	readiness.NotReady(kubernetesComponent, "connecting to the Kubernetes API")
+	registry := selfmetrics.NewRegistry()
+	watchErrors := registry.NewCounter("metrics_proxy_watch_errors_total",
+		"Total number of failed pod list or watch requests to the Kubernetes API.")
+
+	httpClient := buildHTTPClient(cfg.Transport)
+	sharder, membership := buildSharding(cfg.Sharding, logger)
+	elector := buildLeaderElector(cfg.LeaderElection, registry, logger)
+	traces, err := buildTracer(ctx, cfg.Tracing, registry, logger)
+	if err != nil {
+		logger.ErrorContext(ctx, "Error building the tracer", "error", err)
+		return exitUsage
+	}
+	var tracer trace.Tracer
+	if traces != nil {
+		tracer = traces.Tracer(tracing.ScopeName)
+	}
+	jobs, err := buildJobs(cfg, sharder, httpClient, registry, logger)
+	if err != nil {
+		logger.ErrorContext(ctx, "Error building scrape jobs", "error", err)
+		return exitUsage
+	}
+	if cfg.CardinalityTopN > 0 {
+		registerCardinalityMetrics(registry, jobs, cfg.CardinalityTopN)
+	}
+
+	// Connect to Kubernetes and watch pods in the background, so that the HTTP server is up meanwhile. The tasks
+	// outlive the signal: in-flight scrapes still need the pod watchers while they drain, and the exporters only
+	// flush once the last scrapes are traced. They are stopped once the server is shut down, and run returns
+	// after their final exports.
+	tasksCtx, stopTasks := context.WithCancel(logging.NewContext(context.Background(), logger))
+	var tasksWg sync.WaitGroup
+	for _, task := range backgroundTasks(cfg, jobs, membership, elector, httpClient, registry, readiness,
+		watchErrors, traces, logger) {
+		tasksWg.Add(1)
+		go func() {
+			defer tasksWg.Done()
+			task(tasksCtx)
+		}()
+	}
+	waitTasks := func() {
+		stopTasks()
+		tasksWg.Wait()
+	}
+	defer waitTasks()
+
+	// Start the HTTP server
+	server := startServer(cfg, jobs, elector, readiness, registry, tracer, logger)
+
+	logger.InfoContext(ctx, "Starting metrics proxy", "port", cfg.Port)
+	for _, job := range cfg.Jobs {
+		logger.InfoContext(ctx, "Watching pods", "job", job.Name, "labels", job.Labels, "namespace", job.Namespace,
+			"scrape_timeout", time.Duration(job.ScrapeTimeout))
+	}
+
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.ListenAndServe()
+	}()
+
+	select {
+	case err = <-serverErr:
+		logger.ErrorContext(ctx, "HTTP server failed", "error", err)
+		stop()
+
+		return exitError
+	case <-ctx.Done():
+	}
+
+	// Restore default signal handling, so that a second signal terminates immediately
+	stop()
+	logger.InfoContext(ctx, "Shutting down, waiting for in-flight scrapes to finish",
+		"grace_period", cfg.ShutdownGracePeriod)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownGracePeriod)
+	defer cancel()
+	if err = server.Shutdown(shutdownCtx); err != nil {
+		logger.ErrorContext(ctx, "Failed to drain in-flight scrapes", "error", err)
+		return exitError
+	}
+	waitTasks()
+	logger.InfoContext(ctx, "Shutdown complete")
+
+	return exitOK
 }
 
 func main() {
@@ -110,25 +1290,15 @@ func main() {
 
 	if *help {
 		showHelp()
+		os.Exit(exitOK)
 	}
-	// Parse label selector and scrapeTimeout for Kubernetes pods
-	labels, scrapeTimeout, port, err := ParseEnvVars()
+	// Parse the scrape jobs, scrapeTimeout and port
+	cfg, err := ParseEnvVars()
 	if err != nil {
-		log.Printf("Error: %v\n", err)
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		showHelp()
+		os.Exit(exitUsage)
 	}
 
-	// Initialize Kubernetes client and start watching pods
-	clientset := initK8sClient()
-	// Create an instance of PodScrapeWatcher
-	podWatcher := k8s.NewPodScrapeWatcher()
-
-	go podWatcher.WatchPods(clientset, "", labels)
-	// Start the HTTP server
-	server := startServer(scrapeTimeout, port, podWatcher)
-
-	log.Printf("Starting metrics proxy on port %s", port)
-	log.Printf("Scrape timeout set to: %v", scrapeTimeout)
-	log.Printf("Watching pods with labels: %v", labels)
-	log.Fatal(server.ListenAndServe())
+	os.Exit(run(cfg))
 }
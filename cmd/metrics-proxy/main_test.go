@@ -1,9 +1,15 @@
 package main
 
 import (
+	"log/slog"
+	"net/http"
 	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
 	"time"
+
+	"github.com/canonical/metrics-k8s-proxy/internal/config"
 )
 
 // resetEnvVars registers cleanup logic to remove them after the test completes.
@@ -13,6 +19,52 @@ func resetEnvVars(t *testing.T) {
 		os.Unsetenv("POD_LABEL_SELECTOR")
 		os.Unsetenv("SCRAPE_TIMEOUT")
 		os.Unsetenv("PORT")
+		os.Unsetenv("SCRAPE_JOBS_FILE")
+		os.Unsetenv("SCRAPE_TIMEOUT_OFFSET")
+		os.Unsetenv("SHUTDOWN_GRACE_PERIOD")
+		os.Unsetenv("COALESCE_WINDOW")
+		os.Unsetenv("CACHE_TTL")
+		os.Unsetenv("BACKGROUND_SCRAPE_INTERVAL")
+		os.Unsetenv("BACKGROUND_SCRAPE_STALENESS")
+		os.Unsetenv("REMOTE_WRITE_URL")
+		os.Unsetenv("REMOTE_WRITE_INTERVAL")
+		os.Unsetenv("REMOTE_WRITE_HEADERS")
+		os.Unsetenv("REMOTE_WRITE_BEARER_TOKEN_FILE")
+		os.Unsetenv("REMOTE_WRITE_QUEUE_SIZE")
+		os.Unsetenv("REMOTE_WRITE_MAX_ATTEMPTS")
+		os.Unsetenv("OTLP_ENDPOINT")
+		os.Unsetenv("OTLP_INTERVAL")
+		os.Unsetenv("OTLP_HEADERS")
+		os.Unsetenv("OTLP_TRACES_ENDPOINT")
+		os.Unsetenv("OTLP_TRACES_INTERVAL")
+		os.Unsetenv("OTLP_TRACES_HEADERS")
+		os.Unsetenv("OTLP_TRACES_SAMPLE_RATIO")
+		os.Unsetenv("SHARD_COUNT")
+		os.Unsetenv("SHARD_INDEX")
+		os.Unsetenv("SHARD_SERVICE")
+		os.Unsetenv("POD_NAME")
+		os.Unsetenv("POD_NAMESPACE")
+		os.Unsetenv("LEADER_ELECTION_LEASE")
+		os.Unsetenv("LEADER_ELECTION_NAMESPACE")
+		os.Unsetenv("STANDBY_RESPONSE")
+		os.Unsetenv("SD_FILE")
+		os.Unsetenv("DEBUG_ENDPOINTS")
+		os.Unsetenv("SCRAPE_BODY_SIZE_LIMIT")
+		os.Unsetenv("SCRAPE_SAMPLE_LIMIT")
+		os.Unsetenv("SCRAPE_SERIES_LIMIT")
+		os.Unsetenv("UPSTREAM_MAX_IDLE_CONNS_PER_HOST")
+		os.Unsetenv("UPSTREAM_KEEP_ALIVE")
+		os.Unsetenv("UPSTREAM_DIAL_TIMEOUT")
+		os.Unsetenv("UPSTREAM_TLS_HANDSHAKE_TIMEOUT")
+		os.Unsetenv("UPSTREAM_HTTP2")
+		os.Unsetenv("SCRAPE_MAX_ATTEMPTS")
+		os.Unsetenv("SCRAPE_RETRY_BACKOFF")
+		os.Unsetenv("CIRCUIT_BREAKER_THRESHOLD")
+		os.Unsetenv("CIRCUIT_BREAKER_COOLDOWN")
+		os.Unsetenv("CARDINALITY_TOP_N")
+		os.Unsetenv("LOG_LEVEL")
+		os.Unsetenv("LOG_FORMAT")
+		os.Unsetenv("LOG_ERROR_INTERVAL")
 	})
 }
 
@@ -20,11 +72,12 @@ func TestPodSelector_Valid(t *testing.T) {
 	// Set environment variables
 	resetEnvVars(t)
 	t.Setenv("POD_LABEL_SELECTOR", "app=ztunnel")
-	labels, _, _, err := ParseEnvVars()
+	cfg, err := ParseEnvVars()
 	if err != nil {
 		t.Fatalf("Unexpected error: %v", err)
 	}
 
+	labels := cfg.Jobs[0].Labels
 	if len(labels) == 0 || labels["app"] != "ztunnel" {
 		t.Errorf("Expected label selector 'app=ztunnel', got %v", labels)
 	}
@@ -38,10 +91,11 @@ func TestParseEnvVars_Valid(t *testing.T) {
 	t.Setenv("SCRAPE_TIMEOUT", "10s")
 	t.Setenv("PORT", "8080")
 
-	labels, scrapeTimeout, port, err := ParseEnvVars()
+	cfg, err := ParseEnvVars()
 	if err != nil {
 		t.Fatalf("Unexpected error: %v", err)
 	}
+	labels, scrapeTimeout, port := cfg.Jobs[0].Labels, cfg.ScrapeTimeout, cfg.Port
 
 	if len(labels) == 0 || labels["app"] != "ztunnel" {
 		t.Errorf("Expected label selector 'app=ztunnel', got %v", labels)
@@ -61,7 +115,7 @@ func TestParseEnvVars_InvalidScrapeTimeout(t *testing.T) {
 	t.Setenv("SCRAPE_TIMEOUT", "invalid")
 	t.Setenv("PORT", "8080")
 
-	_, _, _, err := ParseEnvVars()
+	_, err := ParseEnvVars()
 	if err == nil || err.Error() != "invalid value for SCRAPE_TIMEOUT: time: invalid duration \"invalid\"" {
 		t.Errorf("Expected error due to invalid SCRAPE_TIMEOUT, but got %v", err)
 	}
@@ -73,7 +127,7 @@ func TestParseEnvVars_MissingPodLabelSelector(t *testing.T) {
 	t.Setenv("SCRAPE_TIMEOUT", "10s")
 	t.Setenv("PORT", "8080")
 
-	_, _, _, err := ParseEnvVars()
+	_, err := ParseEnvVars()
 	if err == nil || err.Error() != "environment variable POD_LABEL_SELECTOR is required" {
 		t.Errorf("Expected error due to missing POD_LABEL_SELECTOR, but got %v", err)
 	}
@@ -83,8 +137,574 @@ func TestPodSelector_Invalid(t *testing.T) {
 	resetEnvVars(t)
 	// Set invalid POD_LABEL_SELECTOR
 	t.Setenv("POD_LABEL_SELECTOR", "invalid@#45")
-	_, _, _, err := ParseEnvVars()
+	_, err := ParseEnvVars()
 	if err == nil || err.Error() != "invalid or empty label selector provided, please ensure valid labels are set" {
 		t.Errorf("Expected error due to invalid POD_LABEL_SELECTOR, but got %v", err)
 	}
 }
+
+func TestParseEnvVars_JobsFile(t *testing.T) {
+	resetEnvVars(t)
+	path := filepath.Join(t.TempDir(), "jobs.yaml")
+	jobs := "jobs:\n  - name: ztunnel\n    pod_label_selector: app=ztunnel\n" +
+		"  - name: waypoint\n    pod_label_selector: role=waypoint\n    scrape_timeout: 5s\n"
+	if err := os.WriteFile(path, []byte(jobs), 0o600); err != nil {
+		t.Fatalf("Failed to write jobs file: %v", err)
+	}
+	t.Setenv("SCRAPE_JOBS_FILE", path)
+	t.Setenv("SCRAPE_TIMEOUT", "10s")
+
+	cfg, err := ParseEnvVars()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if len(cfg.Jobs) != 2 || cfg.Jobs[0].Name != "ztunnel" || cfg.Jobs[1].Name != "waypoint" {
+		t.Fatalf("Expected jobs ztunnel and waypoint, got %+v", cfg.Jobs)
+	}
+	if time.Duration(cfg.Jobs[0].ScrapeTimeout) != 10*time.Second {
+		t.Errorf("Expected ztunnel to inherit SCRAPE_TIMEOUT, got %v", time.Duration(cfg.Jobs[0].ScrapeTimeout))
+	}
+	if time.Duration(cfg.Jobs[1].ScrapeTimeout) != 5*time.Second {
+		t.Errorf("Expected waypoint timeout '5s', got %v", time.Duration(cfg.Jobs[1].ScrapeTimeout))
+	}
+}
+
+func TestParseEnvVars_JobsFileAndSelector(t *testing.T) {
+	resetEnvVars(t)
+	t.Setenv("POD_LABEL_SELECTOR", "app=ztunnel")
+	t.Setenv("SCRAPE_JOBS_FILE", "/nonexistent/jobs.yaml")
+
+	_, err := ParseEnvVars()
+	if err == nil || err.Error() != "POD_LABEL_SELECTOR and SCRAPE_JOBS_FILE are mutually exclusive" {
+		t.Errorf("Expected error due to conflicting job sources, but got %v", err)
+	}
+}
+
+func TestParseEnvVars_ScrapeTimeoutOffset(t *testing.T) {
+	resetEnvVars(t)
+	t.Setenv("POD_LABEL_SELECTOR", "app=ztunnel")
+
+	cfg, err := ParseEnvVars()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if cfg.ScrapeTimeoutOffset != 500*time.Millisecond {
+		t.Errorf("Expected default scrapeTimeoutOffset '500ms', got %v", cfg.ScrapeTimeoutOffset)
+	}
+
+	t.Setenv("SCRAPE_TIMEOUT_OFFSET", "1s")
+	cfg, err = ParseEnvVars()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if cfg.ScrapeTimeoutOffset != time.Second {
+		t.Errorf("Expected scrapeTimeoutOffset '1s', got %v", cfg.ScrapeTimeoutOffset)
+	}
+
+	t.Setenv("SCRAPE_TIMEOUT_OFFSET", "invalid")
+	if _, err = ParseEnvVars(); err == nil {
+		t.Errorf("Expected error due to invalid SCRAPE_TIMEOUT_OFFSET")
+	}
+}
+
+func TestParseEnvVars_ShutdownGracePeriod(t *testing.T) {
+	resetEnvVars(t)
+	t.Setenv("POD_LABEL_SELECTOR", "app=ztunnel")
+
+	cfg, err := ParseEnvVars()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if cfg.ShutdownGracePeriod != 15*time.Second {
+		t.Errorf("Expected default shutdownGracePeriod '15s', got %v", cfg.ShutdownGracePeriod)
+	}
+
+	t.Setenv("SHUTDOWN_GRACE_PERIOD", "invalid")
+	_, err = ParseEnvVars()
+	if err == nil || err.Error() != "invalid value for SHUTDOWN_GRACE_PERIOD: time: invalid duration \"invalid\"" {
+		t.Errorf("Expected error due to invalid SHUTDOWN_GRACE_PERIOD, but got %v", err)
+	}
+}
+
+func TestParseEnvVars_DebugEndpoints(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    bool
+		wantErr bool
+	}{
+		{value: "", want: false},
+		{value: "true", want: true},
+		{value: "0", want: false},
+		{value: "sometimes", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			resetEnvVars(t)
+			t.Setenv("POD_LABEL_SELECTOR", "app=ztunnel")
+			t.Setenv("DEBUG_ENDPOINTS", tt.value)
+
+			cfg, err := ParseEnvVars()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseEnvVars() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if cfg.DebugEndpoints != tt.want {
+				t.Errorf("Expected DebugEndpoints %v, got %v", tt.want, cfg.DebugEndpoints)
+			}
+		})
+	}
+}
+
+func TestParseEnvVars_FanOutCache(t *testing.T) {
+	resetEnvVars(t)
+	t.Setenv("POD_LABEL_SELECTOR", "app=ztunnel")
+	t.Setenv("COALESCE_WINDOW", "1s")
+	t.Setenv("CACHE_TTL", "2s")
+
+	cfg, err := ParseEnvVars()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if cfg.CoalesceWindow != time.Second || cfg.CacheTTL != 2*time.Second {
+		t.Errorf("Expected coalesceWindow '1s' and cacheTTL '2s', got %v and %v", cfg.CoalesceWindow, cfg.CacheTTL)
+	}
+
+	t.Setenv("CACHE_TTL", "invalid")
+	if _, err = ParseEnvVars(); err == nil {
+		t.Errorf("Expected error due to invalid CACHE_TTL")
+	}
+}
+
+func TestParseEnvVars_BackgroundScrape(t *testing.T) {
+	resetEnvVars(t)
+	t.Setenv("POD_LABEL_SELECTOR", "app=ztunnel")
+
+	cfg, err := ParseEnvVars()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if cfg.BackgroundScrapeInterval != 0 {
+		t.Errorf("Expected background scraping to be disabled by default, got %v", cfg.BackgroundScrapeInterval)
+	}
+
+	t.Setenv("BACKGROUND_SCRAPE_INTERVAL", "15s")
+	if cfg, err = ParseEnvVars(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if cfg.BackgroundScrapeInterval != 15*time.Second || cfg.BackgroundScrapeStaleness != 30*time.Second {
+		t.Errorf("Expected interval 15s and default staleness 30s, got %v and %v",
+			cfg.BackgroundScrapeInterval, cfg.BackgroundScrapeStaleness)
+	}
+
+	t.Setenv("BACKGROUND_SCRAPE_STALENESS", "1m")
+	if cfg, err = ParseEnvVars(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if cfg.BackgroundScrapeStaleness != time.Minute {
+		t.Errorf("Expected staleness 1m, got %v", cfg.BackgroundScrapeStaleness)
+	}
+
+	t.Setenv("BACKGROUND_SCRAPE_INTERVAL", "-1s")
+	if _, err = ParseEnvVars(); err == nil {
+		t.Errorf("Expected error due to negative BACKGROUND_SCRAPE_INTERVAL")
+	}
+}
+
+func TestParseEnvVars_RemoteWrite(t *testing.T) {
+	resetEnvVars(t)
+	t.Setenv("POD_LABEL_SELECTOR", "app=ztunnel")
+	t.Setenv("REMOTE_WRITE_URL", "https://prometheus.example.com/api/v1/write")
+	t.Setenv("REMOTE_WRITE_HEADERS", "X-Scope-OrgID=tenant-1")
+
+	cfg, err := ParseEnvVars()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	want := config.RemoteWrite{
+		URL:         "https://prometheus.example.com/api/v1/write",
+		Interval:    30 * time.Second,
+		Headers:     map[string]string{"X-Scope-OrgID": "tenant-1"},
+		QueueSize:   10,
+		MaxAttempts: 5,
+	}
+	if !reflect.DeepEqual(cfg.RemoteWrite, want) {
+		t.Errorf("Expected remote write config %+v, got %+v", want, cfg.RemoteWrite)
+	}
+
+	for name, value := range map[string]string{
+		"REMOTE_WRITE_URL":          "prometheus:9090",
+		"REMOTE_WRITE_INTERVAL":     "0s",
+		"REMOTE_WRITE_QUEUE_SIZE":   "0",
+		"REMOTE_WRITE_MAX_ATTEMPTS": "many",
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv(name, value)
+			if _, parseErr := ParseEnvVars(); parseErr == nil {
+				t.Errorf("Expected error due to invalid %s", name)
+			}
+		})
+	}
+}
+
+func TestParseEnvVars_Limits(t *testing.T) {
+	resetEnvVars(t)
+	t.Setenv("POD_LABEL_SELECTOR", "app=ztunnel")
+	t.Setenv("SCRAPE_BODY_SIZE_LIMIT", "10Mi")
+	t.Setenv("SCRAPE_SAMPLE_LIMIT", "50000")
+
+	cfg, err := ParseEnvVars()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	want := config.Limits{BodySize: 10 << 20, Samples: 50000}
+	if cfg.Limits != want {
+		t.Errorf("Expected limits %+v, got %+v", want, cfg.Limits)
+	}
+
+	for name, value := range map[string]string{
+		"SCRAPE_BODY_SIZE_LIMIT": "lots",
+		"SCRAPE_SAMPLE_LIMIT":    "0",
+		"SCRAPE_SERIES_LIMIT":    "-1",
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv(name, value)
+			if _, parseErr := ParseEnvVars(); parseErr == nil {
+				t.Errorf("Expected error due to invalid %s", name)
+			}
+		})
+	}
+}
+
+func TestParseEnvVars_Transport(t *testing.T) {
+	resetEnvVars(t)
+	t.Setenv("POD_LABEL_SELECTOR", "app=ztunnel")
+	t.Setenv("UPSTREAM_MAX_IDLE_CONNS_PER_HOST", "8")
+	t.Setenv("UPSTREAM_KEEP_ALIVE", "0s")
+	t.Setenv("UPSTREAM_HTTP2", "false")
+
+	cfg, err := ParseEnvVars()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	want := config.Transport{
+		MaxIdleConnsPerHost: 8, DialTimeout: 30 * time.Second, TLSHandshakeTimeout: 10 * time.Second,
+	}
+	if cfg.Transport != want {
+		t.Errorf("Expected transport %+v, got %+v", want, cfg.Transport)
+	}
+
+	for name, value := range map[string]string{
+		"UPSTREAM_MAX_IDLE_CONNS_PER_HOST": "0",
+		"UPSTREAM_KEEP_ALIVE":              "-1s",
+		"UPSTREAM_DIAL_TIMEOUT":            "soon",
+		"UPSTREAM_TLS_HANDSHAKE_TIMEOUT":   "0s",
+		"UPSTREAM_HTTP2":                   "maybe",
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv(name, value)
+			if _, parseErr := ParseEnvVars(); parseErr == nil {
+				t.Errorf("Expected error due to invalid %s", name)
+			}
+		})
+	}
+}
+
+func TestBuildHTTPClient(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  config.Transport
+	}{
+		{name: "Defaults", cfg: config.Transport{
+			MaxIdleConnsPerHost: 2, KeepAlive: 90 * time.Second, DialTimeout: 30 * time.Second,
+			TLSHandshakeTimeout: 10 * time.Second, HTTP2: true,
+		}},
+		{name: "No Keep-Alive Nor HTTP/2", cfg: config.Transport{
+			MaxIdleConnsPerHost: 8, DialTimeout: time.Second, TLSHandshakeTimeout: time.Second,
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport, ok := buildHTTPClient(tt.cfg).Transport.(*http.Transport)
+			if !ok {
+				t.Fatal("Expected an *http.Transport")
+			}
+			if transport.MaxIdleConns != 0 || transport.MaxIdleConnsPerHost != tt.cfg.MaxIdleConnsPerHost ||
+				transport.IdleConnTimeout != tt.cfg.KeepAlive || transport.DisableKeepAlives != (tt.cfg.KeepAlive == 0) ||
+				transport.TLSHandshakeTimeout != tt.cfg.TLSHandshakeTimeout || transport.ForceAttemptHTTP2 != tt.cfg.HTTP2 ||
+				(transport.TLSNextProto != nil) == tt.cfg.HTTP2 {
+				t.Errorf("Unexpected transport settings for %+v", tt.cfg)
+			}
+		})
+	}
+}
+
+func TestParseEnvVars_Retry(t *testing.T) {
+	resetEnvVars(t)
+	t.Setenv("POD_LABEL_SELECTOR", "app=ztunnel")
+
+	cfg, err := ParseEnvVars()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if want := (config.Retry{MaxAttempts: 1, Backoff: 100 * time.Millisecond}); cfg.Retry != want {
+		t.Errorf("Expected default retry %+v, got %+v", want, cfg.Retry)
+	}
+
+	t.Setenv("SCRAPE_MAX_ATTEMPTS", "3")
+	t.Setenv("SCRAPE_RETRY_BACKOFF", "50ms")
+	if cfg, err = ParseEnvVars(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if want := (config.Retry{MaxAttempts: 3, Backoff: 50 * time.Millisecond}); cfg.Retry != want {
+		t.Errorf("Expected retry %+v, got %+v", want, cfg.Retry)
+	}
+
+	for name, value := range map[string]string{
+		"SCRAPE_MAX_ATTEMPTS":  "0",
+		"SCRAPE_RETRY_BACKOFF": "-1s",
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv(name, value)
+			if _, parseErr := ParseEnvVars(); parseErr == nil {
+				t.Errorf("Expected error due to invalid %s", name)
+			}
+		})
+	}
+}
+
+func TestParseEnvVars_CircuitBreaker(t *testing.T) {
+	resetEnvVars(t)
+	t.Setenv("POD_LABEL_SELECTOR", "app=ztunnel")
+	t.Setenv("CIRCUIT_BREAKER_THRESHOLD", "5")
+
+	cfg, err := ParseEnvVars()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if want := (config.CircuitBreaker{Threshold: 5, Cooldown: time.Minute}); cfg.CircuitBreaker != want {
+		t.Errorf("Expected circuit breaker %+v, got %+v", want, cfg.CircuitBreaker)
+	}
+
+	for name, value := range map[string]string{
+		"CIRCUIT_BREAKER_THRESHOLD": "-1",
+		"CIRCUIT_BREAKER_COOLDOWN":  "0s",
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv(name, value)
+			if _, parseErr := ParseEnvVars(); parseErr == nil {
+				t.Errorf("Expected error due to invalid %s", name)
+			}
+		})
+	}
+}
+
+func TestParseEnvVars_Logging(t *testing.T) {
+	resetEnvVars(t)
+	t.Setenv("POD_LABEL_SELECTOR", "app=ztunnel")
+
+	cfg, err := ParseEnvVars()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if want := (config.Logging{Level: slog.LevelInfo, Format: "text", ErrorInterval: time.Minute}); cfg.Logging != want {
+		t.Errorf("Expected default logging %+v, got %+v", want, cfg.Logging)
+	}
+
+	t.Setenv("LOG_LEVEL", "DEBUG")
+	t.Setenv("LOG_FORMAT", "json")
+	t.Setenv("LOG_ERROR_INTERVAL", "0s")
+	if cfg, err = ParseEnvVars(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if want := (config.Logging{Level: slog.LevelDebug, Format: "json"}); cfg.Logging != want {
+		t.Errorf("Expected logging %+v, got %+v", want, cfg.Logging)
+	}
+
+	for name, value := range map[string]string{
+		"LOG_LEVEL":          "verbose",
+		"LOG_FORMAT":         "logfmt",
+		"LOG_ERROR_INTERVAL": "-1m",
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv(name, value)
+			if _, parseErr := ParseEnvVars(); parseErr == nil {
+				t.Errorf("Expected error due to invalid %s", name)
+			}
+		})
+	}
+}
+
+func TestParseEnvVars_CardinalityTopN(t *testing.T) {
+	resetEnvVars(t)
+	t.Setenv("POD_LABEL_SELECTOR", "app=ztunnel")
+	t.Setenv("CARDINALITY_TOP_N", "20")
+
+	cfg, err := ParseEnvVars()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if cfg.CardinalityTopN != 20 {
+		t.Errorf("Expected CardinalityTopN 20, got %d", cfg.CardinalityTopN)
+	}
+
+	t.Setenv("CARDINALITY_TOP_N", "0")
+	if _, err = ParseEnvVars(); err == nil {
+		t.Error("Expected error due to invalid CARDINALITY_TOP_N")
+	}
+}
+
+func TestParseEnvVars_OTLP(t *testing.T) {
+	resetEnvVars(t)
+	t.Setenv("POD_LABEL_SELECTOR", "app=ztunnel")
+	t.Setenv("OTLP_ENDPOINT", "http://otel-collector:4318/v1/metrics")
+	t.Setenv("OTLP_INTERVAL", "1m")
+
+	cfg, err := ParseEnvVars()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	want := config.OTLP{URL: "http://otel-collector:4318/v1/metrics", Interval: time.Minute, Headers: map[string]string{}}
+	if !reflect.DeepEqual(cfg.OTLP, want) {
+		t.Errorf("Expected OTLP config %+v, got %+v", want, cfg.OTLP)
+	}
+
+	t.Setenv("OTLP_ENDPOINT", "otel-collector:4318")
+	if _, err = ParseEnvVars(); err == nil {
+		t.Errorf("Expected error due to invalid OTLP_ENDPOINT")
+	}
+}
+
+func TestParseEnvVars_Tracing(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		want    config.Tracing
+		wantErr bool
+	}{
+		{"disabled", map[string]string{}, config.Tracing{Headers: map[string]string{}}, false},
+		{"defaults", map[string]string{"OTLP_TRACES_ENDPOINT": "http://otel-collector:4318/v1/traces"},
+			config.Tracing{
+				URL: "http://otel-collector:4318/v1/traces", Interval: 5 * time.Second, Headers: map[string]string{},
+				SampleRatio: 1,
+			}, false},
+		{"custom", map[string]string{
+			"OTLP_TRACES_ENDPOINT": "https://otel-collector/v1/traces", "OTLP_TRACES_INTERVAL": "1s",
+			"OTLP_TRACES_HEADERS": "Authorization=Bearer token", "OTLP_TRACES_SAMPLE_RATIO": "0.25",
+		}, config.Tracing{
+			URL: "https://otel-collector/v1/traces", Interval: time.Second,
+			Headers: map[string]string{"Authorization": "Bearer token"}, SampleRatio: 0.25,
+		}, false},
+		{"invalid endpoint", map[string]string{"OTLP_TRACES_ENDPOINT": "otel-collector:4318"}, config.Tracing{}, true},
+		{"invalid interval", map[string]string{
+			"OTLP_TRACES_ENDPOINT": "http://otel-collector:4318/v1/traces", "OTLP_TRACES_INTERVAL": "0s",
+		}, config.Tracing{}, true},
+		{"invalid sample ratio", map[string]string{
+			"OTLP_TRACES_ENDPOINT": "http://otel-collector:4318/v1/traces", "OTLP_TRACES_SAMPLE_RATIO": "1.5",
+		}, config.Tracing{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetEnvVars(t)
+			t.Setenv("POD_LABEL_SELECTOR", "app=ztunnel")
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+
+			cfg, err := ParseEnvVars()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseEnvVars() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(cfg.Tracing, tt.want) {
+				t.Errorf("Expected tracing config %+v, got %+v", tt.want, cfg.Tracing)
+			}
+		})
+	}
+}
+
+func TestParseEnvVars_Sharding(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		want    config.Sharding
+		wantErr bool
+	}{
+		{"disabled", map[string]string{}, config.Sharding{}, false},
+		{"explicit index", map[string]string{"SHARD_COUNT": "3", "SHARD_INDEX": "2"},
+			config.Sharding{Count: 3, Index: 2}, false},
+		{"StatefulSet ordinal", map[string]string{"SHARD_COUNT": "3", "POD_NAME": "metrics-proxy-1"},
+			config.Sharding{Count: 3, Index: 1}, false},
+		{"no ordinal", map[string]string{"SHARD_COUNT": "3", "POD_NAME": "metrics-proxy-abcde"},
+			config.Sharding{}, true},
+		{"index out of range", map[string]string{"SHARD_COUNT": "3", "SHARD_INDEX": "3"}, config.Sharding{}, true},
+		{"service", map[string]string{
+			"SHARD_SERVICE": "metrics-proxy", "POD_NAME": "metrics-proxy-7d9f", "POD_NAMESPACE": "monitoring",
+		}, config.Sharding{Service: "metrics-proxy", Namespace: "monitoring", Self: "metrics-proxy-7d9f"}, false},
+		{"service and count", map[string]string{
+			"SHARD_SERVICE": "metrics-proxy", "SHARD_COUNT": "3", "POD_NAMESPACE": "monitoring",
+		}, config.Sharding{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetEnvVars(t)
+			t.Setenv("POD_LABEL_SELECTOR", "app=ztunnel")
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+
+			cfg, err := ParseEnvVars()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseEnvVars() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(cfg.Sharding, tt.want) {
+				t.Errorf("Expected sharding config %+v, got %+v", tt.want, cfg.Sharding)
+			}
+		})
+	}
+}
+
+func TestParseEnvVars_LeaderElection(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		want    config.LeaderElection
+		wantErr bool
+	}{
+		{"disabled", map[string]string{"STANDBY_RESPONSE": "unavailable"}, config.LeaderElection{}, false},
+		{"defaults", map[string]string{
+			"LEADER_ELECTION_LEASE": "metrics-proxy", "POD_NAME": "metrics-proxy-0", "POD_NAMESPACE": "monitoring",
+		}, config.LeaderElection{
+			Lease: "metrics-proxy", Namespace: "monitoring", Identity: "metrics-proxy-0", StandbyResponse: "empty",
+		}, false},
+		{"explicit namespace and unavailable", map[string]string{
+			"LEADER_ELECTION_LEASE": "metrics-proxy", "LEADER_ELECTION_NAMESPACE": "leases",
+			"POD_NAME": "metrics-proxy-0", "POD_NAMESPACE": "monitoring", "STANDBY_RESPONSE": "unavailable",
+		}, config.LeaderElection{
+			Lease: "metrics-proxy", Namespace: "leases", Identity: "metrics-proxy-0", StandbyResponse: "unavailable",
+		}, false},
+		{"invalid standby response", map[string]string{
+			"LEADER_ELECTION_LEASE": "metrics-proxy", "POD_NAMESPACE": "monitoring", "STANDBY_RESPONSE": "redirect",
+		}, config.LeaderElection{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetEnvVars(t)
+			t.Setenv("POD_LABEL_SELECTOR", "app=ztunnel")
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+
+			cfg, err := ParseEnvVars()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseEnvVars() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(cfg.LeaderElection, tt.want) {
+				t.Errorf("Expected leader election config %+v, got %+v", tt.want, cfg.LeaderElection)
+			}
+		})
+	}
+}
@@ -0,0 +1,382 @@
+// Package aggregate sums series across pods, collapsing the per-pod series of large workloads such as
+// DaemonSets into cluster-wide ones.
+package aggregate
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/canonical/metrics-k8s-proxy/internal/logging"
+	"github.com/canonical/metrics-k8s-proxy/internal/util"
+)
+
+// Config is a single aggregation rule as it appears in the jobs file: sum the series of the metric families
+// matching Metric, keeping only the labels in By, or every label except those in Without. Without either,
+// every series of a family is summed into one.
+type Config struct {
+	Metric  string   `json:"metric"`
+	By      []string `json:"by,omitempty"`
+	Without []string `json:"without,omitempty"`
+}
+
+// Rule is a compiled Config, ready to be applied to scraped metrics.
+type Rule struct {
+	metric  *regexp.Regexp
+	by      []string
+	without []string
+}
+
+// Compile validates the given configs and compiles them into rules.
+func Compile(configs []Config) ([]Rule, error) {
+	rules := make([]Rule, 0, len(configs))
+	for i, cfg := range configs {
+		if cfg.Metric == "" {
+			return nil, fmt.Errorf("aggregation rule %d: metric is required", i)
+		}
+		re, err := regexp.Compile("^(?:" + cfg.Metric + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("aggregation rule %d: invalid metric regex %q: %w", i, cfg.Metric, err)
+		}
+		if len(cfg.By) > 0 && len(cfg.Without) > 0 {
+			return nil, fmt.Errorf("aggregation rule %d: by and without are mutually exclusive", i)
+		}
+		rules = append(rules, Rule{metric: re, by: cfg.By, without: cfg.Without})
+	}
+
+	return rules, nil
+}
+
+// Metric types from the TYPE comments of the exposition format.
+const (
+	typeCounter   = "counter"
+	typeHistogram = "histogram"
+	typeSummary   = "summary"
+)
+
+// bucketLabel is the upper bound label of histogram buckets, which is always kept.
+const bucketLabel = "le"
+
+// upMetric and attemptsMetric, the proxy's own series of every pod, are never aggregated, so that the health
+// of every pod stays visible.
+const (
+	upMetric       = "up"
+	attemptsMetric = "scrape_attempts"
+)
+
+// groupLabels returns the labels the rule keeps, sorted by name.
+func (r Rule) groupLabels(labels []util.Label) []util.Label {
+	kept := []util.Label{}
+	for _, label := range labels {
+		keep := !slices.Contains(r.without, label.Name)
+		if r.by != nil || r.without == nil {
+			keep = slices.Contains(r.by, label.Name)
+		}
+		if keep || label.Name == bucketLabel {
+			kept = append(kept, label)
+		}
+	}
+	slices.SortFunc(kept, func(a, b util.Label) int { return cmp.Compare(a.Name, b.Name) })
+
+	return kept
+}
+
+// family is the metric family of a sample: its name without the suffixes of its type, and its type.
+type family struct {
+	name       string
+	metricType string
+}
+
+// familyOf finds the family of a sample name from the TYPE comments seen in the scraped metrics.
+func familyOf(name string, types map[string]string) family {
+	base := util.FamilyOf(name, types)
+
+	return family{name: base, metricType: types[base]}
+}
+
+// line is a sample line of a pod's response that a rule matched.
+type line struct {
+	pod, index int
+	family     family
+	// sample has the labels kept by the rule, series the line's own name and labels, and value its own value.
+	sample util.Sample
+	series string
+	value  string
+	// group is the aggregated series the sample is summed into, and histogram the pod's histogram it belongs to.
+	group     string
+	histogram string
+}
+
+// group is an aggregated series, the lines summed into it and their total.
+type group struct {
+	family family
+	sample util.Sample
+	lines  []line
+	total  float64
+}
+
+// Apply sums the series matched by the rules across the pod responses. It returns the responses without the
+// summed series, followed by a response holding the aggregated ones. Summary families can't be summed and
+// are left untouched, as are histograms whose pods don't share the same buckets, and the up and scrape_attempts
+// series. Such histograms are logged with the logger of ctx. Counters and histograms are summed through
+// counters, if set, so that their sums don't go down when a pod resets, fails a scrape or leaves.
+func Apply(ctx context.Context, responses []string, rules []Rule, counters *Counters) []string {
+	if len(rules) == 0 {
+		return responses
+	}
+
+	types, help := metadata(responses)
+	groups := map[string]*group{}
+	for pod, response := range responses {
+		for index, text := range strings.Split(response, "\n") {
+			matched, ok := match(text, rules, types)
+			if !ok {
+				continue
+			}
+			matched.pod, matched.index = pod, index
+			g, exists := groups[matched.group]
+			if !exists {
+				g = &group{family: matched.family, sample: matched.sample}
+				groups[matched.group] = g
+			}
+			g.lines = append(g.lines, matched)
+		}
+	}
+	unsummed := dropMismatchedBuckets(ctx, groups)
+	if len(groups) == 0 {
+		return responses
+	}
+	for _, g := range groups {
+		g.total = sum(g.lines)
+	}
+	if counters != nil {
+		counters.update(groups, podsOf(responses))
+	}
+
+	// The summed lines of every pod, and the families whose every line was summed
+	removed := map[int]map[int]bool{}
+	summed := map[string]bool{}
+	for _, g := range groups {
+		for _, l := range g.lines {
+			if removed[l.pod] == nil {
+				removed[l.pod] = map[int]bool{}
+			}
+			removed[l.pod][l.index] = true
+		}
+		summed[g.family.name] = !unsummed[g.family.name]
+	}
+
+	aggregated := make([]string, 0, len(responses)+1)
+	for pod, response := range responses {
+		aggregated = append(aggregated, removeLines(response, removed[pod], summed))
+	}
+
+	return append(aggregated, render(groups, types, help))
+}
+
+// metadata returns the type and help text of every family with TYPE or HELP comments in the responses.
+func metadata(responses []string) (map[string]string, map[string]string) {
+	types, help := map[string]string{}, map[string]string{}
+	for _, response := range responses {
+		for text := range strings.SplitSeq(response, "\n") {
+			comment, ok := util.ParseComment(text)
+			if !ok {
+				continue
+			}
+			switch comment.Keyword {
+			case "TYPE":
+				types[comment.Family] = comment.Text
+			case "HELP":
+				help[comment.Family] = comment.Text
+			}
+		}
+	}
+
+	return types, help
+}
+
+// match parses a sample line and finds the group it is summed into, if a rule matches its family.
+func match(text string, rules []Rule, types map[string]string) (line, bool) {
+	if text == "" || strings.HasPrefix(text, "#") {
+		return line{}, false
+	}
+	sample, err := util.ParseSample(text)
+	if err != nil || sample.Name == upMetric || sample.Name == attemptsMetric {
+		return line{}, false
+	}
+	fam := familyOf(sample.Name, types)
+	// Summaries' quantiles and the creation timestamps of series can't be summed
+	if fam.metricType == typeSummary || (sample.Name != fam.name && strings.HasSuffix(sample.Name, "_created")) {
+		return line{}, false
+	}
+	for _, rule := range rules {
+		if !rule.metric.MatchString(fam.name) {
+			continue
+		}
+		grouped := util.Sample{Name: sample.Name, Labels: rule.groupLabels(sample.Labels)}
+		matched := line{
+			family: fam,
+			sample: grouped,
+			series: util.Sample{Name: sample.Name, Labels: sample.Labels}.String(),
+			value:  sample.Value,
+			group:  grouped.String(),
+		}
+		if fam.metricType == typeHistogram {
+			// The pod's histogram is the series without its bucket, whatever its suffix
+			labels := slices.DeleteFunc(slices.Clone(sample.Labels), func(l util.Label) bool {
+				return l.Name == bucketLabel
+			})
+			matched.histogram = util.Sample{Name: fam.name, Labels: labels}.String()
+		}
+
+		return matched, true
+	}
+
+	return line{}, false
+}
+
+// dropMismatchedBuckets leaves out the aggregated histograms whose pods don't all have the same buckets, as
+// summing them would yield wrong counts for some of the buckets. It returns the families left out.
+func dropMismatchedBuckets(ctx context.Context, groups map[string]*group) map[string]bool {
+	// The buckets of every pod's histogram, by the aggregated histogram it is summed into
+	buckets := map[string]map[string][]string{}
+	for _, g := range groups {
+		if g.family.metricType != typeHistogram || !strings.HasSuffix(g.sample.Name, "_bucket") {
+			continue
+		}
+		histogram := histogramKey(g)
+		if buckets[histogram] == nil {
+			buckets[histogram] = map[string][]string{}
+		}
+		for _, l := range g.lines {
+			buckets[histogram][l.histogram] = append(buckets[histogram][l.histogram], g.sample.Get(bucketLabel))
+		}
+	}
+
+	mismatched := map[string]bool{}
+	for histogram, byPod := range buckets {
+		var want []string
+		for _, les := range byPod {
+			slices.Sort(les)
+			if want == nil {
+				want = les
+			} else if !slices.Equal(want, les) {
+				mismatched[histogram] = true
+				logging.FromContext(ctx).WarnContext(ctx, "Not aggregating histogram: its pods have different buckets",
+					"histogram", strings.TrimSpace(histogram))
+
+				break
+			}
+		}
+	}
+	unsummed := map[string]bool{}
+	for key, g := range groups {
+		if g.family.metricType == typeHistogram && mismatched[histogramKey(g)] {
+			unsummed[g.family.name] = true
+			delete(groups, key)
+		}
+	}
+
+	return unsummed
+}
+
+// histogramKey identifies the aggregated histogram that a bucket, sum or count series belongs to.
+func histogramKey(g *group) string {
+	labels := slices.DeleteFunc(slices.Clone(g.sample.Labels), func(l util.Label) bool {
+		return l.Name == bucketLabel
+	})
+
+	return util.Sample{Name: g.family.name, Labels: labels}.String()
+}
+
+// removeLines drops the summed lines from a pod's response, along with the comments of the families that
+// were summed.
+func removeLines(response string, summed map[int]bool, families map[string]bool) string {
+	kept := []string{}
+	for index, text := range strings.Split(response, "\n") {
+		if summed[index] {
+			continue
+		}
+		if comment, ok := util.ParseComment(text); ok && families[comment.Family] {
+			continue
+		}
+		kept = append(kept, text)
+	}
+
+	return strings.Join(kept, "\n")
+}
+
+// render writes the aggregated series by family, each with its comments, in a stable order.
+func render(groups map[string]*group, types, help map[string]string) string {
+	byFamily := map[string][]*group{}
+	for _, g := range groups {
+		byFamily[g.family.name] = append(byFamily[g.family.name], g)
+	}
+
+	var b strings.Builder
+	for _, name := range slices.Sorted(maps.Keys(byFamily)) {
+		if text, exists := help[name]; exists {
+			fmt.Fprintf(&b, "# HELP %s %s\n", name, text)
+		}
+		if metricType, exists := types[name]; exists {
+			fmt.Fprintf(&b, "# TYPE %s %s\n", name, metricType)
+		}
+		series := byFamily[name]
+		slices.SortFunc(series, compareSeries)
+		for _, g := range series {
+			sample := g.sample
+			sample.Value = strconv.FormatFloat(g.total, 'g', -1, 64)
+			b.WriteString(sample.String())
+			b.WriteByte('\n')
+		}
+	}
+
+	return b.String()
+}
+
+// compareSeries orders the series of a family by their labels, with the buckets of a histogram in increasing
+// order followed by its sum and count.
+func compareSeries(a, b *group) int {
+	return cmp.Or(
+		cmp.Compare(histogramKey(a), histogramKey(b)),
+		cmp.Compare(suffixOrder(a), suffixOrder(b)),
+		cmp.Compare(bucketBound(a), bucketBound(b)),
+		cmp.Compare(a.sample.String(), b.sample.String()),
+	)
+}
+
+func suffixOrder(g *group) int {
+	switch {
+	case strings.HasSuffix(g.sample.Name, "_bucket"):
+		return 0
+	case strings.HasSuffix(g.sample.Name, "_sum"):
+		return 1
+	default:
+		return 2 //nolint:mnd // _count series come last
+	}
+}
+
+// bucketBound is the upper bound of a histogram bucket, or 0 for other series.
+func bucketBound(g *group) float64 {
+	bound, err := strconv.ParseFloat(g.sample.Get(bucketLabel), 64)
+	if err != nil {
+		return 0
+	}
+
+	return bound
+}
+
+// sum adds up the values of the lines. Timestamps are dropped, as the lines come from scrapes at different times.
+func sum(lines []line) float64 {
+	total := 0.0
+	for _, l := range lines {
+		total += parseValue(l.value)
+	}
+
+	return total
+}
@@ -0,0 +1,214 @@
+package aggregate_test
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/canonical/metrics-k8s-proxy/internal/aggregate"
+)
+
+func TestCompile(t *testing.T) {
+	tests := []struct {
+		name    string
+		configs []aggregate.Config
+		wantErr bool
+	}{
+		{name: "Valid", configs: []aggregate.Config{
+			{Metric: "requests_total", Without: []string{"k8s_pod_name"}},
+			{Metric: "ztunnel_.*", By: []string{"k8s_namespace"}},
+			{Metric: "connections"},
+		}},
+		{name: "Missing Metric", configs: []aggregate.Config{{By: []string{"code"}}}, wantErr: true},
+		{name: "Invalid Regex", configs: []aggregate.Config{{Metric: "requests_(total"}}, wantErr: true},
+		{name: "By And Without", configs: []aggregate.Config{
+			{Metric: "requests_total", By: []string{"code"}, Without: []string{"k8s_pod_name"}},
+		}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := aggregate.Compile(tt.configs); (err != nil) != tt.wantErr {
+				t.Errorf("Compile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestApply(t *testing.T) {
+	pod1 := "# HELP requests_total Requests.\n" +
+		"# TYPE requests_total counter\n" +
+		"requests_total{k8s_pod_name=\"pod1\",k8s_namespace=\"default\",code=\"200\"} 5\n" +
+		"requests_total{k8s_pod_name=\"pod1\",k8s_namespace=\"default\",code=\"500\"} 1 1700000000000\n" +
+		"# TYPE connections gauge\n" +
+		"connections{k8s_pod_name=\"pod1\",k8s_namespace=\"default\"} 3\n" +
+		"# TYPE latency_seconds histogram\n" +
+		"latency_seconds_bucket{k8s_pod_name=\"pod1\",k8s_namespace=\"default\",le=\"0.1\"} 2\n" +
+		"latency_seconds_bucket{k8s_pod_name=\"pod1\",k8s_namespace=\"default\",le=\"+Inf\"} 4\n" +
+		"latency_seconds_sum{k8s_pod_name=\"pod1\",k8s_namespace=\"default\"} 0.5\n" +
+		"latency_seconds_count{k8s_pod_name=\"pod1\",k8s_namespace=\"default\"} 4\n" +
+		"# TYPE rpc_seconds summary\n" +
+		"rpc_seconds{k8s_pod_name=\"pod1\",k8s_namespace=\"default\",quantile=\"0.5\"} 0.2\n" +
+		"rpc_seconds_count{k8s_pod_name=\"pod1\",k8s_namespace=\"default\"} 7\n" +
+		"\n" +
+		"up{k8s_pod_name=\"pod1\",k8s_namespace=\"default\"} 1\n"
+	pod2 := "# HELP requests_total Requests.\n" +
+		"# TYPE requests_total counter\n" +
+		"requests_total{k8s_pod_name=\"pod2\",k8s_namespace=\"default\",code=\"200\"} 2\n" +
+		"# TYPE connections gauge\n" +
+		"connections{k8s_pod_name=\"pod2\",k8s_namespace=\"default\"} 4\n" +
+		"# TYPE latency_seconds histogram\n" +
+		"latency_seconds_bucket{k8s_pod_name=\"pod2\",k8s_namespace=\"default\",le=\"+Inf\"} 1\n" +
+		"latency_seconds_bucket{k8s_pod_name=\"pod2\",k8s_namespace=\"default\",le=\"0.1\"} 1\n" +
+		"latency_seconds_sum{k8s_pod_name=\"pod2\",k8s_namespace=\"default\"} 0.05\n" +
+		"latency_seconds_count{k8s_pod_name=\"pod2\",k8s_namespace=\"default\"} 1\n" +
+		"# TYPE rpc_seconds summary\n" +
+		"rpc_seconds{k8s_pod_name=\"pod2\",k8s_namespace=\"default\",quantile=\"0.5\"} 0.3\n" +
+		"rpc_seconds_count{k8s_pod_name=\"pod2\",k8s_namespace=\"default\"} 2\n" +
+		"\n" +
+		"up{k8s_pod_name=\"pod2\",k8s_namespace=\"default\"} 1\n"
+	// pod3 and pod4 have different buckets
+	pod3 := "# TYPE latency_seconds histogram\n" +
+		"latency_seconds_bucket{k8s_pod_name=\"pod3\",k8s_namespace=\"default\",le=\"1\"} 1\n" +
+		"latency_seconds_bucket{k8s_pod_name=\"pod3\",k8s_namespace=\"default\",le=\"+Inf\"} 1\n" +
+		"latency_seconds_sum{k8s_pod_name=\"pod3\",k8s_namespace=\"default\"} 0.5\n" +
+		"latency_seconds_count{k8s_pod_name=\"pod3\",k8s_namespace=\"default\"} 1\n" +
+		"\n" +
+		"up{k8s_pod_name=\"pod3\",k8s_namespace=\"default\"} 1\n"
+	pod4 := "# TYPE latency_seconds histogram\n" +
+		"latency_seconds_bucket{k8s_pod_name=\"pod4\",k8s_namespace=\"default\",le=\"0.1\"} 1\n" +
+		"latency_seconds_bucket{k8s_pod_name=\"pod4\",k8s_namespace=\"default\",le=\"+Inf\"} 1\n" +
+		"latency_seconds_sum{k8s_pod_name=\"pod4\",k8s_namespace=\"default\"} 0.05\n" +
+		"latency_seconds_count{k8s_pod_name=\"pod4\",k8s_namespace=\"default\"} 1\n"
+
+	tests := []struct {
+		name      string
+		configs   []aggregate.Config
+		responses []string
+		want      []string
+	}{
+		{
+			name: "Counters Gauges And Histograms",
+			configs: []aggregate.Config{
+				{Metric: "requests_total", Without: []string{"k8s_pod_name"}},
+				{Metric: "connections|latency_seconds|rpc_seconds"},
+			},
+			responses: []string{pod1, pod2},
+			want: []string{
+				"# TYPE rpc_seconds summary\n" +
+					"rpc_seconds{k8s_pod_name=\"pod1\",k8s_namespace=\"default\",quantile=\"0.5\"} 0.2\n" +
+					"rpc_seconds_count{k8s_pod_name=\"pod1\",k8s_namespace=\"default\"} 7\n" +
+					"\n" +
+					"up{k8s_pod_name=\"pod1\",k8s_namespace=\"default\"} 1\n",
+				"# TYPE rpc_seconds summary\n" +
+					"rpc_seconds{k8s_pod_name=\"pod2\",k8s_namespace=\"default\",quantile=\"0.5\"} 0.3\n" +
+					"rpc_seconds_count{k8s_pod_name=\"pod2\",k8s_namespace=\"default\"} 2\n" +
+					"\n" +
+					"up{k8s_pod_name=\"pod2\",k8s_namespace=\"default\"} 1\n",
+				"# TYPE connections gauge\n" +
+					"connections 7\n" +
+					"# TYPE latency_seconds histogram\n" +
+					"latency_seconds_bucket{le=\"0.1\"} 3\n" +
+					"latency_seconds_bucket{le=\"+Inf\"} 5\n" +
+					"latency_seconds_sum 0.55\n" +
+					"latency_seconds_count 5\n" +
+					"# HELP requests_total Requests.\n" +
+					"# TYPE requests_total counter\n" +
+					"requests_total{code=\"200\",k8s_namespace=\"default\"} 7\n" +
+					"requests_total{code=\"500\",k8s_namespace=\"default\"} 1\n",
+			},
+		},
+		{
+			name:      "Mismatched Buckets",
+			configs:   []aggregate.Config{{Metric: "latency_seconds", By: []string{"k8s_namespace"}}},
+			responses: []string{pod3, pod4},
+			want:      []string{pod3, pod4},
+		},
+		{
+			// The family of an OpenMetrics counter is named without its suffixes, and creation times aren't summed
+			name:    "OpenMetrics Counter",
+			configs: []aggregate.Config{{Metric: "^jobs$"}},
+			responses: []string{
+				"# TYPE jobs counter\n" +
+					"jobs_total{k8s_pod_name=\"pod1\"} 2\n" +
+					"jobs_created{k8s_pod_name=\"pod1\"} 1700000000",
+				"# TYPE jobs counter\n" +
+					"jobs_total{k8s_pod_name=\"pod2\"} 3\n" +
+					"jobs_created{k8s_pod_name=\"pod2\"} 1700000001",
+			},
+			want: []string{
+				"jobs_created{k8s_pod_name=\"pod1\"} 1700000000",
+				"jobs_created{k8s_pod_name=\"pod2\"} 1700000001",
+				"# TYPE jobs counter\njobs_total 5\n",
+			},
+		},
+		{
+			name:      "No Match",
+			configs:   []aggregate.Config{{Metric: "other_total"}},
+			responses: []string{pod1, pod2},
+			want:      []string{pod1, pod2},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules, err := aggregate.Compile(tt.configs)
+			if err != nil {
+				t.Fatalf("Compile() error = %v", err)
+			}
+			if got := aggregate.Apply(context.Background(), tt.responses, rules, nil); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Apply() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApply_Counters(t *testing.T) {
+	pod := func(name string, requests string) string {
+		up := "1"
+		if requests == "" {
+			up = "0"
+		} else {
+			requests = "requests_total{k8s_pod_name=\"" + name + "\"} " + requests + "\n"
+		}
+
+		return "# TYPE requests_total counter\n" + requests +
+			"up{k8s_pod_name=\"" + name + "\"} " + up + "\n" +
+			"scrape_attempts{k8s_pod_name=\"" + name + "\"} 1\n"
+	}
+	rules, err := aggregate.Compile([]aggregate.Config{{Metric: "requests_total|scrape_attempts|up"}})
+	if err != nil {
+		t.Fatalf("Compile() error = %v", err)
+	}
+
+	// Every scrape, by the pod responses, and the aggregated requests_total that follows
+	scrapes := []struct {
+		name      string
+		responses []string
+		want      string
+	}{
+		{name: "First Scrape", responses: []string{pod("pod1", "5"), pod("pod2", "3")}, want: "8"},
+		{name: "Increase", responses: []string{pod("pod1", "6"), pod("pod2", "4")}, want: "10"},
+		{name: "Failed Scrape", responses: []string{pod("pod1", "7"), pod("pod2", "")}, want: "11"},
+		{name: "Recovery", responses: []string{pod("pod1", "7"), pod("pod2", "5")}, want: "12"},
+		{name: "Restart", responses: []string{pod("pod1", "1"), pod("pod2", "5")}, want: "13"},
+		{name: "Pod Left", responses: []string{pod("pod1", "2")}, want: "14"},
+		{name: "Pod Joined", responses: []string{pod("pod1", "2"), pod("pod3", "1")}, want: "15"},
+	}
+
+	var counters aggregate.Counters
+	for _, scrape := range scrapes {
+		got := aggregate.Apply(context.Background(), scrape.responses, rules, &counters)
+		want := "# TYPE requests_total counter\nrequests_total " + scrape.want + "\n"
+		if got[len(got)-1] != want {
+			t.Errorf("%s: Apply() aggregated %q, want %q", scrape.name, got[len(got)-1], want)
+		}
+		for i, response := range got[:len(got)-1] {
+			if !strings.Contains(response, "up{") || !strings.Contains(response, "scrape_attempts{") {
+				t.Errorf("%s: Apply() response %d = %q, want its up and scrape_attempts series", scrape.name, i,
+					response)
+			}
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package aggregate
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/canonical/metrics-k8s-proxy/internal/util"
+)
+
+// Counters keeps the last value of every pod's cumulative series summed by the rules of a job, so that the
+// sums stay monotonic across scrapes. A pod whose counter resets, as it restarts, or which leaves the job
+// has its last values carried into the sums, and a pod failing a scrape keeps contributing its last values.
+// The zero value is ready to use.
+type Counters struct {
+	mu     sync.Mutex
+	series map[string]*cumulative
+}
+
+// cumulative is the state of an aggregated cumulative series.
+type cumulative struct {
+	// last is the last value of every pod's series summed into it, by pod and series.
+	last map[podSeries]float64
+	// carried is the sum of the values the pods had before they reset or left the job.
+	carried float64
+}
+
+// podSeries identifies the series of a pod: the pod by its up series, and the series by its name and labels.
+type podSeries struct {
+	pod, series string
+}
+
+// isCumulative reports whether the series of the family only go up until they reset.
+func isCumulative(f family) bool {
+	return f.metricType == typeCounter || f.metricType == typeHistogram
+}
+
+// update records the values of the cumulative groups scraped from the pods, whose up series are given, and
+// sets their totals.
+func (c *Counters) update(groups map[string]*group, pods []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.series == nil {
+		c.series = map[string]*cumulative{}
+	}
+	present := map[string]bool{}
+	for _, pod := range pods {
+		present[pod] = true
+	}
+	for key, g := range groups {
+		if !isCumulative(g.family) {
+			continue
+		}
+		state, exists := c.series[key]
+		if !exists {
+			state = &cumulative{last: map[podSeries]float64{}}
+			c.series[key] = state
+		}
+		for _, l := range g.lines {
+			id := podSeries{pod: pods[l.pod], series: l.series}
+			value := parseValue(l.value)
+			if last, seen := state.last[id]; seen && value < last {
+				state.carried += last
+			}
+			state.last[id] = value
+		}
+		g.total = state.carried
+		for id, last := range state.last {
+			if !present[id.pod] {
+				state.carried += last
+				g.total += last
+				delete(state.last, id)
+
+				continue
+			}
+			g.total += last
+		}
+	}
+}
+
+// podsOf returns the up series of every pod response, which identifies the pod across scrapes.
+func podsOf(responses []string) []string {
+	pods := make([]string, len(responses))
+	for pod, response := range responses {
+		for text := range strings.SplitSeq(response, "\n") {
+			if !strings.HasPrefix(text, upMetric) {
+				continue
+			}
+			if sample, err := util.ParseSample(text); err == nil && sample.Name == upMetric {
+				pods[pod] = util.Sample{Name: sample.Name, Labels: sample.Labels}.String()
+
+				break
+			}
+		}
+	}
+
+	return pods
+}
+
+// parseValue parses the value of a sample line, which is NaN if it isn't a number.
+func parseValue(value string) float64 {
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return math.NaN()
+	}
+
+	return parsed
+}
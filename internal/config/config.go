@@ -0,0 +1,271 @@
+// Package config holds the proxy's runtime configuration and loads scrape jobs from a jobs file.
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/canonical/metrics-k8s-proxy/internal/aggregate"
+	"github.com/canonical/metrics-k8s-proxy/internal/relabel"
+	"github.com/canonical/metrics-k8s-proxy/internal/timestamps"
+	"github.com/canonical/metrics-k8s-proxy/internal/util"
+	"sigs.k8s.io/yaml"
+)
+
+// DefaultJobName is the name given to the single job configured through POD_LABEL_SELECTOR.
+const DefaultJobName = "default"
+
+// Config is the proxy configuration assembled from the environment and, optionally, a jobs file.
+type Config struct {
+	Jobs          []Job
+	ScrapeTimeout time.Duration
+	// ScrapeTimeoutOffset is subtracted from the scraper's announced timeout to size the fan-out deadline.
+	ScrapeTimeoutOffset time.Duration
+	// CoalesceWindow is how long after a fan-out started concurrent scrapes of the same job still join it.
+	CoalesceWindow time.Duration
+	// CacheTTL is how long the result of a completed fan-out is reused.
+	CacheTTL time.Duration
+	// BackgroundScrapeInterval, if positive, makes the proxy scrape every pod on its own at this interval and
+	// answer scrapes from the latest results.
+	BackgroundScrapeInterval time.Duration
+	// BackgroundScrapeStaleness is how old a pod's latest background scrape may be before it is reported as down.
+	BackgroundScrapeStaleness time.Duration
+	// Transport tunes the HTTP connections to pods and to the remote-write and OTLP endpoints.
+	Transport Transport
+	// Retry bounds the retries of scrapes failing with a transient error.
+	Retry Retry
+	// CircuitBreaker stops scraping pods that keep failing.
+	CircuitBreaker CircuitBreaker
+	// Limits apply to every pod of every job.
+	Limits Limits
+	// CardinalityTopN, if positive, counts the series of every scrape and reports this many top offenders.
+	CardinalityTopN int
+	// DebugEndpoints enables the /debug endpoints on the main listener.
+	DebugEndpoints bool
+	// SDFile, if set, is a file_sd_config file kept up to date with the discovered pods.
+	SDFile string
+	// ShutdownGracePeriod is how long in-flight scrapes may run after a termination signal.
+	ShutdownGracePeriod time.Duration
+	Port                string
+	// RemoteWrite, if its URL is set, pushes the combined metrics of all jobs to a remote-write endpoint.
+	RemoteWrite RemoteWrite
+	// OTLP, if its URL is set, exports the combined metrics of all jobs to an OTLP/HTTP endpoint.
+	OTLP OTLP
+	// Tracing, if its URL is set, traces scrapes of the proxy and exports the spans to an OTLP/HTTP endpoint.
+	Tracing Tracing
+	// Sharding splits the pods of every job between proxy replicas.
+	Sharding Sharding
+	// LeaderElection, if its Lease is set, makes only one replica at a time serve scrapes and push metrics.
+	LeaderElection LeaderElection
+	// Logging configures the proxy's logs.
+	Logging Logging
+}
+
+// Logging configures the level and format of the logs, and how often the errors of a pod failing every scrape
+// are logged. A zero ErrorInterval logs every error.
+type Logging struct {
+	Level         slog.Level
+	Format        string
+	ErrorInterval time.Duration
+}
+
+// Transport configures the HTTP client shared by the scrapes of pods and the pushes of metrics.
+type Transport struct {
+	// MaxIdleConnsPerHost is how many idle connections to each pod are kept for reuse.
+	MaxIdleConnsPerHost int
+	// KeepAlive is how long idle connections are kept open. Zero disables keep-alive, opening a connection per
+	// request.
+	KeepAlive           time.Duration
+	DialTimeout         time.Duration
+	TLSHandshakeTimeout time.Duration
+	// HTTP2 attempts HTTP/2 with endpoints served over TLS.
+	HTTP2 bool
+}
+
+// Retry configures retrying scrapes of a pod that refused or reset the connection, or answered 502 or 503.
+type Retry struct {
+	// MaxAttempts is how many times a pod is requested per scrape. One disables retries.
+	MaxAttempts int
+	// Backoff is the delay before the first retry. It doubles with every retry.
+	Backoff time.Duration
+}
+
+// CircuitBreaker configures reporting pods down without scraping them once they failed Threshold scrapes in a
+// row, probing them every Cooldown. A zero Threshold disables it.
+type CircuitBreaker struct {
+	Threshold int
+	Cooldown  time.Duration
+}
+
+// Limits caps what a single scrape of a pod may return. Pods may tighten them through annotations.
+// A zero limit is no limit.
+type Limits struct {
+	BodySize int64
+	Samples  int
+	Series   int
+}
+
+// LeaderElection configures active/standby replicas, electing the active one through a Lease in Namespace.
+type LeaderElection struct {
+	Lease     string
+	Namespace string
+	// Identity names this replica in the lease, usually its pod name.
+	Identity string
+	// StandbyResponse is how a standby replica answers scrapes: "empty" or "unavailable".
+	StandbyResponse string
+}
+
+// Sharding configures how pods are split between proxy replicas. Replicas are either a fixed Count, this one
+// being Index, or discovered from the ready endpoints of a headless Service, this one being the pod Self.
+// Without a Count above 1 or a Service, every replica scrapes every pod.
+type Sharding struct {
+	Count int
+	Index int
+
+	Service   string
+	Namespace string
+	Self      string
+}
+
+// RemoteWrite configures pushing metrics to a Prometheus remote-write endpoint.
+type RemoteWrite struct {
+	URL      string
+	Interval time.Duration
+	// Headers are added to every push, e.g. for authentication or multi-tenancy.
+	Headers         map[string]string
+	BearerTokenFile string
+	// QueueSize is how many collected batches may wait to be sent.
+	QueueSize int
+	// MaxAttempts is how many times a batch is sent before it is given up on.
+	MaxAttempts int
+}
+
+// OTLP configures exporting metrics to an OpenTelemetry Collector over OTLP/HTTP.
+type OTLP struct {
+	URL      string
+	Interval time.Duration
+	// Headers are added to every export, e.g. for authentication.
+	Headers map[string]string
+}
+
+// Tracing configures tracing scrapes and exporting the spans to an OpenTelemetry Collector over OTLP/HTTP.
+type Tracing struct {
+	URL string
+	// Interval is how often the spans of the scrapes that ended are exported.
+	Interval time.Duration
+	// Headers are added to every export, e.g. for authentication.
+	Headers map[string]string
+	// SampleRatio is the share of the new traces that are sampled, from 0 to 1. Traces started by a scraper
+	// are sampled if the scraper sampled them.
+	SampleRatio float64
+}
+
+// Job is a named scrape job: which pods to watch and how to scrape them.
+type Job struct {
+	Name                 string           `json:"name"`
+	Namespace            string           `json:"namespace,omitempty"`
+	PodLabelSelector     string           `json:"pod_label_selector"`
+	ScrapeTimeout        Duration         `json:"scrape_timeout,omitempty"`
+	MetricRelabelConfigs []relabel.Config `json:"metric_relabel_configs,omitempty"`
+	// AggregationRules sum series across the job's pods, after relabeling.
+	AggregationRules []aggregate.Config `json:"aggregation_rules,omitempty"`
+	// Timestamps is what happens to samples scraped with an explicit timestamp: keep, strip or reject_old, which
+	// drops those older than TimestampMaxAge. Unset passes them through without counting them.
+	Timestamps      string   `json:"timestamps,omitempty"`
+	TimestampMaxAge Duration `json:"timestamp_max_age,omitempty"`
+
+	// Labels is PodLabelSelector parsed into a map.
+	Labels map[string]string `json:"-"`
+}
+
+// jobsFile is the layout of the file referenced by SCRAPE_JOBS_FILE.
+type jobsFile struct {
+	Jobs []Job `json:"jobs"`
+}
+
+// Duration is a time.Duration that unmarshals from strings such as "5s".
+type Duration time.Duration
+
+// UnmarshalJSON parses a duration string.
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string: %w", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+
+	return nil
+}
+
+// jobNamePattern keeps job names safe to use as a URL path segment.
+var jobNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// LoadJobs reads and validates the jobs file at path.
+// Jobs without their own scrape_timeout inherit defaultTimeout.
+func LoadJobs(path string, defaultTimeout time.Duration) ([]Job, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading jobs file: %w", err)
+	}
+
+	var file jobsFile
+	if err = yaml.UnmarshalStrict(data, &file); err != nil {
+		return nil, fmt.Errorf("parsing jobs file %s: %w", path, err)
+	}
+	if len(file.Jobs) == 0 {
+		return nil, fmt.Errorf("jobs file %s defines no jobs", path)
+	}
+
+	seen := map[string]bool{}
+	for i := range file.Jobs {
+		job := &file.Jobs[i]
+		if err = job.validate(defaultTimeout); err != nil {
+			return nil, fmt.Errorf("job %d (%q): %w", i, job.Name, err)
+		}
+		if seen[job.Name] {
+			return nil, fmt.Errorf("duplicate job name %q", job.Name)
+		}
+		seen[job.Name] = true
+	}
+
+	return file.Jobs, nil
+}
+
+// validate checks the job, parses its label selector and fills in defaults.
+func (j *Job) validate(defaultTimeout time.Duration) error {
+	if !jobNamePattern.MatchString(j.Name) {
+		return errors.New("name must be non-empty and contain only letters, digits, '_' or '-'")
+	}
+
+	j.Labels = util.ParseLabels(j.PodLabelSelector)
+	if len(j.Labels) == 0 {
+		return errors.New("invalid or empty pod_label_selector")
+	}
+
+	if j.ScrapeTimeout <= 0 {
+		j.ScrapeTimeout = Duration(defaultTimeout)
+	}
+
+	if _, err := relabel.Compile(j.MetricRelabelConfigs); err != nil {
+		return err
+	}
+	if _, err := aggregate.Compile(j.AggregationRules); err != nil {
+		return err
+	}
+
+	return j.TimestampPolicy().Validate()
+}
+
+// TimestampPolicy returns the job's timestamp settings as a policy.
+func (j *Job) TimestampPolicy() timestamps.Policy {
+	return timestamps.Policy{Action: timestamps.Action(j.Timestamps), MaxAge: time.Duration(j.TimestampMaxAge)}
+}
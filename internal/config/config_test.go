@@ -0,0 +1,115 @@
+package config_test
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/canonical/metrics-k8s-proxy/internal/aggregate"
+	"github.com/canonical/metrics-k8s-proxy/internal/config"
+	"github.com/canonical/metrics-k8s-proxy/internal/timestamps"
+)
+
+// writeJobsFile writes the given contents to a temporary jobs file and returns its path.
+func writeJobsFile(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "jobs.yaml")
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatalf("Failed to write jobs file: %v", err)
+	}
+
+	return path
+}
+
+func TestLoadJobs(t *testing.T) {
+	path := writeJobsFile(t, `
+jobs:
+  - name: ztunnel
+    namespace: istio-system
+    pod_label_selector: app=ztunnel
+    aggregation_rules:
+      - metric: istio_requests_total
+        without: [k8s_pod_name]
+  - name: waypoints
+    pod_label_selector: gateway.istio.io/managed=istio.io-mesh-controller,role=waypoint
+    scrape_timeout: 5s
+    timestamps: reject_old
+    timestamp_max_age: 10m
+    metric_relabel_configs:
+      - source_labels: [__name__]
+        regex: go_.*
+        action: drop
+`)
+
+	jobs, err := config.LoadJobs(path, 9*time.Second)
+	if err != nil {
+		t.Fatalf("LoadJobs() error = %v", err)
+	}
+	if len(jobs) != 2 {
+		t.Fatalf("LoadJobs() returned %d jobs, want 2", len(jobs))
+	}
+
+	if jobs[0].Name != "ztunnel" || jobs[0].Namespace != "istio-system" {
+		t.Errorf("unexpected first job %+v", jobs[0])
+	}
+	if !reflect.DeepEqual(jobs[0].Labels, map[string]string{"app": "ztunnel"}) {
+		t.Errorf("first job labels = %v", jobs[0].Labels)
+	}
+	wantRules := []aggregate.Config{{Metric: "istio_requests_total", Without: []string{"k8s_pod_name"}}}
+	if !reflect.DeepEqual(jobs[0].AggregationRules, wantRules) {
+		t.Errorf("first job aggregation rules = %+v, want %+v", jobs[0].AggregationRules, wantRules)
+	}
+	if time.Duration(jobs[0].ScrapeTimeout) != 9*time.Second {
+		t.Errorf("first job should inherit the default timeout, got %v", time.Duration(jobs[0].ScrapeTimeout))
+	}
+
+	if time.Duration(jobs[1].ScrapeTimeout) != 5*time.Second {
+		t.Errorf("second job timeout = %v, want 5s", time.Duration(jobs[1].ScrapeTimeout))
+	}
+	if len(jobs[1].Labels) != 2 || len(jobs[1].MetricRelabelConfigs) != 1 {
+		t.Errorf("unexpected second job %+v", jobs[1])
+	}
+	wantPolicy := timestamps.Policy{Action: timestamps.RejectOld, MaxAge: 10 * time.Minute}
+	if jobs[1].TimestampPolicy() != wantPolicy || jobs[0].TimestampPolicy() != (timestamps.Policy{}) {
+		t.Errorf("timestamp policies = %+v and %+v, want none and %+v",
+			jobs[0].TimestampPolicy(), jobs[1].TimestampPolicy(), wantPolicy)
+	}
+}
+
+func TestLoadJobs_Invalid(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+	}{
+		{name: "no jobs", contents: "jobs: []"},
+		{name: "unknown field", contents: "jobs:\n  - name: a\n    pod_label_selector: app=a\n    selector: x"},
+		{name: "missing selector", contents: "jobs:\n  - name: a"},
+		{name: "invalid name", contents: "jobs:\n  - name: a/b\n    pod_label_selector: app=a"},
+		{name: "duplicate name", contents: "jobs:\n  - name: a\n    pod_label_selector: app=a\n" +
+			"  - name: a\n    pod_label_selector: app=b"},
+		{name: "invalid timeout", contents: "jobs:\n  - name: a\n    pod_label_selector: app=a\n    scrape_timeout: soon"},
+		{name: "invalid relabel config", contents: "jobs:\n  - name: a\n    pod_label_selector: app=a\n" +
+			"    metric_relabel_configs:\n      - action: hashmod"},
+		{name: "invalid aggregation rule", contents: "jobs:\n  - name: a\n    pod_label_selector: app=a\n" +
+			"    aggregation_rules:\n      - by: [code]"},
+		{name: "invalid timestamps", contents: "jobs:\n  - name: a\n    pod_label_selector: app=a\n" +
+			"    timestamps: clamp"},
+		{name: "timestamp max age without reject_old", contents: "jobs:\n  - name: a\n    pod_label_selector: app=a\n" +
+			"    timestamps: strip\n    timestamp_max_age: 1m"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := config.LoadJobs(writeJobsFile(t, tt.contents), time.Second); err == nil {
+				t.Errorf("LoadJobs() expected an error")
+			}
+		})
+	}
+}
+
+func TestLoadJobs_MissingFile(t *testing.T) {
+	if _, err := config.LoadJobs(filepath.Join(t.TempDir(), "missing.yaml"), time.Second); err == nil {
+		t.Errorf("LoadJobs() expected an error for a missing file")
+	}
+}
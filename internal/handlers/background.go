@@ -0,0 +1,183 @@
+package handlers
+
+import (
+	"context"
+	"math/rand/v2"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/canonical/metrics-k8s-proxy/internal/k8s"
+	"github.com/canonical/metrics-k8s-proxy/internal/util"
+)
+
+// targetSyncInterval is how often the BackgroundScraper picks up pods added to or removed from its watcher.
+const targetSyncInterval = time.Second
+
+// BackgroundScraper scrapes every pod of a watcher on its own interval and keeps the last successful result,
+// so that scrapes of the proxy are answered from memory instead of waiting for the slowest pod.
+type BackgroundScraper struct {
+	Handler *MetricsHandler
+	Watcher *k8s.PodScrapeWatcher
+	// Interval is how often each pod is scraped. It must be positive.
+	Interval time.Duration
+	// Timeout bounds a single scrape of a pod. It is capped at Interval; zero means Interval.
+	Timeout time.Duration
+	// Staleness is how old the last successful scrape of a pod may be before the pod is reported as up=0.
+	Staleness time.Duration
+
+	mu        sync.Mutex
+	snapshots map[string]snapshot
+}
+
+// snapshot is the last successful scrape of a pod, or the last scrape that went past the pod's limits or was
+// skipped by its circuit breaker.
+type snapshot struct {
+	details k8s.PodScrapeDetails
+	body    string
+	scraped time.Time
+	// attempts is how many times the pod was requested in that scrape.
+	attempts int
+	// err is why the pod is dropped, if it went past its limits or its circuit is open.
+	err error
+}
+
+// target is a pod being scraped by its own loop.
+type target struct {
+	details k8s.PodScrapeDetails
+	cancel  context.CancelFunc
+}
+
+// Run scrapes the watcher's pods until ctx is cancelled.
+// Each pod gets its own loop, started at a random offset within the interval so that scrapes are spread out.
+func (b *BackgroundScraper) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	targets := map[string]target{}
+	defer func() {
+		for _, t := range targets {
+			t.cancel()
+		}
+		wg.Wait()
+	}()
+
+	ticker := time.NewTicker(targetSyncInterval)
+	defer ticker.Stop()
+	for {
+		b.syncTargets(ctx, targets, &wg)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// syncTargets starts a loop for every new or changed pod and stops the loops of pods that went away.
+func (b *BackgroundScraper) syncTargets(ctx context.Context, targets map[string]target, wg *sync.WaitGroup) {
+	endpoints := b.Watcher.GetPodMetricsEndpoints()
+
+	for podIP, t := range targets {
+		if details, exists := endpoints[podIP]; !exists || !reflect.DeepEqual(details, t.details) {
+			t.cancel()
+			delete(targets, podIP)
+			b.forget(podIP)
+		}
+	}
+	b.Handler.prune(endpoints)
+
+	for podIP, details := range endpoints {
+		if _, exists := targets[podIP]; exists {
+			continue
+		}
+		loopCtx, cancel := context.WithCancel(ctx)
+		targets[podIP] = target{details: details, cancel: cancel}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b.scrapeLoop(loopCtx, podIP, details)
+		}()
+	}
+}
+
+// scrapeLoop scrapes a single pod every Interval until ctx is cancelled.
+func (b *BackgroundScraper) scrapeLoop(ctx context.Context, podIP string, details k8s.PodScrapeDetails) {
+	//nolint:gosec // The jitter only spreads load, it needs no cryptographic randomness
+	timer := time.NewTimer(rand.N(b.Interval))
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		b.scrapeOnce(ctx, podIP, details)
+		timer.Reset(b.Interval)
+	}
+}
+
+// scrapeOnce scrapes a pod and stores the result if the scrape succeeded. A pod that went past its limits, or
+// whose circuit is open, is dropped right away rather than served from its previous result.
+func (b *BackgroundScraper) scrapeOnce(ctx context.Context, podIP string, details k8s.PodScrapeDetails) {
+	timeout := b.Interval
+	if b.Timeout > 0 && b.Timeout < timeout {
+		timeout = b.Timeout
+	}
+	scrapeCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	body, attempts, err := b.Handler.scrapePod(scrapeCtx, podIP, details)
+	if class := errorClass(err); err != nil && class != ErrorClassLimit && class != ErrorClassCircuitOpen {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.snapshots == nil {
+		b.snapshots = map[string]snapshot{}
+	}
+	b.snapshots[podIP] = snapshot{
+		details: details, body: body, scraped: time.Now(), attempts: attempts, err: err,
+	}
+}
+
+// forget drops the stored result of a pod that is no longer scraped.
+func (b *BackgroundScraper) forget(podIP string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.snapshots, podIP)
+}
+
+// Snapshot returns the latest metrics of every pod currently known to the watcher, in the same form as a
+// fan-out. Pods without a successful scrape within Staleness are reported as up=0.
+func (b *BackgroundScraper) Snapshot() []string {
+	return b.snapshot(b.Watcher.GetPodMetricsEndpoints())
+}
+
+// snapshot returns the latest metrics of the given pods, ordered by namespace and pod name.
+func (b *BackgroundScraper) snapshot(endpoints map[string]k8s.PodScrapeDetails) []string {
+	now := time.Now()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	responses := make([]string, 0, len(endpoints))
+	for _, podIP := range sortedPodIPs(endpoints) {
+		details := endpoints[podIP]
+		// A snapshot taken with other details belongs to a previous pod with the same IP
+		snap, exists := b.snapshots[podIP]
+		switch {
+		case !exists || !reflect.DeepEqual(snap.details, details) || now.Sub(snap.scraped) > b.Staleness:
+			responses = append(responses, util.AppendUpMetric("", details.PodName, details.Namespace, 0))
+		case snap.err != nil:
+			responses = append(responses, b.Handler.appendAttempts(downMetric(details, snap.err), details, snap.attempts))
+		default:
+			up := util.AppendUpMetric(snap.body, details.PodName, details.Namespace, 1)
+			responses = append(responses, b.Handler.appendAttempts(up, details, snap.attempts))
+		}
+	}
+
+	return responses
+}
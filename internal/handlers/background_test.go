@@ -0,0 +1,130 @@
+package handlers_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/canonical/metrics-k8s-proxy/internal/handlers"
+	"github.com/canonical/metrics-k8s-proxy/internal/k8s"
+)
+
+// flakyHTTPClient answers the first `healthy` requests with a fixed body and fails every request after that.
+type flakyHTTPClient struct {
+	healthy int64
+	calls   atomic.Int64
+}
+
+func (c *flakyHTTPClient) Do(_ *http.Request) (*http.Response, error) {
+	if c.calls.Add(1) > c.healthy {
+		return nil, errors.New("connection refused")
+	}
+
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       io.NopCloser(strings.NewReader("metric_a 1")),
+	}, nil
+}
+
+// waitForSnapshot polls the scraper until its snapshot contains want.
+func waitForSnapshot(t *testing.T, scraper *handlers.BackgroundScraper, want string) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if strings.Contains(strings.Join(scraper.Snapshot(), "\n"), want) {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("snapshot never contained %q, last snapshot: %q", want, scraper.Snapshot())
+}
+
+// runScraper runs the scraper in the background and stops it when the test ends.
+func runScraper(t *testing.T, scraper *handlers.BackgroundScraper) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		scraper.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		wg.Wait()
+	})
+}
+
+func newBackgroundScraper(client handlers.HTTPClient, staleness time.Duration) *handlers.BackgroundScraper {
+	pw := k8s.NewPodScrapeWatcher()
+	pw.PodMetricsEndpoints = map[string]k8s.PodScrapeDetails{
+		"10.0.0.1": {Port: "8080", Path: "/metrics", PodName: "pod1", Namespace: "default"},
+	}
+	handler := handlers.NewMetricsHandler(client)
+	scraper := &handlers.BackgroundScraper{
+		Handler:   handler,
+		Watcher:   pw,
+		Interval:  10 * time.Millisecond,
+		Staleness: staleness,
+	}
+	handler.Background = scraper
+
+	return scraper
+}
+
+func TestBackgroundScraper_ServesLatestSnapshot(t *testing.T) {
+	scraper := newBackgroundScraper(&flakyHTTPClient{healthy: 1 << 20}, time.Minute)
+
+	// Before the first scrape the pod is reported as down.
+	want := "up{k8s_pod_name=\"pod1\",k8s_namespace=\"default\"} 0\n"
+	if got := strings.Join(scraper.Snapshot(), "\n"); !strings.Contains(got, want) {
+		t.Errorf("Snapshot() before the first scrape = %q, want it to contain %q", got, want)
+	}
+
+	runScraper(t, scraper)
+	waitForSnapshot(t, scraper, "up{k8s_pod_name=\"pod1\",k8s_namespace=\"default\"} 1\n")
+
+	got := strings.Join(scraper.Handler.AggregateMetrics(context.Background(), scraper.Watcher), "\n")
+	wantMetric := "metric_a{k8s_pod_name=\"pod1\",k8s_namespace=\"default\"} 1"
+	if !strings.Contains(got, wantMetric) {
+		t.Errorf("AggregateMetrics() = %q, want it to contain %q", got, wantMetric)
+	}
+}
+
+func TestBackgroundScraper_Staleness(t *testing.T) {
+	client := &flakyHTTPClient{healthy: 1}
+	scraper := newBackgroundScraper(client, 50*time.Millisecond)
+	runScraper(t, scraper)
+
+	waitForSnapshot(t, scraper, "up{k8s_pod_name=\"pod1\",k8s_namespace=\"default\"} 1\n")
+	// Every later scrape fails, so the snapshot goes stale.
+	waitForSnapshot(t, scraper, "up{k8s_pod_name=\"pod1\",k8s_namespace=\"default\"} 0\n")
+
+	if got := strings.Join(scraper.Snapshot(), "\n"); strings.Contains(got, "metric_a") {
+		t.Errorf("Snapshot() = %q, stale metrics should not be served", got)
+	}
+}
+
+func TestBackgroundScraper_StopsOnCancel(t *testing.T) {
+	scraper := newBackgroundScraper(&flakyHTTPClient{healthy: 1 << 20}, time.Minute)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		scraper.Run(ctx)
+		close(done)
+	}()
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Run() did not return after the context was cancelled")
+	}
+}
@@ -0,0 +1,146 @@
+package handlers
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/canonical/metrics-k8s-proxy/internal/k8s"
+)
+
+// CircuitState is the state of a pod's circuit breaker, as reported on /targets.
+type CircuitState string
+
+const (
+	CircuitClosed   CircuitState = "closed"    // The pod is scraped
+	CircuitOpen     CircuitState = "open"      // The pod failed too often and is reported down without a scrape
+	CircuitHalfOpen CircuitState = "half_open" // A probe scrape decides whether the circuit closes again
+)
+
+// CircuitBreaker stops scraping pods that failed Threshold scrapes in a row, such as pods behind a
+// NetworkPolicy, so that they are reported down right away instead of using up the scrape's time. Once
+// Cooldown has passed, a single probe scrape goes through: the circuit closes if it succeeds, and opens for
+// another Cooldown otherwise. Pods dropped for going past their limits answered, so they don't count as failing.
+// A zero Threshold disables the breaker.
+type CircuitBreaker struct {
+	Threshold int
+	Cooldown  time.Duration
+}
+
+// circuit is the breaker state of a pod.
+type circuit struct {
+	details  k8s.PodScrapeDetails
+	state    CircuitState
+	failures int
+	opened   time.Time
+}
+
+// circuits keeps the breaker state of every pod, by pod IP.
+type circuits struct {
+	mu       sync.Mutex
+	circuits map[string]circuit
+}
+
+// lookup returns the circuit of the pod, which is closed if the pod has no failures yet or its IP belonged to
+// a previous pod. The caller must hold the lock.
+func (c *circuits) lookup(podIP string, details k8s.PodScrapeDetails) circuit {
+	current, exists := c.circuits[podIP]
+	if !exists || !reflect.DeepEqual(current.details, details) {
+		return circuit{details: details, state: CircuitClosed}
+	}
+
+	return current
+}
+
+// allow reports whether the pod may be scraped. An open circuit lets a single probe through once its
+// cooldown has passed, and no other scrape until the probe's outcome is recorded.
+func (c *circuits) allow(podIP string, details k8s.PodScrapeDetails, breaker CircuitBreaker) bool {
+	if breaker.Threshold <= 0 {
+		return true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	current := c.lookup(podIP, details)
+	switch current.state {
+	case CircuitOpen:
+		if time.Since(current.opened) < breaker.Cooldown {
+			return false
+		}
+		current.state = CircuitHalfOpen
+		c.circuits[podIP] = current
+
+		return true
+	case CircuitHalfOpen:
+		return false
+	default:
+		return true
+	}
+}
+
+// record updates the pod's circuit with the outcome of a scrape, opening it after Threshold failures in a
+// row or a failed probe. A pod that went past its limits did answer, so the error leaves a closed circuit
+// alone and closes a half-open one. It returns how many scrapes failed if the circuit just opened, and zero
+// otherwise.
+func (c *circuits) record(podIP string, details k8s.PodScrapeDetails, breaker CircuitBreaker, err error) int {
+	if breaker.Threshold <= 0 {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.circuits == nil {
+		c.circuits = map[string]circuit{}
+	}
+
+	current := c.lookup(podIP, details)
+	if errorClass(err) == ErrorClassLimit && current.state != CircuitHalfOpen {
+		return 0
+	}
+	if err == nil || errorClass(err) == ErrorClassLimit {
+		c.circuits[podIP] = circuit{details: details, state: CircuitClosed}
+		return 0
+	}
+	current.failures++
+	opened := 0
+	if current.state == CircuitHalfOpen || current.failures >= breaker.Threshold {
+		if current.state != CircuitOpen {
+			opened = current.failures
+		}
+		current.state = CircuitOpen
+		current.opened = time.Now()
+	}
+	c.circuits[podIP] = current
+
+	return opened
+}
+
+// state returns the state of the pod's circuit, or "" if the breaker is disabled.
+func (c *circuits) state(podIP string, details k8s.PodScrapeDetails, breaker CircuitBreaker) CircuitState {
+	if breaker.Threshold <= 0 {
+		return ""
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.lookup(podIP, details).state
+}
+
+// prune forgets the circuits of pods that are no longer among endpoints.
+func (c *circuits) prune(endpoints map[string]k8s.PodScrapeDetails) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for podIP := range c.circuits {
+		if _, exists := endpoints[podIP]; !exists {
+			delete(c.circuits, podIP)
+		}
+	}
+}
+
+// circuitOpenError is the error of a scrape skipped because the pod's circuit is open.
+func circuitOpenError(url string) error {
+	return &scrapeError{
+		class: ErrorClassCircuitOpen,
+		err:   fmt.Errorf("not scraping %s: its circuit is open after repeated failures", url),
+	}
+}
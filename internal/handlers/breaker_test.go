@@ -0,0 +1,112 @@
+package handlers_test
+
+import (
+	"context"
+	"net/http"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/canonical/metrics-k8s-proxy/internal/handlers"
+	"github.com/canonical/metrics-k8s-proxy/internal/k8s"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	const cooldown = 50 * time.Millisecond
+	details := k8s.PodScrapeDetails{Port: "8080", Path: "/metrics", PodName: "pod1", Namespace: "default"}
+	client := &sequenceHTTPClient{responses: []func() (*http.Response, error){
+		connError(syscall.ECONNREFUSED),
+		connError(syscall.ECONNREFUSED),
+		statusResponse(http.StatusServiceUnavailable, ""),
+		statusResponse(http.StatusOK, "metric_a 1"),
+	}}
+	handler := handlers.NewMetricsHandler(client)
+	handler.CircuitBreaker = handlers.CircuitBreaker{Threshold: 2, Cooldown: cooldown}
+	job := handlers.Job{Name: "default", Watcher: k8s.NewPodScrapeWatcher(), Handler: handler}
+	job.Watcher.PodMetricsEndpoints = map[string]k8s.PodScrapeDetails{"10.0.0.1": details}
+
+	down := "\nup{k8s_pod_name=\"pod1\",k8s_namespace=\"default\"} 0\n"
+	open := "\nup{k8s_pod_name=\"pod1\",k8s_namespace=\"default\",reason=\"circuit_open\"} 0\n"
+	up := "metric_a{k8s_pod_name=\"pod1\",k8s_namespace=\"default\"} 1\n" +
+		"up{k8s_pod_name=\"pod1\",k8s_namespace=\"default\"} 1\n"
+
+	steps := []struct {
+		name        string
+		wait        time.Duration
+		want        string
+		wantCalls   int
+		wantCircuit handlers.CircuitState
+	}{
+		{name: "First Failure", want: down, wantCalls: 1, wantCircuit: handlers.CircuitClosed},
+		{name: "Threshold Reached", want: down, wantCalls: 2, wantCircuit: handlers.CircuitOpen},
+		{name: "Open", want: open, wantCalls: 2, wantCircuit: handlers.CircuitOpen},
+		{name: "Failed Probe", wait: cooldown, want: down, wantCalls: 3, wantCircuit: handlers.CircuitOpen},
+		{name: "Open Again", want: open, wantCalls: 3, wantCircuit: handlers.CircuitOpen},
+		{name: "Successful Probe", wait: cooldown, want: up, wantCalls: 4, wantCircuit: handlers.CircuitClosed},
+	}
+	for _, step := range steps {
+		time.Sleep(step.wait)
+		if got := handler.ScrapePodMetrics(context.Background(), "10.0.0.1", details); got != step.want {
+			t.Errorf("%s: ScrapePodMetrics() = %q, want %q", step.name, got, step.want)
+		}
+		if client.calls != step.wantCalls {
+			t.Errorf("%s: got %d requests, want %d", step.name, client.calls, step.wantCalls)
+		}
+		if targets := getTargets(t, job, ""); len(targets) != 1 || targets[0].Circuit != step.wantCircuit {
+			t.Errorf("%s: targets = %+v, want circuit %s", step.name, targets, step.wantCircuit)
+		}
+	}
+}
+
+func TestCircuitBreaker_Disabled(t *testing.T) {
+	details := k8s.PodScrapeDetails{Port: "8080", Path: "/metrics", PodName: "pod1", Namespace: "default"}
+	client := &sequenceHTTPClient{responses: []func() (*http.Response, error){connError(syscall.ECONNREFUSED)}}
+	handler := handlers.NewMetricsHandler(client)
+	job := handlers.Job{Name: "default", Watcher: k8s.NewPodScrapeWatcher(), Handler: handler}
+	job.Watcher.PodMetricsEndpoints = map[string]k8s.PodScrapeDetails{"10.0.0.1": details}
+
+	for range 5 {
+		handler.ScrapePodMetrics(context.Background(), "10.0.0.1", details)
+	}
+	if client.calls != 5 {
+		t.Errorf("got %d requests, want every scrape to be sent", client.calls)
+	}
+	if targets := getTargets(t, job, ""); len(targets) != 1 || targets[0].Circuit != "" {
+		t.Errorf("targets = %+v, want no circuit state", targets)
+	}
+}
+
+func TestCircuitBreaker_ProbeOverLimit(t *testing.T) {
+	const cooldown = 50 * time.Millisecond
+	details := k8s.PodScrapeDetails{Port: "8080", Path: "/metrics", PodName: "pod1", Namespace: "default"}
+	client := &sequenceHTTPClient{responses: []func() (*http.Response, error){
+		connError(syscall.ECONNREFUSED),
+		statusResponse(http.StatusOK, "metric_a 1\nmetric_b 2\nmetric_c 3"),
+		statusResponse(http.StatusOK, "metric_a 1"),
+	}}
+	handler := handlers.NewMetricsHandler(client)
+	handler.CircuitBreaker = handlers.CircuitBreaker{Threshold: 1, Cooldown: cooldown}
+	handler.Limits = k8s.ScrapeLimits{Samples: 2}
+	job := handlers.Job{Name: "default", Watcher: k8s.NewPodScrapeWatcher(), Handler: handler}
+	job.Watcher.PodMetricsEndpoints = map[string]k8s.PodScrapeDetails{"10.0.0.1": details}
+
+	limited := "\nup{k8s_pod_name=\"pod1\",k8s_namespace=\"default\",reason=\"limit_exceeded\"} 0\n"
+	up := "metric_a{k8s_pod_name=\"pod1\",k8s_namespace=\"default\"} 1\n" +
+		"up{k8s_pod_name=\"pod1\",k8s_namespace=\"default\"} 1\n"
+
+	handler.ScrapePodMetrics(context.Background(), "10.0.0.1", details)
+	time.Sleep(cooldown)
+	// The probe goes past the sample limit: the pod answered, so its circuit closes
+	if got := handler.ScrapePodMetrics(context.Background(), "10.0.0.1", details); got != limited {
+		t.Errorf("probe: ScrapePodMetrics() = %q, want %q", got, limited)
+	}
+	if targets := getTargets(t, job, ""); len(targets) != 1 || targets[0].Circuit != handlers.CircuitClosed {
+		t.Errorf("targets = %+v, want circuit %s", targets, handlers.CircuitClosed)
+	}
+	if got := handler.ScrapePodMetrics(context.Background(), "10.0.0.1", details); got != up {
+		t.Errorf("after probe: ScrapePodMetrics() = %q, want %q", got, up)
+	}
+	if client.calls != 3 {
+		t.Errorf("got %d requests, want 3", client.calls)
+	}
+}
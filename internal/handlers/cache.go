@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/canonical/metrics-k8s-proxy/internal/selfmetrics"
+)
+
+// Cache lookup results, as reported in the FanOutCache's Requests counter.
+const (
+	cacheHit       = "hit"       // Served from the last completed fan-out
+	cacheCoalesced = "coalesced" // Joined a fan-out already in flight
+	cacheMiss      = "miss"      // Started a new fan-out
+)
+
+// FanOutCache lets scrapes of the same job share fan-outs, so that HA Prometheus pairs scraping at the same
+// time don't double the load on every pod.
+type FanOutCache struct {
+	// Window is how long after a fan-out started new scrapes still join it instead of starting their own.
+	Window time.Duration
+	// TTL is how long the result of a completed fan-out is reused. Zero disables caching of completed results.
+	TTL time.Duration
+	// Requests, if set, counts lookups by result ("hit", "coalesced" or "miss").
+	Requests func(result string) *selfmetrics.Counter
+
+	mu       sync.Mutex
+	inflight *fanOutCall
+	last     *fanOutCall
+}
+
+// fanOutCall is a single fan-out shared by every scrape that joined it.
+type fanOutCall struct {
+	started  time.Time
+	finished time.Time
+	done     chan struct{}
+	result   []string
+}
+
+// Do returns the result of fanOut, sharing it with other scrapes as configured.
+// Scrapes that join a fan-out in flight wait for it to finish, which happens by the deadline of the scrape
+// that started it, unless their own ctx is done first, in which case they get an error instead.
+func (c *FanOutCache) Do(ctx context.Context, fanOut func(context.Context) []string) ([]string, error) {
+	now := time.Now()
+
+	c.mu.Lock()
+	if c.last != nil && now.Sub(c.last.finished) < c.TTL {
+		result := c.last.result
+		c.mu.Unlock()
+		c.record(cacheHit)
+
+		return append([]string(nil), result...), nil
+	}
+	if call := c.inflight; call != nil && now.Sub(call.started) < c.Window {
+		c.mu.Unlock()
+		c.record(cacheCoalesced)
+		select {
+		case <-call.done:
+			return append([]string(nil), call.result...), nil
+		case <-ctx.Done():
+			return nil, fmt.Errorf("waiting for a shared fan-out: %w", ctx.Err())
+		}
+	}
+	call := &fanOutCall{started: now, done: make(chan struct{})}
+	c.inflight = call
+	c.mu.Unlock()
+	c.record(cacheMiss)
+
+	// Keep the deadline of the scrape that started the fan-out, but not its cancellation:
+	// a scraper that disconnects must not fail the scrapes that joined it.
+	fanOutCtx := context.WithoutCancel(ctx)
+	if deadline, ok := ctx.Deadline(); ok {
+		var cancel context.CancelFunc
+		fanOutCtx, cancel = context.WithDeadline(fanOutCtx, deadline)
+		defer cancel()
+	}
+	call.result = fanOut(fanOutCtx)
+	call.finished = time.Now()
+
+	c.mu.Lock()
+	if c.inflight == call {
+		c.inflight = nil
+	}
+	c.last = call
+	c.mu.Unlock()
+	close(call.done)
+
+	return append([]string(nil), call.result...), nil
+}
+
+func (c *FanOutCache) record(result string) {
+	if c.Requests != nil {
+		c.Requests(result).Inc()
+	}
+}
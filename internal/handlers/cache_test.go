@@ -0,0 +1,165 @@
+package handlers_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/canonical/metrics-k8s-proxy/internal/handlers"
+	"github.com/canonical/metrics-k8s-proxy/internal/k8s"
+	"github.com/canonical/metrics-k8s-proxy/internal/selfmetrics"
+)
+
+// countingFanOut returns a fan-out function that counts its calls and takes the given time to complete.
+func countingFanOut(calls *atomic.Int32, duration time.Duration) func(context.Context) []string {
+	return func(ctx context.Context) []string {
+		calls.Add(1)
+		select {
+		case <-time.After(duration):
+			return []string{"up 1"}
+		case <-ctx.Done():
+			return []string{"up 0"}
+		}
+	}
+}
+
+func TestFanOutCache_Coalesces(t *testing.T) {
+	registry := selfmetrics.NewRegistry()
+	requests := registry.NewCounterVec("requests_total", "Lookups.", "result")
+	cache := &handlers.FanOutCache{
+		Window:   time.Second,
+		Requests: func(result string) *selfmetrics.Counter { return requests.WithLabelValues(result) },
+	}
+
+	var calls atomic.Int32
+	var wg sync.WaitGroup
+	results := make([][]string, 4)
+	for i := range results {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], _ = cache.Do(context.Background(), countingFanOut(&calls, 100*time.Millisecond))
+		}()
+		// Make sure the first scrape starts the fan-out
+		time.Sleep(10 * time.Millisecond)
+	}
+	wg.Wait()
+
+	if calls.Load() != 1 {
+		t.Errorf("expected a single fan-out, got %d", calls.Load())
+	}
+	for _, result := range results {
+		if len(result) != 1 || result[0] != "up 1" {
+			t.Errorf("unexpected shared result %v", result)
+		}
+	}
+	miss, coalesced := requests.WithLabelValues("miss").Value(), requests.WithLabelValues("coalesced").Value()
+	if miss != 1 || coalesced != 3 {
+		t.Errorf("expected 1 miss and 3 coalesced lookups, got %d and %d", miss, coalesced)
+	}
+
+	// Without a TTL, a completed fan-out isn't reused
+	cache.Do(context.Background(), countingFanOut(&calls, 0))
+	if calls.Load() != 2 {
+		t.Errorf("expected a new fan-out once the previous one completed, got %d fan-outs", calls.Load())
+	}
+}
+
+func TestFanOutCache_TTL(t *testing.T) {
+	cache := &handlers.FanOutCache{TTL: 200 * time.Millisecond}
+
+	var calls atomic.Int32
+	first, _ := cache.Do(context.Background(), countingFanOut(&calls, 0))
+	// Callers may modify their copy without affecting the cached result
+	first[0] = "modified"
+
+	if second, _ := cache.Do(context.Background(), countingFanOut(&calls, 0)); second[0] != "up 1" {
+		t.Errorf("cached result was modified: %v", second)
+	}
+	if calls.Load() != 1 {
+		t.Errorf("expected the second scrape to be served from the cache, got %d fan-outs", calls.Load())
+	}
+
+	time.Sleep(250 * time.Millisecond)
+	cache.Do(context.Background(), countingFanOut(&calls, 0))
+	if calls.Load() != 2 {
+		t.Errorf("expected a new fan-out after the TTL expired, got %d fan-outs", calls.Load())
+	}
+}
+
+func TestFanOutCache_LeaderCancellation(t *testing.T) {
+	cache := &handlers.FanOutCache{Window: time.Second}
+
+	var calls atomic.Int32
+	leaderCtx, cancelLeader := context.WithCancel(context.Background())
+	go cache.Do(leaderCtx, countingFanOut(&calls, 100*time.Millisecond))
+	time.Sleep(10 * time.Millisecond)
+
+	// The scraper that started the fan-out disconnects; the one that joined it still gets full results
+	cancelLeader()
+	if result, _ := cache.Do(context.Background(), countingFanOut(&calls, 0)); result[0] != "up 1" {
+		t.Errorf("expected the shared fan-out to complete, got %v", result)
+	}
+}
+
+func TestFanOutCache_WaiterCancellation(t *testing.T) {
+	cache := &handlers.FanOutCache{Window: time.Second}
+
+	var calls atomic.Int32
+	go cache.Do(context.Background(), countingFanOut(&calls, time.Second))
+	time.Sleep(10 * time.Millisecond)
+
+	// A scrape with a shorter deadline than the fan-out it joined gives up on it at its own deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if result, err := cache.Do(ctx, countingFanOut(&calls, 0)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected a deadline error once the scrape's deadline passed, got %v, %v", result, err)
+	}
+	if waited := time.Since(start); waited > 500*time.Millisecond {
+		t.Errorf("the scrape waited %v for the shared fan-out, past its own deadline", waited)
+	}
+	if calls.Load() != 1 {
+		t.Errorf("expected the scrape to join the fan-out in flight, got %d fan-outs", calls.Load())
+	}
+}
+
+func TestAggregateMetrics_CoalescedTimeout(t *testing.T) {
+	slowPod := func() (*http.Response, error) {
+		time.Sleep(300 * time.Millisecond)
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("metric_a 1\n"))}, nil
+	}
+	handler := handlers.NewMetricsHandler(routedHTTPClient{
+		"http://10.0.0.1:8080/metrics": slowPod,
+		"http://10.0.0.2:8080/metrics": slowPod,
+	})
+	handler.Cache = &handlers.FanOutCache{Window: time.Second}
+	watcher := k8s.NewPodScrapeWatcher()
+	watcher.PodMetricsEndpoints = map[string]k8s.PodScrapeDetails{
+		"10.0.0.1": {Port: "8080", Path: "/metrics", PodName: "pod1", Namespace: "default"},
+		"10.0.0.2": {Port: "8080", Path: "/metrics", PodName: "pod2", Namespace: "default"},
+	}
+
+	go handler.AggregateMetrics(context.Background(), watcher)
+	time.Sleep(10 * time.Millisecond)
+
+	// A scrape giving up on the fan-out it joined reports its pods down, rather than nothing
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	responses := handler.AggregateMetrics(ctx, watcher)
+	if len(responses) != 2 {
+		t.Fatalf("AggregateMetrics() = %q, want a response per pod", responses)
+	}
+	for i, pod := range []string{"pod1", "pod2"} {
+		want := "up{k8s_pod_name=\"" + pod + "\",k8s_namespace=\"default\"} 0"
+		if !strings.Contains(responses[i], want) {
+			t.Errorf("response %d = %q, want %q", i, responses[i], want)
+		}
+	}
+}
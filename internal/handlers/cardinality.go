@@ -0,0 +1,191 @@
+package handlers
+
+import (
+	"cmp"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/canonical/metrics-k8s-proxy/internal/logging"
+)
+
+// seriesCounts is the cardinality of a single scrape of a pod, after relabeling.
+type seriesCounts struct {
+	series int
+	// metrics and labels count the series by metric name and by label name, values the distinct values of
+	// each label name.
+	metrics map[string]int
+	labels  map[string]int
+	values  map[string]int
+}
+
+// countCardinality counts the distinct series of an exposition body by metric name and label name.
+func countCardinality(metrics string) *seriesCounts {
+	counts := &seriesCounts{metrics: map[string]int{}, labels: map[string]int{}, values: map[string]int{}}
+	seen := map[string]struct{}{}
+	labelValues := map[string]map[string]struct{}{}
+	for line := range strings.SplitSeq(metrics, "\n") {
+		if line = strings.TrimSpace(line); line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		sample, key := parseSeries(line)
+		if _, exists := seen[key]; exists || sample.Name == "" {
+			continue
+		}
+		seen[key] = struct{}{}
+
+		counts.series++
+		counts.metrics[sample.Name]++
+		for _, label := range sample.Labels {
+			counts.labels[label.Name]++
+			if labelValues[label.Name] == nil {
+				labelValues[label.Name] = map[string]struct{}{}
+			}
+			labelValues[label.Name][label.Value] = struct{}{}
+		}
+	}
+	for name, values := range labelValues {
+		counts.values[name] = len(values)
+	}
+
+	return counts
+}
+
+// Cardinality is the number of series served by the latest scrape of every pod, along with the metric names,
+// label names and targets with the most series.
+type Cardinality struct {
+	Series  int                 `json:"series"`
+	Metrics []MetricCardinality `json:"metrics"`
+	Labels  []LabelCardinality  `json:"labels"`
+	Targets []TargetCardinality `json:"targets"`
+}
+
+// MetricCardinality is the number of series of a metric name, over every pod.
+type MetricCardinality struct {
+	Name   string `json:"name"`
+	Series int    `json:"series"`
+}
+
+// LabelCardinality is the number of series carrying a label name, over every pod. Values is the number of
+// distinct values of the label on each pod, summed over the pods, so a value shared by several pods counts
+// once per pod.
+type LabelCardinality struct {
+	Name   string `json:"name"`
+	Series int    `json:"series"`
+	Values int    `json:"values"`
+}
+
+// TargetCardinality is the number of series of a pod scraped by a job.
+type TargetCardinality struct {
+	Job       string `json:"job"`
+	Namespace string `json:"namespace"`
+	Pod       string `json:"pod"`
+	Series    int    `json:"series"`
+}
+
+// CardinalityReport sums up the cardinality of the latest scrape of every pod of the jobs, keeping the top
+// offenders: the metric names and targets with the most series, and the label names with the most values.
+// Only pods scraped by handlers that AnalyzeCardinality are counted, including pods dropped for going past
+// their limits.
+func CardinalityReport(jobs []Job, top int) Cardinality {
+	report := Cardinality{Metrics: []MetricCardinality{}, Labels: []LabelCardinality{}, Targets: []TargetCardinality{}}
+	metrics := map[string]int{}
+	labels := map[string]LabelCardinality{}
+	for _, job := range jobs {
+		for podIP, details := range job.Watcher.GetPodMetricsEndpoints() {
+			result, scraped := job.Handler.targets.lookup(podIP, details)
+			if !scraped || result.cardinality == nil {
+				continue
+			}
+			counts := result.cardinality
+
+			report.Series += counts.series
+			report.Targets = append(report.Targets, TargetCardinality{
+				Job: job.Name, Namespace: details.Namespace, Pod: details.PodName, Series: counts.series,
+			})
+			for name, series := range counts.metrics {
+				metrics[name] += series
+			}
+			for name, series := range counts.labels {
+				label := labels[name]
+				label.Name = name
+				label.Series += series
+				label.Values += counts.values[name]
+				labels[name] = label
+			}
+		}
+	}
+
+	for name, series := range metrics {
+		report.Metrics = append(report.Metrics, MetricCardinality{Name: name, Series: series})
+	}
+	for _, label := range labels {
+		report.Labels = append(report.Labels, label)
+	}
+	slices.SortFunc(report.Metrics, func(a, b MetricCardinality) int {
+		return cmp.Or(cmp.Compare(b.Series, a.Series), cmp.Compare(a.Name, b.Name))
+	})
+	slices.SortFunc(report.Labels, func(a, b LabelCardinality) int {
+		return cmp.Or(cmp.Compare(b.Values, a.Values), cmp.Compare(b.Series, a.Series), cmp.Compare(a.Name, b.Name))
+	})
+	slices.SortFunc(report.Targets, func(a, b TargetCardinality) int {
+		return cmp.Or(cmp.Compare(b.Series, a.Series), cmp.Compare(a.Job, b.Job),
+			cmp.Compare(a.Namespace, b.Namespace), cmp.Compare(a.Pod, b.Pod))
+	})
+	report.Metrics = report.Metrics[:min(top, len(report.Metrics))]
+	report.Labels = report.Labels[:min(top, len(report.Labels))]
+	report.Targets = report.Targets[:min(top, len(report.Targets))]
+
+	return report
+}
+
+// cardinalityPage renders the report as HTML tables.
+const cardinalityPage = `<!DOCTYPE html>
+<html>
+<head><title>Cardinality - metrics-k8s-proxy</title></head>
+<body>
+<h1>Cardinality</h1>
+<p>{{.Series}} series in the latest scrapes.</p>
+<h2>Metric names</h2>
+<table border="1" cellpadding="4">
+<tr><th>Name</th><th>Series</th></tr>
+{{range .Metrics}}<tr><td>{{.Name}}</td><td>{{.Series}}</td></tr>
+{{end}}</table>
+<h2>Label names</h2>
+<table border="1" cellpadding="4">
+<tr><th>Name</th><th>Values</th><th>Series</th></tr>
+{{range .Labels}}<tr><td>{{.Name}}</td><td>{{.Values}}</td><td>{{.Series}}</td></tr>
+{{end}}</table>
+<h2>Targets</h2>
+<table border="1" cellpadding="4">
+<tr><th>Job</th><th>Namespace</th><th>Pod</th><th>Series</th></tr>
+{{range .Targets}}<tr><td>{{.Job}}</td><td>{{.Namespace}}</td><td>{{.Pod}}</td><td>{{.Series}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`
+
+// CardinalityHandler serves the top offenders of the jobs, as JSON if the request asks for it with
+// ?format=json or its Accept header, and as an HTML page otherwise.
+func CardinalityHandler(jobs []Job, top int) http.Handler {
+	page := template.Must(template.New("cardinality").Parse(cardinalityPage))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := CardinalityReport(jobs, top)
+
+		if r.URL.Query().Get("format") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json") {
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(report); err != nil {
+				logging.FromContext(r.Context()).ErrorContext(r.Context(), "Error writing cardinality", "error", err)
+			}
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := page.Execute(w, report); err != nil {
+			logging.FromContext(r.Context()).ErrorContext(r.Context(), "Error writing cardinality", "error", err)
+		}
+	})
+}
@@ -0,0 +1,132 @@
+package handlers_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/canonical/metrics-k8s-proxy/internal/handlers"
+	"github.com/canonical/metrics-k8s-proxy/internal/k8s"
+)
+
+// cardinalityJob returns a job whose two pods have been scraped once.
+func cardinalityJob(t *testing.T, analyze bool) handlers.Job {
+	t.Helper()
+	bodies := map[string]string{
+		"http://10.0.0.1:8080/metrics": "# TYPE requests_total counter\n" +
+			"requests_total{path=\"/a\",code=\"200\"} 5\n" +
+			"requests_total{code=\"200\",path=\"/a\"} 5\n" +
+			"requests_total{path=\"/b\",code=\"200\"} 1\n" +
+			"requests_total{path=\"/c\",code=\"500\"} 1\n" +
+			"go_goroutines 10",
+		"http://10.0.0.2:8080/metrics": "requests_total{path=\"/a\",code=\"200\"} 2\ngo_goroutines 8",
+	}
+	client := routedHTTPClient{}
+	for url, body := range bodies {
+		client[url] = func() (*http.Response, error) {
+			return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(body))}, nil
+		}
+	}
+	pw := k8s.NewPodScrapeWatcher()
+	pw.PodMetricsEndpoints = map[string]k8s.PodScrapeDetails{
+		"10.0.0.1": {Port: "8080", Path: "/metrics", PodName: "pod1", Namespace: "default"},
+		"10.0.0.2": {Port: "8080", Path: "/metrics", PodName: "pod2", Namespace: "default"},
+	}
+	handler := handlers.NewMetricsHandler(client)
+	handler.AnalyzeCardinality = analyze
+	handler.AggregateMetrics(context.Background(), pw)
+
+	return handlers.Job{Name: "default", Watcher: pw, Handler: handler}
+}
+
+func TestCardinalityReport(t *testing.T) {
+	tests := []struct {
+		name    string
+		analyze bool
+		top     int
+		want    handlers.Cardinality
+	}{
+		{
+			name:    "Top Offenders",
+			analyze: true,
+			top:     2,
+			want: handlers.Cardinality{
+				Series: 6,
+				Metrics: []handlers.MetricCardinality{
+					{Name: "requests_total", Series: 4},
+					{Name: "go_goroutines", Series: 2},
+				},
+				Labels: []handlers.LabelCardinality{
+					{Name: "path", Series: 4, Values: 4},
+					{Name: "code", Series: 4, Values: 3},
+				},
+				Targets: []handlers.TargetCardinality{
+					{Job: "default", Namespace: "default", Pod: "pod1", Series: 4},
+					{Job: "default", Namespace: "default", Pod: "pod2", Series: 2},
+				},
+			},
+		},
+		{
+			name: "Not Analyzed",
+			top:  2,
+			want: handlers.Cardinality{
+				Metrics: []handlers.MetricCardinality{},
+				Labels:  []handlers.LabelCardinality{},
+				Targets: []handlers.TargetCardinality{},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := handlers.CardinalityReport([]handlers.Job{cardinalityJob(t, tt.analyze)}, tt.top)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("CardinalityReport() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCardinalityHandler(t *testing.T) {
+	job := cardinalityJob(t, true)
+	tests := []struct {
+		name     string
+		query    string
+		accept   string
+		wantType string
+		wantBody string
+	}{
+		{name: "HTML", wantType: "text/html; charset=utf-8", wantBody: "<td>requests_total</td><td>4</td>"},
+		{name: "JSON Format", query: "?format=json", wantType: "application/json",
+			wantBody: `{"name":"requests_total","series":4}`},
+		{name: "JSON Accept", accept: "application/json", wantType: "application/json",
+			wantBody: `"targets":[{"job":"default","namespace":"default","pod":"pod1","series":4}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, "/cardinality"+tt.query, nil)
+			if err != nil {
+				t.Fatalf("Failed to create request: %v", err)
+			}
+			req.Header.Set("Accept", tt.accept)
+			rr := httptest.NewRecorder()
+			handlers.CardinalityHandler([]handlers.Job{job}, 1).ServeHTTP(rr, req)
+
+			if got := rr.Header().Get("Content-Type"); got != tt.wantType {
+				t.Errorf("Content-Type = %q, want %q", got, tt.wantType)
+			}
+			if !strings.Contains(rr.Body.String(), tt.wantBody) {
+				t.Errorf("body = %q, want it to contain %q", rr.Body.String(), tt.wantBody)
+			}
+			if tt.wantType == "application/json" && !json.Valid(rr.Body.Bytes()) {
+				t.Errorf("body = %q, want valid JSON", rr.Body.String())
+			}
+		})
+	}
+}
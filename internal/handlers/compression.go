@@ -0,0 +1,114 @@
+package handlers
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/canonical/metrics-k8s-proxy/internal/logging"
+)
+
+// acceptEncoding is the Accept-Encoding of scrapes of pods.
+const acceptEncoding = "zstd, gzip"
+
+// maxZstdWindow bounds the memory a pod's zstd stream can make the proxy allocate for decoding. It is the
+// window size every zstd decoder is expected to support, which compressors stay within by default.
+const maxZstdWindow = 8 << 20
+
+// decodedBody returns the body of a pod's response, decompressed according to its Content-Encoding. The
+// caller must close it, which doesn't close the response's body.
+func decodedBody(resp *http.Response) (io.ReadCloser, error) {
+	switch encoding := strings.ToLower(resp.Header.Get("Content-Encoding")); encoding {
+	case "", "identity":
+		return io.NopCloser(resp.Body), nil
+	case "gzip":
+		return gzip.NewReader(resp.Body)
+	case "zstd":
+		// A single goroutine decodes synchronously, which is all a scrape needs
+		decoder, err := zstd.NewReader(resp.Body, zstd.WithDecoderConcurrency(1),
+			zstd.WithDecoderMaxWindow(maxZstdWindow))
+		if err != nil {
+			return nil, err
+		}
+
+		return decoder.IOReadCloser(), nil
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %q", encoding)
+	}
+}
+
+// acceptsGzip reports whether the request's Accept-Encoding header lists gzip, without a zero quality.
+func acceptsGzip(r *http.Request) bool {
+	for _, header := range r.Header.Values("Accept-Encoding") {
+		for coding := range strings.SplitSeq(header, ",") {
+			name, params, _ := strings.Cut(coding, ";")
+			if name = strings.TrimSpace(name); name != "gzip" && name != "*" {
+				continue
+			}
+			if value, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+				quality, err := strconv.ParseFloat(value, 64)
+				return err != nil || quality > 0
+			}
+
+			return true
+		}
+	}
+
+	return false
+}
+
+// gzipResponseWriter compresses everything written to the wrapped ResponseWriter.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz          *gzip.Writer
+	wroteHeader bool
+}
+
+func (w *gzipResponseWriter) WriteHeader(statusCode int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	// The length set by the handler is that of the uncompressed body
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Encoding", "gzip")
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *gzipResponseWriter) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+
+	return w.gz.Write(b)
+}
+
+// Compress gzips the responses of next for clients that accept it, such as Prometheus, whose scrapes of large
+// fan-outs are otherwise mostly spent transferring text.
+func Compress(next http.Handler) http.Handler {
+	writers := sync.Pool{New: func() any { return gzip.NewWriter(io.Discard) }}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		gz, _ := writers.Get().(*gzip.Writer)
+		defer writers.Put(gz)
+		gz.Reset(w)
+
+		gw := &gzipResponseWriter{ResponseWriter: w, gz: gz}
+		next.ServeHTTP(gw, r)
+		// Even an empty body is a gzip stream, which the header must announce
+		gw.WriteHeader(http.StatusOK)
+		if err := gz.Close(); err != nil {
+			logging.FromContext(r.Context()).ErrorContext(r.Context(), "Error compressing response", "error", err)
+		}
+	})
+}
@@ -0,0 +1,178 @@
+package handlers_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/canonical/metrics-k8s-proxy/internal/handlers"
+	"github.com/canonical/metrics-k8s-proxy/internal/k8s"
+)
+
+func gzipped(t *testing.T, text string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write([]byte(text)); err != nil {
+		t.Fatalf("Failed to compress: %v", err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatalf("Failed to compress: %v", err)
+	}
+
+	return buf.Bytes()
+}
+
+func zstdCompressed(t *testing.T, text string) []byte {
+	t.Helper()
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatalf("Failed to compress: %v", err)
+	}
+	defer encoder.Close()
+
+	return encoder.EncodeAll([]byte(text), nil)
+}
+
+func TestCompress(t *testing.T) {
+	const body = "metric_a{k8s_pod_name=\"pod1\",k8s_namespace=\"default\"} 1\n"
+	tests := []struct {
+		name           string
+		acceptEncoding string
+		wantGzip       bool
+	}{
+		{name: "Gzip", acceptEncoding: "gzip", wantGzip: true},
+		{name: "Among Others", acceptEncoding: "deflate, gzip;q=0.5, br", wantGzip: true},
+		{name: "Any", acceptEncoding: "*", wantGzip: true},
+		{name: "Refused", acceptEncoding: "gzip;q=0, identity"},
+		{name: "Other", acceptEncoding: "br"},
+		{name: "None"},
+	}
+
+	handler := handlers.Compress(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		if _, err := w.Write([]byte(body)); err != nil {
+			t.Errorf("Failed to write: %v", err)
+		}
+	}))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequestWithContext(context.Background(), http.MethodGet, "/metrics", nil)
+			if tt.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			if rr.Header().Get("Vary") != "Accept-Encoding" {
+				t.Errorf("Vary = %q, want Accept-Encoding", rr.Header().Get("Vary"))
+			}
+			got := rr.Body.Bytes()
+			if gotGzip := rr.Header().Get("Content-Encoding") == "gzip"; gotGzip != tt.wantGzip {
+				t.Fatalf("Content-Encoding = %q, want gzip %v", rr.Header().Get("Content-Encoding"), tt.wantGzip)
+			}
+			if tt.wantGzip {
+				gz, err := gzip.NewReader(rr.Body)
+				if err != nil {
+					t.Fatalf("Failed to decompress: %v", err)
+				}
+				if got, err = io.ReadAll(gz); err != nil {
+					t.Fatalf("Failed to decompress: %v", err)
+				}
+			}
+			if string(got) != body {
+				t.Errorf("body = %q, want %q", got, body)
+			}
+		})
+	}
+}
+
+func TestCompress_EmptyBody(t *testing.T) {
+	handler := handlers.Compress(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	req := httptest.NewRequestWithContext(context.Background(), http.MethodGet, "/metrics", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	gz, err := gzip.NewReader(rr.Body)
+	if err != nil {
+		t.Fatalf("Failed to decompress: %v", err)
+	}
+	if got, readErr := io.ReadAll(gz); readErr != nil || len(got) != 0 {
+		t.Errorf("body = %q, %v, want an empty gzip stream", got, readErr)
+	}
+}
+
+// encodingHTTPClient records the Accept-Encoding of the request and answers with its response.
+type encodingHTTPClient struct {
+	acceptEncoding string
+	respond        func() (*http.Response, error)
+}
+
+func (c *encodingHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	c.acceptEncoding = req.Header.Get("Accept-Encoding")
+
+	return c.respond()
+}
+
+func TestScrapePodMetrics_Compression(t *testing.T) {
+	details := k8s.PodScrapeDetails{Port: "8080", Path: "/metrics", PodName: "pod1", Namespace: "default"}
+	up := "metric_a{k8s_pod_name=\"pod1\",k8s_namespace=\"default\"} 1\n" +
+		"up{k8s_pod_name=\"pod1\",k8s_namespace=\"default\"} 1\n"
+	down := "\nup{k8s_pod_name=\"pod1\",k8s_namespace=\"default\"} 0\n"
+
+	tests := []struct {
+		name               string
+		headers            http.Header
+		encoding           string
+		body               []byte
+		want               string
+		wantAcceptEncoding string
+	}{
+		{name: "Gzip", encoding: "gzip", body: gzipped(t, "metric_a 1"), want: up, wantAcceptEncoding: "zstd, gzip"},
+		{name: "Zstd", encoding: "zstd", body: zstdCompressed(t, "metric_a 1"), want: up, wantAcceptEncoding: "zstd, gzip"},
+		{name: "Uncompressed", body: []byte("metric_a 1"), want: up, wantAcceptEncoding: "zstd, gzip"},
+		{name: "Corrupt Gzip", encoding: "gzip", body: []byte("metric_a 1"), want: down, wantAcceptEncoding: "zstd, gzip"},
+		{name: "Corrupt Zstd", encoding: "zstd", body: []byte("metric_a 1"), want: down, wantAcceptEncoding: "zstd, gzip"},
+		{
+			name:               "Encoding From Annotation",
+			headers:            http.Header{"Accept-Encoding": {"br"}},
+			encoding:           "br",
+			body:               []byte("compressed"),
+			want:               down,
+			wantAcceptEncoding: "br",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &encodingHTTPClient{respond: func() (*http.Response, error) {
+				header := http.Header{}
+				if tt.encoding != "" {
+					header.Set("Content-Encoding", tt.encoding)
+				}
+				return &http.Response{
+					StatusCode: http.StatusOK, Header: header, Body: io.NopCloser(bytes.NewReader(tt.body)),
+				}, nil
+			}}
+			pod := details
+			pod.Headers = tt.headers
+
+			got := handlers.NewMetricsHandler(client).ScrapePodMetrics(context.Background(), "10.0.0.1", pod)
+			if got != tt.want {
+				t.Errorf("ScrapePodMetrics() = %q, want %q", got, tt.want)
+			}
+			if client.acceptEncoding != tt.wantAcceptEncoding {
+				t.Errorf("Accept-Encoding = %q, want %q", client.acceptEncoding, tt.wantAcceptEncoding)
+			}
+		})
+	}
+}
@@ -0,0 +1,185 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/canonical/metrics-k8s-proxy/internal/k8s"
+	"github.com/canonical/metrics-k8s-proxy/internal/logging"
+	"github.com/canonical/metrics-k8s-proxy/internal/relabel"
+	"github.com/canonical/metrics-k8s-proxy/internal/timestamps"
+	"github.com/canonical/metrics-k8s-proxy/internal/util"
+)
+
+// maxDiffExamples bounds the lines listed for each kind of difference, so that a pod whose every series is
+// dropped doesn't produce a huge answer. The counts are always complete.
+const maxDiffExamples = 100
+
+// DebugScrape is a single scrape of a pod, showing what it answered and what the proxy made of it.
+type DebugScrape struct {
+	Job      string           `json:"job"`
+	URL      string           `json:"url"`
+	Upstream UpstreamResponse `json:"upstream"`
+	// Error is why the scrape failed, in which case the pod is reported as up=0. A pod going past its sample or
+	// series limit still has its Output shown.
+	Error string `json:"error,omitempty"`
+	// Output is what the proxy serves for the pod, without its up series.
+	Output string      `json:"output"`
+	Diff   RelabelDiff `json:"diff"`
+}
+
+// UpstreamResponse is the pod's response, as received but decompressed.
+type UpstreamResponse struct {
+	Status  int         `json:"status"`
+	Headers http.Header `json:"headers"`
+	Body    string      `json:"body"`
+}
+
+// RelabelDiff summarizes how the proxy changed the pod's samples.
+type RelabelDiff struct {
+	Samples int `json:"samples"`
+	// Dropped samples were removed by the job's relabel rules.
+	Dropped         int      `json:"dropped"`
+	DroppedExamples []string `json:"droppedExamples,omitempty"`
+	// Changed samples had their name or labels rewritten by the relabel rules, beyond the pod labels.
+	Changed         int             `json:"changed"`
+	ChangedExamples []ChangedSample `json:"changedExamples,omitempty"`
+	// ParseErrors are lines that aren't valid samples. They are passed through without relabeling.
+	ParseErrors        int      `json:"parseErrors"`
+	ParseErrorExamples []string `json:"parseErrorExamples,omitempty"`
+}
+
+// ChangedSample is a sample before and after relabeling.
+type ChangedSample struct {
+	Before string `json:"before"`
+	After  string `json:"after"`
+}
+
+// debugScrape scrapes the pod and compares its response with the output of the proxy. Unlike a regular scrape,
+// it reads the body whatever the status, and isn't recorded as the pod's latest scrape.
+func (h *MetricsHandler) debugScrape(ctx context.Context, podIP string, details k8s.PodScrapeDetails) DebugScrape {
+	debug := DebugScrape{URL: scrapeURL(podIP, details)}
+
+	if details.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, details.Timeout)
+		defer cancel()
+	}
+	req, err := newScrapeRequest(ctx, debug.URL, details)
+	if err != nil {
+		debug.Error = err.Error()
+		return debug
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		debug.Error = fmt.Sprintf("request to %s failed: %v", debug.URL, err)
+		return debug
+	}
+	defer resp.Body.Close()
+
+	// The body is decompressed and read up to the limit, so that a debug scrape can't use more memory than a
+	// regular one
+	limits := details.Limits.Within(h.Limits)
+	var body []byte
+	decoded, err := decodedBody(resp)
+	if err == nil {
+		body, err = readBody(decoded, limits.BodySize)
+		decoded.Close()
+	}
+	debug.Upstream = UpstreamResponse{Status: resp.StatusCode, Headers: resp.Header, Body: string(body)}
+	switch {
+	case err != nil:
+		debug.Error = fmt.Sprintf("reading response from %s: %v", debug.URL, err)
+	case resp.StatusCode != http.StatusOK:
+		debug.Error = fmt.Sprintf("%s returned status code %d", debug.URL, resp.StatusCode)
+	case limits.BodySize > 0 && int64(len(body)) > limits.BodySize:
+		debug.Error = bodySizeError(debug.URL, limits.BodySize).Error()
+	default:
+		labeled := util.AppendLabels(string(body), details.PodName, details.Namespace)
+		relabeled, _ := timestamps.Apply(relabel.Apply(labeled, h.RelabelRules), h.Timestamps, time.Now())
+		debug.Output = util.SortFamilies(relabeled)
+		debug.Diff = h.relabelDiff(labeled)
+		if limitErr := checkSampleLimits(debug.Output, countSamples(debug.Output), limits); limitErr != nil {
+			debug.Error = limitErr.Error()
+		}
+	}
+
+	return debug
+}
+
+// relabelDiff replays the relabel rules on every sample of the labeled body, as relabel.Apply does.
+func (h *MetricsHandler) relabelDiff(labeled string) RelabelDiff {
+	diff := RelabelDiff{}
+	for line := range strings.SplitSeq(labeled, "\n") {
+		if strings.HasPrefix(line, "#") || strings.TrimSpace(line) == "" {
+			continue
+		}
+		diff.Samples++
+
+		sample, err := util.ParseSample(line)
+		if err != nil {
+			diff.ParseErrors++
+			if len(diff.ParseErrorExamples) < maxDiffExamples {
+				diff.ParseErrorExamples = append(diff.ParseErrorExamples, err.Error())
+			}
+			continue
+		}
+		// Processing may modify the labels in place
+		before := sample.String()
+		processed, keep := relabel.Process(sample, h.RelabelRules)
+		switch {
+		case !keep:
+			diff.Dropped++
+			if len(diff.DroppedExamples) < maxDiffExamples {
+				diff.DroppedExamples = append(diff.DroppedExamples, before)
+			}
+		case processed.String() != before:
+			diff.Changed++
+			if len(diff.ChangedExamples) < maxDiffExamples {
+				diff.ChangedExamples = append(diff.ChangedExamples, ChangedSample{Before: before, After: processed.String()})
+			}
+		}
+	}
+
+	return diff
+}
+
+// DebugScrapeHandler scrapes the pod named by the pod query parameter, as namespace/name, and answers with its
+// raw response, the proxy's output and a summary of the differences, as JSON. The optional job parameter picks
+// the job whose relabel rules apply; by default it is the first job that discovered the pod.
+func DebugScrapeHandler(jobs []Job) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		namespace, pod, ok := strings.Cut(r.URL.Query().Get("pod"), "/")
+		if !ok || namespace == "" || pod == "" {
+			http.Error(w, "the pod parameter must be namespace/name", http.StatusBadRequest)
+			return
+		}
+		jobName := r.URL.Query().Get("job")
+		filter := ScrapeFilter{Namespace: namespace, PodName: pod}
+
+		for _, job := range jobs {
+			if jobName != "" && job.Name != jobName {
+				continue
+			}
+			for podIP, details := range filter.selectEndpoints(job.Watcher.GetPodMetricsEndpoints()) {
+				debug := job.Handler.debugScrape(r.Context(), podIP, details)
+				debug.Job = job.Name
+
+				w.Header().Set("Content-Type", "application/json")
+				encoder := json.NewEncoder(w)
+				encoder.SetIndent("", "  ")
+				if err := encoder.Encode(debug); err != nil {
+					logging.FromContext(r.Context()).ErrorContext(r.Context(), "Error writing debug scrape", "error", err)
+				}
+
+				return
+			}
+		}
+
+		http.Error(w, fmt.Sprintf("pod %s/%s is not scraped by the proxy", namespace, pod), http.StatusNotFound)
+	})
+}
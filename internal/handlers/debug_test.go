@@ -0,0 +1,144 @@
+package handlers_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/canonical/metrics-k8s-proxy/internal/handlers"
+	"github.com/canonical/metrics-k8s-proxy/internal/k8s"
+	"github.com/canonical/metrics-k8s-proxy/internal/relabel"
+)
+
+func debugJob(t *testing.T) handlers.Job {
+	t.Helper()
+	client := routedHTTPClient{
+		"http://10.0.0.1:8080/metrics": func() (*http.Response, error) {
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     http.Header{"Content-Type": {"text/plain; version=0.0.4"}},
+				Body: io.NopCloser(strings.NewReader("# TYPE requests_total counter\n" +
+					"requests_total{code=\"200\"} 5\n" +
+					"go_goroutines 10\n" +
+					"broken{code=\"200\" 1\n")),
+			}, nil
+		},
+		"http://10.0.0.2:8080/metrics": func() (*http.Response, error) {
+			return &http.Response{StatusCode: http.StatusServiceUnavailable, Body: io.NopCloser(strings.NewReader("busy"))}, nil
+		},
+	}
+	rules, err := relabel.Compile([]relabel.Config{
+		{SourceLabels: []string{"__name__"}, Regex: "go_.*", Action: relabel.Drop},
+		{SourceLabels: []string{"code"}, TargetLabel: "status"},
+	})
+	if err != nil {
+		t.Fatalf("Compile() error = %v", err)
+	}
+
+	pw := k8s.NewPodScrapeWatcher()
+	pw.PodMetricsEndpoints = map[string]k8s.PodScrapeDetails{
+		"10.0.0.1": {Port: "8080", Path: "/metrics", PodName: "pod1", Namespace: "default"},
+		"10.0.0.2": {Port: "8080", Path: "/metrics", PodName: "pod2", Namespace: "default"},
+	}
+	handler := handlers.NewMetricsHandler(client)
+	handler.RelabelRules = rules
+
+	return handlers.Job{Name: "default", Watcher: pw, Handler: handler}
+}
+
+func debugScrape(t *testing.T, job handlers.Job, query string) (int, handlers.DebugScrape) {
+	t.Helper()
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, "/debug/scrape"+query, nil)
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	rr := httptest.NewRecorder()
+	handlers.DebugScrapeHandler([]handlers.Job{job}).ServeHTTP(rr, req)
+
+	var debug handlers.DebugScrape
+	if rr.Code == http.StatusOK {
+		if err = json.NewDecoder(rr.Body).Decode(&debug); err != nil {
+			t.Fatalf("Failed to decode debug scrape: %v", err)
+		}
+	}
+
+	return rr.Code, debug
+}
+
+func TestDebugScrapeHandler(t *testing.T) {
+	job := debugJob(t)
+
+	status, debug := debugScrape(t, job, "?pod=default/pod1")
+	if status != http.StatusOK {
+		t.Fatalf("status = %d, want 200", status)
+	}
+	if debug.Job != "default" || debug.URL != "http://10.0.0.1:8080/metrics" || debug.Error != "" {
+		t.Errorf("debug scrape = %+v", debug)
+	}
+	if debug.Upstream.Status != http.StatusOK ||
+		debug.Upstream.Headers.Get("Content-Type") != "text/plain; version=0.0.4" ||
+		!strings.HasPrefix(debug.Upstream.Body, "# TYPE requests_total counter\nrequests_total{code=\"200\"} 5\n") {
+		t.Errorf("upstream = %+v", debug.Upstream)
+	}
+	wantOutput := "broken{k8s_pod_name=\"pod1\",k8s_namespace=\"default\",code=\"200\" 1\n" +
+		"# TYPE requests_total counter\n" +
+		"requests_total{k8s_pod_name=\"pod1\",k8s_namespace=\"default\",code=\"200\",status=\"200\"} 5"
+	if debug.Output != wantOutput {
+		t.Errorf("output = %q, want %q", debug.Output, wantOutput)
+	}
+
+	diff := debug.Diff
+	if diff.Samples != 3 || diff.Dropped != 1 || diff.Changed != 1 || diff.ParseErrors != 1 {
+		t.Errorf("diff = %+v, want 3 samples, 1 dropped, 1 changed and 1 parse error", diff)
+	}
+	wantDropped := []string{`go_goroutines{k8s_pod_name="pod1",k8s_namespace="default"} 10`}
+	if !reflect.DeepEqual(diff.DroppedExamples, wantDropped) {
+		t.Errorf("dropped = %v", diff.DroppedExamples)
+	}
+	wantChanged := []handlers.ChangedSample{{
+		Before: `requests_total{k8s_pod_name="pod1",k8s_namespace="default",code="200"} 5`,
+		After:  `requests_total{k8s_pod_name="pod1",k8s_namespace="default",code="200",status="200"} 5`,
+	}}
+	if !reflect.DeepEqual(diff.ChangedExamples, wantChanged) {
+		t.Errorf("changed = %+v, want %+v", diff.ChangedExamples, wantChanged)
+	}
+	if len(diff.ParseErrorExamples) != 1 || !strings.Contains(diff.ParseErrorExamples[0], "broken") {
+		t.Errorf("parse errors = %v", diff.ParseErrorExamples)
+	}
+}
+
+func TestDebugScrapeHandler_Errors(t *testing.T) {
+	job := debugJob(t)
+	tests := []struct {
+		name       string
+		query      string
+		wantStatus int
+		wantError  string
+	}{
+		{name: "Upstream Error", query: "?pod=default/pod2", wantStatus: http.StatusOK,
+			wantError: "http://10.0.0.2:8080/metrics returned status code 503"},
+		{name: "Unknown Pod", query: "?pod=default/pod3", wantStatus: http.StatusNotFound},
+		{name: "Other Job", query: "?pod=default/pod1&job=other", wantStatus: http.StatusNotFound},
+		{name: "Malformed Pod", query: "?pod=pod1", wantStatus: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, debug := debugScrape(t, job, tt.query)
+			if status != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", status, tt.wantStatus)
+			}
+			if debug.Error != tt.wantError {
+				t.Errorf("error = %q, want %q", debug.Error, tt.wantError)
+			}
+			if tt.wantError != "" && (debug.Upstream.Status != http.StatusServiceUnavailable || debug.Upstream.Body != "busy") {
+				t.Errorf("upstream = %+v, want the 503 response", debug.Upstream)
+			}
+		})
+	}
+}
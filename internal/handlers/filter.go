@@ -0,0 +1,62 @@
+package handlers
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/canonical/metrics-k8s-proxy/internal/k8s"
+	"github.com/canonical/metrics-k8s-proxy/internal/relabel"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// ScrapeFilter narrows a scrape of the proxy down to some of the pods, and some of their series.
+// The zero value selects everything.
+type ScrapeFilter struct {
+	Namespace string
+	PodName   string
+	// PodSelector, if set, selects pods by their labels.
+	PodSelector labels.Selector
+	// Match, if set, keeps the series selected by at least one of the selectors, as match[] does on /federate.
+	Match []relabel.Selector
+}
+
+// ParseScrapeFilter reads a filter from the namespace, selector (a Kubernetes label selector for pods) and
+// match[] query parameters.
+func ParseScrapeFilter(query url.Values) (ScrapeFilter, error) {
+	filter := ScrapeFilter{Namespace: query.Get("namespace")}
+	if selector := query.Get("selector"); selector != "" {
+		parsed, err := labels.Parse(selector)
+		if err != nil {
+			return ScrapeFilter{}, fmt.Errorf("invalid pod selector %q: %w", selector, err)
+		}
+		filter.PodSelector = parsed
+	}
+	for _, match := range query["match[]"] {
+		selector, err := relabel.ParseSelector(match)
+		if err != nil {
+			return ScrapeFilter{}, fmt.Errorf("invalid match[]: %w", err)
+		}
+		filter.Match = append(filter.Match, selector)
+	}
+
+	return filter, nil
+}
+
+// selectsPods reports whether the filter excludes any pods.
+func (f ScrapeFilter) selectsPods() bool {
+	return f.Namespace != "" || f.PodName != "" || f.PodSelector != nil
+}
+
+// selectEndpoints returns the endpoints of the pods the filter selects.
+func (f ScrapeFilter) selectEndpoints(endpoints map[string]k8s.PodScrapeDetails) map[string]k8s.PodScrapeDetails {
+	selected := make(map[string]k8s.PodScrapeDetails, len(endpoints))
+	for podIP, details := range endpoints {
+		if (f.Namespace == "" || details.Namespace == f.Namespace) &&
+			(f.PodName == "" || details.PodName == f.PodName) &&
+			(f.PodSelector == nil || f.PodSelector.Matches(labels.Set(details.Labels))) {
+			selected[podIP] = details
+		}
+	}
+
+	return selected
+}
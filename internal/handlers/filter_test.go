@@ -0,0 +1,206 @@
+package handlers_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/canonical/metrics-k8s-proxy/internal/aggregate"
+	"github.com/canonical/metrics-k8s-proxy/internal/handlers"
+	"github.com/canonical/metrics-k8s-proxy/internal/k8s"
+)
+
+// filterJob builds a job scraping three pods, each answering with the given body.
+func filterJob(body string) handlers.Job {
+	client := routedHTTPClient{}
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		client["http://"+ip+":8080/metrics"] = func() (*http.Response, error) {
+			return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(body))}, nil
+		}
+	}
+	pw := k8s.NewPodScrapeWatcher()
+	pw.PodMetricsEndpoints = map[string]k8s.PodScrapeDetails{
+		"10.0.0.1": {Port: "8080", Path: "/metrics", PodName: "web-1", Namespace: "apps",
+			Labels: map[string]string{"app": "web", "tier": "frontend"}},
+		"10.0.0.2": {Port: "8080", Path: "/metrics", PodName: "api-1", Namespace: "apps",
+			Labels: map[string]string{"app": "api", "tier": "backend"}},
+		"10.0.0.3": {Port: "8080", Path: "/metrics", PodName: "web-1", Namespace: "staging",
+			Labels: map[string]string{"app": "web", "tier": "frontend"}},
+	}
+
+	return handlers.Job{
+		Name:          "default",
+		Watcher:       pw,
+		Handler:       handlers.NewMetricsHandler(client),
+		ScrapeTimeout: time.Second,
+	}
+}
+
+// servedPods returns the sorted namespace/pod of the up series in body, and the names of the other series.
+func servedPods(body string) ([]string, []string) {
+	pods, names := []string{}, []string{}
+	for line := range strings.SplitSeq(body, "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name := line[:strings.IndexByte(line, '{')]
+		if name != "up" {
+			names = append(names, name)
+			continue
+		}
+		pod := line[strings.Index(line, `k8s_pod_name="`)+len(`k8s_pod_name="`):]
+		namespace := line[strings.Index(line, `k8s_namespace="`)+len(`k8s_namespace="`):]
+		pods = append(pods, namespace[:strings.IndexByte(namespace, '"')]+"/"+pod[:strings.IndexByte(pod, '"')])
+	}
+	sort.Strings(pods)
+	sort.Strings(names)
+
+	return pods, names
+}
+
+func Test_ProxyJobs_Filters(t *testing.T) {
+	job := filterJob("# TYPE requests_total counter\nrequests_total 5\ngo_goroutines 10\n")
+	tests := []struct {
+		name       string
+		query      string
+		wantStatus int
+		wantPods   []string
+		wantNames  []string
+	}{
+		{name: "No Filter", query: "", wantStatus: http.StatusOK,
+			wantPods: []string{"apps/api-1", "apps/web-1", "staging/web-1"},
+			wantNames: []string{
+				"go_goroutines", "go_goroutines", "go_goroutines", "requests_total", "requests_total", "requests_total",
+			}},
+		{name: "Namespace", query: "?namespace=apps", wantStatus: http.StatusOK,
+			wantPods:  []string{"apps/api-1", "apps/web-1"},
+			wantNames: []string{"go_goroutines", "go_goroutines", "requests_total", "requests_total"}},
+		{name: "Pod Selector", query: "?selector=tier%3Dfrontend,app+in+(web)", wantStatus: http.StatusOK,
+			wantPods:  []string{"apps/web-1", "staging/web-1"},
+			wantNames: []string{"go_goroutines", "go_goroutines", "requests_total", "requests_total"}},
+		{name: "Match", query: "?namespace=staging&match[]=requests_total&match[]=up", wantStatus: http.StatusOK,
+			wantPods: []string{"staging/web-1"}, wantNames: []string{"requests_total"}},
+		{name: "Invalid Selector", query: "?selector=app+in+web", wantStatus: http.StatusBadRequest},
+		{name: "Invalid Match", query: "?match[]=%7Bapp%7D", wantStatus: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, "/metrics"+tt.query, nil)
+			if err != nil {
+				t.Fatalf("Failed to create request: %v", err)
+			}
+			rr := httptest.NewRecorder()
+			handlers.ProxyJobs(rr, req, []handlers.Job{job})
+
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d, body %q", rr.Code, tt.wantStatus, rr.Body.String())
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			pods, names := servedPods(rr.Body.String())
+			if strings.Join(pods, " ") != strings.Join(tt.wantPods, " ") {
+				t.Errorf("served pods %v, want %v", pods, tt.wantPods)
+			}
+			if strings.Join(names, " ") != strings.Join(tt.wantNames, " ") {
+				t.Errorf("served series %v, want %v", names, tt.wantNames)
+			}
+		})
+	}
+}
+
+func Test_ProxyPod(t *testing.T) {
+	job := filterJob("metric1 1")
+	tests := []struct {
+		name       string
+		namespace  string
+		pod        string
+		query      string
+		wantStatus int
+		wantBody   string
+	}{
+		{name: "Known Pod", namespace: "staging", pod: "web-1", wantStatus: http.StatusOK,
+			wantBody: "metric1{k8s_pod_name=\"web-1\",k8s_namespace=\"staging\"} 1\n" +
+				"up{k8s_pod_name=\"web-1\",k8s_namespace=\"staging\"} 1\n"},
+		{name: "Known Pod With Match", namespace: "apps", pod: "api-1", query: "?match[]=up", wantStatus: http.StatusOK,
+			wantBody: "up{k8s_pod_name=\"api-1\",k8s_namespace=\"apps\"} 1\n"},
+		{name: "Unknown Pod", namespace: "apps", pod: "web-2", wantStatus: http.StatusNotFound,
+			wantBody: "pod apps/web-2 is not scraped by the proxy\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequestWithContext(context.Background(), http.MethodGet,
+				"/metrics/"+tt.namespace+"/"+tt.pod+tt.query, nil)
+			if err != nil {
+				t.Fatalf("Failed to create request: %v", err)
+			}
+			rr := httptest.NewRecorder()
+			handlers.ProxyPod(rr, req, []handlers.Job{job}, tt.namespace, tt.pod)
+
+			if rr.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rr.Code, tt.wantStatus)
+			}
+			if rr.Body.String() != tt.wantBody {
+				t.Errorf("body = %q, want %q", rr.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
+
+func Test_AggregationRules(t *testing.T) {
+	job := filterJob("requests_total 5")
+	rules, err := aggregate.Compile([]aggregate.Config{{Metric: "requests_total", Without: []string{"k8s_pod_name"}}})
+	if err != nil {
+		t.Fatalf("Compile() error = %v", err)
+	}
+	job.Handler.AggregationRules = rules
+
+	tests := []struct {
+		name     string
+		path     string
+		pod      string
+		wantBody []string
+	}{
+		{name: "All Pods", path: "/metrics", wantBody: []string{
+			"requests_total{k8s_namespace=\"apps\"} 10\n",
+			"requests_total{k8s_namespace=\"staging\"} 5\n",
+			"up{k8s_pod_name=\"web-1\",k8s_namespace=\"apps\"} 1\n",
+			"up{k8s_pod_name=\"api-1\",k8s_namespace=\"apps\"} 1\n",
+			"up{k8s_pod_name=\"web-1\",k8s_namespace=\"staging\"} 1\n",
+		}},
+		{name: "Filtered Pods", path: "/metrics?namespace=apps", wantBody: []string{
+			"requests_total{k8s_namespace=\"apps\"} 10\n",
+		}},
+		{name: "Single Pod", path: "/metrics/apps/api-1", pod: "api-1", wantBody: []string{
+			"requests_total{k8s_pod_name=\"api-1\",k8s_namespace=\"apps\"} 5\n",
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, reqErr := http.NewRequestWithContext(context.Background(), http.MethodGet, tt.path, nil)
+			if reqErr != nil {
+				t.Fatalf("Failed to create request: %v", reqErr)
+			}
+			rr := httptest.NewRecorder()
+			if tt.pod != "" {
+				handlers.ProxyPod(rr, req, []handlers.Job{job}, "apps", tt.pod)
+			} else {
+				handlers.ProxyJobs(rr, req, []handlers.Job{job})
+			}
+
+			for _, want := range tt.wantBody {
+				if !strings.Contains(rr.Body.String(), want) {
+					t.Errorf("body = %q, want it to contain %q", rr.Body.String(), want)
+				}
+			}
+		})
+	}
+}
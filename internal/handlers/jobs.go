@@ -0,0 +1,105 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/canonical/metrics-k8s-proxy/internal/k8s"
+	"github.com/canonical/metrics-k8s-proxy/internal/relabel"
+)
+
+// JobLabel is the label that tells series from different jobs apart on the combined endpoint.
+const JobLabel = "job"
+
+// Job is a named scrape job: the pods a watcher discovers, the handler that scrapes them,
+// and the deadline for a full fan-out.
+type Job struct {
+	Name          string
+	Watcher       *k8s.PodScrapeWatcher
+	Handler       *MetricsHandler
+	ScrapeTimeout time.Duration
+}
+
+// AggregateJobs runs the fan-out of every job concurrently, each within its own scrape timeout.
+// When more than one job is given, every series is tagged with a JobLabel naming the job it came from.
+func AggregateJobs(ctx context.Context, jobs []Job) []string {
+	return AggregateJobsFiltered(ctx, jobs, ScrapeFilter{})
+}
+
+// AggregateJobsFiltered is AggregateJobs for the pods and series selected by filter. Its Match selectors see
+// the JobLabel. The responses come in the order of jobs, whichever fan-out finishes first.
+func AggregateJobsFiltered(ctx context.Context, jobs []Job, filter ScrapeFilter) []string {
+	var wg sync.WaitGroup
+	jobResponses := make([][]string, len(jobs))
+
+	for i, job := range jobs {
+		wg.Add(1)
+
+		go func(i int, job Job) {
+			defer wg.Done()
+
+			jobCtx, cancel := context.WithTimeout(ctx, job.ScrapeTimeout)
+			defer cancel()
+
+			results := job.Handler.AggregateFiltered(jobCtx, job.Watcher, filter)
+			if len(jobs) > 1 {
+				rules := []relabel.Rule{relabel.SetLabel(JobLabel, job.Name)}
+				for i := range results {
+					results[i] = relabel.Apply(results[i], rules)
+				}
+			}
+			if len(filter.Match) > 0 {
+				for i := range results {
+					results[i] = relabel.Filter(results[i], filter.Match)
+				}
+			}
+
+			jobResponses[i] = results
+		}(i, job)
+	}
+
+	wg.Wait()
+
+	responses := []string{}
+	for _, results := range jobResponses {
+		responses = append(responses, results...)
+	}
+
+	return responses
+}
+
+// ProxyJobs serves the combined metrics of all jobs, narrowed down by the filter in the request's query.
+func ProxyJobs(w http.ResponseWriter, r *http.Request, jobs []Job) {
+	filter, err := ParseScrapeFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	writeMetrics(w, AggregateJobsFiltered(r.Context(), jobs, filter))
+}
+
+// ProxyPod serves the metrics of a single pod, as scraped by every job that discovered it.
+// The request's query may narrow its series down with match[] selectors.
+func ProxyPod(w http.ResponseWriter, r *http.Request, jobs []Job, namespace, pod string) {
+	filter, err := ParseScrapeFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter.Namespace, filter.PodName = namespace, pod
+
+	found := false
+	for _, job := range jobs {
+		found = found || len(filter.selectEndpoints(job.Watcher.GetPodMetricsEndpoints())) > 0
+	}
+	if !found {
+		http.Error(w, fmt.Sprintf("pod %s/%s is not scraped by the proxy", namespace, pod), http.StatusNotFound)
+		return
+	}
+
+	writeMetrics(w, AggregateJobsFiltered(r.Context(), jobs, filter))
+}
@@ -0,0 +1,116 @@
+package handlers_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/canonical/metrics-k8s-proxy/internal/handlers"
+	"github.com/canonical/metrics-k8s-proxy/internal/k8s"
+)
+
+// newTestJob builds a job that scrapes a single pod with the given response body.
+func newTestJob(name, podIP, podName, body string) handlers.Job {
+	client := &mockHTTPClient{
+		responses: map[string]*http.Response{
+			"http://" + podIP + ":8080/metrics": {
+				StatusCode: http.StatusOK,
+				Body:       io.NopCloser(strings.NewReader(body)),
+			},
+		},
+	}
+	pw := k8s.NewPodScrapeWatcher()
+	pw.PodMetricsEndpoints = map[string]k8s.PodScrapeDetails{
+		podIP: {Port: "8080", Path: "/metrics", PodName: podName, Namespace: "test-namespace"},
+	}
+
+	return handlers.Job{
+		Name:          name,
+		Watcher:       pw,
+		Handler:       handlers.NewMetricsHandler(client),
+		ScrapeTimeout: time.Second,
+	}
+}
+
+func Test_ProxyJobs(t *testing.T) {
+	tests := []struct {
+		name             string
+		jobs             []handlers.Job
+		expectedResponse string
+	}{
+		{
+			name: "Single Job Is Not Labeled",
+			jobs: []handlers.Job{newTestJob("ztunnel", "127.0.0.1", "ztunnel-1", "metric1 1")},
+			expectedResponse: "metric1{k8s_pod_name=\"ztunnel-1\",k8s_namespace=\"test-namespace\"} 1\n" +
+				"up{k8s_pod_name=\"ztunnel-1\",k8s_namespace=\"test-namespace\"} 1\n",
+		},
+		{
+			name: "Multiple Jobs Are Labeled",
+			jobs: []handlers.Job{
+				newTestJob("ztunnel", "127.0.0.1", "ztunnel-1", "metric1 1"),
+				newTestJob("waypoint", "127.0.0.2", "waypoint-1", "metric2 2"),
+			},
+			expectedResponse: "metric1{k8s_pod_name=\"ztunnel-1\",k8s_namespace=\"test-namespace\",job=\"ztunnel\"} 1\n" +
+				"up{k8s_pod_name=\"ztunnel-1\",k8s_namespace=\"test-namespace\",job=\"ztunnel\"} 1\n" +
+				"\nmetric2{k8s_pod_name=\"waypoint-1\",k8s_namespace=\"test-namespace\",job=\"waypoint\"} 2\n" +
+				"up{k8s_pod_name=\"waypoint-1\",k8s_namespace=\"test-namespace\",job=\"waypoint\"} 1\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, "/metrics", nil)
+			if err != nil {
+				t.Fatalf("Failed to create request: %v", err)
+			}
+
+			handlers.ProxyJobs(rr, req, tt.jobs)
+
+			if rr.Code != http.StatusOK {
+				t.Errorf("ProxyJobs() status = %v, want %v", rr.Code, http.StatusOK)
+			}
+			if got := rr.Body.String(); !compareSortedStrings(got, tt.expectedResponse) {
+				t.Errorf("ProxyJobs() got = %v, want %v", got, tt.expectedResponse)
+			}
+		})
+	}
+}
+
+func TestAggregateJobs_Order(t *testing.T) {
+	// The first job's pod answers last, so the jobs finish in the reverse of their order
+	delayedJob := func(name, podIP string, delay time.Duration) handlers.Job {
+		pw := k8s.NewPodScrapeWatcher()
+		pw.PodMetricsEndpoints = map[string]k8s.PodScrapeDetails{
+			podIP: {Port: "8080", Path: "/metrics", PodName: name + "-1", Namespace: "test-namespace"},
+		}
+		client := routedHTTPClient{
+			"http://" + podIP + ":8080/metrics": func() (*http.Response, error) {
+				time.Sleep(delay)
+				return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("metric 1"))}, nil
+			},
+		}
+
+		return handlers.Job{Name: name, Watcher: pw, Handler: handlers.NewMetricsHandler(client), ScrapeTimeout: time.Second}
+	}
+	jobs := []handlers.Job{
+		delayedJob("ztunnel", "10.0.0.1", 6*time.Millisecond),
+		delayedJob("waypoint", "10.0.0.2", 3*time.Millisecond),
+		delayedJob("gateway", "10.0.0.3", 0),
+	}
+
+	want := handlers.AggregateJobs(context.Background(), jobs)
+	if len(want) != 3 || !strings.Contains(want[0], "job=\"ztunnel\"") || !strings.Contains(want[2], "job=\"gateway\"") {
+		t.Fatalf("AggregateJobs() = %q, want the jobs' responses in their order", want)
+	}
+	for range 3 {
+		if got := handlers.AggregateJobs(context.Background(), jobs); !reflect.DeepEqual(got, want) {
+			t.Fatalf("AggregateJobs() = %q, want %q", got, want)
+		}
+	}
+}
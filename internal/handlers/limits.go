@@ -0,0 +1,91 @@
+package handlers
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/canonical/metrics-k8s-proxy/internal/k8s"
+	"github.com/canonical/metrics-k8s-proxy/internal/util"
+)
+
+// readBody reads a response body of at most limit bytes, reading one byte more to tell whether the body went
+// past the limit. A zero limit reads the whole body.
+func readBody(body io.Reader, limit int64) ([]byte, error) {
+	if limit > 0 {
+		body = io.LimitReader(body, limit+1)
+	}
+
+	return io.ReadAll(body)
+}
+
+// bodySizeError is the error of a scrape whose response is larger than limit bytes.
+func bodySizeError(url string, limit int64) error {
+	return &scrapeError{
+		class: ErrorClassLimit,
+		err:   fmt.Errorf("response from %s exceeds the body size limit of %d bytes", url, limit),
+	}
+}
+
+// checkSampleLimits fails if the relabeled metrics, holding the given number of samples, exceed the sample or
+// series limit.
+func checkSampleLimits(metrics string, samples int, limits k8s.ScrapeLimits) error {
+	if limits.Samples > 0 && samples > limits.Samples {
+		return &scrapeError{
+			class: ErrorClassLimit,
+			err:   fmt.Errorf("%d samples exceed the sample limit of %d", samples, limits.Samples),
+		}
+	}
+	// There can't be more series than samples, so only count them when it matters
+	if limits.Series > 0 && samples > limits.Series {
+		if series := countSeries(metrics); series > limits.Series {
+			return &scrapeError{
+				class: ErrorClassLimit,
+				err:   fmt.Errorf("%d series exceed the series limit of %d", series, limits.Series),
+			}
+		}
+	}
+
+	return nil
+}
+
+// countSeries counts the distinct series of an exposition body, whatever the order of their labels.
+// Lines that can't be parsed count as a series each.
+func countSeries(metrics string) int {
+	series := map[string]struct{}{}
+	for line := range strings.SplitSeq(metrics, "\n") {
+		if line = strings.TrimSpace(line); line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		_, key := parseSeries(line)
+		series[key] = struct{}{}
+	}
+
+	return len(series)
+}
+
+// parseSeries parses a sample line, with its labels sorted by name, and returns it along with the key
+// identifying its series. A line that can't be parsed is its own key, and its sample has no name.
+func parseSeries(line string) (util.Sample, string) {
+	sample, err := util.ParseSample(line)
+	if err != nil {
+		return util.Sample{}, line
+	}
+	slices.SortFunc(sample.Labels, func(a, b util.Label) int { return cmp.Compare(a.Name, b.Name) })
+
+	return sample, util.Sample{Name: sample.Name, Labels: sample.Labels}.String()
+}
+
+// downMetric returns the up=0 series of a pod whose scrape failed. A pod dropped for exceeding one of its limits
+// is marked with a limit_exceeded reason, and a pod whose circuit is open with a circuit_open reason, so that
+// they can be told apart from a pod that just failed.
+func downMetric(details k8s.PodScrapeDetails, err error) string {
+	reason := ""
+	if class := errorClass(err); class == ErrorClassLimit || class == ErrorClassCircuitOpen {
+		reason = class
+	}
+
+	return util.AppendUpMetricWithReason("", details.PodName, details.Namespace, 0, reason)
+}
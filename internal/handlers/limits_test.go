@@ -0,0 +1,104 @@
+package handlers_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/canonical/metrics-k8s-proxy/internal/handlers"
+	"github.com/canonical/metrics-k8s-proxy/internal/k8s"
+)
+
+func TestScrapeLimits(t *testing.T) {
+	body := "# TYPE requests_total counter\n" +
+		"requests_total{code=\"200\",method=\"GET\"} 5\n" +
+		"requests_total{method=\"GET\",code=\"200\"} 5\n" +
+		"requests_total{code=\"500\",method=\"GET\"} 1"
+	respond := func(contentLength int64) func() (*http.Response, error) {
+		return func() (*http.Response, error) {
+			return &http.Response{
+				StatusCode:    http.StatusOK,
+				ContentLength: contentLength,
+				Body:          io.NopCloser(strings.NewReader(body)),
+			}, nil
+		}
+	}
+	limitedUp := "up{k8s_pod_name=\"pod1\",k8s_namespace=\"default\",reason=\"limit_exceeded\"} 0\n"
+	okUp := "up{k8s_pod_name=\"pod1\",k8s_namespace=\"default\"} 1\n"
+
+	tests := []struct {
+		name          string
+		contentLength int64
+		global        k8s.ScrapeLimits
+		pod           k8s.ScrapeLimits
+		wantUp        string
+		wantError     string
+	}{
+		{name: "No Limits", contentLength: -1, wantUp: okUp},
+		{name: "Body Size", contentLength: -1, global: k8s.ScrapeLimits{BodySize: 64}, wantUp: limitedUp,
+			wantError: "exceeds the body size limit of 64 bytes"},
+		{name: "Content Length", contentLength: 1 << 30, global: k8s.ScrapeLimits{BodySize: 1 << 20}, wantUp: limitedUp,
+			wantError: "exceeds the body size limit of 1048576 bytes"},
+		{name: "Body Size Within", contentLength: -1, global: k8s.ScrapeLimits{BodySize: int64(len(body))}, wantUp: okUp},
+		{name: "Samples", contentLength: -1, pod: k8s.ScrapeLimits{Samples: 2}, wantUp: limitedUp,
+			wantError: "3 samples exceed the sample limit of 2"},
+		{name: "Pod Can't Loosen", contentLength: -1, global: k8s.ScrapeLimits{Samples: 2},
+			pod: k8s.ScrapeLimits{Samples: 10}, wantUp: limitedUp, wantError: "3 samples exceed the sample limit of 2"},
+		{name: "Series", contentLength: -1, global: k8s.ScrapeLimits{Series: 1}, wantUp: limitedUp,
+			wantError: "2 series exceed the series limit of 1"},
+		// The first two samples are the same series, whatever the order of their labels
+		{name: "Series Within", contentLength: -1, global: k8s.ScrapeLimits{Series: 2}, wantUp: okUp},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pw := k8s.NewPodScrapeWatcher()
+			pw.PodMetricsEndpoints = map[string]k8s.PodScrapeDetails{
+				"10.0.0.1": {Port: "8080", Path: "/metrics", PodName: "pod1", Namespace: "default", Limits: tt.pod},
+				"10.0.0.2": {Port: "8080", Path: "/metrics", PodName: "pod2", Namespace: "default"},
+			}
+			handler := handlers.NewMetricsHandler(routedHTTPClient{
+				"http://10.0.0.1:8080/metrics": respond(tt.contentLength),
+				"http://10.0.0.2:8080/metrics": func() (*http.Response, error) {
+					return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("metric_b 1"))}, nil
+				},
+			})
+			handler.Limits = tt.global
+
+			got := strings.Join(handler.AggregateMetrics(context.Background(), pw), "\n")
+			if !strings.Contains(got, tt.wantUp) {
+				t.Errorf("AggregateMetrics() = %q, want it to contain %q", got, tt.wantUp)
+			}
+			if tt.wantUp == limitedUp && strings.Contains(got, "requests_total") {
+				t.Errorf("AggregateMetrics() = %q, the pod's samples should be dropped", got)
+			}
+			// The other pod is never affected
+			if !strings.Contains(got, "up{k8s_pod_name=\"pod2\",k8s_namespace=\"default\"} 1\n") {
+				t.Errorf("AggregateMetrics() = %q, want pod2 to be up", got)
+			}
+
+			for _, target := range handler.Targets("default", pw) {
+				if target.Labels["k8s_pod_name"] != "pod1" {
+					continue
+				}
+				if !strings.Contains(target.LastError, tt.wantError) || (tt.wantError == "") != (target.LastError == "") {
+					t.Errorf("last error = %q, want it to contain %q", target.LastError, tt.wantError)
+				}
+				if tt.wantError != "" && target.ErrorClass != handlers.ErrorClassLimit {
+					t.Errorf("error class = %q, want %q", target.ErrorClass, handlers.ErrorClassLimit)
+				}
+			}
+		})
+	}
+}
+
+func TestBackgroundScraper_Limits(t *testing.T) {
+	scraper := newBackgroundScraper(&flakyHTTPClient{healthy: 1 << 20}, time.Minute)
+	scraper.Handler.Limits = k8s.ScrapeLimits{BodySize: 4}
+	runScraper(t, scraper)
+
+	waitForSnapshot(t, scraper, "up{k8s_pod_name=\"pod1\",k8s_namespace=\"default\",reason=\"limit_exceeded\"} 0\n")
+}
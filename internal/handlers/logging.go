@@ -0,0 +1,131 @@
+package handlers
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/canonical/metrics-k8s-proxy/internal/k8s"
+	"github.com/canonical/metrics-k8s-proxy/internal/logging"
+)
+
+// RequestIDHeader carries the ID of a request, as sent by the client or generated by the proxy.
+const RequestIDHeader = "X-Request-Id"
+
+// maxRequestIDLength bounds the request IDs taken from clients, which end up in every line logged for them.
+const maxRequestIDLength = 128
+
+// RequestLogger gives every request an ID, taken from its X-Request-Id header or generated, and returns it in
+// the same header. The request's context carries the logger, with the ID added to every line.
+func RequestLogger(logger *slog.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id := r.Header.Get(RequestIDHeader)
+			if !validRequestID(id) {
+				id = logging.NewRequestID()
+			}
+			w.Header().Set(RequestIDHeader, id)
+
+			ctx := logging.NewContext(r.Context(), logger.With(logging.RequestIDAttr, id))
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// validRequestID reports whether a client's request ID is short and only made of printable ASCII characters.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range []byte(id) {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// errorLog rate-limits the scrape errors logged for each pod, so that a pod failing every scrape is logged
+// once per interval rather than on every scrape. An error of another class than the last one logged for the
+// pod, or the first one after a successful scrape, is logged right away.
+type errorLog struct {
+	mu     sync.Mutex
+	logged map[string]loggedError
+}
+
+// loggedError is the last error logged for a pod, and how many errors were left out since.
+type loggedError struct {
+	class      string
+	time       time.Time
+	suppressed int
+}
+
+// allow reports whether an error of the class should be logged for the pod, and if so how many of its errors
+// were left out since the last one logged. A zero interval logs every error.
+func (l *errorLog) allow(podIP, class string, interval time.Duration, now time.Time) (bool, int) {
+	if interval <= 0 {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.logged == nil {
+		l.logged = map[string]loggedError{}
+	}
+
+	last, exists := l.logged[podIP]
+	if exists && last.class == class && now.Sub(last.time) < interval {
+		last.suppressed++
+		l.logged[podIP] = last
+
+		return false, 0
+	}
+	l.logged[podIP] = loggedError{class: class, time: now}
+
+	return true, last.suppressed
+}
+
+// reset forgets the errors of a pod that was scraped successfully, so that its next failure is logged right away.
+func (l *errorLog) reset(podIP string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.logged, podIP)
+}
+
+// prune forgets the errors of pods that are no longer among endpoints.
+func (l *errorLog) prune(endpoints map[string]k8s.PodScrapeDetails) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for podIP := range l.logged {
+		if _, exists := endpoints[podIP]; !exists {
+			delete(l.logged, podIP)
+		}
+	}
+}
+
+// logScrape logs the outcome of a scrape of the pod with the logger of ctx: failures as warnings, rate-limited
+// by ErrorLogInterval, and successes at debug level.
+func (h *MetricsHandler) logScrape(ctx context.Context, podIP string, metricsEndpoint k8s.PodScrapeDetails,
+	result TargetResult) {
+	logger := logging.FromContext(ctx).With(
+		"pod", metricsEndpoint.PodName,
+		"namespace", metricsEndpoint.Namespace,
+		"url", scrapeURL(podIP, metricsEndpoint),
+		"duration", result.Duration,
+		"attempts", result.Attempts,
+	)
+	if result.Err == nil {
+		h.errorLog.reset(podIP)
+		logger.DebugContext(ctx, "Scraped pod", "samples", result.Samples, "bytes", result.Bytes)
+		return
+	}
+
+	class := errorClass(result.Err)
+	allowed, suppressed := h.errorLog.allow(podIP, class, h.ErrorLogInterval, time.Now())
+	if !allowed {
+		return
+	}
+	logger.WarnContext(ctx, "Error scraping pod", "error_class", class, "error", result.Err, "suppressed", suppressed)
+}
@@ -0,0 +1,163 @@
+package handlers_test
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/canonical/metrics-k8s-proxy/internal/handlers"
+	"github.com/canonical/metrics-k8s-proxy/internal/k8s"
+	"github.com/canonical/metrics-k8s-proxy/internal/logging"
+)
+
+func bufferLogger(buf *bytes.Buffer) *slog.Logger {
+	return slog.New(slog.NewTextHandler(buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+}
+
+func TestRequestLogger(t *testing.T) {
+	generated := regexp.MustCompile(`^[0-9a-f]{16}$`)
+	tests := []struct {
+		name   string
+		header string
+		want   string
+	}{
+		{name: "Client ID", header: "scrape-42", want: "scrape-42"},
+		{name: "Missing ID"},
+		{name: "Invalid ID", header: "two words"},
+		{name: "Long ID", header: strings.Repeat("x", 129)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			handler := handlers.RequestLogger(bufferLogger(&buf))(http.HandlerFunc(
+				func(_ http.ResponseWriter, r *http.Request) {
+					logging.FromContext(r.Context()).InfoContext(r.Context(), "Handled")
+				}))
+
+			req := httptest.NewRequestWithContext(context.Background(), http.MethodGet, "/metrics", nil)
+			if tt.header != "" {
+				req.Header.Set(handlers.RequestIDHeader, tt.header)
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			id := rr.Header().Get(handlers.RequestIDHeader)
+			if tt.want != "" && id != tt.want {
+				t.Errorf("request ID = %q, want %q", id, tt.want)
+			}
+			if tt.want == "" && !generated.MatchString(id) {
+				t.Errorf("request ID = %q, want a generated one", id)
+			}
+			if !strings.Contains(buf.String(), "request_id="+id) {
+				t.Errorf("log = %q, want it to carry the request ID %q", buf.String(), id)
+			}
+		})
+	}
+}
+
+func TestScrapePodMetrics_ErrorLogging(t *testing.T) {
+	details := k8s.PodScrapeDetails{Port: "8080", Path: "/metrics", PodName: "pod1", Namespace: "default"}
+	unavailable := statusResponse(http.StatusServiceUnavailable, "busy")
+	tests := []struct {
+		name      string
+		interval  time.Duration
+		responses []func() (*http.Response, error)
+		want      []string
+	}{
+		{
+			name:     "Repeated Errors",
+			interval: time.Hour,
+			responses: []func() (*http.Response, error){
+				unavailable, unavailable, unavailable, connError(syscall.ECONNREFUSED), connError(syscall.ECONNREFUSED),
+			},
+			want: []string{
+				`level=WARN msg="Error scraping pod" request_id=abc pod=pod1 namespace=default ` +
+					`url=http://10.0.0.1:8080/metrics duration=`,
+				`attempts=1 error_class=http_status error="http://10.0.0.1:8080/metrics returned status code 503" ` +
+					`suppressed=0`,
+				`error_class=connection`,
+				`suppressed=2`,
+			},
+		},
+		{
+			name:      "Every Error",
+			responses: []func() (*http.Response, error){unavailable},
+			want:      []string{"suppressed=0", "suppressed=0", "suppressed=0", "suppressed=0", "suppressed=0"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			ctx := logging.NewContext(context.Background(), bufferLogger(&buf).With(logging.RequestIDAttr, "abc"))
+			handler := handlers.NewMetricsHandler(&sequenceHTTPClient{responses: tt.responses})
+			handler.ErrorLogInterval = tt.interval
+
+			for range 5 {
+				handler.ScrapePodMetrics(ctx, "10.0.0.1", details)
+			}
+
+			lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+			if want := strings.Count(strings.Join(tt.want, " "), "suppressed="); len(lines) != want {
+				t.Fatalf("logged %d lines, want %d: %q", len(lines), want, buf.String())
+			}
+			// Every expected fragment appears in order across the lines
+			rest := buf.String()
+			for _, fragment := range tt.want {
+				index := strings.Index(rest, fragment)
+				if index < 0 {
+					t.Fatalf("log = %q, want %q next", buf.String(), fragment)
+				}
+				rest = rest[index+len(fragment):]
+			}
+		})
+	}
+}
+
+func TestScrapePodMetrics_ErrorLoggingAfterRecovery(t *testing.T) {
+	var buf bytes.Buffer
+	ctx := logging.NewContext(context.Background(), bufferLogger(&buf))
+	details := k8s.PodScrapeDetails{Port: "8080", Path: "/metrics", PodName: "pod1", Namespace: "default"}
+	unavailable := statusResponse(http.StatusServiceUnavailable, "busy")
+	handler := handlers.NewMetricsHandler(&sequenceHTTPClient{
+		responses: []func() (*http.Response, error){
+			unavailable, unavailable, statusResponse(http.StatusOK, "metric_a 1"), unavailable,
+		},
+	})
+	handler.ErrorLogInterval = time.Hour
+
+	for range 4 {
+		handler.ScrapePodMetrics(ctx, "10.0.0.1", details)
+	}
+
+	// The second error is left out, but the pod recovered before the third one
+	if got := strings.Count(buf.String(), `msg="Error scraping pod"`); got != 2 {
+		t.Errorf("logged %d errors, want 2: %q", got, buf.String())
+	}
+	if got := strings.Count(buf.String(), "suppressed=0"); got != 2 {
+		t.Errorf("log = %q, want no error reported as suppressed", buf.String())
+	}
+}
+
+func TestScrapePodMetrics_DebugLogging(t *testing.T) {
+	var buf bytes.Buffer
+	ctx := logging.NewContext(context.Background(), bufferLogger(&buf))
+	details := k8s.PodScrapeDetails{Port: "8080", Path: "/metrics", PodName: "pod1", Namespace: "default"}
+	handler := handlers.NewMetricsHandler(&sequenceHTTPClient{
+		responses: []func() (*http.Response, error){statusResponse(http.StatusOK, "metric_a 1\nmetric_b 2\n")},
+	})
+
+	handler.ScrapePodMetrics(ctx, "10.0.0.1", details)
+	if !strings.Contains(buf.String(), `level=DEBUG msg="Scraped pod" pod=pod1 namespace=default`) ||
+		!strings.Contains(buf.String(), "samples=2") {
+		t.Errorf("log = %q, want the successful scrape at debug level", buf.String())
+	}
+}
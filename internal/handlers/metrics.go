@@ -1,17 +1,28 @@
 package handlers
 
 import (
+	"cmp"
 	"context"
 	"fmt"
-	"io"
-	"log"
+	"maps"
 	"net"
 	"net/http"
+	"slices"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/canonical/metrics-k8s-proxy/internal/aggregate"
 	"github.com/canonical/metrics-k8s-proxy/internal/k8s"
+	"github.com/canonical/metrics-k8s-proxy/internal/logging"
+	"github.com/canonical/metrics-k8s-proxy/internal/relabel"
+	"github.com/canonical/metrics-k8s-proxy/internal/selfmetrics"
+	"github.com/canonical/metrics-k8s-proxy/internal/timestamps"
+	"github.com/canonical/metrics-k8s-proxy/internal/tracing"
 	"github.com/canonical/metrics-k8s-proxy/internal/util"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"k8s.io/apimachinery/pkg/util/wait"
 )
 
 // HTTPClient defines the interface for the HTTP client.
@@ -24,9 +35,45 @@ type RealHTTPClient struct {
 	*http.Client
 }
 
+// Outcomes of timestamped samples, as counted by TimestampedSamples.
+const (
+	TimestampsKept     = "kept"
+	TimestampsStripped = "stripped"
+	TimestampsRejected = "rejected"
+)
+
 // MetricsHandler holds the HTTP client.
 type MetricsHandler struct {
 	client HTTPClient
+
+	// RelabelRules are applied to every scraped sample after the pod labels are added.
+	RelabelRules []relabel.Rule
+	// Timestamps is applied to the samples scraped with an explicit timestamp, after relabeling.
+	Timestamps timestamps.Policy
+	// TimestampedSamples, if set, counts the timestamped samples by outcome: kept, stripped or rejected.
+	TimestampedSamples func(outcome string) *selfmetrics.Counter
+	// AggregationRules sum series across pods once every pod has been scraped. Pods keep their own up series.
+	AggregationRules []aggregate.Rule
+	// Retry spaces out the attempts of a scrape failing with a transient error. Its Steps is the maximum
+	// number of attempts; zero or one disables retries.
+	Retry wait.Backoff
+	// CircuitBreaker stops scraping pods that keep failing.
+	CircuitBreaker CircuitBreaker
+	// Limits apply to every pod. Pods may tighten them through annotations.
+	Limits k8s.ScrapeLimits
+	// AnalyzeCardinality counts the series of every scrape by metric name and label name, for CardinalityReport.
+	AnalyzeCardinality bool
+	// Cache, if set, shares fan-outs between concurrent scrapes.
+	Cache *FanOutCache
+	// Background, if set, answers scrapes from its latest snapshot instead of fanning out.
+	Background *BackgroundScraper
+	// ErrorLogInterval is how often the errors of a pod failing every scrape are logged. Zero logs every error.
+	ErrorLogInterval time.Duration
+
+	targets  targetResults
+	circuits circuits
+	errorLog errorLog
+	counters aggregate.Counters
 }
 
 // NewMetricsHandler creates a new MetricsHandler with the given HTTP client.
@@ -35,66 +82,248 @@ func NewMetricsHandler(client HTTPClient) *MetricsHandler {
 }
 
 // ScrapePodMetrics scrapes metrics from a given pod and returns the combined metrics with the "up" metric.
-// In case of errors, it logs them and returns the 'up=0' metric.
+// In case of errors, it logs them with the logger of ctx and returns the 'up=0' metric. If ctx carries a span,
+// the scrape is traced as its child.
 func (h *MetricsHandler) ScrapePodMetrics(ctx context.Context, podIP string,
 	metricsEndpoint k8s.PodScrapeDetails) string {
-	hostPort := net.JoinHostPort(podIP, metricsEndpoint.Port)
-	url := fmt.Sprintf("http://%s%s", hostPort, metricsEndpoint.Path)
+	ctx, span := startScrapeSpan(ctx, podIP, metricsEndpoint)
+	defer span.End()
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	labeledMetrics, attempts, err := h.scrapePod(ctx, podIP, metricsEndpoint)
+	if err != nil {
+		span.SetAttributes(attribute.String("error.type", errorClass(err)))
+		span.SetStatus(codes.Error, err.Error())
+		return h.appendAttempts(downMetric(metricsEndpoint, err), metricsEndpoint, attempts)
+	}
+
+	// Append 'up=1' for successful scrape
+	up := util.AppendUpMetric(labeledMetrics, metricsEndpoint.PodName, metricsEndpoint.Namespace, 1)
+
+	return h.appendAttempts(up, metricsEndpoint, attempts)
+}
+
+// scrapePod fetches the pod's metrics and returns them labeled and relabeled, without the 'up' metric, along
+// with the number of attempts it took. Pods going past their sample or series limit fail as a whole, and pods
+// whose circuit is open fail without being requested. The outcome of the scrapes sent is recorded as the pod's
+// latest scrape result and logged; pods with an open circuit are only logged when it opens.
+func (h *MetricsHandler) scrapePod(ctx context.Context, podIP string,
+	metricsEndpoint k8s.PodScrapeDetails) (string, int, error) {
+	if !h.circuits.allow(podIP, metricsEndpoint, h.CircuitBreaker) {
+		return "", 0, circuitOpenError(scrapeURL(podIP, metricsEndpoint))
+	}
+
+	start := time.Now()
+	body, attempts, err := h.fetchWithRetries(ctx, podIP, metricsEndpoint)
+	result := TargetResult{Time: start, Duration: time.Since(start), Bytes: len(body), Attempts: attempts, Err: err}
+	if err != nil {
+		h.record(ctx, podIP, metricsEndpoint, result)
+		return "", attempts, err
+	}
+
+	labeledMetrics := util.AppendLabels(string(body), metricsEndpoint.PodName, metricsEndpoint.Namespace)
+	relabeled := util.SortFamilies(h.applyTimestamps(relabel.Apply(labeledMetrics, h.RelabelRules)))
+	result.Samples = countSamples(relabeled)
+	if h.AnalyzeCardinality {
+		result.cardinality = countCardinality(relabeled)
+	}
+	result.Err = checkSampleLimits(relabeled, result.Samples, metricsEndpoint.Limits.Within(h.Limits))
+	h.record(ctx, podIP, metricsEndpoint, result)
+	if result.Err != nil {
+		return "", attempts, result.Err
+	}
+
+	return relabeled, attempts, nil
+}
+
+// applyTimestamps enforces the timestamp policy on relabeled metrics and counts the timestamped samples.
+func (h *MetricsHandler) applyTimestamps(metrics string) string {
+	applied, counts := timestamps.Apply(metrics, h.Timestamps, time.Now())
+	if h.TimestampedSamples != nil {
+		for outcome, count := range map[string]int{
+			TimestampsKept: counts.Kept, TimestampsStripped: counts.Stripped, TimestampsRejected: counts.Rejected,
+		} {
+			if count > 0 {
+				h.TimestampedSamples(outcome).Add(uint64(count)) //nolint:gosec // count is positive
+			}
+		}
+	}
+
+	return applied
+}
+
+// record keeps the result as the pod's latest scrape, updates its circuit, and logs and traces the outcome.
+func (h *MetricsHandler) record(ctx context.Context, podIP string, metricsEndpoint k8s.PodScrapeDetails,
+	result TargetResult) {
+	h.targets.record(podIP, metricsEndpoint, result)
+	h.logScrape(ctx, podIP, metricsEndpoint, result)
+	traceScrape(ctx, result)
+	if failures := h.circuits.record(podIP, metricsEndpoint, h.CircuitBreaker, result.Err); failures > 0 {
+		logging.FromContext(ctx).WarnContext(ctx, "Circuit open, probing pod after cooldown",
+			"pod", metricsEndpoint.PodName, "namespace", metricsEndpoint.Namespace,
+			"failures", failures, "cooldown", h.CircuitBreaker.Cooldown)
+	}
+}
+
+// fetch returns the raw body of the pod's metrics endpoint, failing if it is larger than the body size limit.
+func (h *MetricsHandler) fetch(ctx context.Context, podIP string,
+	metricsEndpoint k8s.PodScrapeDetails) ([]byte, error) {
+	url := scrapeURL(podIP, metricsEndpoint)
+	req, err := newScrapeRequest(ctx, url, metricsEndpoint)
 	if err != nil {
-		// Log the error and return the 'up=0' metric
-		log.Printf("Error creating request for %s: %v", url, err)
-		return util.AppendUpMetric("", metricsEndpoint.PodName, metricsEndpoint.Namespace, 0)
+		return nil, err
 	}
 
 	resp, err := h.client.Do(req)
 	if err != nil {
-		// Log the error and return the 'up=0' metric
-		log.Printf("Error scraping %s: %v", url, err)
-		return util.AppendUpMetric("", metricsEndpoint.PodName, metricsEndpoint.Namespace, 0)
+		return nil, &scrapeError{class: ErrorClassConnection, err: fmt.Errorf("request to %s failed: %w", url, err)}
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		// Log the error and return the 'up=0' metric for non-200 responses
-		log.Printf("Failed to scrape %s, status code: %d", url, resp.StatusCode)
-		return util.AppendUpMetric("", metricsEndpoint.PodName, metricsEndpoint.Namespace, 0)
+		return nil, &scrapeError{
+			class:  ErrorClassHTTPStatus,
+			status: resp.StatusCode,
+			err:    fmt.Errorf("%s returned status code %d", url, resp.StatusCode),
+		}
 	}
 
-	body, err := io.ReadAll(resp.Body)
+	// Limits apply to the decompressed body, so only an uncompressed one can be rejected from its length
+	limit := metricsEndpoint.Limits.Within(h.Limits).BodySize
+	if limit > 0 && resp.Header.Get("Content-Encoding") == "" && resp.ContentLength > limit {
+		return nil, bodySizeError(url, limit)
+	}
+	decoded, err := decodedBody(resp)
+	if err != nil {
+		return nil, &scrapeError{class: ErrorClassRead, err: fmt.Errorf("reading response from %s: %w", url, err)}
+	}
+	defer decoded.Close()
+	body, err := readBody(decoded, limit)
 	if err != nil {
-		// Log the error and return the 'up=0' metric for body read errors
-		log.Printf("Error reading response from %s: %v", url, err)
-		return util.AppendUpMetric("", metricsEndpoint.PodName, metricsEndpoint.Namespace, 0)
+		return nil, &scrapeError{class: ErrorClassRead, err: fmt.Errorf("reading response from %s: %w", url, err)}
+	}
+	if limit > 0 && int64(len(body)) > limit {
+		return nil, bodySizeError(url, limit)
 	}
 
-	// Append 'up=1' for successful scrape
-	labeledMetrics := util.AppendLabels(string(body), metricsEndpoint.PodName, metricsEndpoint.Namespace)
-	return util.AppendUpMetric(labeledMetrics, metricsEndpoint.PodName, metricsEndpoint.Namespace, 1)
+	return body, nil
+}
+
+// newScrapeRequest builds the request scraping the pod at url, accepting a compressed response unless the
+// headers set through annotations say otherwise. The request carries the trace context of ctx, if any.
+func newScrapeRequest(ctx context.Context, url string, metricsEndpoint k8s.PodScrapeDetails) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, &scrapeError{class: ErrorClassRequest, err: fmt.Errorf("creating request for %s: %w", url, err)}
+	}
+	req.Header.Set("Accept-Encoding", acceptEncoding)
+	tracing.Inject(ctx, req.Header)
+	for name, values := range metricsEndpoint.Headers {
+		req.Header[name] = values
+	}
+
+	return req, nil
+}
+
+// scrapeURL builds the pod's metrics URL, including any query params set through annotations.
+func scrapeURL(podIP string, metricsEndpoint k8s.PodScrapeDetails) string {
+	hostPort := net.JoinHostPort(podIP, metricsEndpoint.Port)
+	url := fmt.Sprintf("http://%s%s", hostPort, metricsEndpoint.Path)
+	if len(metricsEndpoint.Params) == 0 {
+		return url
+	}
+
+	separator := "?"
+	if strings.Contains(metricsEndpoint.Path, "?") {
+		separator = "&"
+	}
+
+	return url + separator + metricsEndpoint.Params.Encode()
 }
 
 // AggregateMetrics collects metrics from all pods concurrently and returns aggregated results.
+// When the handler has a Cache, the fan-out may be shared with other scrapes. When it scrapes in the
+// Background, the latest snapshot is returned right away. Series are then summed by the AggregationRules.
 func (h *MetricsHandler) AggregateMetrics(ctx context.Context, pw *k8s.PodScrapeWatcher) []string {
-	var wg sync.WaitGroup
-	var respMu sync.Mutex
-	responses := []string{}
+	return aggregate.Apply(ctx, h.collect(ctx, pw), h.AggregationRules, &h.counters)
+}
+
+// collect returns the metrics of every pod of the watcher, one response per pod.
+func (h *MetricsHandler) collect(ctx context.Context, pw *k8s.PodScrapeWatcher) []string {
+	if h.Background != nil {
+		return h.Background.Snapshot()
+	}
+	if h.Cache == nil {
+		return h.fanOut(ctx, pw)
+	}
 
+	responses, err := h.Cache.Do(ctx, func(fanOutCtx context.Context) []string {
+		return h.fanOut(fanOutCtx, pw)
+	})
+	if err != nil {
+		// The scrape ran out of time before the fan-out it joined finished, as if every pod had timed out
+		logging.FromContext(ctx).WarnContext(ctx, "Scrape timed out", "error", err)
+		return downAll(pw.GetPodMetricsEndpoints(), err)
+	}
+
+	return responses
+}
+
+// AggregateFiltered is AggregateMetrics for the pods selected by filter. Its Match selectors are not applied.
+// Fan-outs over a subset of the pods are not shared through the Cache, and their sums don't carry the
+// counters of pods that reset or left. A single pod is returned as scraped, without the AggregationRules.
+func (h *MetricsHandler) AggregateFiltered(ctx context.Context, pw *k8s.PodScrapeWatcher,
+	filter ScrapeFilter) []string {
+	if !filter.selectsPods() {
+		return h.AggregateMetrics(ctx, pw)
+	}
+
+	endpoints := filter.selectEndpoints(pw.GetPodMetricsEndpoints())
+	var responses []string
+	if h.Background != nil {
+		responses = h.Background.snapshot(endpoints)
+	} else {
+		responses = h.scrapeAll(ctx, endpoints)
+	}
+	if filter.PodName != "" {
+		return responses
+	}
+
+	return aggregate.Apply(ctx, responses, h.AggregationRules, nil)
+}
+
+// fanOut scrapes all pods of the watcher concurrently.
+func (h *MetricsHandler) fanOut(ctx context.Context, pw *k8s.PodScrapeWatcher) []string {
 	// Get a copy of the PodMetricsEndpoints
 	podMetricsEndpoints := pw.GetPodMetricsEndpoints()
-	for podIP, metrics := range podMetricsEndpoints {
+	responses := h.scrapeAll(ctx, podMetricsEndpoints)
+	h.prune(podMetricsEndpoints)
+
+	return responses
+}
+
+// prune forgets the results, circuits and logged errors of pods that are no longer among endpoints.
+func (h *MetricsHandler) prune(endpoints map[string]k8s.PodScrapeDetails) {
+	h.targets.prune(endpoints)
+	h.circuits.prune(endpoints)
+	h.errorLog.prune(endpoints)
+}
+
+// scrapeAll scrapes the given pods concurrently, and returns their responses ordered by namespace and pod name.
+func (h *MetricsHandler) scrapeAll(ctx context.Context, podMetricsEndpoints map[string]k8s.PodScrapeDetails) []string {
+	var wg sync.WaitGroup
+	podIPs := sortedPodIPs(podMetricsEndpoints)
+	// Each goroutine writes its own slot, so no lock is needed
+	responses := make([]string, len(podIPs))
+
+	for i, podIP := range podIPs {
 		wg.Add(1)
 
-		go func(podIP string, metrics k8s.PodScrapeDetails) {
+		go func(i int, podIP string, metrics k8s.PodScrapeDetails) {
 			defer wg.Done()
 
-			metricsResult := h.ScrapePodMetrics(ctx, podIP, metrics)
-
 			// Always add the result, even if the context is done
-			respMu.Lock()
-			responses = append(responses, metricsResult)
-			respMu.Unlock()
-		}(podIP, metrics)
+			responses[i] = h.ScrapePodMetrics(ctx, podIP, metrics)
+		}(i, podIP, podMetricsEndpoints[podIP])
 	}
 
 	// Wait for all goroutines to complete.
@@ -103,11 +332,42 @@ func (h *MetricsHandler) AggregateMetrics(ctx context.Context, pw *k8s.PodScrape
 	return responses
 }
 
+// downAll returns an up=0 response for every pod, in the order of scrapeAll.
+func downAll(podMetricsEndpoints map[string]k8s.PodScrapeDetails, err error) []string {
+	podIPs := sortedPodIPs(podMetricsEndpoints)
+	responses := make([]string, len(podIPs))
+	for i, podIP := range podIPs {
+		responses[i] = downMetric(podMetricsEndpoints[podIP], err)
+	}
+
+	return responses
+}
+
+// sortedPodIPs returns the IPs of the pods ordered by namespace, then pod name, so that responses are
+// rendered in the same order on every scrape.
+func sortedPodIPs(endpoints map[string]k8s.PodScrapeDetails) []string {
+	podIPs := slices.Collect(maps.Keys(endpoints))
+	slices.SortFunc(podIPs, func(a, b string) int {
+		return cmp.Or(
+			cmp.Compare(endpoints[a].Namespace, endpoints[b].Namespace),
+			cmp.Compare(endpoints[a].PodName, endpoints[b].PodName),
+			cmp.Compare(a, b),
+		)
+	})
+
+	return podIPs
+}
+
 // ProxyMetrics aggregates metrics from all pods, appends pod metadata and 'up' metric, and returns them as text.
 func (h *MetricsHandler) ProxyMetrics(w http.ResponseWriter, r *http.Request, pw *k8s.PodScrapeWatcher) {
 	ctx := r.Context()
 	responses := h.AggregateMetrics(ctx, pw)
 
+	writeMetrics(w, responses)
+}
+
+// writeMetrics writes the aggregated responses as a text exposition body.
+func writeMetrics(w http.ResponseWriter, responses []string) {
 	w.Header().Set("Content-Type", "text/plain")
 
 	// If there are responses, write them to the response body.
@@ -7,6 +7,7 @@ import (
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"reflect"
 	"sort"
 	"strings"
@@ -15,6 +16,8 @@ import (
 
 	"github.com/canonical/metrics-k8s-proxy/internal/handlers"
 	"github.com/canonical/metrics-k8s-proxy/internal/k8s"
+	"github.com/canonical/metrics-k8s-proxy/internal/selfmetrics"
+	"github.com/canonical/metrics-k8s-proxy/internal/timestamps"
 )
 
 // Mock HTTP Client.
@@ -484,3 +487,157 @@ func compareSortedStrings(a, b string) bool {
 
 	return sortedA == sortedB
 }
+
+// recordingHTTPClient records the last request and answers every request with the same body.
+type recordingHTTPClient struct {
+	lastRequest *http.Request
+	body        string
+}
+
+func (c *recordingHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	c.lastRequest = req
+	<-time.After(10 * time.Millisecond)
+	if err := req.Context().Err(); err != nil {
+		return nil, err
+	}
+
+	return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(c.body))}, nil
+}
+
+func Test_scrapePodMetrics_Overrides(t *testing.T) {
+	client := &recordingHTTPClient{body: "metric1 1"}
+	h := handlers.NewMetricsHandler(client)
+
+	got := h.ScrapePodMetrics(context.Background(), "127.0.0.1", k8s.PodScrapeDetails{
+		Port:      "8080",
+		Path:      "/stats?kind=all",
+		PodName:   "test-pod",
+		Namespace: "test-namespace",
+		Params:    url.Values{"format": {"prometheus"}},
+		Headers:   http.Header{"X-Tenant": {"team-a"}},
+	})
+
+	if want := "http://127.0.0.1:8080/stats?kind=all&format=prometheus"; client.lastRequest.URL.String() != want {
+		t.Errorf("scrape URL = %v, want %v", client.lastRequest.URL, want)
+	}
+	if tenant := client.lastRequest.Header.Get("X-Tenant"); tenant != "team-a" {
+		t.Errorf("X-Tenant header = %q, want team-a", tenant)
+	}
+	if !strings.Contains(got, "up{k8s_pod_name=\"test-pod\",k8s_namespace=\"test-namespace\"} 1") {
+		t.Errorf("expected a successful scrape, got %q", got)
+	}
+}
+
+func Test_scrapePodMetrics_PodTimeout(t *testing.T) {
+	client := &recordingHTTPClient{body: "metric1 1"}
+	h := handlers.NewMetricsHandler(client)
+
+	got := h.ScrapePodMetrics(context.Background(), "127.0.0.1", k8s.PodScrapeDetails{
+		Port:      "8080",
+		Path:      "/metrics",
+		PodName:   "test-pod",
+		Namespace: "test-namespace",
+		Timeout:   time.Millisecond,
+	})
+
+	if want := "\nup{k8s_pod_name=\"test-pod\",k8s_namespace=\"test-namespace\"} 0\n"; got != want {
+		t.Errorf("scrapePodMetrics() = %q, want %q", got, want)
+	}
+}
+
+func TestAggregateMetrics_Order(t *testing.T) {
+	// Pods answer with their families in different orders, and after delays that change their completion order
+	delayed := func(delay time.Duration, body string) func() (*http.Response, error) {
+		return func() (*http.Response, error) {
+			time.Sleep(delay)
+			return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(body))}, nil
+		}
+	}
+	client := routedHTTPClient{
+		"http://10.0.0.1:8080/metrics": delayed(3*time.Millisecond, "metric_b 1\nmetric_a 2"),
+		"http://10.0.0.2:8080/metrics": delayed(2*time.Millisecond, "metric_a 3\nmetric_b 4"),
+		"http://10.0.0.3:8080/metrics": delayed(time.Millisecond, "metric_a 5"),
+	}
+	watcher := k8s.NewPodScrapeWatcher()
+	watcher.PodMetricsEndpoints = map[string]k8s.PodScrapeDetails{
+		"10.0.0.1": {Port: "8080", Path: "/metrics", PodName: "pod2", Namespace: "default"},
+		"10.0.0.2": {Port: "8080", Path: "/metrics", PodName: "pod1", Namespace: "other"},
+		"10.0.0.3": {Port: "8080", Path: "/metrics", PodName: "pod1", Namespace: "default"},
+	}
+	handler := handlers.NewMetricsHandler(client)
+
+	want := []string{
+		"metric_a{k8s_pod_name=\"pod1\",k8s_namespace=\"default\"} 5\n" +
+			"up{k8s_pod_name=\"pod1\",k8s_namespace=\"default\"} 1\n",
+		"metric_a{k8s_pod_name=\"pod2\",k8s_namespace=\"default\"} 2\n" +
+			"metric_b{k8s_pod_name=\"pod2\",k8s_namespace=\"default\"} 1\n" +
+			"up{k8s_pod_name=\"pod2\",k8s_namespace=\"default\"} 1\n",
+		"metric_a{k8s_pod_name=\"pod1\",k8s_namespace=\"other\"} 3\n" +
+			"metric_b{k8s_pod_name=\"pod1\",k8s_namespace=\"other\"} 4\n" +
+			"up{k8s_pod_name=\"pod1\",k8s_namespace=\"other\"} 1\n",
+	}
+	for range 3 {
+		if got := handler.AggregateMetrics(context.Background(), watcher); !reflect.DeepEqual(got, want) {
+			t.Fatalf("AggregateMetrics() = %q, want %q", got, want)
+		}
+	}
+}
+
+func TestScrapePodMetrics_Timestamps(t *testing.T) {
+	client := routedHTTPClient{
+		"http://10.0.0.1:8080/metrics": func() (*http.Response, error) {
+			body := "metric_a 1 1700000000000\nmetric_b{code=\"200\"} 2 1000\nmetric_c 3"
+			return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(body))}, nil
+		},
+	}
+	details := k8s.PodScrapeDetails{Port: "8080", Path: "/metrics", PodName: "pod1", Namespace: "default"}
+	registry := selfmetrics.NewRegistry()
+	samples := registry.NewCounterVec("timestamped_samples_total", "Timestamped samples.", "outcome")
+
+	tests := []struct {
+		name       string
+		policy     timestamps.Policy
+		want       string
+		wantCounts map[string]uint64
+	}{
+		{
+			name:   "Strip",
+			policy: timestamps.Policy{Action: timestamps.Strip},
+			want: "metric_a{k8s_pod_name=\"pod1\",k8s_namespace=\"default\"} 1\n" +
+				"metric_b{k8s_pod_name=\"pod1\",k8s_namespace=\"default\",code=\"200\"} 2\n" +
+				"metric_c{k8s_pod_name=\"pod1\",k8s_namespace=\"default\"} 3\n" +
+				"up{k8s_pod_name=\"pod1\",k8s_namespace=\"default\"} 1\n",
+			wantCounts: map[string]uint64{handlers.TimestampsStripped: 2},
+		},
+		{
+			name: "Reject Old",
+			// Old enough to reject metric_b, from 1970, but not metric_a, from 2023
+			policy: timestamps.Policy{Action: timestamps.RejectOld, MaxAge: 30 * 365 * 24 * time.Hour},
+			want: "metric_a{k8s_pod_name=\"pod1\",k8s_namespace=\"default\"} 1 1700000000000\n" +
+				"metric_c{k8s_pod_name=\"pod1\",k8s_namespace=\"default\"} 3\n" +
+				"up{k8s_pod_name=\"pod1\",k8s_namespace=\"default\"} 1\n",
+			wantCounts: map[string]uint64{
+				handlers.TimestampsStripped: 2, handlers.TimestampsKept: 1, handlers.TimestampsRejected: 1,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := handlers.NewMetricsHandler(client)
+			handler.Timestamps = tt.policy
+			handler.TimestampedSamples = func(outcome string) *selfmetrics.Counter {
+				return samples.WithLabelValues(outcome)
+			}
+
+			if got := handler.ScrapePodMetrics(context.Background(), "10.0.0.1", details); got != tt.want {
+				t.Errorf("ScrapePodMetrics() = %q, want %q", got, tt.want)
+			}
+			for outcome, want := range tt.wantCounts {
+				if count := samples.WithLabelValues(outcome).Value(); count != want {
+					t.Errorf("%s samples = %d, want %d", outcome, count, want)
+				}
+			}
+		})
+	}
+}
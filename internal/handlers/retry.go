@@ -0,0 +1,71 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"syscall"
+	"time"
+
+	"github.com/canonical/metrics-k8s-proxy/internal/k8s"
+	"github.com/canonical/metrics-k8s-proxy/internal/util"
+)
+
+// fetchWithRetries fetches the pod's metrics, retrying transient failures with backoff as long as the scrape's
+// deadline leaves room for the delay. It returns the number of attempts made along with the outcome of the last.
+func (h *MetricsHandler) fetchWithRetries(ctx context.Context, podIP string,
+	metricsEndpoint k8s.PodScrapeDetails) ([]byte, int, error) {
+	// A per-pod timeout can only shorten the scrape, never extend it past the overall deadline.
+	if metricsEndpoint.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, metricsEndpoint.Timeout)
+		defer cancel()
+	}
+
+	backoff := h.Retry
+	for attempts := 1; ; attempts++ {
+		body, err := h.fetch(ctx, podIP, metricsEndpoint)
+		if err == nil || !transient(err) || backoff.Steps <= 1 || ctx.Err() != nil {
+			return body, attempts, err
+		}
+
+		delay := backoff.Step()
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) <= delay {
+			return body, attempts, err
+		}
+		select {
+		case <-ctx.Done():
+			return body, attempts, err
+		case <-time.After(delay):
+		}
+	}
+}
+
+// transient reports whether a failed scrape may succeed if tried again right away: the pod refused or reset
+// the connection, closed it before the end of the response's body, or answered 502 Bad Gateway or 503
+// Service Unavailable. Scrapes are GET requests, so repeating them is safe. Timeouts aren't retried, as they
+// have used up the scrape's time.
+func transient(err error) bool {
+	switch errorClass(err) {
+	case ErrorClassConnection:
+		return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET)
+	case ErrorClassRead:
+		return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF)
+	case ErrorClassHTTPStatus:
+		var scrapeErr *scrapeError
+		return errors.As(err, &scrapeErr) &&
+			(scrapeErr.status == http.StatusBadGateway || scrapeErr.status == http.StatusServiceUnavailable)
+	default:
+		return false
+	}
+}
+
+// appendAttempts adds the scrape_attempts series of the pod after its up series, when retries are enabled.
+func (h *MetricsHandler) appendAttempts(metrics string, details k8s.PodScrapeDetails, attempts int) string {
+	if h.Retry.Steps <= 1 || attempts == 0 {
+		return metrics
+	}
+
+	return util.AppendAttemptsMetric(metrics, details.PodName, details.Namespace, attempts)
+}
@@ -0,0 +1,188 @@
+package handlers_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/canonical/metrics-k8s-proxy/internal/handlers"
+	"github.com/canonical/metrics-k8s-proxy/internal/k8s"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// sequenceHTTPClient answers the successive requests with its responses in turn, repeating the last one.
+type sequenceHTTPClient struct {
+	responses []func() (*http.Response, error)
+	calls     int
+}
+
+func (c *sequenceHTTPClient) Do(_ *http.Request) (*http.Response, error) {
+	respond := c.responses[min(c.calls, len(c.responses)-1)]
+	c.calls++
+
+	return respond()
+}
+
+func statusResponse(status int, body string) func() (*http.Response, error) {
+	return func() (*http.Response, error) {
+		return &http.Response{StatusCode: status, Body: io.NopCloser(strings.NewReader(body))}, nil
+	}
+}
+
+func connError(errno syscall.Errno) func() (*http.Response, error) {
+	return func() (*http.Response, error) {
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: errno}
+	}
+}
+
+// truncatedResponse answers with a body that fails with err after its first bytes.
+func truncatedResponse(err error) func() (*http.Response, error) {
+	return func() (*http.Response, error) {
+		body := io.MultiReader(strings.NewReader("metric_a"), iotest.ErrReader(err))
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(body)}, nil
+	}
+}
+
+func TestScrapePodMetrics_Retry(t *testing.T) {
+	details := k8s.PodScrapeDetails{Port: "8080", Path: "/metrics", PodName: "pod1", Namespace: "default"}
+	up := "metric_a{k8s_pod_name=\"pod1\",k8s_namespace=\"default\"} 1\n" +
+		"up{k8s_pod_name=\"pod1\",k8s_namespace=\"default\"} 1\n"
+	down := "\nup{k8s_pod_name=\"pod1\",k8s_namespace=\"default\"} 0\n"
+	attempts := func(n string) string {
+		return "scrape_attempts{k8s_pod_name=\"pod1\",k8s_namespace=\"default\"} " + n + "\n"
+	}
+
+	tests := []struct {
+		name         string
+		maxAttempts  int
+		responses    []func() (*http.Response, error)
+		want         string
+		wantAttempts int
+	}{
+		{
+			name:        "Connection Refused",
+			maxAttempts: 3,
+			responses: []func() (*http.Response, error){
+				connError(syscall.ECONNREFUSED), statusResponse(http.StatusOK, "metric_a 1"),
+			},
+			want:         up + attempts("2"),
+			wantAttempts: 2,
+		},
+		{
+			name:        "Connection Reset And Unavailable",
+			maxAttempts: 3,
+			responses: []func() (*http.Response, error){
+				connError(syscall.ECONNRESET),
+				statusResponse(http.StatusServiceUnavailable, ""),
+				statusResponse(http.StatusOK, "metric_a 1"),
+			},
+			want:         up + attempts("3"),
+			wantAttempts: 3,
+		},
+		{
+			name:        "Connection Reset While Reading",
+			maxAttempts: 3,
+			responses: []func() (*http.Response, error){
+				truncatedResponse(&net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}),
+				truncatedResponse(io.ErrUnexpectedEOF),
+				statusResponse(http.StatusOK, "metric_a 1"),
+			},
+			want:         up + attempts("3"),
+			wantAttempts: 3,
+		},
+		{
+			name:         "Not Transient Read Error",
+			maxAttempts:  3,
+			responses:    []func() (*http.Response, error){truncatedResponse(errors.New("invalid chunk length"))},
+			want:         down + attempts("1"),
+			wantAttempts: 1,
+		},
+		{
+			name:         "Attempts Exhausted",
+			maxAttempts:  3,
+			responses:    []func() (*http.Response, error){statusResponse(http.StatusBadGateway, "")},
+			want:         down + attempts("3"),
+			wantAttempts: 3,
+		},
+		{
+			name:         "Not Transient Status",
+			maxAttempts:  3,
+			responses:    []func() (*http.Response, error){statusResponse(http.StatusInternalServerError, "")},
+			want:         down + attempts("1"),
+			wantAttempts: 1,
+		},
+		{
+			name:        "Not Transient Error",
+			maxAttempts: 3,
+			responses: []func() (*http.Response, error){func() (*http.Response, error) {
+				return nil, errors.New("no such host")
+			}},
+			want:         down + attempts("1"),
+			wantAttempts: 1,
+		},
+		{
+			name:        "Retries Disabled",
+			maxAttempts: 1,
+			responses: []func() (*http.Response, error){
+				connError(syscall.ECONNREFUSED), statusResponse(http.StatusOK, "metric_a 1"),
+			},
+			want:         down,
+			wantAttempts: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &sequenceHTTPClient{responses: tt.responses}
+			handler := handlers.NewMetricsHandler(client)
+			handler.Retry = wait.Backoff{Duration: time.Millisecond, Factor: 2, Steps: tt.maxAttempts}
+
+			if got := handler.ScrapePodMetrics(context.Background(), "10.0.0.1", details); got != tt.want {
+				t.Errorf("ScrapePodMetrics() = %q, want %q", got, tt.want)
+			}
+			if client.calls != tt.wantAttempts {
+				t.Errorf("got %d requests, want %d", client.calls, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestScrapePodMetrics_RetryDeadline(t *testing.T) {
+	details := k8s.PodScrapeDetails{Port: "8080", Path: "/metrics", PodName: "pod1", Namespace: "default"}
+	client := &sequenceHTTPClient{responses: []func() (*http.Response, error){
+		connError(syscall.ECONNREFUSED), statusResponse(http.StatusOK, "metric_a 1"),
+	}}
+	handler := handlers.NewMetricsHandler(client)
+	handler.Retry = wait.Backoff{Duration: time.Minute, Factor: 2, Steps: 3}
+
+	// The backoff is longer than what is left of the scrape, so the pod isn't retried
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	start := time.Now()
+	got := handler.ScrapePodMetrics(ctx, "10.0.0.1", details)
+
+	want := "\nup{k8s_pod_name=\"pod1\",k8s_namespace=\"default\"} 0\n" +
+		"scrape_attempts{k8s_pod_name=\"pod1\",k8s_namespace=\"default\"} 1\n"
+	if got != want {
+		t.Errorf("ScrapePodMetrics() = %q, want %q", got, want)
+	}
+	if client.calls != 1 {
+		t.Errorf("got %d requests, want 1", client.calls)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("scrape took %v, it should have given up right away", elapsed)
+	}
+
+	job := handlers.Job{Name: "default", Watcher: k8s.NewPodScrapeWatcher(), Handler: handler}
+	job.Watcher.PodMetricsEndpoints = map[string]k8s.PodScrapeDetails{"10.0.0.1": details}
+	if targets := getTargets(t, job, ""); len(targets) != 1 || targets[0].Attempts != 1 {
+		t.Errorf("targets = %+v, want a single target with 1 attempt", targets)
+	}
+}
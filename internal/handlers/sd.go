@@ -0,0 +1,146 @@
+package handlers
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/canonical/metrics-k8s-proxy/internal/k8s"
+	"github.com/canonical/metrics-k8s-proxy/internal/logging"
+)
+
+// TargetGroup is a group of targets sharing labels, in the JSON format of Prometheus' http_sd_config and
+// file_sd_config.
+type TargetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+// TargetGroups returns one target group per pod of every job, so that Prometheus can scrape the pods directly.
+// Pods keep the labels the proxy would give their series, and their scrape path, query params and timeout
+// become the corresponding reserved labels. Headers set through annotations can't be expressed and are lost.
+// When more than one job is given, every group is labeled with the JobLabel of its job, as AggregateJobs does.
+func TargetGroups(jobs []Job) []TargetGroup {
+	groups := []TargetGroup{}
+	for _, job := range jobs {
+		for podIP, details := range job.Watcher.GetPodMetricsEndpoints() {
+			group := targetGroup(podIP, details)
+			if len(jobs) > 1 {
+				group.Labels[JobLabel] = job.Name
+			}
+			groups = append(groups, group)
+		}
+	}
+	slices.SortFunc(groups, func(a, b TargetGroup) int {
+		return cmp.Or(
+			cmp.Compare(a.Labels[JobLabel], b.Labels[JobLabel]),
+			cmp.Compare(a.Labels["k8s_namespace"], b.Labels["k8s_namespace"]),
+			cmp.Compare(a.Labels["k8s_pod_name"], b.Labels["k8s_pod_name"]),
+			cmp.Compare(a.Targets[0], b.Targets[0]),
+		)
+	})
+
+	return groups
+}
+
+func targetGroup(podIP string, details k8s.PodScrapeDetails) TargetGroup {
+	labels := map[string]string{
+		"__scheme__":       "http",
+		"__metrics_path__": details.Path,
+		"k8s_pod_name":     details.PodName,
+		"k8s_namespace":    details.Namespace,
+	}
+	for name, values := range details.Params {
+		if len(values) > 0 {
+			labels["__param_"+name] = values[0]
+		}
+	}
+	if details.Timeout > 0 {
+		labels["__scrape_timeout__"] = strconv.FormatInt(details.Timeout.Milliseconds(), 10) + "ms"
+	}
+
+	return TargetGroup{Targets: []string{net.JoinHostPort(podIP, details.Port)}, Labels: labels}
+}
+
+// ServiceDiscoveryHandler serves the target groups of every job for Prometheus' http_sd_config.
+func ServiceDiscoveryHandler(jobs []Job) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(TargetGroups(jobs)); err != nil {
+			logging.FromContext(r.Context()).ErrorContext(r.Context(), "Error writing target groups", "error", err)
+		}
+	})
+}
+
+// SDFileWriter keeps a file_sd_config file up to date with the target groups of its jobs.
+type SDFileWriter struct {
+	Path string
+	Jobs []Job
+}
+
+// Run writes the target groups to Path right away, then again whenever they change, until ctx is cancelled.
+// Changes are picked up every targetSyncInterval. The file is replaced atomically, so that Prometheus never
+// reads it half-written.
+func (s *SDFileWriter) Run(ctx context.Context) {
+	ticker := time.NewTicker(targetSyncInterval)
+	defer ticker.Stop()
+
+	var written []byte
+	for {
+		content, err := json.MarshalIndent(TargetGroups(s.Jobs), "", "  ")
+		if err != nil {
+			logging.FromContext(ctx).ErrorContext(ctx, "Error encoding target groups", "error", err)
+		} else if !bytes.Equal(content, written) {
+			if writeErr := writeFileAtomic(s.Path, content); writeErr != nil {
+				logging.FromContext(ctx).ErrorContext(ctx, "Error writing service discovery file",
+					"path", s.Path, "error", writeErr)
+			} else {
+				written = content
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sdFileMode lets Prometheus read the file when it runs as another user.
+const sdFileMode = 0o644
+
+// writeFileAtomic writes content to a temporary file next to path, then renames it over path.
+func writeFileAtomic(path string, content []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("creating temporary file for %s: %w", path, err)
+	}
+	defer os.Remove(tmp.Name()) // Only succeeds if the rename didn't happen
+
+	if _, err = tmp.Write(content); err != nil {
+		tmp.Close()
+		return fmt.Errorf("writing %s: %w", tmp.Name(), err)
+	}
+	if err = tmp.Chmod(sdFileMode); err != nil {
+		tmp.Close()
+		return fmt.Errorf("setting the mode of %s: %w", tmp.Name(), err)
+	}
+	if err = tmp.Close(); err != nil {
+		return fmt.Errorf("writing %s: %w", tmp.Name(), err)
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("replacing %s: %w", path, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,156 @@
+package handlers_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/canonical/metrics-k8s-proxy/internal/handlers"
+	"github.com/canonical/metrics-k8s-proxy/internal/k8s"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func sdJob(name string, endpoints map[string]k8s.PodScrapeDetails) handlers.Job {
+	watcher := k8s.NewPodScrapeWatcher()
+	watcher.PodMetricsEndpoints = endpoints
+
+	return handlers.Job{Name: name, Watcher: watcher, Handler: handlers.NewMetricsHandler(nil)}
+}
+
+func TestTargetGroups(t *testing.T) {
+	pod1 := k8s.PodScrapeDetails{
+		Port: "8080", Path: "/metrics", PodName: "pod1", Namespace: "default",
+		Timeout: 2500 * time.Millisecond, Params: url.Values{"module": {"http_2xx"}},
+	}
+	pod2 := k8s.PodScrapeDetails{Port: "9090", Path: "/stats", PodName: "pod2", Namespace: "default"}
+
+	tests := []struct {
+		name string
+		jobs []handlers.Job
+		want []handlers.TargetGroup
+	}{
+		{
+			name: "Single Job",
+			jobs: []handlers.Job{sdJob("default", map[string]k8s.PodScrapeDetails{"10.0.0.2": pod2, "10.0.0.1": pod1})},
+			want: []handlers.TargetGroup{
+				{Targets: []string{"10.0.0.1:8080"}, Labels: map[string]string{
+					"__scheme__": "http", "__metrics_path__": "/metrics", "__param_module": "http_2xx",
+					"__scrape_timeout__": "2500ms", "k8s_pod_name": "pod1", "k8s_namespace": "default",
+				}},
+				{Targets: []string{"10.0.0.2:9090"}, Labels: map[string]string{
+					"__scheme__": "http", "__metrics_path__": "/stats", "k8s_pod_name": "pod2", "k8s_namespace": "default",
+				}},
+			},
+		},
+		{
+			name: "Several Jobs",
+			jobs: []handlers.Job{
+				sdJob("stats", map[string]k8s.PodScrapeDetails{"10.0.0.2": pod2}),
+				sdJob("apps", map[string]k8s.PodScrapeDetails{"fd00::2": pod2}),
+			},
+			want: []handlers.TargetGroup{
+				{Targets: []string{"[fd00::2]:9090"}, Labels: map[string]string{
+					"__scheme__": "http", "__metrics_path__": "/stats", "k8s_pod_name": "pod2", "k8s_namespace": "default",
+					"job": "apps",
+				}},
+				{Targets: []string{"10.0.0.2:9090"}, Labels: map[string]string{
+					"__scheme__": "http", "__metrics_path__": "/stats", "k8s_pod_name": "pod2", "k8s_namespace": "default",
+					"job": "stats",
+				}},
+			},
+		},
+		{name: "No Pods", jobs: []handlers.Job{sdJob("default", nil)}, want: []handlers.TargetGroup{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, "/sd", nil)
+			if err != nil {
+				t.Fatalf("Failed to create request: %v", err)
+			}
+			rr := httptest.NewRecorder()
+			handlers.ServiceDiscoveryHandler(tt.jobs).ServeHTTP(rr, req)
+
+			var got []handlers.TargetGroup
+			if err = json.NewDecoder(rr.Body).Decode(&got); err != nil {
+				t.Fatalf("Failed to decode target groups: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("target groups = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// readGroups polls the file until it holds the given number of target groups.
+func readGroups(t *testing.T, path string, want int) []handlers.TargetGroup {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	var groups []handlers.TargetGroup
+	for time.Now().Before(deadline) {
+		if content, err := os.ReadFile(path); err == nil {
+			if err = json.Unmarshal(content, &groups); err != nil {
+				t.Fatalf("%s holds invalid JSON: %v", path, err)
+			}
+			if len(groups) == want {
+				return groups
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%s never held %d target groups, last read %+v", path, want, groups)
+
+	return nil
+}
+
+func TestSDFileWriter(t *testing.T) {
+	job := sdJob("default", map[string]k8s.PodScrapeDetails{
+		"10.0.0.1": {Port: "8080", Path: "/metrics", PodName: "pod1", Namespace: "default"},
+	})
+	path := filepath.Join(t.TempDir(), "targets.json")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		(&handlers.SDFileWriter{Path: path, Jobs: []handlers.Job{job}}).Run(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	readGroups(t, path, 1)
+
+	job.Watcher.UpdatePodMetrics(&corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "pod2", Namespace: "default",
+			Annotations: map[string]string{k8s.ScrapeAnnotation: "true", k8s.PortAnnotation: "8080"},
+		},
+		Status: corev1.PodStatus{PodIP: "10.0.0.2"},
+	})
+	groups := readGroups(t, path, 2)
+	if groups[1].Targets[0] != "10.0.0.2:8080" {
+		t.Errorf("second group = %+v, want pod2", groups[1])
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Failed to stat %s: %v", path, err)
+	}
+	if info.Mode().Perm() != 0o644 {
+		t.Errorf("%s has mode %v, want 0644", path, info.Mode().Perm())
+	}
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil || len(entries) != 1 {
+		t.Errorf("temporary files were left behind: %v", entries)
+	}
+}
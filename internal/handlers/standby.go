@@ -0,0 +1,33 @@
+package handlers
+
+import (
+	"net/http"
+)
+
+// StandbyResponse is how a standby replica answers scrapes while another replica is the leader.
+type StandbyResponse string
+
+const (
+	// StandbyEmpty answers with an empty body, so that the standby is scraped successfully but adds no series.
+	StandbyEmpty StandbyResponse = "empty"
+	// StandbyUnavailable answers with 503, so that the standby's scrape target shows as down.
+	StandbyUnavailable StandbyResponse = "unavailable"
+)
+
+// LeaderOnly serves scrapes with next while isLeader reports true, and answers them as response says otherwise.
+func LeaderOnly(isLeader func() bool, response StandbyResponse, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isLeader() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		switch response {
+		case StandbyUnavailable:
+			w.Header().Set("Content-Type", "text/plain")
+			writeResponse(w, "standby replica, not the leader\n", http.StatusServiceUnavailable)
+		case StandbyEmpty:
+			writeMetrics(w, nil)
+		}
+	})
+}
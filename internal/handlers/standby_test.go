@@ -0,0 +1,50 @@
+package handlers_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/canonical/metrics-k8s-proxy/internal/handlers"
+)
+
+func TestLeaderOnly(t *testing.T) {
+	tests := []struct {
+		name       string
+		leader     bool
+		response   handlers.StandbyResponse
+		wantStatus int
+		wantBody   string
+	}{
+		{name: "Leader", leader: true, response: handlers.StandbyUnavailable, wantStatus: http.StatusOK,
+			wantBody: "up 1\n"},
+		{name: "Standby Empty", leader: false, response: handlers.StandbyEmpty, wantStatus: http.StatusOK,
+			wantBody: ""},
+		{name: "Standby Unavailable", leader: false, response: handlers.StandbyUnavailable,
+			wantStatus: http.StatusServiceUnavailable, wantBody: "standby replica, not the leader\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				_, _ = w.Write([]byte("up 1\n"))
+			})
+			handler := handlers.LeaderOnly(func() bool { return tt.leader }, tt.response, next)
+
+			req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, "/metrics", nil)
+			if err != nil {
+				t.Fatalf("Failed to create request: %v", err)
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			if rr.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rr.Code, tt.wantStatus)
+			}
+			if rr.Body.String() != tt.wantBody {
+				t.Errorf("body = %q, want %q", rr.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
@@ -0,0 +1,269 @@
+package handlers
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/canonical/metrics-k8s-proxy/internal/k8s"
+	"github.com/canonical/metrics-k8s-proxy/internal/logging"
+)
+
+// Classes of scrape errors, as reported on /targets.
+const (
+	ErrorClassRequest     = "request"        // The scrape request could not be built, e.g. from an invalid path
+	ErrorClassConnection  = "connection"     // The pod could not be reached
+	ErrorClassTimeout     = "timeout"        // The scrape ran out of time
+	ErrorClassHTTPStatus  = "http_status"    // The pod answered with a status other than 200
+	ErrorClassRead        = "read"           // The response body could not be read
+	ErrorClassLimit       = "limit_exceeded" // The pod went past its body size, sample or series limit
+	ErrorClassCircuitOpen = "circuit_open"   // The pod wasn't scraped, as its circuit breaker is open
+	ErrorClassUnknown     = "unknown"
+)
+
+// TargetHealth is the outcome of a target's latest scrape.
+type TargetHealth string
+
+const (
+	HealthUp      TargetHealth = "up"
+	HealthDown    TargetHealth = "down"
+	HealthUnknown TargetHealth = "unknown" // Not scraped yet
+)
+
+// scrapeError is a failed scrape, along with the class it is reported under.
+type scrapeError struct {
+	class string
+	// status is the pod's HTTP status, for the http_status class.
+	status int
+	err    error
+}
+
+func (e *scrapeError) Error() string {
+	return e.err.Error()
+}
+
+func (e *scrapeError) Unwrap() error {
+	return e.err
+}
+
+// errorClass classifies a scrape error. Timeouts take precedence, as they may surface at any step.
+func errorClass(err error) string {
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return ErrorClassTimeout
+	}
+	var scrapeErr *scrapeError
+	if errors.As(err, &scrapeErr) {
+		return scrapeErr.class
+	}
+
+	return ErrorClassUnknown
+}
+
+// TargetResult is the outcome of a single scrape of a pod.
+type TargetResult struct {
+	Time     time.Time
+	Duration time.Duration
+	// Samples is the number of samples served after relabeling, Bytes the size of the pod's response.
+	Samples int
+	Bytes   int
+	// Attempts is how many times the pod was requested, more than once if transient failures were retried.
+	Attempts int
+	Err      error
+
+	// cardinality is only counted by handlers that AnalyzeCardinality.
+	cardinality *seriesCounts
+}
+
+// countSamples counts the sample lines of an exposition body.
+func countSamples(metrics string) int {
+	samples := 0
+	for line := range strings.SplitSeq(metrics, "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			samples++
+		}
+	}
+
+	return samples
+}
+
+// targetResults keeps the latest scrape result of every pod, by pod IP.
+type targetResults struct {
+	mu      sync.Mutex
+	results map[string]targetResult
+}
+
+type targetResult struct {
+	details k8s.PodScrapeDetails
+	result  TargetResult
+}
+
+func (t *targetResults) record(podIP string, details k8s.PodScrapeDetails, result TargetResult) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.results == nil {
+		t.results = map[string]targetResult{}
+	}
+	t.results[podIP] = targetResult{details: details, result: result}
+}
+
+// lookup returns the latest result of the pod, unless it belongs to a previous pod with the same IP.
+func (t *targetResults) lookup(podIP string, details k8s.PodScrapeDetails) (TargetResult, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	latest, exists := t.results[podIP]
+	if !exists || !reflect.DeepEqual(latest.details, details) {
+		return TargetResult{}, false
+	}
+
+	return latest.result, true
+}
+
+// prune forgets the results of pods that are no longer among endpoints.
+func (t *targetResults) prune(endpoints map[string]k8s.PodScrapeDetails) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for podIP := range t.results {
+		if _, exists := endpoints[podIP]; !exists {
+			delete(t.results, podIP)
+		}
+	}
+}
+
+// Target is the status of a pod scraped by a job, as served on /targets.
+type Target struct {
+	Job    string            `json:"job"`
+	URL    string            `json:"url"`
+	Labels map[string]string `json:"labels"`
+	Health TargetHealth      `json:"health"`
+	// LastScrape and the fields after it are only set once the pod has been scraped.
+	LastScrape         *time.Time `json:"lastScrape,omitempty"`
+	LastScrapeDuration float64    `json:"lastScrapeDurationSeconds"`
+	Samples            int        `json:"samples"`
+	Bytes              int        `json:"bytes"`
+	Attempts           int        `json:"attempts"`
+	LastError          string     `json:"lastError,omitempty"`
+	ErrorClass         string     `json:"errorClass,omitempty"`
+	// Circuit is the state of the pod's circuit breaker, if the handler has one. LastError is then that of the
+	// latest scrape actually sent.
+	Circuit CircuitState `json:"circuit,omitempty"`
+}
+
+// Targets returns the status of every pod the watcher currently knows, as scraped by the named job.
+func (h *MetricsHandler) Targets(job string, pw *k8s.PodScrapeWatcher) []Target {
+	endpoints := pw.GetPodMetricsEndpoints()
+	targets := make([]Target, 0, len(endpoints))
+	for podIP, details := range endpoints {
+		target := Target{
+			Job: job,
+			URL: scrapeURL(podIP, details),
+			Labels: map[string]string{
+				"k8s_pod_name":  details.PodName,
+				"k8s_namespace": details.Namespace,
+			},
+			Health:  HealthUnknown,
+			Circuit: h.circuits.state(podIP, details, h.CircuitBreaker),
+		}
+		if result, scraped := h.targets.lookup(podIP, details); scraped {
+			target.LastScrape = &result.Time
+			target.LastScrapeDuration = result.Duration.Seconds()
+			target.Samples = result.Samples
+			target.Bytes = result.Bytes
+			target.Attempts = result.Attempts
+			target.Health = HealthUp
+			if result.Err != nil {
+				target.Health = HealthDown
+				target.LastError = result.Err.Error()
+				target.ErrorClass = errorClass(result.Err)
+			}
+		}
+		targets = append(targets, target)
+	}
+
+	return targets
+}
+
+// targetsPage renders the targets as an HTML table.
+const targetsPage = `<!DOCTYPE html>
+<html>
+<head><title>Targets - metrics-k8s-proxy</title></head>
+<body>
+<h1>Targets</h1>
+<table border="1" cellpadding="4">
+<tr><th>Job</th><th>Endpoint</th><th>Labels</th><th>Health</th><th>Last scrape</th><th>Duration</th>` +
+	`<th>Samples</th><th>Bytes</th><th>Error</th></tr>
+{{range .}}<tr>
+<td>{{.Job}}</td>
+<td><a href="{{.URL}}">{{.URL}}</a></td>
+<td>{{range $name, $value := .Labels}}{{$name}}="{{$value}}" {{end}}</td>
+<td>{{.Health}}{{with .Circuit}} (circuit {{.}}){{end}}</td>
+<td>{{with .LastScrape}}{{.Format "2006-01-02T15:04:05Z07:00"}}{{end}}</td>
+<td>{{if .LastScrape}}{{printf "%.3fs" .LastScrapeDuration}}{{end}}</td>
+<td>{{.Samples}}</td>
+<td>{{.Bytes}}</td>
+<td>{{with .ErrorClass}}[{{.}}] {{end}}{{.LastError}}</td>
+</tr>
+{{end}}</table>
+</body>
+</html>
+`
+
+// TargetsHandler serves the status of the pods of every job, as JSON if the request asks for it with
+// ?format=json or its Accept header, and as an HTML page otherwise. Targets can be filtered with the
+// namespace and health query parameters.
+func TargetsHandler(jobs []Job) http.Handler {
+	page := template.Must(template.New("targets").Parse(targetsPage))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		namespace := r.URL.Query().Get("namespace")
+		health := TargetHealth(r.URL.Query().Get("health"))
+		switch health {
+		case "", HealthUp, HealthDown, HealthUnknown:
+		default:
+			http.Error(w, fmt.Sprintf("invalid health %q, must be one of %q, %q or %q",
+				health, HealthUp, HealthDown, HealthUnknown), http.StatusBadRequest)
+			return
+		}
+
+		targets := []Target{}
+		for _, job := range jobs {
+			for _, target := range job.Handler.Targets(job.Name, job.Watcher) {
+				if (namespace == "" || target.Labels["k8s_namespace"] == namespace) &&
+					(health == "" || target.Health == health) {
+					targets = append(targets, target)
+				}
+			}
+		}
+		slices.SortFunc(targets, func(a, b Target) int {
+			return cmp.Or(
+				cmp.Compare(a.Job, b.Job),
+				cmp.Compare(a.Labels["k8s_namespace"], b.Labels["k8s_namespace"]),
+				cmp.Compare(a.Labels["k8s_pod_name"], b.Labels["k8s_pod_name"]),
+				cmp.Compare(a.URL, b.URL),
+			)
+		})
+
+		if r.URL.Query().Get("format") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json") {
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(map[string][]Target{"targets": targets}); err != nil {
+				logging.FromContext(r.Context()).ErrorContext(r.Context(), "Error writing targets", "error", err)
+			}
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := page.Execute(w, targets); err != nil {
+			logging.FromContext(r.Context()).ErrorContext(r.Context(), "Error writing targets", "error", err)
+		}
+	})
+}
@@ -0,0 +1,183 @@
+package handlers_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/canonical/metrics-k8s-proxy/internal/handlers"
+	"github.com/canonical/metrics-k8s-proxy/internal/k8s"
+)
+
+// routedHTTPClient answers every request with the response built for its URL.
+type routedHTTPClient map[string]func() (*http.Response, error)
+
+func (c routedHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	if respond, exists := c[req.URL.String()]; exists {
+		return respond()
+	}
+
+	return nil, errors.New("no route for " + req.URL.String())
+}
+
+// scrapedJob returns a job whose pods have been scraped once, except for pod5, discovered afterwards.
+func scrapedJob(t *testing.T) handlers.Job {
+	t.Helper()
+	client := routedHTTPClient{
+		"http://10.0.0.1:8080/metrics": func() (*http.Response, error) {
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       io.NopCloser(strings.NewReader("# TYPE metric_a gauge\nmetric_a 1\nmetric_b{code=\"200\"} 2\n")),
+			}, nil
+		},
+		"http://10.0.0.2:8080/metrics": func() (*http.Response, error) {
+			return &http.Response{StatusCode: http.StatusInternalServerError, Body: io.NopCloser(strings.NewReader(""))}, nil
+		},
+		"http://10.0.0.3:8080/metrics": func() (*http.Response, error) {
+			return nil, errors.New("connection refused")
+		},
+		"http://10.0.0.4:8080/metrics": func() (*http.Response, error) {
+			return nil, context.DeadlineExceeded
+		},
+	}
+
+	watcher := k8s.NewPodScrapeWatcher()
+	watcher.PodMetricsEndpoints = map[string]k8s.PodScrapeDetails{
+		"10.0.0.1": {Port: "8080", Path: "/metrics", PodName: "pod1", Namespace: "default"},
+		"10.0.0.2": {Port: "8080", Path: "/metrics", PodName: "pod2", Namespace: "default"},
+		"10.0.0.3": {Port: "8080", Path: "/metrics", PodName: "pod3", Namespace: "other"},
+		"10.0.0.4": {Port: "8080", Path: "/metrics", PodName: "pod4", Namespace: "other"},
+	}
+	handler := handlers.NewMetricsHandler(client)
+	handler.AggregateMetrics(context.Background(), watcher)
+
+	watcher.PodMetricsEndpoints["10.0.0.5"] = k8s.PodScrapeDetails{
+		Port: "8080", Path: "/metrics", PodName: "pod5", Namespace: "default",
+	}
+
+	return handlers.Job{Name: "default", Watcher: watcher, Handler: handler}
+}
+
+func getTargets(t *testing.T, job handlers.Job, query string) []handlers.Target {
+	t.Helper()
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, "/targets?format=json&"+query, nil)
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	rr := httptest.NewRecorder()
+	handlers.TargetsHandler([]handlers.Job{job}).ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %q", rr.Code, rr.Body.String())
+	}
+
+	var body struct {
+		Targets []handlers.Target `json:"targets"`
+	}
+	if err = json.NewDecoder(rr.Body).Decode(&body); err != nil {
+		t.Fatalf("Failed to decode targets: %v", err)
+	}
+
+	return body.Targets
+}
+
+func TestTargetsHandler_JSON(t *testing.T) {
+	targets := getTargets(t, scrapedJob(t), "")
+
+	want := []struct {
+		pod        string
+		health     handlers.TargetHealth
+		errorClass string
+		samples    int
+	}{
+		{"pod1", handlers.HealthUp, "", 2},
+		{"pod2", handlers.HealthDown, handlers.ErrorClassHTTPStatus, 0},
+		{"pod5", handlers.HealthUnknown, "", 0},
+		{"pod3", handlers.HealthDown, handlers.ErrorClassConnection, 0},
+		{"pod4", handlers.HealthDown, handlers.ErrorClassTimeout, 0},
+	}
+	if len(targets) != len(want) {
+		t.Fatalf("got %d targets, want %d: %+v", len(targets), len(want), targets)
+	}
+	for i, w := range want {
+		got := targets[i]
+		if got.Labels["k8s_pod_name"] != w.pod || got.Health != w.health || got.ErrorClass != w.errorClass ||
+			got.Samples != w.samples {
+			t.Errorf("target %d = %+v, want pod %s, health %s, error class %q and %d samples",
+				i, got, w.pod, w.health, w.errorClass, w.samples)
+		}
+	}
+
+	pod1 := targets[0]
+	if pod1.URL != "http://10.0.0.1:8080/metrics" || pod1.Job != "default" || pod1.LastScrape == nil ||
+		pod1.Bytes != 56 || pod1.LastError != "" {
+		t.Errorf("pod1 = %+v", pod1)
+	}
+	if targets[2].LastScrape != nil {
+		t.Errorf("pod5 was never scraped, but has a last scrape time")
+	}
+	if !strings.Contains(targets[1].LastError, "returned status code 500") {
+		t.Errorf("pod2 error = %q", targets[1].LastError)
+	}
+}
+
+func TestTargetsHandler_Filters(t *testing.T) {
+	job := scrapedJob(t)
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"namespace=other", []string{"pod3", "pod4"}},
+		{"health=up", []string{"pod1"}},
+		{"health=down&namespace=default", []string{"pod2"}},
+		{"health=unknown", []string{"pod5"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			targets := getTargets(t, job, tt.query)
+			got := []string{}
+			for _, target := range targets {
+				got = append(got, target.Labels["k8s_pod_name"])
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("got targets %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTargetsHandler_HTML(t *testing.T) {
+	job := scrapedJob(t)
+	tests := []struct {
+		name       string
+		query      string
+		wantStatus int
+		wantBody   string
+	}{
+		{name: "Page", query: "", wantStatus: http.StatusOK, wantBody: "[http_status] http://10.0.0.2:8080/metrics"},
+		{name: "Invalid Health", query: "?health=sick", wantStatus: http.StatusBadRequest, wantBody: "invalid health"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, "/targets"+tt.query, nil)
+			if err != nil {
+				t.Fatalf("Failed to create request: %v", err)
+			}
+			rr := httptest.NewRecorder()
+			handlers.TargetsHandler([]handlers.Job{job}).ServeHTTP(rr, req)
+
+			if rr.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rr.Code, tt.wantStatus)
+			}
+			if !strings.Contains(rr.Body.String(), tt.wantBody) {
+				t.Errorf("body = %q, want it to contain %q", rr.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
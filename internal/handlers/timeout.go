@@ -0,0 +1,34 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ScrapeTimeoutHeader is the header in which Prometheus sends the scrape_timeout of the requesting job.
+const ScrapeTimeoutHeader = "X-Prometheus-Scrape-Timeout-Seconds"
+
+// FanOutTimeout returns how long a fan-out serving r may take.
+// When the scraper announces its own scrape timeout, the fan-out finishes offset earlier so that partial
+// results still reach it in time. The result never exceeds limit, which also applies when the header is
+// missing or invalid.
+func FanOutTimeout(r *http.Request, limit, offset time.Duration) time.Duration {
+	header := r.Header.Get(ScrapeTimeoutHeader)
+	if header == "" {
+		return limit
+	}
+
+	seconds, err := strconv.ParseFloat(header, 64)
+	if err != nil || seconds <= 0 {
+		return limit
+	}
+	requested := time.Duration(seconds * float64(time.Second))
+
+	// Keep the scraper's timeout as is if it is too short to subtract the offset from.
+	if requested > offset {
+		requested -= offset
+	}
+
+	return min(requested, limit)
+}
@@ -0,0 +1,48 @@
+package handlers_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/canonical/metrics-k8s-proxy/internal/handlers"
+)
+
+func TestFanOutTimeout(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		limit  time.Duration
+		offset time.Duration
+		want   time.Duration
+	}{
+		{name: "No Header", header: "", limit: 9 * time.Second, offset: time.Second, want: 9 * time.Second},
+		{name: "Shorter Scraper Timeout", header: "5", limit: 9 * time.Second, offset: 500 * time.Millisecond,
+			want: 4500 * time.Millisecond},
+		{name: "Fractional Seconds", header: "2.5", limit: 9 * time.Second, offset: 500 * time.Millisecond,
+			want: 2 * time.Second},
+		{name: "Longer Scraper Timeout Is Capped", header: "30", limit: 9 * time.Second, offset: time.Second,
+			want: 9 * time.Second},
+		{name: "Timeout Shorter Than Offset", header: "0.2", limit: 9 * time.Second, offset: time.Second,
+			want: 200 * time.Millisecond},
+		{name: "Invalid Header", header: "soon", limit: 9 * time.Second, offset: time.Second, want: 9 * time.Second},
+		{name: "Negative Header", header: "-1", limit: 9 * time.Second, offset: time.Second, want: 9 * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, "/metrics", nil)
+			if err != nil {
+				t.Fatalf("Failed to create request: %v", err)
+			}
+			if tt.header != "" {
+				req.Header.Set(handlers.ScrapeTimeoutHeader, tt.header)
+			}
+
+			if got := handlers.FanOutTimeout(req, tt.limit, tt.offset); got != tt.want {
+				t.Errorf("FanOutTimeout() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/canonical/metrics-k8s-proxy/internal/k8s"
+	"github.com/canonical/metrics-k8s-proxy/internal/logging"
+	"github.com/canonical/metrics-k8s-proxy/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// scrapeSpanName names the span of every pod scrape, whatever the pod, so that spans can be compared by name.
+const scrapeSpanName = "scrape pod"
+
+// Trace wraps next in a server span named after the request's method and route, continuing the trace of its
+// traceparent header if it has one. The span records the response's status code, and the logger of the
+// request's context gets the trace ID. A nil tracer traces nothing.
+func Trace(tracer trace.Tracer, route string, next http.Handler) http.Handler {
+	if tracer == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, span := tracer.Start(tracing.Extract(r.Context(), r.Header), r.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", r.Method),
+				attribute.String("http.route", route),
+				attribute.String("url.path", r.URL.Path),
+			))
+		defer span.End()
+		traceID := span.SpanContext().TraceID().String()
+		ctx = logging.NewContext(ctx, logging.FromContext(ctx).With(logging.TraceIDAttr, traceID))
+
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+		span.SetAttributes(attribute.Int("http.response.status_code", recorder.status))
+		if recorder.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(recorder.status))
+		}
+	})
+}
+
+// statusRecorder remembers the status code written through it.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// startScrapeSpan starts the span of a pod scrape, as a child of the span carried by ctx if any.
+func startScrapeSpan(ctx context.Context, podIP string,
+	metricsEndpoint k8s.PodScrapeDetails) (context.Context, trace.Span) {
+	return tracing.StartSpan(ctx, scrapeSpanName,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("k8s.pod.name", metricsEndpoint.PodName),
+			attribute.String("k8s.namespace.name", metricsEndpoint.Namespace),
+			attribute.String("url.full", scrapeURL(podIP, metricsEndpoint)),
+		))
+}
+
+// traceScrape adds the outcome of a scrape to the span carried by ctx, if it records one.
+func traceScrape(ctx context.Context, result TargetResult) {
+	span := trace.SpanFromContext(ctx)
+	if !span.IsRecording() {
+		return
+	}
+	span.SetAttributes(
+		attribute.Int("scrape.attempts", result.Attempts),
+		attribute.Int("http.response.body.size", result.Bytes),
+		attribute.Int("scrape.samples", result.Samples),
+	)
+
+	var scrapeErr *scrapeError
+	switch {
+	case result.Err == nil:
+		span.SetAttributes(attribute.Int("http.response.status_code", http.StatusOK))
+	case errors.As(result.Err, &scrapeErr) && scrapeErr.class == ErrorClassHTTPStatus:
+		span.SetAttributes(attribute.Int("http.response.status_code", scrapeErr.status))
+	}
+}
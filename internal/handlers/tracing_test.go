@@ -0,0 +1,142 @@
+package handlers_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/canonical/metrics-k8s-proxy/internal/handlers"
+	"github.com/canonical/metrics-k8s-proxy/internal/k8s"
+	"github.com/canonical/metrics-k8s-proxy/internal/tracing"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// traceparentHTTPClient records the traceparent header sent to every URL and answers with the URL's status.
+type traceparentHTTPClient struct {
+	mu       sync.Mutex
+	headers  map[string]string
+	statuses map[string]int
+}
+
+func (c *traceparentHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.headers[req.URL.String()] = req.Header.Get(tracing.TraceparentHeader)
+
+	return &http.Response{
+		StatusCode: c.statuses[req.URL.String()],
+		Body:       io.NopCloser(strings.NewReader("metric_a 1\n")),
+	}, nil
+}
+
+func spanAttribute(span sdktrace.ReadOnlySpan, key string) any {
+	for _, attr := range span.Attributes() {
+		if string(attr.Key) == key {
+			return attr.Value.AsInterface()
+		}
+	}
+
+	return nil
+}
+
+func TestTrace(t *testing.T) {
+	const (
+		remoteTrace = "4bf92f3577b34da6a3ce929d0e0e4736"
+		remoteSpan  = "00f067aa0ba902b7"
+	)
+	client := &traceparentHTTPClient{headers: map[string]string{}, statuses: map[string]int{
+		"http://10.0.0.1:8080/metrics": http.StatusOK,
+		"http://10.0.0.2:8080/metrics": http.StatusServiceUnavailable,
+	}}
+	watcher := k8s.NewPodScrapeWatcher()
+	watcher.PodMetricsEndpoints = map[string]k8s.PodScrapeDetails{
+		"10.0.0.1": {Port: "8080", Path: "/metrics", PodName: "pod1", Namespace: "default"},
+		"10.0.0.2": {Port: "8080", Path: "/metrics", PodName: "pod2", Namespace: "default"},
+	}
+	handler := handlers.NewMetricsHandler(client)
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	traced := handlers.Trace(provider.Tracer(tracing.ScopeName), "/metrics",
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handler.ProxyMetrics(w, r, watcher)
+		}))
+
+	req := httptest.NewRequestWithContext(context.Background(), http.MethodGet, "/metrics", nil)
+	req.Header.Set(tracing.TraceparentHeader, "00-"+remoteTrace+"-"+remoteSpan+"-01")
+	traced.ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := recorder.Ended()
+	if len(spans) != 3 {
+		t.Fatalf("recorded %d spans, want a server span and a span per pod", len(spans))
+	}
+	server := spans[2]
+	if server.Name() != "GET /metrics" || server.SpanKind() != trace.SpanKindServer ||
+		server.SpanContext().TraceID().String() != remoteTrace || server.Parent().SpanID().String() != remoteSpan ||
+		spanAttribute(server, "http.response.status_code") != int64(http.StatusOK) {
+		t.Errorf("server span = %+v, want a child of the remote span answering 200", server)
+	}
+
+	tests := []struct {
+		pod       string
+		url       string
+		status    int64
+		wantError bool
+	}{
+		{pod: "pod1", url: "http://10.0.0.1:8080/metrics", status: http.StatusOK},
+		{pod: "pod2", url: "http://10.0.0.2:8080/metrics", status: http.StatusServiceUnavailable, wantError: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pod, func(t *testing.T) {
+			var span sdktrace.ReadOnlySpan
+			for _, s := range spans[:2] {
+				if spanAttribute(s, "k8s.pod.name") == tt.pod {
+					span = s
+				}
+			}
+			if span == nil {
+				t.Fatalf("no span for %s", tt.pod)
+			}
+			if span.SpanKind() != trace.SpanKindClient || span.Parent().SpanID() != server.SpanContext().SpanID() ||
+				span.SpanContext().TraceID() != server.SpanContext().TraceID() {
+				t.Errorf("span = %+v, want a client span under the server span", span)
+			}
+			if spanAttribute(span, "k8s.namespace.name") != "default" || spanAttribute(span, "url.full") != tt.url ||
+				spanAttribute(span, "http.response.status_code") != tt.status ||
+				spanAttribute(span, "scrape.attempts") != int64(1) {
+				t.Errorf("span attributes = %+v", span.Attributes())
+			}
+			if tt.wantError != (span.Status().Code == codes.Error) {
+				t.Errorf("span status = %v, want an error: %v", span.Status(), tt.wantError)
+			}
+			if !tt.wantError && spanAttribute(span, "http.response.body.size") != int64(len("metric_a 1\n")) {
+				t.Errorf("span attributes = %+v, want the size of the body", span.Attributes())
+			}
+
+			// The pod sees the scrape's span as the parent of its own spans
+			want := "00-" + remoteTrace + "-" + span.SpanContext().SpanID().String() + "-01"
+			if got := client.headers[tt.url]; got != want {
+				t.Errorf("traceparent sent to the pod = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestScrapePodMetrics_Untraced(t *testing.T) {
+	client := &traceparentHTTPClient{headers: map[string]string{}, statuses: map[string]int{
+		"http://10.0.0.1:8080/metrics": http.StatusOK,
+	}}
+	handler := handlers.NewMetricsHandler(client)
+
+	handler.ScrapePodMetrics(context.Background(), "10.0.0.1",
+		k8s.PodScrapeDetails{Port: "8080", Path: "/metrics", PodName: "pod1", Namespace: "default"})
+	if got := client.headers["http://10.0.0.1:8080/metrics"]; got != "" {
+		t.Errorf("traceparent sent to the pod = %q, want none outside of a traced request", got)
+	}
+}
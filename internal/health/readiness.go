@@ -0,0 +1,69 @@
+// Package health tracks whether the proxy is ready to serve and reports it on a readiness endpoint.
+package health
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// Readiness is the set of components that still keep the proxy from being ready.
+// The proxy is ready once every component that was reported as not ready has become ready.
+type Readiness struct {
+	mu      sync.Mutex
+	pending map[string]string // component name -> reason it isn't ready
+}
+
+// NewReadiness creates a Readiness with no pending components.
+func NewReadiness() *Readiness {
+	return &Readiness{pending: map[string]string{}}
+}
+
+// NotReady marks the component as not ready for the given reason.
+func (r *Readiness) NotReady(component, reason string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.pending[component] = reason
+}
+
+// Ready marks the component as ready.
+func (r *Readiness) Ready(component string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.pending, component)
+}
+
+// Check reports whether the proxy is ready, along with the reasons it isn't, sorted by component.
+func (r *Readiness) Check() (bool, []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	reasons := make([]string, 0, len(r.pending))
+	for component, reason := range r.pending {
+		reasons = append(reasons, fmt.Sprintf("%s: %s", component, reason))
+	}
+	sort.Strings(reasons)
+
+	return len(reasons) == 0, reasons
+}
+
+// ServeHTTP answers 200 when ready and 503 with the pending reasons otherwise.
+func (r *Readiness) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	ready, reasons := r.Check()
+
+	w.Header().Set("Content-Type", "text/plain")
+	if ready {
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, "ok")
+
+		return
+	}
+
+	w.WriteHeader(http.StatusServiceUnavailable)
+	for _, reason := range reasons {
+		fmt.Fprintln(w, reason)
+	}
+}
@@ -0,0 +1,45 @@
+package health_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/canonical/metrics-k8s-proxy/internal/health"
+)
+
+func serveReadiness(t *testing.T, readiness *health.Readiness) *httptest.ResponseRecorder {
+	t.Helper()
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, "/readyz", nil)
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	readiness.ServeHTTP(rr, req)
+
+	return rr
+}
+
+func TestReadiness(t *testing.T) {
+	readiness := health.NewReadiness()
+	if rr := serveReadiness(t, readiness); rr.Code != http.StatusOK || rr.Body.String() != "ok\n" {
+		t.Errorf("empty readiness should be ready, got %d %q", rr.Code, rr.Body.String())
+	}
+
+	readiness.NotReady("kubernetes", "connecting")
+	readiness.NotReady("informer", "syncing")
+	rr := serveReadiness(t, readiness)
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want %d", rr.Code, http.StatusServiceUnavailable)
+	}
+	if want := "informer: syncing\nkubernetes: connecting\n"; rr.Body.String() != want {
+		t.Errorf("body = %q, want %q", rr.Body.String(), want)
+	}
+
+	readiness.Ready("kubernetes")
+	readiness.Ready("informer")
+	if ready, reasons := readiness.Check(); !ready || len(reasons) != 0 {
+		t.Errorf("Check() = %v, %v, want ready", ready, reasons)
+	}
+}
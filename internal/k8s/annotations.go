@@ -0,0 +1,126 @@
+package k8s
+
+import (
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// Pod annotations read by the watcher.
+const (
+	ScrapeAnnotation = "prometheus.io/scrape"
+	PortAnnotation   = "prometheus.io/port"
+	PathAnnotation   = "prometheus.io/path"
+
+	// ScrapeTimeoutAnnotation sets a per-pod scrape timeout (e.g. "2s"), capped by the job's overall deadline.
+	ScrapeTimeoutAnnotation = "prometheus.io/scrape-timeout"
+	// ParamAnnotationPrefix adds a URL query parameter to the scrape request, as in Prometheus' `params`:
+	// `prometheus.io/param_format: prometheus` scrapes `<path>?format=prometheus`.
+	ParamAnnotationPrefix = "prometheus.io/param_"
+	// HeaderAnnotationPrefix adds a request header to the scrape request:
+	// `prometheus.io/header_X-Tenant: a` sends `X-Tenant: a`.
+	HeaderAnnotationPrefix = "prometheus.io/header_"
+
+	// BodySizeLimitAnnotation caps the size of the pod's response, as a quantity (e.g. "10Mi").
+	BodySizeLimitAnnotation = "prometheus.io/body-size-limit"
+	// SampleLimitAnnotation caps the number of samples the pod may expose after relabeling.
+	SampleLimitAnnotation = "prometheus.io/sample-limit"
+	// SeriesLimitAnnotation caps the number of unique series the pod may expose after relabeling.
+	SeriesLimitAnnotation = "prometheus.io/series-limit"
+)
+
+// ScrapeLimits caps what a single scrape of a pod may return. A zero limit is no limit.
+type ScrapeLimits struct {
+	BodySize int64
+	Samples  int
+	Series   int
+}
+
+// Within returns the limits capped by global ones: a pod may tighten a global limit but not loosen it.
+func (l ScrapeLimits) Within(global ScrapeLimits) ScrapeLimits {
+	return ScrapeLimits{
+		BodySize: tighter(l.BodySize, global.BodySize),
+		Samples:  tighter(l.Samples, global.Samples),
+		Series:   tighter(l.Series, global.Series),
+	}
+}
+
+// tighter returns the lower of two limits, where zero is no limit.
+func tighter[T int | int64](a, b T) T {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+
+	return a
+}
+
+// scrapeOverrides holds the per-pod scrape settings read from annotations.
+type scrapeOverrides struct {
+	timeout time.Duration
+	params  url.Values
+	headers http.Header
+	limits  ScrapeLimits
+}
+
+// parseScrapeOverrides reads the per-pod timeout, limits, query params and headers from the pod annotations.
+// Invalid values are logged and ignored so that a typo doesn't stop the pod from being scraped.
+func parseScrapeOverrides(logger *slog.Logger, annotations map[string]string) scrapeOverrides {
+	var overrides scrapeOverrides
+
+	if value, exists := annotations[ScrapeTimeoutAnnotation]; exists {
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout <= 0 {
+			logger.Warn("Ignoring invalid annotation", "annotation", ScrapeTimeoutAnnotation, "value", value)
+		} else {
+			overrides.timeout = timeout
+		}
+	}
+
+	if value, exists := annotations[BodySizeLimitAnnotation]; exists {
+		quantity, err := resource.ParseQuantity(value)
+		if err != nil || quantity.Sign() <= 0 {
+			logger.Warn("Ignoring invalid annotation", "annotation", BodySizeLimitAnnotation, "value", value)
+		} else {
+			overrides.limits.BodySize = quantity.Value()
+		}
+	}
+	overrides.limits.Samples = parseCountAnnotation(logger, annotations, SampleLimitAnnotation)
+	overrides.limits.Series = parseCountAnnotation(logger, annotations, SeriesLimitAnnotation)
+
+	for key, value := range annotations {
+		switch {
+		case strings.HasPrefix(key, ParamAnnotationPrefix):
+			if overrides.params == nil {
+				overrides.params = url.Values{}
+			}
+			overrides.params.Add(strings.TrimPrefix(key, ParamAnnotationPrefix), value)
+		case strings.HasPrefix(key, HeaderAnnotationPrefix):
+			if overrides.headers == nil {
+				overrides.headers = http.Header{}
+			}
+			overrides.headers.Set(strings.TrimPrefix(key, HeaderAnnotationPrefix), value)
+		}
+	}
+
+	return overrides
+}
+
+// parseCountAnnotation reads a positive count from the named annotation, or returns 0 if it is unset or invalid.
+func parseCountAnnotation(logger *slog.Logger, annotations map[string]string, name string) int {
+	value, exists := annotations[name]
+	if !exists {
+		return 0
+	}
+	count, err := strconv.Atoi(value)
+	if err != nil || count <= 0 {
+		logger.Warn("Ignoring invalid annotation", "annotation", name, "value", value)
+		return 0
+	}
+
+	return count
+}
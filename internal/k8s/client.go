@@ -1,8 +1,11 @@
 package k8s
 
 import (
+	"context"
 	"os"
+	"time"
 
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
@@ -38,3 +41,29 @@ func DefaultBuildConfigFunc() (*rest.Config, error) {
 func DefaultNewClientsetFunc(config *rest.Config) (kubernetes.Interface, error) {
 	return kubernetes.NewForConfig(config)
 }
+
+// ConnectWithBackoff keeps calling GetKubernetesClient until it succeeds or ctx is cancelled,
+// waiting between attempts as dictated by backoff. Each failure is passed to onError.
+func ConnectWithBackoff(
+	ctx context.Context,
+	backoff wait.Backoff,
+	buildConfigFunc func() (*rest.Config, error),
+	newClientsetFunc func(*rest.Config) (kubernetes.Interface, error),
+	onError func(err error, retryIn time.Duration),
+) (kubernetes.Interface, error) {
+	for {
+		_, clientset, err := GetKubernetesClient(buildConfigFunc, newClientsetFunc)
+		if err == nil {
+			return clientset, nil
+		}
+
+		retryIn := backoff.Step()
+		onError(err, retryIn)
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(retryIn):
+		}
+	}
+}
@@ -1,11 +1,14 @@
 package k8s_test
 
 import (
+	"context"
 	"errors"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/canonical/metrics-k8s-proxy/internal/k8s"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/fake"
 	"k8s.io/client-go/rest"
@@ -72,3 +75,41 @@ func TestGetKubernetesClient(t *testing.T) {
 		})
 	}
 }
+
+func TestConnectWithBackoff(t *testing.T) {
+	attempts := 0
+	flakyBuildConfig := func() (*rest.Config, error) {
+		attempts++
+		if attempts < 3 {
+			return nil, errors.New("API server unavailable")
+		}
+
+		return mockBuildConfigSuccess()
+	}
+
+	var retries []time.Duration
+	backoff := wait.Backoff{Duration: time.Millisecond, Factor: 2, Steps: 10}
+	clientset, err := k8s.ConnectWithBackoff(context.Background(), backoff, flakyBuildConfig, mockNewClientsetSuccess,
+		func(_ error, retryIn time.Duration) {
+			retries = append(retries, retryIn)
+		})
+	if err != nil || clientset == nil {
+		t.Fatalf("ConnectWithBackoff() = %v, %v, want a clientset", clientset, err)
+	}
+	if !reflect.DeepEqual(retries, []time.Duration{time.Millisecond, 2 * time.Millisecond}) {
+		t.Errorf("ConnectWithBackoff() retried after %v, want [1ms 2ms]", retries)
+	}
+}
+
+func TestConnectWithBackoff_Cancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	backoff := wait.Backoff{Duration: time.Hour}
+
+	_, err := k8s.ConnectWithBackoff(ctx, backoff, mockBuildConfigFailure, mockNewClientsetSuccess,
+		func(error, time.Duration) {
+			cancel()
+		})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("ConnectWithBackoff() error = %v, want %v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,98 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/canonical/metrics-k8s-proxy/internal/logging"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// Default timings of the leader election, as used by Kubernetes controllers.
+const (
+	DefaultLeaseDuration = 15 * time.Second
+	DefaultRenewDeadline = 10 * time.Second
+	DefaultRetryPeriod   = 2 * time.Second
+)
+
+// LeaderElector elects a single active replica through a Lease, using client-go's leader election.
+// Standby replicas keep running for the lease, so that one of them takes over when the leader goes away.
+type LeaderElector struct {
+	Namespace string
+	Lease     string
+	// Identity names this replica in the lease. It must be unique among the replicas, e.g. the pod name.
+	Identity string
+
+	LeaseDuration time.Duration
+	RenewDeadline time.Duration
+	RetryPeriod   time.Duration
+
+	// OnChange, if set, is called whenever this replica becomes the leader or stops being it.
+	OnChange func(leading bool)
+
+	leading atomic.Bool
+}
+
+// IsLeader reports whether this replica currently holds the lease.
+func (l *LeaderElector) IsLeader() bool {
+	return l.leading.Load()
+}
+
+// Run takes part in the election until ctx is cancelled, running for the lease again whenever it is lost.
+// On shutdown, a held lease is released so that a standby takes over without waiting for it to expire.
+func (l *LeaderElector) Run(ctx context.Context, clientset kubernetes.Interface) error {
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta:  metav1.ObjectMeta{Name: l.Lease, Namespace: l.Namespace},
+		Client:     clientset.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: l.Identity},
+	}
+
+	for ctx.Err() == nil {
+		elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+			Lock:            lock,
+			Name:            l.Lease,
+			LeaseDuration:   l.LeaseDuration,
+			RenewDeadline:   l.RenewDeadline,
+			RetryPeriod:     l.RetryPeriod,
+			ReleaseOnCancel: true,
+			Callbacks: leaderelection.LeaderCallbacks{
+				OnStartedLeading: func(context.Context) { l.setLeading(ctx, true) },
+				OnStoppedLeading: func() { l.setLeading(ctx, false) },
+				OnNewLeader: func(identity string) {
+					if identity != l.Identity {
+						logging.FromContext(ctx).InfoContext(ctx, "Another replica holds the lease, standing by",
+							"leader", identity, "lease", l.Lease, "namespace", l.Namespace)
+					}
+				},
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("configuring leader election: %w", err)
+		}
+
+		// Returns once the lease is lost, or ctx is cancelled
+		elector.Run(ctx)
+	}
+
+	return nil
+}
+
+func (l *LeaderElector) setLeading(ctx context.Context, leading bool) {
+	if !l.leading.CompareAndSwap(!leading, leading) {
+		return
+	}
+	logger := logging.FromContext(ctx).With("lease", l.Lease, "namespace", l.Namespace)
+	if leading {
+		logger.InfoContext(ctx, "Acquired the lease, serving metrics")
+	} else {
+		logger.InfoContext(ctx, "Lost the lease, standing by")
+	}
+	if l.OnChange != nil {
+		l.OnChange(leading)
+	}
+}
@@ -0,0 +1,95 @@
+package k8s_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/canonical/metrics-k8s-proxy/internal/k8s"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// waitForLeader waits until exactly one of the electors leads, and returns its index.
+func waitForLeader(t *testing.T, electors []*k8s.LeaderElector, running []bool) int {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		leaders := []int{}
+		for i, elector := range electors {
+			if running[i] && elector.IsLeader() {
+				leaders = append(leaders, i)
+			}
+		}
+		if len(leaders) == 1 {
+			return leaders[0]
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("timed out waiting for a single leader")
+
+	return -1
+}
+
+func TestLeaderElector_Failover(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+
+	var mu sync.Mutex
+	changes := map[string][]bool{}
+	electors := []*k8s.LeaderElector{}
+	for _, identity := range []string{"metrics-proxy-0", "metrics-proxy-1"} {
+		electors = append(electors, &k8s.LeaderElector{
+			Namespace:     "monitoring",
+			Lease:         "metrics-proxy",
+			Identity:      identity,
+			LeaseDuration: time.Second,
+			RenewDeadline: 500 * time.Millisecond,
+			RetryPeriod:   100 * time.Millisecond,
+			OnChange: func(leading bool) {
+				mu.Lock()
+				defer mu.Unlock()
+				changes[identity] = append(changes[identity], leading)
+			},
+		})
+	}
+
+	cancels := make([]context.CancelFunc, len(electors))
+	done := make([]chan struct{}, len(electors))
+	for i, elector := range electors {
+		ctx, cancel := context.WithCancel(t.Context())
+		cancels[i], done[i] = cancel, make(chan struct{})
+		go func() {
+			defer close(done[i])
+			if err := elector.Run(ctx, clientset); err != nil {
+				t.Errorf("Run() failed: %v", err)
+			}
+		}()
+	}
+	defer func() {
+		for i := range electors {
+			cancels[i]()
+			<-done[i]
+		}
+	}()
+
+	leader := waitForLeader(t, electors, []bool{true, true})
+
+	// The leader releases the lease on shutdown, and the standby takes over
+	cancels[leader]()
+	<-done[leader]
+	if electors[leader].IsLeader() {
+		t.Errorf("replica %d still leads after shutting down", leader)
+	}
+	running := []bool{true, true}
+	running[leader] = false
+	standby := waitForLeader(t, electors, running)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if got := changes[electors[leader].Identity]; len(got) != 2 || !got[0] || got[1] {
+		t.Errorf("leader saw changes %v, want [true false]", got)
+	}
+	if got := changes[electors[standby].Identity]; len(got) != 1 || !got[0] {
+		t.Errorf("standby saw changes %v, want [true]", got)
+	}
+}
@@ -0,0 +1,73 @@
+package k8s
+
+import (
+	"maps"
+	"slices"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// WatchScope is the set of pods seen by one informer, together with every watcher fed from it.
+type WatchScope struct {
+	Namespace string
+	// Labels is the server-side label selector of the informer.
+	Labels   map[string]string
+	Watchers []*PodScrapeWatcher
+
+	// OnSynced, if set, is called once the informer's cache has synced for the first time.
+	OnSynced func()
+	// OnWatchError, if set, is called every time the informer fails to list or watch pods.
+	// The informer retries on its own with backoff.
+	OnWatchError func(err error)
+}
+
+// PlanWatchScopes groups watchers so that jobs with overlapping scopes share one informer cache. A watcher
+// joins a scope in its namespace whose selector already selects all of its pods, that is whose labels are a
+// subset of the watcher's own; each watcher then narrows the shared pod stream down to its own Labels. Jobs
+// with disjoint or only partly overlapping selectors keep an informer each, as a selector covering both would
+// list and cache pods that neither job scrapes.
+func PlanWatchScopes(watchers []*PodScrapeWatcher) []WatchScope {
+	// The widest selectors come first, so that narrower ones can join their scope
+	ordered := slices.Clone(watchers)
+	slices.SortStableFunc(ordered, func(a, b *PodScrapeWatcher) int {
+		return len(a.Labels) - len(b.Labels)
+	})
+
+	scopes := []*WatchScope{}
+	for _, pw := range ordered {
+		index := slices.IndexFunc(scopes, func(scope *WatchScope) bool {
+			return scope.Namespace == pw.Namespace && containsLabels(pw.Labels, scope.Labels)
+		})
+		if index < 0 {
+			scopes = append(scopes, &WatchScope{Namespace: pw.Namespace, Labels: maps.Clone(pw.Labels)})
+			index = len(scopes) - 1
+		}
+		scopes[index].Watchers = append(scopes[index].Watchers, pw)
+	}
+
+	planned := make([]WatchScope, 0, len(scopes))
+	for _, scope := range scopes {
+		planned = append(planned, *scope)
+	}
+	slices.SortStableFunc(planned, func(a, b WatchScope) int {
+		if a.Namespace != b.Namespace {
+			return strings.Compare(a.Namespace, b.Namespace)
+		}
+
+		return strings.Compare(labels.SelectorFromSet(a.Labels).String(), labels.SelectorFromSet(b.Labels).String())
+	})
+
+	return planned
+}
+
+// containsLabels reports whether every key/value pair of subset is also in set.
+func containsLabels(set, subset map[string]string) bool {
+	for key, value := range subset {
+		if other, exists := set[key]; !exists || other != value {
+			return false
+		}
+	}
+
+	return true
+}
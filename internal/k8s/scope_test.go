@@ -0,0 +1,149 @@
+package k8s_test
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/canonical/metrics-k8s-proxy/internal/k8s"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	clienttesting "k8s.io/client-go/testing"
+)
+
+func newWatcher(namespace string, labels map[string]string) *k8s.PodScrapeWatcher {
+	pw := k8s.NewPodScrapeWatcher()
+	pw.Namespace = namespace
+	pw.Labels = labels
+
+	return pw
+}
+
+func TestPlanWatchScopes(t *testing.T) {
+	ztunnel := newWatcher("istio-system", map[string]string{"app": "ztunnel", "mesh": "ambient"})
+	mesh := newWatcher("istio-system", map[string]string{"mesh": "ambient"})
+	waypoint := newWatcher("apps", map[string]string{"role": "waypoint"})
+
+	scopes := k8s.PlanWatchScopes([]*k8s.PodScrapeWatcher{ztunnel, mesh, waypoint})
+	if len(scopes) != 2 {
+		t.Fatalf("PlanWatchScopes() returned %d scopes, want 2", len(scopes))
+	}
+
+	apps, istio := scopes[0], scopes[1]
+	if apps.Namespace != "apps" || !reflect.DeepEqual(apps.Labels, map[string]string{"role": "waypoint"}) {
+		t.Errorf("unexpected apps scope %+v", apps)
+	}
+	if len(apps.Watchers) != 1 || apps.Watchers[0] != waypoint {
+		t.Errorf("apps scope should only feed the waypoint watcher")
+	}
+
+	if istio.Namespace != "istio-system" || !reflect.DeepEqual(istio.Labels, map[string]string{"mesh": "ambient"}) {
+		t.Errorf("istio-system scope should select on the widest selector, got %+v", istio)
+	}
+	if len(istio.Watchers) != 2 {
+		t.Errorf("istio-system scope should feed both watchers, got %d", len(istio.Watchers))
+	}
+}
+
+func TestPlanWatchScopes_Disjoint(t *testing.T) {
+	tests := []struct {
+		name     string
+		watchers []*k8s.PodScrapeWatcher
+	}{
+		{
+			name: "Disjoint Selectors",
+			watchers: []*k8s.PodScrapeWatcher{
+				newWatcher("istio-system", map[string]string{"app": "ztunnel"}),
+				newWatcher("istio-system", map[string]string{"app": "istiod"}),
+			},
+		},
+		{
+			name: "Cluster-Wide",
+			watchers: []*k8s.PodScrapeWatcher{
+				newWatcher("", map[string]string{"app": "ztunnel"}),
+				newWatcher("", map[string]string{"app": "istiod"}),
+			},
+		},
+		{
+			// Pods may match both selectors, but the labels they have in common select every pod
+			name: "Partly Overlapping Selectors",
+			watchers: []*k8s.PodScrapeWatcher{
+				newWatcher("istio-system", map[string]string{"app": "ztunnel"}),
+				newWatcher("istio-system", map[string]string{"mesh": "ambient"}),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scopes := k8s.PlanWatchScopes(tt.watchers)
+			if len(scopes) != len(tt.watchers) {
+				t.Fatalf("PlanWatchScopes() returned %d scopes, want one per watcher", len(scopes))
+			}
+			for _, scope := range scopes {
+				if len(scope.Watchers) != 1 || !reflect.DeepEqual(scope.Labels, scope.Watchers[0].Labels) {
+					t.Errorf("scope %+v should select on its only watcher's labels", scope)
+				}
+			}
+		})
+	}
+}
+
+func TestUpdatePodMetrics_SharedScopeFiltering(t *testing.T) {
+	pw := newWatcher("istio-system", map[string]string{"app": "ztunnel"})
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "ztunnel-1",
+			Namespace:   "istio-system",
+			Labels:      map[string]string{"app": "ztunnel"},
+			Annotations: map[string]string{"prometheus.io/scrape": "true"},
+		},
+		Status: corev1.PodStatus{PodIP: "10.0.0.1"},
+	}
+
+	captureLogOutput(pw, func() { pw.UpdatePodMetrics(pod) })
+	if _, exists := pw.GetPodMetricsEndpoints()["10.0.0.1"]; !exists {
+		t.Fatalf("expected matching pod to be added")
+	}
+
+	// A pod relabeled out of the job's selector must be dropped.
+	pod.Labels = map[string]string{"app": "istiod"}
+	captureLogOutput(pw, func() { pw.UpdatePodMetrics(pod) })
+	if _, exists := pw.GetPodMetricsEndpoints()["10.0.0.1"]; exists {
+		t.Errorf("expected non-matching pod to be removed")
+	}
+}
+
+func TestWatchPodGroup_EmptySelector(t *testing.T) {
+	// A scope without labels selects every pod of the namespace
+	clientset := fake.NewSimpleClientset()
+	selectors := make(chan string, 1)
+	clientset.PrependReactor("list", "pods", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		if list, ok := action.(clienttesting.ListActionImpl); ok {
+			select {
+			case selectors <- list.ListOptions.LabelSelector:
+			default:
+			}
+		}
+		return false, nil, nil
+	})
+
+	go func() {
+		_ = k8s.WatchPodGroup(t.Context(), clientset, k8s.WatchScope{
+			Namespace: "default",
+			Labels:    map[string]string{},
+			Watchers:  []*k8s.PodScrapeWatcher{k8s.NewPodScrapeWatcher()},
+		})
+	}()
+
+	select {
+	case selector := <-selectors:
+		if selector != "" {
+			t.Errorf("LabelSelector = %q, want an empty selector", selector)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the informer did not list pods")
+	}
+}
@@ -0,0 +1,208 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"slices"
+	"strconv"
+	"sync"
+
+	"github.com/canonical/metrics-k8s-proxy/internal/logging"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Sharder splits pods between proxy replicas with rendezvous hashing: every pod goes to the member that
+// scores highest for it. Adding or removing a member only moves the pods that member gains or loses.
+// A nil Sharder owns every pod.
+type Sharder struct {
+	mu      sync.RWMutex
+	self    string
+	members []string
+}
+
+// NewSharder returns a sharder for the member named self, initially the only member.
+func NewSharder(self string) *Sharder {
+	return &Sharder{self: self, members: []string{self}}
+}
+
+// NewStaticSharder returns a sharder for replica index out of count, for a fixed number of replicas.
+func NewStaticSharder(index, count int) *Sharder {
+	s := NewSharder(strconv.Itoa(index))
+	members := make([]string, 0, count)
+	for i := range count {
+		members = append(members, strconv.Itoa(i))
+	}
+	s.SetMembers(members)
+
+	return s
+}
+
+// SetMembers replaces the set of members, and reports whether they changed. The sharder's own member is always
+// included.
+func (s *Sharder) SetMembers(members []string) bool {
+	members = slices.Clone(members)
+	if !slices.Contains(members, s.self) {
+		members = append(members, s.self)
+	}
+	slices.Sort(members)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	changed := !slices.Equal(members, s.members)
+	s.members = members
+
+	return changed
+}
+
+// Members returns the current members, sorted.
+func (s *Sharder) Members() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return slices.Clone(s.members)
+}
+
+// Owns reports whether the pod identified by key is scraped by this member.
+func (s *Sharder) Owns(key string) bool {
+	if s == nil {
+		return true
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	owner, best := "", uint64(0)
+	for _, member := range s.members {
+		if score := rendezvousScore(member, key); owner == "" || score > best {
+			owner, best = member, score
+		}
+	}
+
+	return owner == s.self
+}
+
+// Constants of the splitmix64 finalizer.
+const (
+	splitmixShift1      = 30
+	splitmixShift2      = 27
+	splitmixShift3      = 31
+	splitmixMultiplier1 = 0xbf58476d1ce4e5b9
+	splitmixMultiplier2 = 0x94d049bb133111eb
+)
+
+// rendezvousScore hashes a member and key together. FNV alone spreads similar inputs poorly, so its result
+// goes through the splitmix64 finalizer.
+func rendezvousScore(member, key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(member))
+	h.Write([]byte{0})
+	h.Write([]byte(key))
+
+	x := h.Sum64()
+	x ^= x >> splitmixShift1
+	x *= splitmixMultiplier1
+	x ^= x >> splitmixShift2
+	x *= splitmixMultiplier2
+	x ^= x >> splitmixShift3
+
+	return x
+}
+
+// shardKey identifies a pod for sharding. Unlike its IP, it stays the same while the pod exists.
+func shardKey(details PodScrapeDetails) string {
+	return details.Namespace + "/" + details.PodName
+}
+
+// ShardMembership discovers the proxy replicas sharing the pods from the endpoints of a headless Service,
+// whose members are identified by pod name.
+type ShardMembership struct {
+	Namespace string
+	Service   string
+	Sharder   *Sharder
+
+	// OnSynced, if set, is called once the members are known for the first time.
+	OnSynced func()
+	// OnWatchError, if set, is called every time the informer fails to list or watch endpoints.
+	OnWatchError func(err error)
+}
+
+// Watch keeps the sharder's members in sync with the Service's ready endpoints until ctx is cancelled.
+func (m ShardMembership) Watch(ctx context.Context, clientset kubernetes.Interface) error {
+	factory := informers.NewSharedInformerFactoryWithOptions(
+		clientset,
+		defaultResyncPeriod,
+		informers.WithNamespace(m.Namespace),
+		informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+			opts.LabelSelector = labels.SelectorFromSet(labels.Set{discoveryv1.LabelServiceName: m.Service}).String()
+		}),
+	)
+	sliceInformer := factory.Discovery().V1().EndpointSlices().Informer()
+
+	update := func() {
+		members := []string{}
+		for _, obj := range sliceInformer.GetStore().List() {
+			slice, ok := obj.(*discoveryv1.EndpointSlice)
+			if !ok {
+				continue
+			}
+			members = append(members, readyPods(slice)...)
+		}
+		slices.Sort(members)
+		if m.Sharder.SetMembers(slices.Compact(members)) {
+			logging.FromContext(ctx).InfoContext(ctx, "Shard members changed", "members", m.Sharder.Members())
+		}
+	}
+	if _, err := sliceInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(_ interface{}) { update() },
+		UpdateFunc: func(_, _ interface{}) { update() },
+		DeleteFunc: func(_ interface{}) { update() },
+	}); err != nil {
+		return fmt.Errorf("failed to add event handler: %w", err)
+	}
+
+	if m.OnWatchError != nil {
+		if err := sliceInformer.SetWatchErrorHandler(func(_ *cache.Reflector, watchErr error) {
+			m.OnWatchError(watchErr)
+		}); err != nil {
+			return fmt.Errorf("failed to set watch error handler: %w", err)
+		}
+	}
+
+	factory.Start(ctx.Done())
+	defer factory.Shutdown()
+
+	if !cache.WaitForCacheSync(ctx.Done(), sliceInformer.HasSynced) {
+		return nil
+	}
+	// Handlers may not have run yet for a Service without endpoints
+	update()
+	if m.OnSynced != nil {
+		m.OnSynced()
+	}
+
+	<-ctx.Done()
+
+	return nil
+}
+
+// readyPods returns the names of the pods behind the slice's ready endpoints.
+func readyPods(slice *discoveryv1.EndpointSlice) []string {
+	pods := []string{}
+	for _, endpoint := range slice.Endpoints {
+		// A nil Ready means unknown, which consumers must treat as ready
+		if endpoint.Conditions.Ready != nil && !*endpoint.Conditions.Ready {
+			continue
+		}
+		if endpoint.TargetRef != nil && endpoint.TargetRef.Kind == "Pod" {
+			pods = append(pods, endpoint.TargetRef.Name)
+		}
+	}
+
+	return pods
+}
@@ -0,0 +1,180 @@
+package k8s_test
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/canonical/metrics-k8s-proxy/internal/k8s"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func podKeys(n int) []string {
+	keys := make([]string, 0, n)
+	for i := range n {
+		keys = append(keys, fmt.Sprintf("default/pod-%d", i))
+	}
+
+	return keys
+}
+
+// owners returns, for every key, the indexes of the sharders that own it.
+func owners(sharders []*k8s.Sharder, keys []string) map[string][]int {
+	owned := map[string][]int{}
+	for _, key := range keys {
+		for i, s := range sharders {
+			if s.Owns(key) {
+				owned[key] = append(owned[key], i)
+			}
+		}
+	}
+
+	return owned
+}
+
+func TestSharder_Partitions(t *testing.T) {
+	const replicas, pods = 3, 3000
+	sharders := make([]*k8s.Sharder, 0, replicas)
+	for i := range replicas {
+		sharders = append(sharders, k8s.NewStaticSharder(i, replicas))
+	}
+
+	perReplica := make([]int, replicas)
+	for key, owned := range owners(sharders, podKeys(pods)) {
+		if len(owned) != 1 {
+			t.Fatalf("pod %s is owned by replicas %v, want exactly one", key, owned)
+		}
+		perReplica[owned[0]]++
+	}
+	for i, count := range perReplica {
+		if count < pods/replicas*8/10 || count > pods/replicas*12/10 {
+			t.Errorf("replica %d owns %d of %d pods, want about a third", i, count, pods)
+		}
+	}
+
+	var unsharded *k8s.Sharder
+	if !unsharded.Owns("default/pod-0") {
+		t.Errorf("a nil Sharder should own every pod")
+	}
+}
+
+func TestSharder_MinimalMovement(t *testing.T) {
+	keys := podKeys(1000)
+	before := owners([]*k8s.Sharder{
+		k8s.NewStaticSharder(0, 3), k8s.NewStaticSharder(1, 3), k8s.NewStaticSharder(2, 3),
+	}, keys)
+	after := owners([]*k8s.Sharder{
+		k8s.NewStaticSharder(0, 4), k8s.NewStaticSharder(1, 4), k8s.NewStaticSharder(2, 4), k8s.NewStaticSharder(3, 4),
+	}, keys)
+
+	moved := 0
+	for _, key := range keys {
+		if before[key][0] == after[key][0] {
+			continue
+		}
+		moved++
+		if after[key][0] != 3 {
+			t.Errorf("pod %s moved from replica %d to %d, only moves to the new replica are expected",
+				key, before[key][0], after[key][0])
+		}
+	}
+	if moved == 0 || moved > len(keys)/3 {
+		t.Errorf("%d of %d pods moved, want about a quarter", moved, len(keys))
+	}
+}
+
+func TestPodScrapeWatcher_Shard(t *testing.T) {
+	endpoints := map[string]k8s.PodScrapeDetails{}
+	for i := range 100 {
+		endpoints[fmt.Sprintf("10.0.0.%d", i)] = k8s.PodScrapeDetails{
+			Port: "8080", Path: "/metrics", PodName: fmt.Sprintf("pod-%d", i), Namespace: "default",
+		}
+	}
+
+	union := map[string]k8s.PodScrapeDetails{}
+	for i := range 2 {
+		pw := k8s.NewPodScrapeWatcher()
+		pw.PodMetricsEndpoints = endpoints
+		pw.Shard = k8s.NewStaticSharder(i, 2)
+
+		shard := pw.GetPodMetricsEndpoints()
+		if len(shard) == 0 || len(shard) == len(endpoints) {
+			t.Errorf("replica %d serves %d of %d pods, want a share", i, len(shard), len(endpoints))
+		}
+		for ip, details := range shard {
+			if _, duplicate := union[ip]; duplicate {
+				t.Errorf("pod %s is served by both replicas", details.PodName)
+			}
+			union[ip] = details
+		}
+	}
+	if !reflect.DeepEqual(union, endpoints) {
+		t.Errorf("replicas together serve %d pods, want all %d", len(union), len(endpoints))
+	}
+}
+
+func endpointSlice(name string, pods map[string]bool) *discoveryv1.EndpointSlice {
+	slice := &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "monitoring",
+			Labels:    map[string]string{discoveryv1.LabelServiceName: "metrics-proxy"},
+		},
+		AddressType: discoveryv1.AddressTypeIPv4,
+	}
+	for pod, ready := range pods {
+		slice.Endpoints = append(slice.Endpoints, discoveryv1.Endpoint{
+			Addresses:  []string{"10.0.0.1"},
+			Conditions: discoveryv1.EndpointConditions{Ready: &ready},
+			TargetRef:  &corev1.ObjectReference{Kind: "Pod", Name: pod},
+		})
+	}
+
+	return slice
+}
+
+func TestShardMembership_Watch(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		endpointSlice("metrics-proxy-abc", map[string]bool{"metrics-proxy-0": true, "metrics-proxy-1": true}),
+		endpointSlice("metrics-proxy-def", map[string]bool{"metrics-proxy-2": false}),
+	)
+	sharder := k8s.NewSharder("metrics-proxy-0")
+
+	ctx := t.Context()
+	synced := make(chan struct{})
+	go func() {
+		_ = k8s.ShardMembership{
+			Namespace: "monitoring",
+			Service:   "metrics-proxy",
+			Sharder:   sharder,
+			OnSynced:  func() { close(synced) },
+		}.Watch(ctx, clientset)
+	}()
+
+	select {
+	case <-synced:
+	case <-time.After(5 * time.Second):
+		t.Fatal("membership never synced")
+	}
+	// Endpoints that aren't ready don't count as members
+	if got, want := sharder.Members(), []string{"metrics-proxy-0", "metrics-proxy-1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Members() = %v, want %v", got, want)
+	}
+
+	ready := endpointSlice("metrics-proxy-def", map[string]bool{"metrics-proxy-2": true})
+	if _, err := clientset.DiscoveryV1().EndpointSlices("monitoring").Update(ctx, ready, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("failed to update endpoint slice: %v", err)
+	}
+	want := []string{"metrics-proxy-0", "metrics-proxy-1", "metrics-proxy-2"}
+	deadline := time.Now().Add(5 * time.Second)
+	for !reflect.DeepEqual(sharder.Members(), want) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Members() = %v, want %v", sharder.Members(), want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
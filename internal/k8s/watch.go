@@ -1,12 +1,19 @@
 package k8s
 
 import (
-	"log"
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/url"
 	"sync"
 	"time"
 
+	"github.com/canonical/metrics-k8s-proxy/internal/logging"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/cache"
@@ -18,6 +25,14 @@ type PodScrapeDetails struct {
 	Path      string
 	PodName   string
 	Namespace string
+	// Labels are the pod's labels, for selecting pods when scraping the proxy.
+	Labels map[string]string
+
+	// Per-pod overrides read from annotations. A zero Timeout means the scrape only uses the overall deadline.
+	Timeout time.Duration
+	Params  url.Values
+	Headers http.Header
+	Limits  ScrapeLimits
 }
 
 // PodScrapeWatcher manages pod metrics and provides methods to handle updates and deletions.
@@ -25,19 +40,31 @@ type PodScrapeWatcher struct {
 	PodMetricsEndpoints map[string]PodScrapeDetails
 	mu                  sync.Mutex
 
+	// Namespace and Labels describe the pods this watcher is interested in. When the watcher shares an
+	// informer with other jobs, pods that don't carry all of Labels are ignored. A nil Labels matches every pod.
+	Namespace string
+	Labels    map[string]string
+	// Shard, if set, limits the endpoints returned by GetPodMetricsEndpoints to the pods this replica owns.
+	Shard *Sharder
+	// Logger, if set, logs the pods added and removed, and their invalid annotations, instead of the default logger.
+	Logger *slog.Logger
+
 	// Function variables for update and delete operations, to allow mocking during tests.
 	UpdatePodMetricsFunc func(*corev1.Pod)
 	DeletePodMetricsFunc func(*corev1.Pod)
 }
 
-// GetPodMetricsEndpoints returns a copy of the current pod metrics endpoints.
+// GetPodMetricsEndpoints returns a copy of the current pod metrics endpoints, limited to the watcher's shard.
+// Every pod is kept regardless of the shard, so that pods move between replicas as soon as the shard changes.
 func (pw *PodScrapeWatcher) GetPodMetricsEndpoints() map[string]PodScrapeDetails {
 	pw.mu.Lock()
 	defer pw.mu.Unlock()
 
 	endpointsCopy := make(map[string]PodScrapeDetails, len(pw.PodMetricsEndpoints))
 	for k, v := range pw.PodMetricsEndpoints {
-		endpointsCopy[k] = v
+		if pw.Shard.Owns(shardKey(v)) {
+			endpointsCopy[k] = v
+		}
 	}
 	return endpointsCopy
 }
@@ -56,13 +83,24 @@ func NewPodScrapeWatcher() *PodScrapeWatcher {
 }
 
 // WatchPods starts the SharedInformer to monitor pod events and updates the metrics endpoints accordingly.
-func (pw *PodScrapeWatcher) WatchPods(clientset kubernetes.Interface, namespace string, labels map[string]string) {
+// It blocks until ctx is cancelled.
+func (pw *PodScrapeWatcher) WatchPods(ctx context.Context, clientset kubernetes.Interface, namespace string,
+	labels map[string]string) error {
+	return WatchPodGroup(ctx, clientset,
+		WatchScope{Namespace: namespace, Labels: labels, Watchers: []*PodScrapeWatcher{pw}})
+}
+
+// WatchPodGroup runs a single SharedInformer for the scope and feeds its pod events to every watcher in it.
+// It blocks until ctx is cancelled, then stops the informer and waits for it to exit.
+// While the API server is unreachable the informer keeps retrying, and the watchers keep their last-known pods.
+func WatchPodGroup(ctx context.Context, clientset kubernetes.Interface, scope WatchScope) error {
 	factory := informers.NewSharedInformerFactoryWithOptions(
 		clientset,
 		defaultResyncPeriod,
-		informers.WithNamespace(namespace),
+		informers.WithNamespace(scope.Namespace),
 		informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
-			opts.LabelSelector = metav1.FormatLabelSelector(&metav1.LabelSelector{MatchLabels: labels})
+			// An empty selector must select every pod, which FormatLabelSelector would render as "<none>"
+			opts.LabelSelector = labels.SelectorFromSet(scope.Labels).String()
 		}),
 	)
 
@@ -73,73 +111,115 @@ func (pw *PodScrapeWatcher) WatchPods(clientset kubernetes.Interface, namespace
 		AddFunc: func(obj interface{}) {
 			pod, ok := obj.(*corev1.Pod)
 			if !ok {
-				log.Println("Error casting added object to Pod")
+				logging.FromContext(ctx).ErrorContext(ctx, "Error casting added object to Pod")
 				return
 			}
-			pw.UpdatePodMetricsFunc(pod)
+			for _, pw := range scope.Watchers {
+				pw.UpdatePodMetricsFunc(pod)
+			}
 		},
 		UpdateFunc: func(_, newObj interface{}) {
 			newPod, ok := newObj.(*corev1.Pod)
 			if !ok {
-				log.Println("Error casting updated object to Pod")
+				logging.FromContext(ctx).ErrorContext(ctx, "Error casting updated object to Pod")
 				return
 			}
-			pw.UpdatePodMetricsFunc(newPod)
+			for _, pw := range scope.Watchers {
+				pw.UpdatePodMetricsFunc(newPod)
+			}
 		},
 		DeleteFunc: func(obj interface{}) {
+			// Deletions missed while the watch was down arrive as tombstones once it reconnects
+			if tombstone, isTombstone := obj.(cache.DeletedFinalStateUnknown); isTombstone {
+				obj = tombstone.Obj
+			}
 			pod, ok := obj.(*corev1.Pod)
 			if !ok {
-				log.Println("Error casting deleted object to Pod")
+				logging.FromContext(ctx).ErrorContext(ctx, "Error casting deleted object to Pod")
 				return
 			}
-			pw.DeletePodMetricsFunc(pod)
+			for _, pw := range scope.Watchers {
+				pw.DeletePodMetricsFunc(pod)
+			}
 		},
 	}); err != nil {
-		log.Fatalf("Failed to add event handler: %v", err)
+		return fmt.Errorf("failed to add event handler: %w", err)
+	}
+
+	if scope.OnWatchError != nil {
+		if err := podInformer.SetWatchErrorHandler(func(_ *cache.Reflector, watchErr error) {
+			scope.OnWatchError(watchErr)
+		}); err != nil {
+			return fmt.Errorf("failed to set watch error handler: %w", err)
+		}
 	}
 
-	// Start the informer
-	stopCh := make(chan struct{})
-	factory.Start(stopCh)
+	// Start the informer, and stop it once the context is cancelled
+	factory.Start(ctx.Done())
+	defer factory.Shutdown()
+
 	// Wait for the informer cache to sync
-	if !cache.WaitForCacheSync(stopCh, podInformer.HasSynced) {
-		close(stopCh) // Explicitly close the channel before exiting
-		log.Fatal("Failed to sync pod cache")
+	if !cache.WaitForCacheSync(ctx.Done(), podInformer.HasSynced) {
+		// The context was cancelled before the first sync completed
+		return nil
 	}
+	if scope.OnSynced != nil {
+		scope.OnSynced()
+	}
+
+	// Block until the context is cancelled
+	<-ctx.Done()
 
-	// Block until stopCh is closed
-	<-stopCh
+	return nil
 }
 
 // UpdatePodMetrics updates or adds pod metrics based on the pod annotations.
 func (pw *PodScrapeWatcher) UpdatePodMetrics(pod *corev1.Pod) {
+	if !pw.selects(pod) {
+		// The pod may have been relabeled out of this watcher's selector.
+		if podIP := pod.Status.PodIP; podIP != "" {
+			pw.mu.Lock()
+			delete(pw.PodMetricsEndpoints, podIP)
+			pw.mu.Unlock()
+		}
+
+		return
+	}
+
 	annotations := pod.GetAnnotations()
-	if scrape, exists := annotations["prometheus.io/scrape"]; exists && scrape == "true" {
+	if scrape, exists := annotations[ScrapeAnnotation]; exists && scrape == "true" {
 		podIP := pod.Status.PodIP
 		if podIP == "" {
 			return
 		}
 
-		port := annotations["prometheus.io/port"]
+		port := annotations[PortAnnotation]
 		if port == "" {
 			port = "80"
 		}
-		path := annotations["prometheus.io/path"]
+		path := annotations[PathAnnotation]
 		if path == "" {
 			path = "/metrics"
 		}
+		logger := pw.logger().With("pod", pod.Name, "namespace", pod.Namespace, "ip", podIP)
+		overrides := parseScrapeOverrides(logger, annotations)
 
-		// Store the pod IP, port, path, and additional metadata like name and namespace.
+		// Store the pod IP, port, path, scrape overrides, and additional metadata like name and namespace.
 		pw.mu.Lock()
 		pw.PodMetricsEndpoints[podIP] = PodScrapeDetails{
 			Port:      port,
 			Path:      path,
 			PodName:   pod.Name,
 			Namespace: pod.Namespace,
+			Labels:    maps.Clone(pod.Labels),
+			Timeout:   overrides.timeout,
+			Params:    overrides.params,
+			Headers:   overrides.headers,
+			Limits:    overrides.limits,
 		}
 		pw.mu.Unlock()
 
-		log.Printf("Updated pod %s with IP %s", pod.Name, podIP)
+		logger.Debug("Updated pod")
 	}
 }
 
@@ -151,6 +231,20 @@ func (pw *PodScrapeWatcher) DeletePodMetrics(pod *corev1.Pod) {
 		delete(pw.PodMetricsEndpoints, podIP)
 		pw.mu.Unlock()
 
-		log.Printf("Deleted pod %s with IP %s", pod.Name, podIP)
+		pw.logger().Debug("Deleted pod", "pod", pod.Name, "namespace", pod.Namespace, "ip", podIP)
 	}
 }
+
+// logger returns the watcher's Logger, or the default logger.
+func (pw *PodScrapeWatcher) logger() *slog.Logger {
+	if pw.Logger != nil {
+		return pw.Logger
+	}
+
+	return slog.Default()
+}
+
+// selects reports whether the pod carries every label the watcher is interested in.
+func (pw *PodScrapeWatcher) selects(pod *corev1.Pod) bool {
+	return labels.SelectorFromSet(pw.Labels).Matches(labels.Set(pod.GetLabels()))
+}
@@ -2,8 +2,11 @@ package k8s_test
 
 import (
 	"bytes"
-	"log"
-	"os"
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
 	"reflect"
 	"strings"
 	"testing"
@@ -12,21 +15,21 @@ import (
 	"github.com/canonical/metrics-k8s-proxy/internal/k8s"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/fake"
 	clienttesting "k8s.io/client-go/testing"
 )
 
-// captureLogOutput captures log output during the execution of a function.
-func captureLogOutput(f func()) string {
+// captureLogOutput captures the watcher's log output, at every level, during the execution of a function.
+func captureLogOutput(pw *k8s.PodScrapeWatcher, f func()) string {
 	var buf bytes.Buffer
 
-	// Temporarily set the default logger output to the buffer
-	log.SetOutput(&buf)
+	// Temporarily log to the buffer
+	pw.Logger = slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
 	defer func() {
-		// Reset the logger output to the default after capturing the logs
-		log.SetOutput(os.Stderr)
+		pw.Logger = nil
 	}()
 
 	// Execute the function passed in
@@ -56,6 +59,7 @@ func TestUpdatePodMetrics(t *testing.T) {
 					ObjectMeta: metav1.ObjectMeta{
 						Name:      "test-pod",
 						Namespace: "default",
+						Labels:    map[string]string{"app": "ztunnel"},
 						Annotations: map[string]string{
 							"prometheus.io/scrape": "true",
 							"prometheus.io/port":   "8080",
@@ -72,9 +76,10 @@ func TestUpdatePodMetrics(t *testing.T) {
 				Path:      "/custom-metrics",
 				PodName:   "test-pod",
 				Namespace: "default",
+				Labels:    map[string]string{"app": "ztunnel"},
 			},
 			wantIP:   "10.0.0.1",
-			wantLogs: "Updated pod test-pod with IP 10.0.0.1",
+			wantLogs: `msg="Updated pod" pod=test-pod namespace=default ip=10.0.0.1`,
 		},
 		{
 			name: "Valid pod with no custom path",
@@ -99,7 +104,96 @@ func TestUpdatePodMetrics(t *testing.T) {
 				Namespace: "default",
 			},
 			wantIP:   "10.0.0.2",
-			wantLogs: "Updated pod no-custom-pod with IP 10.0.0.2",
+			wantLogs: `msg="Updated pod" pod=no-custom-pod namespace=default ip=10.0.0.2`,
+		},
+		{
+			name: "Valid pod with scrape overrides",
+			args: args{
+				pod: &corev1.Pod{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "override-pod",
+						Namespace: "default",
+						Annotations: map[string]string{
+							"prometheus.io/scrape":            "true",
+							"prometheus.io/scrape-timeout":    "2s",
+							"prometheus.io/param_format":      "prometheus",
+							"prometheus.io/header_x-tenant":   "team-a",
+							"prometheus.io/header_X-Scope-Id": "1",
+						},
+					},
+					Status: corev1.PodStatus{
+						PodIP: "10.0.0.3",
+					},
+				},
+			},
+			expected: k8s.PodScrapeDetails{
+				Port:      "80",
+				Path:      "/metrics",
+				PodName:   "override-pod",
+				Namespace: "default",
+				Timeout:   2 * time.Second,
+				Params:    url.Values{"format": {"prometheus"}},
+				Headers:   http.Header{"X-Tenant": {"team-a"}, "X-Scope-Id": {"1"}},
+			},
+			wantIP:   "10.0.0.3",
+			wantLogs: `msg="Updated pod" pod=override-pod namespace=default ip=10.0.0.3`,
+		},
+		{
+			name: "Valid pod with scrape limits",
+			args: args{
+				pod: &corev1.Pod{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "limited-pod",
+						Namespace: "default",
+						Annotations: map[string]string{
+							"prometheus.io/scrape":          "true",
+							"prometheus.io/body-size-limit": "1Mi",
+							"prometheus.io/sample-limit":    "1000",
+							"prometheus.io/series-limit":    "none",
+						},
+					},
+					Status: corev1.PodStatus{
+						PodIP: "10.0.0.5",
+					},
+				},
+			},
+			expected: k8s.PodScrapeDetails{
+				Port:      "80",
+				Path:      "/metrics",
+				PodName:   "limited-pod",
+				Namespace: "default",
+				Limits:    k8s.ScrapeLimits{BodySize: 1 << 20, Samples: 1000},
+			},
+			wantIP: "10.0.0.5",
+			wantLogs: `msg="Ignoring invalid annotation" pod=limited-pod namespace=default ip=10.0.0.5 ` +
+				`annotation=prometheus.io/series-limit value=none`,
+		},
+		{
+			name: "Invalid scrape timeout is ignored",
+			args: args{
+				pod: &corev1.Pod{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "bad-timeout-pod",
+						Namespace: "default",
+						Annotations: map[string]string{
+							"prometheus.io/scrape":         "true",
+							"prometheus.io/scrape-timeout": "soon",
+						},
+					},
+					Status: corev1.PodStatus{
+						PodIP: "10.0.0.4",
+					},
+				},
+			},
+			expected: k8s.PodScrapeDetails{
+				Port:      "80",
+				Path:      "/metrics",
+				PodName:   "bad-timeout-pod",
+				Namespace: "default",
+			},
+			wantIP: "10.0.0.4",
+			wantLogs: `msg="Ignoring invalid annotation" pod=bad-timeout-pod namespace=default ip=10.0.0.4 ` +
+				`annotation=prometheus.io/scrape-timeout value=soon`,
 		},
 		{
 			name: "Pod without IP",
@@ -148,7 +242,7 @@ func TestUpdatePodMetrics(t *testing.T) {
 			// Clear the PodMetricsEndpoints map for a clean test.
 			pw.PodMetricsEndpoints = make(map[string]k8s.PodScrapeDetails)
 
-			logOutput := captureLogOutput(func() {
+			logOutput := captureLogOutput(pw, func() {
 				pw.UpdatePodMetrics(tt.args.pod)
 			})
 
@@ -166,6 +260,30 @@ func TestUpdatePodMetrics(t *testing.T) {
 	}
 }
 
+func TestScrapeLimitsWithin(t *testing.T) {
+	tests := []struct {
+		name   string
+		pod    k8s.ScrapeLimits
+		global k8s.ScrapeLimits
+		want   k8s.ScrapeLimits
+	}{
+		{name: "No Limits"},
+		{name: "Global Only", global: k8s.ScrapeLimits{BodySize: 100, Samples: 10, Series: 5},
+			want: k8s.ScrapeLimits{BodySize: 100, Samples: 10, Series: 5}},
+		{name: "Pod Only", pod: k8s.ScrapeLimits{Samples: 10}, want: k8s.ScrapeLimits{Samples: 10}},
+		{name: "Pod Tightens", pod: k8s.ScrapeLimits{BodySize: 50, Samples: 20},
+			global: k8s.ScrapeLimits{BodySize: 100, Samples: 10}, want: k8s.ScrapeLimits{BodySize: 50, Samples: 10}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.pod.Within(tt.global); got != tt.want {
+				t.Errorf("Within() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
 func TestDeletePodMetrics(t *testing.T) {
 	pw := k8s.NewPodScrapeWatcher()
 
@@ -192,7 +310,7 @@ func TestDeletePodMetrics(t *testing.T) {
 				},
 			},
 			wantIP:   "10.0.0.1",
-			wantLogs: "Deleted pod delete-pod with IP 10.0.0.1",
+			wantLogs: `msg="Deleted pod" pod=delete-pod namespace=default ip=10.0.0.1`,
 		},
 		{
 			name: "Pod with no IP",
@@ -221,7 +339,7 @@ func TestDeletePodMetrics(t *testing.T) {
 				},
 			}
 
-			logOutput := captureLogOutput(func() {
+			logOutput := captureLogOutput(pw, func() {
 				pw.DeletePodMetrics(tt.args.pod)
 			})
 
@@ -248,6 +366,8 @@ func TestWatchPods(t *testing.T) {
 	}
 
 	pw := k8s.NewPodScrapeWatcher()
+	// Stop every informer started below once the test completes
+	ctx := t.Context()
 
 	// Create a fake Kubernetes client
 	fakeClientset := fake.NewSimpleClientset()
@@ -313,8 +433,10 @@ func TestWatchPods(t *testing.T) {
 			// Resetting the pod metrics map for isolation
 			pw.PodMetricsEndpoints = make(map[string]k8s.PodScrapeDetails)
 
-			// Run WatchPods in a goroutine since it blocks indefinitely
-			go pw.WatchPods(tt.args.clientset, tt.args.namespace, tt.args.labels)
+			// Run WatchPods in a goroutine since it blocks until the context is cancelled
+			go func() {
+				_ = pw.WatchPods(ctx, tt.args.clientset, tt.args.namespace, tt.args.labels)
+			}()
 
 			// Simulate different pod events
 			pod := &corev1.Pod{
@@ -363,3 +485,78 @@ func TestWatchPods(t *testing.T) {
 		})
 	}
 }
+
+// TestWatchPods_StopsOnCancel tests that WatchPods returns once its context is cancelled.
+func TestWatchPods_StopsOnCancel(t *testing.T) {
+	pw := k8s.NewPodScrapeWatcher()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	done := make(chan struct{})
+	go func() {
+		if err := pw.WatchPods(ctx, fake.NewSimpleClientset(), "default", map[string]string{"app": "test"}); err != nil {
+			t.Errorf("WatchPods() error = %v", err)
+		}
+		close(done)
+	}()
+
+	// Let the informer start and sync before stopping it
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("WatchPods did not return after its context was cancelled")
+	}
+}
+
+// TestWatchPodGroup_Hooks tests that the sync and watch error hooks of a scope are called.
+func TestWatchPodGroup_Hooks(t *testing.T) {
+	ctx := t.Context()
+
+	// A healthy API server syncs the cache.
+	synced := make(chan struct{})
+	go func() {
+		_ = k8s.WatchPodGroup(ctx, fake.NewSimpleClientset(), k8s.WatchScope{
+			Namespace: "default",
+			Watchers:  []*k8s.PodScrapeWatcher{k8s.NewPodScrapeWatcher()},
+			OnSynced:  func() { close(synced) },
+		})
+	}()
+
+	select {
+	case <-synced:
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnSynced was not called")
+	}
+
+	// An unreachable API server reports watch errors instead of crashing.
+	failingClientset := fake.NewSimpleClientset()
+	failingClientset.PrependReactor("list", "pods",
+		func(_ clienttesting.Action) (bool, runtime.Object, error) {
+			return true, nil, errors.New("API server unavailable")
+		})
+
+	watchErrors := make(chan error, 1)
+	go func() {
+		_ = k8s.WatchPodGroup(ctx, failingClientset, k8s.WatchScope{
+			Namespace: "default",
+			Watchers:  []*k8s.PodScrapeWatcher{k8s.NewPodScrapeWatcher()},
+			OnWatchError: func(err error) {
+				select {
+				case watchErrors <- err:
+				default:
+				}
+			},
+		})
+	}()
+
+	select {
+	case err := <-watchErrors:
+		if !strings.Contains(err.Error(), "API server unavailable") {
+			t.Errorf("OnWatchError got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnWatchError was not called")
+	}
+}
@@ -0,0 +1,61 @@
+// Package logging builds the proxy's structured logger and carries it through contexts, so that every line
+// logged while serving a request can be correlated through the request's ID.
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log/slog"
+)
+
+// Formats of the log output.
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// RequestIDAttr is the attribute holding the ID of the request a line was logged for.
+const RequestIDAttr = "request_id"
+
+// TraceIDAttr is the attribute holding the ID of the trace of the request a line was logged for, if traced.
+const TraceIDAttr = "trace_id"
+
+// requestIDBytes is the size of the random part of a generated request ID.
+const requestIDBytes = 8
+
+// New returns a logger writing the lines of at least the given level to w, as JSON if format is FormatJSON
+// and as text otherwise.
+func New(w io.Writer, level slog.Level, format string) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: level}
+	if format == FormatJSON {
+		return slog.New(slog.NewJSONHandler(w, opts))
+	}
+
+	return slog.New(slog.NewTextHandler(w, opts))
+}
+
+type loggerKey struct{}
+
+// NewContext returns a copy of ctx carrying the logger.
+func NewContext(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// FromContext returns the logger carried by ctx, or the default logger if it carries none.
+func FromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+
+	return slog.Default()
+}
+
+// NewRequestID generates a random request ID.
+func NewRequestID() string {
+	b := make([]byte, requestIDBytes)
+	_, _ = rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
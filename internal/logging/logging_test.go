@@ -0,0 +1,46 @@
+package logging_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/canonical/metrics-k8s-proxy/internal/logging"
+)
+
+func TestNew(t *testing.T) {
+	var text, jsonBuf bytes.Buffer
+	logging.New(&text, slog.LevelWarn, logging.FormatText).Warn("Scrape failed", "pod", "pod1")
+	logging.New(&jsonBuf, slog.LevelWarn, logging.FormatJSON).Warn("Scrape failed", "pod", "pod1")
+	logging.New(&text, slog.LevelWarn, logging.FormatText).Info("Not logged")
+
+	if !strings.Contains(text.String(), `level=WARN msg="Scrape failed" pod=pod1`) ||
+		strings.Contains(text.String(), "Not logged") {
+		t.Errorf("text output = %q", text.String())
+	}
+	var line map[string]any
+	err := json.Unmarshal(jsonBuf.Bytes(), &line)
+	if err != nil || line["msg"] != "Scrape failed" || line["pod"] != "pod1" {
+		t.Errorf("JSON output = %q, err = %v", jsonBuf.String(), err)
+	}
+}
+
+func TestFromContext(t *testing.T) {
+	logger := logging.New(&bytes.Buffer{}, slog.LevelInfo, logging.FormatText)
+	if got := logging.FromContext(logging.NewContext(context.Background(), logger)); got != logger {
+		t.Errorf("FromContext() = %v, want the logger of the context", got)
+	}
+	if got := logging.FromContext(context.Background()); got != slog.Default() {
+		t.Errorf("FromContext() = %v, want the default logger", got)
+	}
+}
+
+func TestNewRequestID(t *testing.T) {
+	a, b := logging.NewRequestID(), logging.NewRequestID()
+	if len(a) != 16 || a == b {
+		t.Errorf("NewRequestID() = %q and %q, want distinct 16 character IDs", a, b)
+	}
+}
@@ -0,0 +1,370 @@
+package otlp
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/canonical/metrics-k8s-proxy/internal/util"
+)
+
+// scopeName identifies the proxy as the instrumentation scope of every exported metric.
+const scopeName = "metrics-k8s-proxy"
+
+// Labels that split histogram and summary series into buckets and quantiles.
+const (
+	bucketLabel   = "le"
+	quantileLabel = "quantile"
+)
+
+// convert turns aggregated text exposition responses into an OTLP export request, with a resource for every
+// pod, whose attributes come from the pod labels of its series. Samples without a timestamp are stamped with
+// now, and cumulative series start at the time starts keeps for them.
+func convert(responses []string, now time.Time, starts *startTimes) exportMetricsServiceRequest {
+	request := exportMetricsServiceRequest{ResourceMetrics: []resourceMetrics{}}
+	byResource := map[string]int{}
+	for _, response := range responses {
+		for _, f := range parseFamilies(response) {
+			for _, pod := range splitByPod(f) {
+				attributes := resourceAttributes(pod.samples[0])
+				key := seriesKey(podSample(pod.samples[0]), "")
+				index, exists := byResource[key]
+				if !exists {
+					index = len(request.ResourceMetrics)
+					byResource[key] = index
+					request.ResourceMetrics = append(request.ResourceMetrics, resourceMetrics{
+						Resource:     resource{Attributes: attributes},
+						ScopeMetrics: []scopeMetrics{{Scope: instrumentationScope{Name: scopeName}}},
+					})
+				}
+				scope := &request.ResourceMetrics[index].ScopeMetrics[0]
+				scope.Metrics = append(scope.Metrics, convertFamily(pod, now, starts))
+			}
+		}
+	}
+	starts.rotate()
+
+	return request
+}
+
+// startTimes keeps the start time of the cumulative series, which OTLP requires of sums, histograms and
+// summaries. A series starts at its first export, and again at the previous export when its value drops, as it
+// does when its pod restarts. Series that are no longer exported are forgotten.
+type startTimes struct {
+	current, previous map[string]seriesStart
+}
+
+// seriesStart is the start time of a series, along with its latest value and the time of that value.
+type seriesStart struct {
+	start, last uint64
+	value       float64
+}
+
+// of returns the start time of the series, given the value it has at the time of a new point.
+func (s *startTimes) of(series string, value float64, at uint64) uint64 {
+	if s.current == nil {
+		s.current = map[string]seriesStart{}
+	}
+	known, exists := s.current[series]
+	if !exists {
+		known, exists = s.previous[series]
+	}
+	start := at
+	switch {
+	case !exists:
+	case value < known.value:
+		// The series was reset after its previous point
+		start = known.last
+	default:
+		start = known.start
+	}
+	s.current[series] = seriesStart{start: start, last: at, value: value}
+
+	return start
+}
+
+// rotate forgets the series without points since the previous rotation.
+func (s *startTimes) rotate() {
+	s.previous, s.current = s.current, nil
+}
+
+// splitByPod splits the samples of a family by the pod labels they carry, in order of first appearance.
+func splitByPod(f *family) []*family {
+	pods := []*family{}
+	byPod := map[string]*family{}
+	for _, sample := range f.samples {
+		key := seriesKey(podSample(sample), "")
+		pod, exists := byPod[key]
+		if !exists {
+			pod = &family{name: f.name, help: f.help, typ: f.typ}
+			byPod[key] = pod
+			pods = append(pods, pod)
+		}
+		pod.samples = append(pod.samples, sample)
+	}
+
+	return pods
+}
+
+// convertFamily maps a family to the matching OTLP metric. Untyped families become gauges.
+func convertFamily(f *family, now time.Time, starts *startTimes) metric {
+	m := metric{Name: f.name, Description: f.help}
+	switch f.typ {
+	case typeCounter:
+		m.Sum = &sum{
+			DataPoints:             numberDataPoints(f, now, starts),
+			AggregationTemporality: aggregationTemporalityCumulative,
+			IsMonotonic:            true,
+		}
+	case typeHistogram:
+		m.Histogram = &histogram{
+			DataPoints:             histogramDataPoints(f, now, starts),
+			AggregationTemporality: aggregationTemporalityCumulative,
+		}
+	case typeSummary:
+		m.Summary = &summary{DataPoints: summaryDataPoints(f, now, starts)}
+	case typeGauge, typeUntyped:
+		m.Gauge = &gauge{DataPoints: numberDataPoints(f, now, nil)}
+	default:
+		m.Gauge = &gauge{DataPoints: numberDataPoints(f, now, nil)}
+	}
+
+	return m
+}
+
+// numberDataPoints converts the samples of a counter, gauge or untyped family. The points of a counter get a
+// start time from starts, which is nil for other families.
+func numberDataPoints(f *family, now time.Time, starts *startTimes) []numberDataPoint {
+	points := make([]numberDataPoint, 0, len(f.samples))
+	for _, sample := range f.samples {
+		if strings.HasSuffix(sample.Name, suffixCreated) && sample.Name != f.name {
+			continue
+		}
+		point := numberDataPoint{
+			Attributes:   attributesOf(sample, ""),
+			TimeUnixNano: timestamp(sample, now),
+			AsDouble:     jsonFloat(parseValue(sample.Value)),
+		}
+		if starts != nil {
+			point.StartTimeUnixNano = starts.of(sample.Name+seriesKey(sample, ""), float64(point.AsDouble),
+				point.TimeUnixNano)
+		}
+		points = append(points, point)
+	}
+
+	return points
+}
+
+// series is the set of samples of one histogram or summary, i.e. of one label set ignoring `le` or `quantile`.
+type series struct {
+	sample util.Sample // Any sample of the series, for its labels and timestamp
+	points map[float64]float64
+	sum    *float64
+	count  float64
+}
+
+// groupSeries groups the samples of a histogram or summary family by label set, ignoring splitLabel.
+func groupSeries(f *family, splitLabel string) []*series {
+	groups := []*series{}
+	byKey := map[string]*series{}
+	for _, sample := range f.samples {
+		key := seriesKey(sample, splitLabel)
+		s, exists := byKey[key]
+		if !exists {
+			s = &series{sample: sample, points: map[float64]float64{}}
+			byKey[key] = s
+			groups = append(groups, s)
+		}
+
+		value := parseValue(sample.Value)
+		switch sample.Name {
+		case f.name + suffixSum:
+			s.sum = &value
+		case f.name + suffixCount:
+			s.count = value
+		case f.name + suffixBucket, f.name:
+			bound, err := strconv.ParseFloat(sample.Get(splitLabel), 64)
+			if err != nil {
+				continue
+			}
+			s.points[bound] = value
+		}
+	}
+
+	return groups
+}
+
+// histogramDataPoints converts Prometheus' cumulative buckets into OTLP's per-bucket counts.
+func histogramDataPoints(f *family, now time.Time, starts *startTimes) []histogramDataPoint {
+	groups := groupSeries(f, bucketLabel)
+	points := make([]histogramDataPoint, 0, len(groups))
+	for _, s := range groups {
+		bounds := sortedKeys(s.points)
+		point := histogramDataPoint{
+			Attributes:     attributesOf(s.sample, bucketLabel),
+			TimeUnixNano:   timestamp(s.sample, now),
+			Count:          toCount(s.count),
+			BucketCounts:   make([]uint64String, 0, len(bounds)+1),
+			ExplicitBounds: make([]jsonFloat, 0, len(bounds)),
+		}
+		point.StartTimeUnixNano = starts.of(f.name+seriesKey(s.sample, bucketLabel), s.count, point.TimeUnixNano)
+		if s.sum != nil {
+			sumValue := jsonFloat(*s.sum)
+			point.Sum = &sumValue
+		}
+
+		var previous uint64
+		for _, bound := range bounds {
+			if math.IsInf(bound, 1) {
+				break
+			}
+			cumulative := max(toCount(s.points[bound]), previous)
+			point.ExplicitBounds = append(point.ExplicitBounds, jsonFloat(bound))
+			point.BucketCounts = append(point.BucketCounts, uint64String(cumulative-previous))
+			previous = cumulative
+		}
+		// The last OTLP bucket is everything above the highest bound, i.e. what the +Inf bucket adds
+		point.BucketCounts = append(point.BucketCounts, uint64String(max(point.Count, previous)-previous))
+
+		points = append(points, point)
+	}
+
+	return points
+}
+
+func summaryDataPoints(f *family, now time.Time, starts *startTimes) []summaryDataPoint {
+	groups := groupSeries(f, quantileLabel)
+	points := make([]summaryDataPoint, 0, len(groups))
+	for _, s := range groups {
+		point := summaryDataPoint{
+			Attributes:     attributesOf(s.sample, quantileLabel),
+			TimeUnixNano:   timestamp(s.sample, now),
+			Count:          toCount(s.count),
+			QuantileValues: make([]valueAtQuantile, 0, len(s.points)),
+		}
+		point.StartTimeUnixNano = starts.of(f.name+seriesKey(s.sample, quantileLabel), s.count, point.TimeUnixNano)
+		if s.sum != nil {
+			point.Sum = jsonFloat(*s.sum)
+		}
+		for _, quantile := range sortedKeys(s.points) {
+			point.QuantileValues = append(point.QuantileValues, valueAtQuantile{
+				Quantile: jsonFloat(quantile),
+				Value:    jsonFloat(s.points[quantile]),
+			})
+		}
+
+		points = append(points, point)
+	}
+
+	return points
+}
+
+// podSample returns the sample with only its pod labels, sorted by name, which identify the pod it came from.
+func podSample(sample util.Sample) util.Sample {
+	pod := util.Sample{}
+	for _, label := range sample.Labels {
+		if _, isResource := resourceAttributeKey(label.Name); isResource {
+			pod.Labels = append(pod.Labels, label)
+		}
+	}
+	sort.Slice(pod.Labels, func(i, j int) bool { return pod.Labels[i].Name < pod.Labels[j].Name })
+
+	return pod
+}
+
+// resourceAttributes returns the pod metadata of a sample as resource attributes.
+func resourceAttributes(sample util.Sample) []keyValue {
+	attributes := []keyValue{}
+	for _, label := range sample.Labels {
+		if key, isResource := resourceAttributeKey(label.Name); isResource {
+			attributes = append(attributes, keyValue{Key: key, Value: anyValue{StringValue: label.Value}})
+		}
+	}
+	sort.Slice(attributes, func(i, j int) bool { return attributes[i].Key < attributes[j].Key })
+
+	return attributes
+}
+
+// resourceAttributeKey maps the pod labels added by the proxy to the resource attributes replacing them.
+func resourceAttributeKey(label string) (string, bool) {
+	switch label {
+	case "k8s_pod_name":
+		return "k8s.pod.name", true
+	case "k8s_namespace":
+		return "k8s.namespace.name", true
+	default:
+		return "", false
+	}
+}
+
+// attributesOf returns the labels of a sample as data point attributes, leaving out pod metadata and skipLabel.
+func attributesOf(sample util.Sample, skipLabel string) []keyValue {
+	attributes := []keyValue{}
+	for _, label := range sample.Labels {
+		if _, isResource := resourceAttributeKey(label.Name); isResource || label.Name == skipLabel {
+			continue
+		}
+		attributes = append(attributes, keyValue{Key: label.Name, Value: anyValue{StringValue: label.Value}})
+	}
+
+	return attributes
+}
+
+// seriesKey identifies the label set of a sample, ignoring skipLabel.
+func seriesKey(sample util.Sample, skipLabel string) string {
+	var b strings.Builder
+	for _, label := range sample.Labels {
+		if label.Name == skipLabel {
+			continue
+		}
+		b.WriteString(label.Name)
+		b.WriteByte('=')
+		b.WriteString(label.Value)
+		b.WriteByte(0xff)
+	}
+
+	return b.String()
+}
+
+// timestamp returns the sample's timestamp, or now if it has none, in nanoseconds since the epoch.
+func timestamp(sample util.Sample, now time.Time) uint64 {
+	at := now
+	if sample.Timestamp != "" {
+		if millis, err := strconv.ParseInt(sample.Timestamp, 10, 64); err == nil {
+			at = time.UnixMilli(millis)
+		}
+	}
+
+	return uint64(max(at.UnixNano(), 0))
+}
+
+// parseValue parses a sample value, including Prometheus' `+Inf`, `-Inf` and `NaN`.
+func parseValue(value string) float64 {
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return math.NaN()
+	}
+
+	return parsed
+}
+
+// toCount converts a float count to an integer one, treating NaN and negative values as zero.
+func toCount(value float64) uint64 {
+	if math.IsNaN(value) || value < 0 {
+		return 0
+	}
+
+	return uint64(value)
+}
+
+func sortedKeys(points map[float64]float64) []float64 {
+	keys := make([]float64, 0, len(points))
+	for key := range points {
+		keys = append(keys, key)
+	}
+	sort.Float64s(keys)
+
+	return keys
+}
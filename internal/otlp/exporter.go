@@ -0,0 +1,118 @@
+// Package otlp exports the proxy's aggregated metrics, and the spans of its scrapes, to an OpenTelemetry
+// Collector over OTLP/HTTP.
+package otlp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/canonical/metrics-k8s-proxy/internal/handlers"
+	"github.com/canonical/metrics-k8s-proxy/internal/logging"
+	"github.com/canonical/metrics-k8s-proxy/internal/selfmetrics"
+)
+
+// Export outcomes, as reported in the Exporter's Exports counter.
+const (
+	exportSucceeded = "success"
+	exportFailed    = "failed"
+)
+
+// Exporter periodically collects metrics, converts them to OTLP and posts them to an OTLP/HTTP endpoint,
+// using the JSON encoding. Counters become monotonic cumulative sums, gauges and untyped metrics gauges, and
+// histograms and summaries their OTLP counterparts, starting when first exported or when their value last
+// dropped. The pod name and namespace of each series become the attributes of its resource.
+type Exporter struct {
+	// URL is the full metrics endpoint, usually ending in /v1/metrics.
+	URL    string
+	Client handlers.HTTPClient
+	// Collect runs a fan-out and returns its responses, as AggregateMetrics does.
+	Collect func(ctx context.Context) []string
+	// Interval is how often metrics are exported. It also bounds every fan-out and export request.
+	Interval time.Duration
+	// Headers are added to every export request, e.g. for authentication.
+	Headers http.Header
+	// Exports, if set, counts exports by outcome ("success" or "failed").
+	Exports func(result string) *selfmetrics.Counter
+
+	starts startTimes
+}
+
+// Run exports metrics every Interval until ctx is cancelled.
+// Failed exports are not retried: the next export carries fresh cumulative values anyway.
+func (e *Exporter) Run(ctx context.Context) {
+	ticker := time.NewTicker(e.Interval)
+	defer ticker.Stop()
+	for {
+		if err := e.export(ctx); err != nil {
+			logging.FromContext(ctx).ErrorContext(ctx, "OTLP export failed", "url", e.URL, "error", err)
+			e.record(exportFailed)
+		} else {
+			e.record(exportSucceeded)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// export runs a fan-out and posts its conversion.
+func (e *Exporter) export(ctx context.Context) error {
+	exportCtx, cancel := context.WithTimeout(ctx, e.Interval)
+	defer cancel()
+
+	request := convert(e.Collect(exportCtx), time.Now(), &e.starts)
+	if len(request.ResourceMetrics) == 0 {
+		return nil
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return fmt.Errorf("encoding metrics: %w", err)
+	}
+
+	return post(exportCtx, e.Client, e.URL, e.Headers, body)
+}
+
+// post sends an encoded export request, returning an error with the collector's explanation, if any, when it
+// doesn't accept it.
+func post(ctx context.Context, client handlers.HTTPClient, url string, headers http.Header, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("creating request for %s: %w", url, err)
+	}
+	for name, values := range headers {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("request to %s failed: %w", url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusOK && resp.StatusCode < http.StatusMultipleChoices {
+		return nil
+	}
+	err = fmt.Errorf("%s returned status code %d", url, resp.StatusCode)
+	// The collector may explain why it rejected the export
+	const maxErrorBody = 512
+	if message, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody)); len(bytes.TrimSpace(message)) > 0 {
+		err = fmt.Errorf("%w: %s", err, bytes.TrimSpace(message))
+	}
+
+	return err
+}
+
+func (e *Exporter) record(result string) {
+	if e.Exports != nil {
+		e.Exports(result).Inc()
+	}
+}
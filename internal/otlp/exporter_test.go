@@ -0,0 +1,351 @@
+package otlp_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/canonical/metrics-k8s-proxy/internal/handlers"
+	"github.com/canonical/metrics-k8s-proxy/internal/otlp"
+	"github.com/canonical/metrics-k8s-proxy/internal/selfmetrics"
+)
+
+// The subset of the OTLP JSON encoding the tests look at. Numbers that may be NaN are kept as raw JSON.
+type exportRequest struct {
+	ResourceMetrics []struct {
+		Resource struct {
+			Attributes []keyValue `json:"attributes"`
+		} `json:"resource"`
+		ScopeMetrics []struct {
+			Scope struct {
+				Name string `json:"name"`
+			} `json:"scope"`
+			Metrics []metric `json:"metrics"`
+		} `json:"scopeMetrics"`
+	} `json:"resourceMetrics"`
+}
+
+type keyValue struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+type dataPoint struct {
+	Attributes        []keyValue        `json:"attributes"`
+	StartTimeUnixNano string            `json:"startTimeUnixNano"`
+	TimeUnixNano      string            `json:"timeUnixNano"`
+	AsDouble          json.RawMessage   `json:"asDouble"`
+	Count             string            `json:"count"`
+	Sum               json.RawMessage   `json:"sum"`
+	BucketCounts      []string          `json:"bucketCounts"`
+	ExplicitBounds    []json.RawMessage `json:"explicitBounds"`
+	QuantileValues    []struct {
+		Quantile json.RawMessage `json:"quantile"`
+		Value    json.RawMessage `json:"value"`
+	} `json:"quantileValues"`
+}
+
+type metric struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Gauge       *struct {
+		DataPoints []dataPoint `json:"dataPoints"`
+	} `json:"gauge"`
+	Sum *struct {
+		DataPoints             []dataPoint `json:"dataPoints"`
+		AggregationTemporality int         `json:"aggregationTemporality"`
+		IsMonotonic            bool        `json:"isMonotonic"`
+	} `json:"sum"`
+	Histogram *struct {
+		DataPoints             []dataPoint `json:"dataPoints"`
+		AggregationTemporality int         `json:"aggregationTemporality"`
+	} `json:"histogram"`
+	Summary *struct {
+		DataPoints []dataPoint `json:"dataPoints"`
+	} `json:"summary"`
+}
+
+// collector is a stand-in for an OpenTelemetry Collector's OTLP/HTTP receiver.
+type collector struct {
+	mu       sync.Mutex
+	requests []exportRequest
+	status   int
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var request exportRequest
+	if r.Header.Get("Content-Type") != "application/json" || r.Header.Get("Authorization") != "Bearer token" {
+		http.Error(w, "unexpected headers", http.StatusBadRequest)
+		return
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.requests = append(c.requests, request)
+	if c.status != 0 {
+		w.WriteHeader(c.status)
+	}
+}
+
+func (c *collector) first() exportRequest {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.requests[0]
+}
+
+// export runs the exporter against the collector until the first export is counted with the given result.
+func export(t *testing.T, c *collector, result string, responses ...string) {
+	t.Helper()
+	srv := httptest.NewServer(c)
+	defer srv.Close()
+
+	exports := selfmetrics.NewRegistry().NewCounterVec("exports_total", "Exports.", "result")
+	exporter := &otlp.Exporter{
+		URL:    srv.URL + "/v1/metrics",
+		Client: &handlers.RealHTTPClient{Client: &http.Client{}},
+		Collect: func(_ context.Context) []string {
+			return responses
+		},
+		Interval: time.Hour,
+		Headers:  http.Header{"Authorization": []string{"Bearer token"}},
+		Exports: func(result string) *selfmetrics.Counter {
+			return exports.WithLabelValues(result)
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		exporter.Run(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for exports.WithLabelValues(result).Value() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for a %q export", result)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestExporter_ConvertsFamilies(t *testing.T) {
+	pod1 := `# HELP requests_total Total requests.
+# TYPE requests_total counter
+requests_total{k8s_pod_name="pod1",k8s_namespace="default",code="200"} 10 1700000000000
+# TYPE temperature gauge
+temperature{k8s_pod_name="pod1",k8s_namespace="default"} NaN
+# TYPE latency_seconds histogram
+latency_seconds_bucket{k8s_pod_name="pod1",k8s_namespace="default",le="0.1"} 1
+latency_seconds_bucket{k8s_pod_name="pod1",k8s_namespace="default",le="0.5"} 3
+latency_seconds_bucket{k8s_pod_name="pod1",k8s_namespace="default",le="+Inf"} 4
+latency_seconds_sum{k8s_pod_name="pod1",k8s_namespace="default"} 1.25
+latency_seconds_count{k8s_pod_name="pod1",k8s_namespace="default"} 4
+# TYPE rpc_seconds summary
+rpc_seconds{k8s_pod_name="pod1",k8s_namespace="default",quantile="0.5"} 0.2
+rpc_seconds{k8s_pod_name="pod1",k8s_namespace="default",quantile="0.99"} 0.9
+rpc_seconds_sum{k8s_pod_name="pod1",k8s_namespace="default"} 3
+rpc_seconds_count{k8s_pod_name="pod1",k8s_namespace="default"} 7
+
+up{k8s_pod_name="pod1",k8s_namespace="default"} 1
+`
+	pod2 := "\nup{k8s_pod_name=\"pod2\",k8s_namespace=\"other\"} 0\n"
+
+	c := &collector{}
+	export(t, c, "success", pod1, pod2)
+	request := c.first()
+
+	if len(request.ResourceMetrics) != 2 {
+		t.Fatalf("got %d resources, want 2", len(request.ResourceMetrics))
+	}
+	wantResource := []keyValue{attribute("k8s.namespace.name", "default"), attribute("k8s.pod.name", "pod1")}
+	if got := request.ResourceMetrics[0].Resource.Attributes; !reflect.DeepEqual(got, wantResource) {
+		t.Errorf("resource attributes = %+v, want %+v", got, wantResource)
+	}
+	scope := request.ResourceMetrics[0].ScopeMetrics[0]
+	if scope.Scope.Name != "metrics-k8s-proxy" {
+		t.Errorf("scope name = %q, want metrics-k8s-proxy", scope.Scope.Name)
+	}
+	metrics := map[string]metric{}
+	for _, m := range scope.Metrics {
+		metrics[m.Name] = m
+	}
+
+	requests := metrics["requests_total"]
+	if requests.Sum == nil || !requests.Sum.IsMonotonic || requests.Sum.AggregationTemporality != 2 {
+		t.Fatalf("requests_total = %+v, want a monotonic cumulative sum", requests)
+	}
+	point := requests.Sum.DataPoints[0]
+	if string(point.AsDouble) != "10" || point.TimeUnixNano != "1700000000000000000" ||
+		!reflect.DeepEqual(point.Attributes, []keyValue{attribute("code", "200")}) {
+		t.Errorf("requests_total data point = %+v", point)
+	}
+	if requests.Description != "Total requests." {
+		t.Errorf("requests_total description = %q", requests.Description)
+	}
+
+	if temperature := metrics["temperature"]; temperature.Gauge == nil ||
+		string(temperature.Gauge.DataPoints[0].AsDouble) != `"NaN"` {
+		t.Errorf("temperature = %+v, want a NaN gauge", temperature)
+	}
+	if up := metrics["up"]; up.Gauge == nil || string(up.Gauge.DataPoints[0].AsDouble) != "1" {
+		t.Errorf("up = %+v, want a gauge of 1", up)
+	}
+
+	latency := metrics["latency_seconds"]
+	if latency.Histogram == nil {
+		t.Fatalf("latency_seconds = %+v, want a histogram", latency)
+	}
+	point = latency.Histogram.DataPoints[0]
+	if point.Count != "4" || string(point.Sum) != "1.25" ||
+		!reflect.DeepEqual(point.BucketCounts, []string{"1", "2", "1"}) ||
+		!reflect.DeepEqual(point.ExplicitBounds, []json.RawMessage{json.RawMessage("0.1"), json.RawMessage("0.5")}) ||
+		len(point.Attributes) != 0 {
+		t.Errorf("latency_seconds data point = %+v", point)
+	}
+
+	rpc := metrics["rpc_seconds"]
+	if rpc.Summary == nil {
+		t.Fatalf("rpc_seconds = %+v, want a summary", rpc)
+	}
+	point = rpc.Summary.DataPoints[0]
+	if point.Count != "7" || string(point.Sum) != "3" || len(point.QuantileValues) != 2 ||
+		string(point.QuantileValues[1].Quantile) != "0.99" || string(point.QuantileValues[1].Value) != "0.9" {
+		t.Errorf("rpc_seconds data point = %+v", point)
+	}
+
+	wantResource = []keyValue{attribute("k8s.namespace.name", "other"), attribute("k8s.pod.name", "pod2")}
+	if got := request.ResourceMetrics[1].Resource.Attributes; !reflect.DeepEqual(got, wantResource) {
+		t.Errorf("resource attributes = %+v, want %+v", got, wantResource)
+	}
+}
+
+func TestExporter_CountsFailures(t *testing.T) {
+	export(t, &collector{status: http.StatusServiceUnavailable}, "failed", "up 1")
+}
+
+func attribute(key, value string) keyValue {
+	kv := keyValue{Key: key}
+	kv.Value.StringValue = value
+
+	return kv
+}
+
+func TestExporter_StartTimes(t *testing.T) {
+	// The counter grows, then drops as its pod restarts
+	responses := []string{
+		"# TYPE requests_total counter\nrequests_total{k8s_pod_name=\"pod1\"} 10 1000\n" +
+			"# TYPE connections gauge\nconnections 3",
+		"# TYPE requests_total counter\nrequests_total{k8s_pod_name=\"pod1\"} 15 2000",
+		"# TYPE requests_total counter\nrequests_total{k8s_pod_name=\"pod1\"} 3 3000",
+		"# TYPE requests_total counter\nrequests_total{k8s_pod_name=\"pod1\"} 4 4000",
+	}
+	c := &collector{}
+	srv := httptest.NewServer(c)
+	defer srv.Close()
+
+	var mu sync.Mutex
+	exporter := &otlp.Exporter{
+		URL:    srv.URL + "/v1/metrics",
+		Client: &handlers.RealHTTPClient{Client: &http.Client{}},
+		Collect: func(_ context.Context) []string {
+			mu.Lock()
+			defer mu.Unlock()
+			response := responses[0]
+			if len(responses) > 1 {
+				responses = responses[1:]
+			}
+			return []string{response}
+		},
+		Interval: 5 * time.Millisecond,
+		Headers:  http.Header{"Authorization": []string{"Bearer token"}},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		exporter.Run(ctx)
+		close(done)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c.mu.Lock()
+		exported := len(c.requests)
+		c.mu.Unlock()
+		if exported >= 4 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for 4 exports, got %d", exported)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	wantStarts := []string{"1000000000", "1000000000", "2000000000", "2000000000"}
+	for i, want := range wantStarts {
+		metrics := c.requests[i].ResourceMetrics[0].ScopeMetrics[0].Metrics
+		if got := metrics[0].Sum.DataPoints[0].StartTimeUnixNano; got != want {
+			t.Errorf("export %d: requests_total start time = %q, want %q", i, got, want)
+		}
+	}
+	gauge := c.requests[0].ResourceMetrics[1].ScopeMetrics[0].Metrics[0]
+	if gauge.Name != "connections" || gauge.Gauge.DataPoints[0].StartTimeUnixNano != "" {
+		t.Errorf("connections = %+v, want a gauge without a start time", gauge)
+	}
+}
+
+func TestExporter_ResourcesFromPodLabels(t *testing.T) {
+	// The first series was summed across pods, and the other two come from different pods
+	response := "# TYPE connections gauge\n" +
+		"connections 7\n" +
+		"# TYPE requests_total counter\n" +
+		"requests_total{k8s_pod_name=\"pod1\",k8s_namespace=\"default\"} 1\n" +
+		"requests_total{k8s_namespace=\"default\",k8s_pod_name=\"pod2\"} 2\n" +
+		"up{k8s_pod_name=\"pod1\",k8s_namespace=\"default\"} 1"
+
+	c := &collector{}
+	export(t, c, "success", response)
+	request := c.first()
+
+	if len(request.ResourceMetrics) != 3 {
+		t.Fatalf("got %d resources, want 3", len(request.ResourceMetrics))
+	}
+	wantResources := [][]keyValue{
+		nil,
+		{attribute("k8s.namespace.name", "default"), attribute("k8s.pod.name", "pod1")},
+		{attribute("k8s.namespace.name", "default"), attribute("k8s.pod.name", "pod2")},
+	}
+	wantMetrics := [][]string{{"connections"}, {"requests_total", "up"}, {"requests_total"}}
+	for i, resource := range request.ResourceMetrics {
+		if got := resource.Resource.Attributes; len(got) != len(wantResources[i]) ||
+			(len(got) > 0 && !reflect.DeepEqual(got, wantResources[i])) {
+			t.Errorf("resource %d attributes = %+v, want %+v", i, got, wantResources[i])
+		}
+		names := []string{}
+		for _, m := range resource.ScopeMetrics[0].Metrics {
+			names = append(names, m.Name)
+		}
+		if !reflect.DeepEqual(names, wantMetrics[i]) {
+			t.Errorf("resource %d metrics = %v, want %v", i, names, wantMetrics[i])
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package otlp
+
+import (
+	"strings"
+
+	"github.com/canonical/metrics-k8s-proxy/internal/util"
+)
+
+// metricType is the type of a metric family, as declared by its `# TYPE` line.
+type metricType string
+
+const (
+	typeCounter   metricType = "counter"
+	typeGauge     metricType = "gauge"
+	typeHistogram metricType = "histogram"
+	typeSummary   metricType = "summary"
+	typeUntyped   metricType = "untyped"
+)
+
+// Suffixes of the series that make up histogram and summary families, and of creation times.
+const (
+	suffixCreated = "_created"
+	suffixBucket  = "_bucket"
+	suffixSum     = "_sum"
+	suffixCount   = "_count"
+)
+
+// family is a metric family parsed from the text exposition format.
+type family struct {
+	name    string
+	help    string
+	typ     metricType
+	samples []util.Sample
+}
+
+// parseFamilies groups the samples of a text exposition body into families, in order of first appearance.
+// Samples without a `# TYPE` line form untyped families of their own. Unparsable lines are skipped.
+func parseFamilies(metricsData string) []*family {
+	families := []*family{}
+	byName := map[string]*family{}
+	// The type of every family, for util.FamilyOf to find the family of suffixed samples
+	types := map[string]string{}
+	get := func(name string) *family {
+		f, exists := byName[name]
+		if !exists {
+			f = &family{name: name, typ: typeUntyped}
+			byName[name] = f
+			types[name] = string(typeUntyped)
+			families = append(families, f)
+		}
+
+		return f
+	}
+
+	for _, line := range strings.Split(metricsData, "\n") {
+		if strings.HasPrefix(line, "#") {
+			if comment, ok := util.ParseComment(line); ok {
+				f := get(comment.Family)
+				switch comment.Keyword {
+				case "HELP":
+					f.help = comment.Text
+				case "TYPE":
+					f.typ = metricType(strings.TrimSpace(comment.Text))
+					types[comment.Family] = string(f.typ)
+				}
+			}
+
+			continue
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		sample, err := util.ParseSample(line)
+		if err != nil {
+			continue
+		}
+		f := get(util.FamilyOf(sample.Name, types))
+		f.samples = append(f.samples, sample)
+	}
+
+	return families
+}
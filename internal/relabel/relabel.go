@@ -0,0 +1,181 @@
+// Package relabel implements the subset of Prometheus' metric_relabel_configs that the proxy applies
+// to scraped samples before they are returned.
+package relabel
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/canonical/metrics-k8s-proxy/internal/util"
+)
+
+// Action is the relabeling action to perform, named as in Prometheus.
+type Action string
+
+const (
+	Replace   Action = "replace"
+	Keep      Action = "keep"
+	Drop      Action = "drop"
+	LabelDrop Action = "labeldrop"
+	LabelKeep Action = "labelkeep"
+)
+
+const (
+	defaultSeparator   = ";"
+	defaultRegex       = "(.*)"
+	defaultReplacement = "$1"
+)
+
+// Config is a single relabeling step as it appears in the jobs file.
+// Unset fields take the same defaults as in Prometheus.
+type Config struct {
+	SourceLabels []string `json:"source_labels,omitempty"`
+	Separator    string   `json:"separator,omitempty"`
+	Regex        string   `json:"regex,omitempty"`
+	TargetLabel  string   `json:"target_label,omitempty"`
+	Replacement  *string  `json:"replacement,omitempty"`
+	Action       Action   `json:"action,omitempty"`
+}
+
+// Rule is a compiled Config, ready to be applied to samples.
+type Rule struct {
+	sourceLabels []string
+	separator    string
+	regex        *regexp.Regexp
+	targetLabel  string
+	replacement  string
+	action       Action
+}
+
+// Compile validates the given configs and compiles them into rules.
+func Compile(configs []Config) ([]Rule, error) {
+	rules := make([]Rule, 0, len(configs))
+	for i, cfg := range configs {
+		rule := Rule{
+			sourceLabels: cfg.SourceLabels,
+			separator:    cfg.Separator,
+			targetLabel:  cfg.TargetLabel,
+			replacement:  defaultReplacement,
+			action:       cfg.Action,
+		}
+		if rule.separator == "" {
+			rule.separator = defaultSeparator
+		}
+		if cfg.Replacement != nil {
+			rule.replacement = *cfg.Replacement
+		}
+		if rule.action == "" {
+			rule.action = Replace
+		}
+
+		pattern := cfg.Regex
+		if pattern == "" {
+			pattern = defaultRegex
+		}
+		re, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("relabel config %d: invalid regex %q: %w", i, pattern, err)
+		}
+		rule.regex = re
+
+		switch rule.action {
+		case Replace:
+			if rule.targetLabel == "" {
+				return nil, fmt.Errorf("relabel config %d: target_label is required for action %q", i, rule.action)
+			}
+		case Keep, Drop, LabelDrop, LabelKeep:
+		default:
+			return nil, fmt.Errorf("relabel config %d: unknown action %q", i, rule.action)
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+// SetLabel returns a rule that unconditionally sets a label to a fixed value.
+func SetLabel(name, value string) Rule {
+	return Rule{
+		separator:   defaultSeparator,
+		regex:       regexp.MustCompile("^(?:" + defaultRegex + ")$"),
+		targetLabel: name,
+		replacement: strings.ReplaceAll(value, "$", "$$"),
+		action:      Replace,
+	}
+}
+
+// Process applies the rules to a sample in order.
+// It returns the relabeled sample and false if the sample was dropped.
+// The sample's label slice may be modified in place.
+func Process(sample util.Sample, rules []Rule) (util.Sample, bool) {
+	for _, rule := range rules {
+		switch rule.action {
+		case Replace:
+			value := rule.sourceValue(sample)
+			indexes := rule.regex.FindStringSubmatchIndex(value)
+			if indexes == nil {
+				continue
+			}
+			target := string(rule.regex.ExpandString(nil, rule.targetLabel, value, indexes))
+			replacement := string(rule.regex.ExpandString(nil, rule.replacement, value, indexes))
+			sample.Set(target, replacement)
+		case Keep:
+			if !rule.regex.MatchString(rule.sourceValue(sample)) {
+				return sample, false
+			}
+		case Drop:
+			if rule.regex.MatchString(rule.sourceValue(sample)) {
+				return sample, false
+			}
+		case LabelDrop, LabelKeep:
+			kept := sample.Labels[:0]
+			for _, label := range sample.Labels {
+				if rule.regex.MatchString(label.Name) == (rule.action == LabelKeep) {
+					kept = append(kept, label)
+				}
+			}
+			sample.Labels = kept
+		}
+	}
+
+	return sample, true
+}
+
+// Apply relabels every sample line of the given metrics text.
+// Comments are passed through untouched, as are lines that can't be parsed as samples.
+func Apply(metricsData string, rules []Rule) string {
+	if len(rules) == 0 {
+		return metricsData
+	}
+
+	lines := strings.Split(metricsData, "\n")
+	relabeled := make([]string, 0, len(lines))
+	for _, line := range lines {
+		if strings.HasPrefix(line, "#") || strings.TrimSpace(line) == "" {
+			relabeled = append(relabeled, line)
+			continue
+		}
+
+		sample, err := util.ParseSample(line)
+		if err != nil {
+			relabeled = append(relabeled, line)
+			continue
+		}
+		if processed, keep := Process(sample, rules); keep {
+			relabeled = append(relabeled, processed.String())
+		}
+	}
+
+	return strings.Join(relabeled, "\n")
+}
+
+func (r Rule) sourceValue(sample util.Sample) string {
+	values := make([]string, 0, len(r.sourceLabels))
+	for _, name := range r.sourceLabels {
+		values = append(values, sample.Get(name))
+	}
+
+	return strings.Join(values, r.separator)
+}
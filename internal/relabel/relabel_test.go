@@ -0,0 +1,104 @@
+package relabel_test
+
+import (
+	"testing"
+
+	"github.com/canonical/metrics-k8s-proxy/internal/relabel"
+)
+
+func strPtr(s string) *string {
+	return &s
+}
+
+func TestApply(t *testing.T) {
+	metrics := "# HELP requests_total Total requests.\n" +
+		"requests_total{k8s_pod_name=\"pod-1\",method=\"GET\"} 5\n" +
+		"go_goroutines{k8s_pod_name=\"pod-1\"} 10\n"
+
+	tests := []struct {
+		name    string
+		configs []relabel.Config
+		want    string
+	}{
+		{
+			name:    "no rules",
+			configs: nil,
+			want:    metrics,
+		},
+		{
+			name:    "drop by metric name",
+			configs: []relabel.Config{{SourceLabels: []string{"__name__"}, Regex: "go_.*", Action: relabel.Drop}},
+			want: "# HELP requests_total Total requests.\n" +
+				"requests_total{k8s_pod_name=\"pod-1\",method=\"GET\"} 5\n",
+		},
+		{
+			name:    "keep by label",
+			configs: []relabel.Config{{SourceLabels: []string{"method"}, Regex: "GET", Action: relabel.Keep}},
+			want: "# HELP requests_total Total requests.\n" +
+				"requests_total{k8s_pod_name=\"pod-1\",method=\"GET\"} 5\n",
+		},
+		{
+			name: "replace with capture group",
+			configs: []relabel.Config{{
+				SourceLabels: []string{"k8s_pod_name"},
+				Regex:        "pod-(.*)",
+				TargetLabel:  "instance",
+				Replacement:  strPtr("replica-$1"),
+			}},
+			want: "# HELP requests_total Total requests.\n" +
+				"requests_total{k8s_pod_name=\"pod-1\",method=\"GET\",instance=\"replica-1\"} 5\n" +
+				"go_goroutines{k8s_pod_name=\"pod-1\",instance=\"replica-1\"} 10\n",
+		},
+		{
+			name:    "labeldrop",
+			configs: []relabel.Config{{Regex: "method", Action: relabel.LabelDrop}},
+			want: "# HELP requests_total Total requests.\n" +
+				"requests_total{k8s_pod_name=\"pod-1\"} 5\n" +
+				"go_goroutines{k8s_pod_name=\"pod-1\"} 10\n",
+		},
+		{
+			name:    "labelkeep",
+			configs: []relabel.Config{{Regex: "method", Action: relabel.LabelKeep}},
+			want: "# HELP requests_total Total requests.\n" +
+				"requests_total{method=\"GET\"} 5\n" +
+				"go_goroutines 10\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules, err := relabel.Compile(tt.configs)
+			if err != nil {
+				t.Fatalf("Compile() error = %v", err)
+			}
+			if got := relabel.Apply(metrics, rules); got != tt.want {
+				t.Errorf("Apply() got = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		config relabel.Config
+	}{
+		{name: "invalid regex", config: relabel.Config{Regex: "(", Action: relabel.Drop}},
+		{name: "unknown action", config: relabel.Config{Action: "hashmod"}},
+		{name: "replace without target", config: relabel.Config{SourceLabels: []string{"a"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := relabel.Compile([]relabel.Config{tt.config}); err == nil {
+				t.Errorf("Compile() expected an error for %+v", tt.config)
+			}
+		})
+	}
+}
+
+func TestSetLabel(t *testing.T) {
+	rules := []relabel.Rule{relabel.SetLabel("job", "cost$1")}
+	got := relabel.Apply("up{k8s_pod_name=\"pod-1\"} 1", rules)
+	if want := "up{k8s_pod_name=\"pod-1\",job=\"cost$1\"} 1"; got != want {
+		t.Errorf("Apply() got = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,240 @@
+package relabel
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/canonical/metrics-k8s-proxy/internal/util"
+)
+
+// MatchType is how a Matcher compares a label value, with the same operators as PromQL.
+type MatchType string
+
+const (
+	MatchEqual     MatchType = "="
+	MatchNotEqual  MatchType = "!="
+	MatchRegexp    MatchType = "=~"
+	MatchNotRegexp MatchType = "!~"
+)
+
+// Matcher compares the value of a single label. The metric name is matched as the `__name__` label.
+type Matcher struct {
+	name      string
+	matchType MatchType
+	value     string
+	regex     *regexp.Regexp
+}
+
+// Matches reports whether the sample's label satisfies the matcher. A missing label has an empty value.
+func (m Matcher) Matches(sample util.Sample) bool {
+	value := sample.Get(m.name)
+	switch m.matchType {
+	case MatchEqual:
+		return value == m.value
+	case MatchNotEqual:
+		return value != m.value
+	case MatchRegexp:
+		return m.regex.MatchString(value)
+	case MatchNotRegexp:
+		return !m.regex.MatchString(value)
+	}
+
+	return false
+}
+
+// Selector is a series selector such as `http_requests_total{code=~"5.."}`, as taken by match[] on Prometheus'
+// /federate endpoint. A sample is selected when it satisfies every matcher.
+type Selector []Matcher
+
+var (
+	errEmptySelector       = errors.New("selector has no matchers")
+	errUnterminatedMatcher = errors.New("unterminated label matchers")
+	errInvalidMatcher      = errors.New("invalid label matcher")
+)
+
+// Operators in the order they are tried, so that `=~` isn't read as `=`.
+func matchOperators() []MatchType {
+	return []MatchType{MatchRegexp, MatchNotRegexp, MatchNotEqual, MatchEqual}
+}
+
+// ParseSelector parses a series selector: a metric name, label matchers in braces, or both.
+func ParseSelector(s string) (Selector, error) {
+	input := s
+	s = strings.TrimSpace(s)
+	selector := Selector{}
+
+	if name := leadingName(s); name != "" {
+		selector = append(selector, Matcher{name: "__name__", matchType: MatchEqual, value: name})
+		s = strings.TrimSpace(s[len(name):])
+	}
+	if strings.HasPrefix(s, "{") {
+		matchers, rest, err := parseMatchers(s[1:])
+		if err != nil {
+			return nil, fmt.Errorf("%w in %q", err, input)
+		}
+		selector = append(selector, matchers...)
+		s = strings.TrimSpace(rest)
+	}
+
+	if s != "" {
+		return nil, fmt.Errorf("%w: unexpected %q in %q", errInvalidMatcher, s, input)
+	}
+	if len(selector) == 0 {
+		return nil, fmt.Errorf("%w: %q", errEmptySelector, input)
+	}
+
+	return selector, nil
+}
+
+// parseMatchers parses the inside of a `{...}` block and returns the matchers and the text following `}`.
+func parseMatchers(s string) ([]Matcher, string, error) {
+	matchers := []Matcher{}
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		if strings.HasPrefix(s, "}") {
+			return matchers, s[1:], nil
+		}
+		if s == "" {
+			return nil, "", errUnterminatedMatcher
+		}
+
+		name := leadingName(s)
+		if name == "" {
+			return nil, "", fmt.Errorf("%w: expected a label name at %q", errInvalidMatcher, s)
+		}
+		s = strings.TrimLeft(s[len(name):], " \t")
+
+		matcher := Matcher{name: name}
+		for _, op := range matchOperators() {
+			if strings.HasPrefix(s, string(op)) {
+				matcher.matchType = op
+				s = strings.TrimLeft(s[len(op):], " \t")
+
+				break
+			}
+		}
+		if matcher.matchType == "" {
+			return nil, "", fmt.Errorf("%w: expected an operator after %q", errInvalidMatcher, name)
+		}
+
+		value, rest, err := unquote(s)
+		if err != nil {
+			return nil, "", err
+		}
+		matcher.value = value
+		s = rest
+
+		if matcher.matchType == MatchRegexp || matcher.matchType == MatchNotRegexp {
+			if matcher.regex, err = regexp.Compile("^(?:" + value + ")$"); err != nil {
+				return nil, "", fmt.Errorf("%w: invalid regex %q: %w", errInvalidMatcher, value, err)
+			}
+		}
+		matchers = append(matchers, matcher)
+	}
+}
+
+// leadingName returns the metric or label name at the start of s, if any.
+func leadingName(s string) string {
+	for i, c := range s {
+		isLetter := c == '_' || c == ':' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+		if !isLetter && (i == 0 || c < '0' || c > '9') {
+			return s[:i]
+		}
+	}
+
+	return s
+}
+
+// unquote reads the double-quoted string at the start of s and returns its value and the text following it.
+func unquote(s string) (string, string, error) {
+	if !strings.HasPrefix(s, `"`) {
+		return "", "", fmt.Errorf("%w: expected a quoted value at %q", errInvalidMatcher, s)
+	}
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			value, err := strconv.Unquote(s[:i+1])
+			if err != nil {
+				return "", "", fmt.Errorf("%w: %s: %w", errInvalidMatcher, s[:i+1], err)
+			}
+
+			return value, s[i+1:], nil
+		}
+	}
+
+	return "", "", errUnterminatedMatcher
+}
+
+// Matches reports whether the sample satisfies every matcher of the selector.
+func (s Selector) Matches(sample util.Sample) bool {
+	for _, matcher := range s {
+		if !matcher.Matches(sample) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Filter keeps the samples of metricsData selected by any of the selectors, along with the HELP and TYPE
+// comments of their metric families. Empty lines are kept, and other lines that can't be parsed as samples
+// are dropped.
+func Filter(metricsData string, selectors []Selector) string {
+	lines := strings.Split(metricsData, "\n")
+	kept := make([]bool, len(lines))
+	names := map[string]bool{}
+	for i, line := range lines {
+		if strings.HasPrefix(line, "#") || strings.TrimSpace(line) == "" {
+			continue
+		}
+		sample, err := util.ParseSample(line)
+		if err != nil {
+			continue
+		}
+		for _, selector := range selectors {
+			if selector.Matches(sample) {
+				kept[i] = true
+				names[sample.Name] = true
+
+				break
+			}
+		}
+	}
+
+	filtered := []string{}
+	for i, line := range lines {
+		if kept[i] || line == "" || (strings.HasPrefix(line, "#") && familyKept(line, names)) {
+			filtered = append(filtered, line)
+		}
+	}
+
+	return strings.Join(filtered, "\n")
+}
+
+// familyKept reports whether a HELP or TYPE comment describes a family with some of the named samples.
+func familyKept(line string, names map[string]bool) bool {
+	comment, ok := util.ParseComment(line)
+	if !ok {
+		return false
+	}
+	// A HELP comment doesn't tell the family's type, so it keeps the samples with the suffixes of any type
+	metricType := ""
+	if comment.Keyword == "TYPE" {
+		metricType = comment.Text
+	}
+	if names[comment.Family] {
+		return true
+	}
+	for _, suffix := range util.FamilySuffixes(metricType) {
+		if names[comment.Family+suffix] {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,100 @@
+package relabel_test
+
+import (
+	"testing"
+
+	"github.com/canonical/metrics-k8s-proxy/internal/relabel"
+)
+
+func TestFilter(t *testing.T) {
+	metrics := "# HELP requests_total Total requests.\n" +
+		"# TYPE requests_total counter\n" +
+		"requests_total{k8s_pod_name=\"pod-1\",code=\"200\"} 5\n" +
+		"requests_total{k8s_pod_name=\"pod-1\",code=\"503\"} 1\n" +
+		"# TYPE latency_seconds histogram\n" +
+		"latency_seconds_bucket{k8s_pod_name=\"pod-1\",le=\"+Inf\"} 3\n" +
+		"latency_seconds_count{k8s_pod_name=\"pod-1\"} 3\n" +
+		"up{k8s_pod_name=\"pod-1\",k8s_namespace=\"default\"} 1\n"
+
+	tests := []struct {
+		name      string
+		selectors []string
+		want      string
+	}{
+		{
+			name:      "metric name",
+			selectors: []string{"up"},
+			want:      "up{k8s_pod_name=\"pod-1\",k8s_namespace=\"default\"} 1\n",
+		},
+		{
+			name:      "label matchers keep family comments",
+			selectors: []string{`requests_total{code!="200"}`},
+			want: "# HELP requests_total Total requests.\n" +
+				"# TYPE requests_total counter\n" +
+				"requests_total{k8s_pod_name=\"pod-1\",code=\"503\"} 1\n",
+		},
+		{
+			name:      "regex on the name matches histogram series",
+			selectors: []string{`{__name__=~"latency_seconds_.+", le !~ "0\\.5|1"}`},
+			want: "# TYPE latency_seconds histogram\n" +
+				"latency_seconds_bucket{k8s_pod_name=\"pod-1\",le=\"+Inf\"} 3\n" +
+				"latency_seconds_count{k8s_pod_name=\"pod-1\"} 3\n",
+		},
+		{
+			name:      "union of selectors",
+			selectors: []string{`up`, `requests_total{code="200"}`},
+			want: "# HELP requests_total Total requests.\n" +
+				"# TYPE requests_total counter\n" +
+				"requests_total{k8s_pod_name=\"pod-1\",code=\"200\"} 5\n" +
+				"up{k8s_pod_name=\"pod-1\",k8s_namespace=\"default\"} 1\n",
+		},
+		{
+			name:      "missing label matches empty value",
+			selectors: []string{`{code=""}`},
+			want: "# TYPE latency_seconds histogram\n" +
+				"latency_seconds_bucket{k8s_pod_name=\"pod-1\",le=\"+Inf\"} 3\n" +
+				"latency_seconds_count{k8s_pod_name=\"pod-1\"} 3\n" +
+				"up{k8s_pod_name=\"pod-1\",k8s_namespace=\"default\"} 1\n",
+		},
+		{
+			name:      "no match",
+			selectors: []string{`process_cpu_seconds_total`},
+			want:      "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			selectors := []relabel.Selector{}
+			for _, s := range tt.selectors {
+				selector, err := relabel.ParseSelector(s)
+				if err != nil {
+					t.Fatalf("ParseSelector(%q) error = %v", s, err)
+				}
+				selectors = append(selectors, selector)
+			}
+			if got := relabel.Filter(metrics, selectors); got != tt.want {
+				t.Errorf("Filter() got = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSelectorErrors(t *testing.T) {
+	tests := []string{
+		``,
+		`{}`,
+		`up{code="200"`,
+		`up{code}`,
+		`up{code=200}`,
+		`up{code=~"("}`,
+		`up{code="200"} extra`,
+		`{"code"="200"}`,
+	}
+	for _, s := range tests {
+		t.Run(s, func(t *testing.T) {
+			if _, err := relabel.ParseSelector(s); err == nil {
+				t.Errorf("ParseSelector(%q) succeeded, want an error", s)
+			}
+		})
+	}
+}
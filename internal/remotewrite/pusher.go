@@ -0,0 +1,206 @@
+// Package remotewrite pushes the proxy's aggregated metrics to a Prometheus remote-write endpoint, for setups
+// where Prometheus can't reach the proxy.
+package remotewrite
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/canonical/metrics-k8s-proxy/internal/handlers"
+	"github.com/canonical/metrics-k8s-proxy/internal/logging"
+	"github.com/canonical/metrics-k8s-proxy/internal/selfmetrics"
+	"github.com/klauspost/compress/snappy"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// Batch outcomes, as reported in the Pusher's Batches counter.
+const (
+	batchSent    = "sent"    // Accepted by the receiver
+	batchFailed  = "failed"  // Rejected, or still failing after every attempt
+	batchDropped = "dropped" // Evicted from a full queue before it could be sent
+)
+
+// remoteWriteVersion is the protocol version announced to the receiver.
+const remoteWriteVersion = "0.1.0"
+
+// Pusher periodically collects metrics and pushes them to a remote-write endpoint.
+// Collected batches wait in a bounded queue, so that a slow or unavailable receiver doesn't hold up collection.
+type Pusher struct {
+	URL    string
+	Client handlers.HTTPClient
+	// Collect runs a fan-out and returns its responses, as AggregateMetrics does.
+	Collect func(ctx context.Context) []string
+	// Interval is how often metrics are collected. It also bounds every fan-out and push request.
+	Interval time.Duration
+	// Headers are added to every push request, e.g. for authentication.
+	Headers http.Header
+	// BearerTokenFile, if set, is read before every push and sent as a bearer token, so that rotated
+	// tokens are picked up.
+	BearerTokenFile string
+	// QueueSize is how many batches may wait to be sent. When the queue is full, the oldest batch is dropped.
+	QueueSize int
+	// Backoff spaces out the attempts to send a batch. Its Steps is the maximum number of attempts.
+	Backoff wait.Backoff
+	// Batches, if set, counts batches by outcome ("sent", "failed" or "dropped").
+	Batches func(result string) *selfmetrics.Counter
+}
+
+// retryableError marks push failures that may succeed if tried again.
+type retryableError struct {
+	err error
+}
+
+func (e *retryableError) Error() string { return e.err.Error() }
+
+func (e *retryableError) Unwrap() error { return e.err }
+
+// Run collects and pushes metrics until ctx is cancelled.
+func (p *Pusher) Run(ctx context.Context) {
+	queue := make(chan []byte, max(p.QueueSize, 1))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.sendLoop(ctx, queue)
+	}()
+	defer func() { <-done }()
+
+	ticker := time.NewTicker(p.Interval)
+	defer ticker.Stop()
+	for {
+		p.collect(ctx, queue)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// collect runs a fan-out and queues the encoded batch, dropping the oldest batch if the queue is full.
+func (p *Pusher) collect(ctx context.Context, queue chan []byte) {
+	collectCtx, cancel := context.WithTimeout(ctx, p.Interval)
+	defer cancel()
+
+	series := parseTimeSeries(p.Collect(collectCtx), time.Now())
+	if len(series) == 0 {
+		return
+	}
+	batch := snappy.Encode(nil, encodeWriteRequest(series))
+
+	for {
+		select {
+		case queue <- batch:
+			return
+		default:
+		}
+		select {
+		case <-queue:
+			logging.FromContext(ctx).WarnContext(ctx, "Remote write queue is full, dropping the oldest batch")
+			p.record(batchDropped)
+		default:
+		}
+	}
+}
+
+// sendLoop sends queued batches one at a time until ctx is cancelled.
+func (p *Pusher) sendLoop(ctx context.Context, queue chan []byte) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case batch := <-queue:
+			p.sendWithRetries(ctx, batch)
+		}
+	}
+}
+
+// sendWithRetries sends a batch, retrying retryable failures with backoff.
+func (p *Pusher) sendWithRetries(ctx context.Context, batch []byte) {
+	backoff := p.Backoff
+	for {
+		err := p.send(ctx, batch)
+		if err == nil {
+			p.record(batchSent)
+			return
+		}
+		if ctx.Err() != nil {
+			p.record(batchFailed)
+			return
+		}
+		var retryable *retryableError
+		if !errors.As(err, &retryable) || backoff.Steps <= 1 {
+			logging.FromContext(ctx).ErrorContext(ctx, "Remote write failed, dropping batch", "url", p.URL, "error", err)
+			p.record(batchFailed)
+			return
+		}
+
+		delay := backoff.Step()
+		logging.FromContext(ctx).WarnContext(ctx, "Remote write failed, retrying",
+			"url", p.URL, "delay", delay, "error", err)
+		select {
+		case <-ctx.Done():
+			p.record(batchFailed)
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// send pushes a single batch. Network errors, throttling and server errors are retryable.
+func (p *Pusher) send(ctx context.Context, batch []byte) error {
+	sendCtx, cancel := context.WithTimeout(ctx, p.Interval)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(sendCtx, http.MethodPost, p.URL, bytes.NewReader(batch))
+	if err != nil {
+		return fmt.Errorf("creating request for %s: %w", p.URL, err)
+	}
+	for name, values := range p.Headers {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", remoteWriteVersion)
+	if p.BearerTokenFile != "" {
+		token, readErr := os.ReadFile(p.BearerTokenFile)
+		if readErr != nil {
+			return &retryableError{fmt.Errorf("reading bearer token: %w", readErr)}
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return &retryableError{fmt.Errorf("request to %s failed: %w", p.URL, err)}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusOK && resp.StatusCode < http.StatusMultipleChoices {
+		return nil
+	}
+	// The receiver may explain why it rejected the batch
+	const maxErrorBody = 512
+	err = fmt.Errorf("%s returned status code %d", p.URL, resp.StatusCode)
+	if body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody)); len(bytes.TrimSpace(body)) > 0 {
+		err = fmt.Errorf("%w: %s", err, bytes.TrimSpace(body))
+	}
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError {
+		return &retryableError{err}
+	}
+
+	return err
+}
+
+func (p *Pusher) record(result string) {
+	if p.Batches != nil {
+		p.Batches(result).Inc()
+	}
+}
@@ -0,0 +1,293 @@
+package remotewrite_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/canonical/metrics-k8s-proxy/internal/handlers"
+	"github.com/canonical/metrics-k8s-proxy/internal/remotewrite"
+	"github.com/canonical/metrics-k8s-proxy/internal/selfmetrics"
+	"github.com/klauspost/compress/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// receiver is a stand-in for a remote-write endpoint that decodes every push into one line per series.
+type receiver struct {
+	mu       sync.Mutex
+	requests []*http.Request
+	series   [][]string
+	statuses []int // Status codes to answer with, in order; 204 once exhausted
+	block    chan struct{}
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if rc.block != nil {
+		<-rc.block
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	decompressed, err := snappy.Decode(nil, body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	series, err := decodeWriteRequest(decompressed)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.requests = append(rc.requests, r)
+	rc.series = append(rc.series, series)
+	status := http.StatusNoContent
+	if len(rc.statuses) > 0 {
+		status, rc.statuses = rc.statuses[0], rc.statuses[1:]
+	}
+	w.WriteHeader(status)
+}
+
+// push returns the request and decoded series of the i-th push.
+func (rc *receiver) push(i int) (*http.Request, []string) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	return rc.requests[i], rc.series[i]
+}
+
+func (rc *receiver) pushes() int {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	return len(rc.requests)
+}
+
+// decodeWriteRequest renders every series of a WriteRequest as `name="value",... value timestamp`.
+func decodeWriteRequest(b []byte) ([]string, error) {
+	series := []string{}
+	err := consumeMessage(b, func(_ protowire.Number, ts []byte) error {
+		labels := []string{}
+		var sample string
+		err := consumeMessage(ts, func(num protowire.Number, field []byte) error {
+			if num == 1 {
+				var pair []string
+				err := consumeMessage(field, func(_ protowire.Number, v []byte) error {
+					pair = append(pair, string(v))
+					return nil
+				})
+				labels = append(labels, fmt.Sprintf("%s=%q", pair[0], pair[1]))
+				return err
+			}
+			value, n := protowire.ConsumeFixed64(field[1:])
+			timestamp, _ := protowire.ConsumeVarint(field[1+n+1:])
+			sample = fmt.Sprintf("%v %d", math.Float64frombits(value), int64(timestamp))
+			return nil
+		})
+		series = append(series, strings.Join(labels, ",")+" "+sample)
+		return err
+	})
+
+	return series, err
+}
+
+// consumeMessage calls fn with the number and payload of every length-delimited field of a message.
+func consumeMessage(b []byte, fn func(protowire.Number, []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 || typ != protowire.BytesType {
+			return fmt.Errorf("unexpected field %d of type %d", num, typ)
+		}
+		b = b[n:]
+		value, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return errors.New("truncated field")
+		}
+		if err := fn(num, value); err != nil {
+			return err
+		}
+		b = b[n:]
+	}
+
+	return nil
+}
+
+// runPusher runs the pusher in the background and stops it when the test ends.
+func runPusher(t *testing.T, p *remotewrite.Pusher) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		p.Run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+// waitFor polls cond until it holds or the test times out.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func newPusher(url string, responses ...string) (*remotewrite.Pusher, *selfmetrics.CounterVec) {
+	batches := selfmetrics.NewRegistry().NewCounterVec("batches_total", "Batches.", "result")
+
+	return &remotewrite.Pusher{
+		URL:    url,
+		Client: &handlers.RealHTTPClient{Client: &http.Client{}},
+		Collect: func(_ context.Context) []string {
+			return responses
+		},
+		Interval:  time.Hour,
+		QueueSize: 1,
+		Backoff:   wait.Backoff{Duration: time.Millisecond, Factor: 2, Steps: 3},
+		Batches: func(result string) *selfmetrics.Counter {
+			return batches.WithLabelValues(result)
+		},
+	}, batches
+}
+
+func TestPusher_PushesSamples(t *testing.T) {
+	rc := &receiver{}
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("s3cret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	p, batches := newPusher(srv.URL,
+		"# TYPE metric_a counter\nmetric_a{k8s_pod_name=\"pod1\",k8s_namespace=\"default\"} 5 1700000000000\n"+
+			"\nup{k8s_pod_name=\"pod1\",k8s_namespace=\"default\"} 1\n",
+		"\nup{k8s_pod_name=\"pod2\",k8s_namespace=\"default\"} 0\n")
+	p.Headers = http.Header{"X-Scope-Orgid": []string{"tenant-1"}}
+	p.BearerTokenFile = tokenFile
+	runPusher(t, p)
+
+	waitFor(t, "a push", func() bool { return batches.WithLabelValues("sent").Value() == 1 })
+
+	req, got := rc.push(0)
+	for header, want := range map[string]string{
+		"Content-Encoding":                  "snappy",
+		"Content-Type":                      "application/x-protobuf",
+		"X-Prometheus-Remote-Write-Version": "0.1.0",
+		"Authorization":                     "Bearer s3cret",
+		"X-Scope-Orgid":                     "tenant-1",
+	} {
+		if got := req.Header.Get(header); got != want {
+			t.Errorf("header %s = %q, want %q", header, got, want)
+		}
+	}
+
+	if len(got) != 3 {
+		t.Fatalf("received %d series, want 3: %q", len(got), got)
+	}
+	want := `__name__="metric_a",k8s_namespace="default",k8s_pod_name="pod1" 5 1700000000000`
+	if got[0] != want {
+		t.Errorf("series[0] = %q, want %q", got[0], want)
+	}
+	for i, prefix := range []string{
+		`__name__="up",k8s_namespace="default",k8s_pod_name="pod1" 1 `,
+		`__name__="up",k8s_namespace="default",k8s_pod_name="pod2" 0 `,
+	} {
+		if !strings.HasPrefix(got[i+1], prefix) {
+			t.Errorf("series[%d] = %q, want prefix %q", i+1, got[i+1], prefix)
+		}
+	}
+}
+
+func TestPusher_LargeBatch(t *testing.T) {
+	rc := &receiver{}
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+
+	// Well over one 64KiB snappy block, with both repetitive and unique content
+	var b strings.Builder
+	for i := range 5000 {
+		fmt.Fprintf(&b, "metric_%d{k8s_pod_name=\"pod-%d\",k8s_namespace=\"default\"} %d 1700000000000\n", i%7, i, i)
+	}
+	p, batches := newPusher(srv.URL, b.String())
+	runPusher(t, p)
+
+	waitFor(t, "a push", func() bool { return batches.WithLabelValues("sent").Value() == 1 })
+	_, series := rc.push(0)
+	if len(series) != 5000 {
+		t.Fatalf("received %d series, want 5000", len(series))
+	}
+	want := `__name__="metric_1",k8s_namespace="default",k8s_pod_name="pod-4999" 4999 1700000000000`
+	if got := series[4999]; got != want {
+		t.Errorf("last series = %q, want %q", got, want)
+	}
+}
+
+func TestPusher_Retries(t *testing.T) {
+	tests := []struct {
+		name       string
+		statuses   []int
+		wantPushes int
+		wantResult string
+	}{
+		{"server errors are retried", []int{500, 429}, 3, "sent"},
+		{"attempts are bounded", []int{503, 503, 503}, 3, "failed"},
+		{"client errors are not retried", []int{400}, 1, "failed"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rc := &receiver{statuses: tt.statuses}
+			srv := httptest.NewServer(rc)
+			defer srv.Close()
+
+			p, batches := newPusher(srv.URL, "up 1")
+			runPusher(t, p)
+
+			waitFor(t, "a "+tt.wantResult+" batch", func() bool {
+				return batches.WithLabelValues(tt.wantResult).Value() == 1
+			})
+			if got := rc.pushes(); got != tt.wantPushes {
+				t.Errorf("receiver got %d pushes, want %d", got, tt.wantPushes)
+			}
+		})
+	}
+}
+
+func TestPusher_DropsOldestWhenQueueIsFull(t *testing.T) {
+	rc := &receiver{block: make(chan struct{})}
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+	defer close(rc.block)
+
+	p, batches := newPusher(srv.URL, "up 1")
+	p.Interval = 10 * time.Millisecond
+	runPusher(t, p)
+
+	// The first batch is stuck in flight and the queue holds one more, so later batches evict older ones
+	waitFor(t, "a dropped batch", func() bool { return batches.WithLabelValues("dropped").Value() > 0 })
+}
@@ -0,0 +1,97 @@
+package remotewrite
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/canonical/metrics-k8s-proxy/internal/util"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Field numbers of the remote-write 1.0 protobuf messages (prometheus/prompb).
+const (
+	writeRequestTimeseries = 1 // WriteRequest.timeseries
+	timeSeriesLabels       = 1 // TimeSeries.labels
+	timeSeriesSamples      = 2 // TimeSeries.samples
+	labelName              = 1 // Label.name
+	labelValue             = 2 // Label.value
+	sampleValue            = 1 // Sample.value
+	sampleTimestamp        = 2 // Sample.timestamp
+)
+
+// metricNameLabel carries the metric name among the labels of a remote-write series.
+const metricNameLabel = "__name__"
+
+// timeSeries is a single sample of a series, ready to be encoded.
+type timeSeries struct {
+	labels    []util.Label
+	value     float64
+	timestamp int64
+}
+
+// parseTimeSeries turns aggregated text exposition responses into series.
+// Samples without a timestamp are stamped with now. Comments and unparsable lines are skipped.
+func parseTimeSeries(responses []string, now time.Time) []timeSeries {
+	series := []timeSeries{}
+	for _, response := range responses {
+		for _, line := range strings.Split(response, "\n") {
+			if strings.HasPrefix(line, "#") || strings.TrimSpace(line) == "" {
+				continue
+			}
+			sample, err := util.ParseSample(line)
+			if err != nil {
+				continue
+			}
+			value, err := strconv.ParseFloat(sample.Value, 64)
+			if err != nil {
+				continue
+			}
+			timestamp := now.UnixMilli()
+			if sample.Timestamp != "" {
+				if timestamp, err = strconv.ParseInt(sample.Timestamp, 10, 64); err != nil {
+					continue
+				}
+			}
+
+			labels := append([]util.Label{{Name: metricNameLabel, Value: sample.Name}}, sample.Labels...)
+			// Remote-write receivers expect labels sorted by name
+			sort.Slice(labels, func(i, j int) bool { return labels[i].Name < labels[j].Name })
+			series = append(series, timeSeries{labels: labels, value: value, timestamp: timestamp})
+		}
+	}
+
+	return series
+}
+
+// encodeWriteRequest encodes series as a remote-write WriteRequest protobuf message.
+func encodeWriteRequest(series []timeSeries) []byte {
+	var request, ts, message []byte
+	for _, s := range series {
+		ts = ts[:0]
+		for _, label := range s.labels {
+			message = message[:0]
+			message = protowire.AppendTag(message, labelName, protowire.BytesType)
+			message = protowire.AppendString(message, label.Name)
+			message = protowire.AppendTag(message, labelValue, protowire.BytesType)
+			message = protowire.AppendString(message, label.Value)
+			ts = protowire.AppendTag(ts, timeSeriesLabels, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, message)
+		}
+
+		message = message[:0]
+		message = protowire.AppendTag(message, sampleValue, protowire.Fixed64Type)
+		message = protowire.AppendFixed64(message, math.Float64bits(s.value))
+		message = protowire.AppendTag(message, sampleTimestamp, protowire.VarintType)
+		message = protowire.AppendVarint(message, uint64(s.timestamp))
+		ts = protowire.AppendTag(ts, timeSeriesSamples, protowire.BytesType)
+		ts = protowire.AppendBytes(ts, message)
+
+		request = protowire.AppendTag(request, writeRequestTimeseries, protowire.BytesType)
+		request = protowire.AppendBytes(request, ts)
+	}
+
+	return request
+}
@@ -0,0 +1,218 @@
+// Package selfmetrics exposes the proxy's own operational metrics in the Prometheus text format.
+package selfmetrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Registry holds the proxy's own metrics and renders them in registration order.
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+type metric interface {
+	write(w io.Writer)
+}
+
+// desc is the name and help text shared by all metric types.
+type desc struct {
+	name string
+	help string
+}
+
+func (d desc) writeHeader(w io.Writer, metricType string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.name, d.help, d.name, metricType)
+}
+
+// NewRegistry creates an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.metrics = append(r.metrics, m)
+}
+
+// Write writes every registered metric to w.
+func (r *Registry) Write(w io.Writer) {
+	r.mu.Lock()
+	metrics := append([]metric(nil), r.metrics...)
+	r.mu.Unlock()
+
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+// ServeHTTP serves the registered metrics.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.Write(w)
+}
+
+// Counter is a monotonically increasing count of events.
+type Counter struct {
+	desc
+	value atomic.Uint64
+}
+
+// NewCounter registers and returns a new counter.
+func (r *Registry) NewCounter(name, help string) *Counter {
+	c := &Counter{desc: desc{name: name, help: help}}
+	r.register(c)
+
+	return c
+}
+
+// Inc increments the counter by one.
+func (c *Counter) Inc() {
+	c.value.Add(1)
+}
+
+// Add increments the counter by n.
+func (c *Counter) Add(n uint64) {
+	c.value.Add(n)
+}
+
+// Value returns the current count.
+func (c *Counter) Value() uint64 {
+	return c.value.Load()
+}
+
+func (c *Counter) write(w io.Writer) {
+	c.writeHeader(w, "counter")
+	fmt.Fprintf(w, "%s %d\n", c.name, c.Value())
+}
+
+// Gauge is a value that can go up and down.
+type Gauge struct {
+	desc
+	bits atomic.Uint64
+}
+
+// NewGauge registers and returns a new gauge.
+func (r *Registry) NewGauge(name, help string) *Gauge {
+	g := &Gauge{desc: desc{name: name, help: help}}
+	r.register(g)
+
+	return g
+}
+
+// Set sets the gauge to v.
+func (g *Gauge) Set(v float64) {
+	g.bits.Store(math.Float64bits(v))
+}
+
+// Value returns the current value of the gauge.
+func (g *Gauge) Value() float64 {
+	return math.Float64frombits(g.bits.Load())
+}
+
+func (g *Gauge) write(w io.Writer) {
+	g.writeHeader(w, "gauge")
+	fmt.Fprintf(w, "%s %s\n", g.name, strconv.FormatFloat(g.Value(), 'g', -1, 64))
+}
+
+// CounterVec is a family of counters that share a name and are told apart by label values.
+type CounterVec struct {
+	desc
+	labelNames []string
+
+	mu       sync.Mutex
+	order    []string
+	counters map[string]*Counter
+}
+
+// NewCounterVec registers and returns a new counter family with the given label names.
+func (r *Registry) NewCounterVec(name, help string, labelNames ...string) *CounterVec {
+	v := &CounterVec{desc: desc{name: name, help: help}, labelNames: labelNames, counters: map[string]*Counter{}}
+	r.register(v)
+
+	return v
+}
+
+// WithLabelValues returns the counter for the given label values, creating it on first use.
+// The values must be given in the order of the label names.
+func (v *CounterVec) WithLabelValues(values ...string) *Counter {
+	key := formatLabels(v.labelNames, values)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	counter, exists := v.counters[key]
+	if !exists {
+		counter = &Counter{desc: v.desc}
+		v.counters[key] = counter
+		v.order = append(v.order, key)
+	}
+
+	return counter
+}
+
+func (v *CounterVec) write(w io.Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.writeHeader(w, "counter")
+	for _, key := range v.order {
+		fmt.Fprintf(w, "%s%s %d\n", v.name, key, v.counters[key].Value())
+	}
+}
+
+// GaugeSample is a single gauge of a GaugeVecFunc.
+type GaugeSample struct {
+	// LabelValues are in the order of the family's label names.
+	LabelValues []string
+	Value       float64
+}
+
+// GaugeVecFunc is a family of gauges computed every time the registry is written, for series that come and go
+// between writes.
+type GaugeVecFunc struct {
+	desc
+	labelNames []string
+	collect    func() []GaugeSample
+}
+
+// NewGaugeVecFunc registers and returns a new gauge family whose gauges are returned by collect.
+func (r *Registry) NewGaugeVecFunc(name, help string, collect func() []GaugeSample,
+	labelNames ...string) *GaugeVecFunc {
+	v := &GaugeVecFunc{desc: desc{name: name, help: help}, labelNames: labelNames, collect: collect}
+	r.register(v)
+
+	return v
+}
+
+func (v *GaugeVecFunc) write(w io.Writer) {
+	v.writeHeader(w, "gauge")
+	for _, sample := range v.collect() {
+		fmt.Fprintf(w, "%s%s %s\n", v.name, formatLabels(v.labelNames, sample.LabelValues),
+			strconv.FormatFloat(sample.Value, 'g', -1, 64))
+	}
+}
+
+// formatLabels renders label names and values as a `{name="value",...}` label set.
+func formatLabels(names, values []string) string {
+	escaper := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	pairs := make([]string, 0, len(names))
+	for i, name := range names {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		pairs = append(pairs, name+`="`+escaper.Replace(value)+`"`)
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
@@ -0,0 +1,86 @@
+package selfmetrics_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/canonical/metrics-k8s-proxy/internal/selfmetrics"
+)
+
+func TestRegistry(t *testing.T) {
+	registry := selfmetrics.NewRegistry()
+	watchErrors := registry.NewCounter("metrics_proxy_watch_errors_total", "Total watch watchErrors.")
+	leader := registry.NewGauge("metrics_proxy_leader", "Whether this replica is the leader.")
+
+	watchErrors.Inc()
+	watchErrors.Inc()
+	leader.Set(1)
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, "/self-metrics", nil)
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	registry.ServeHTTP(rr, req)
+
+	want := "# HELP metrics_proxy_watch_errors_total Total watch watchErrors.\n" +
+		"# TYPE metrics_proxy_watch_errors_total counter\n" +
+		"metrics_proxy_watch_errors_total 2\n" +
+		"# HELP metrics_proxy_leader Whether this replica is the leader.\n" +
+		"# TYPE metrics_proxy_leader gauge\n" +
+		"metrics_proxy_leader 1\n"
+	if got := rr.Body.String(); got != want {
+		t.Errorf("ServeHTTP() got = %q, want %q", got, want)
+	}
+	if watchErrors.Value() != 2 || leader.Value() != 1 {
+		t.Errorf("unexpected values %d, %v", watchErrors.Value(), leader.Value())
+	}
+}
+
+func TestCounterVec(t *testing.T) {
+	registry := selfmetrics.NewRegistry()
+	requests := registry.NewCounterVec("metrics_proxy_fanout_cache_requests_total", "Fan-out cache lookups.",
+		"job", "result")
+
+	requests.WithLabelValues("ztunnel", "miss").Inc()
+	requests.WithLabelValues("ztunnel", "hit").Inc()
+	requests.WithLabelValues("ztunnel", "hit").Add(1)
+
+	var b strings.Builder
+	registry.Write(&b)
+
+	want := "# HELP metrics_proxy_fanout_cache_requests_total Fan-out cache lookups.\n" +
+		"# TYPE metrics_proxy_fanout_cache_requests_total counter\n" +
+		"metrics_proxy_fanout_cache_requests_total{job=\"ztunnel\",result=\"miss\"} 1\n" +
+		"metrics_proxy_fanout_cache_requests_total{job=\"ztunnel\",result=\"hit\"} 2\n"
+	if got := b.String(); got != want {
+		t.Errorf("Write() got = %q, want %q", got, want)
+	}
+}
+
+func TestGaugeVecFunc(t *testing.T) {
+	registry := selfmetrics.NewRegistry()
+	series := []selfmetrics.GaugeSample{{LabelValues: []string{"http_requests_total"}, Value: 120}}
+	registry.NewGaugeVecFunc("metrics_proxy_cardinality_metric_series", "Series by metric name.",
+		func() []selfmetrics.GaugeSample { return series }, "metric")
+
+	var b strings.Builder
+	registry.Write(&b)
+	want := "# HELP metrics_proxy_cardinality_metric_series Series by metric name.\n" +
+		"# TYPE metrics_proxy_cardinality_metric_series gauge\n" +
+		"metrics_proxy_cardinality_metric_series{metric=\"http_requests_total\"} 120\n"
+	if got := b.String(); got != want {
+		t.Errorf("Write() got = %q, want %q", got, want)
+	}
+
+	// The gauges are computed again on every write
+	series = nil
+	b.Reset()
+	registry.Write(&b)
+	if got := b.String(); strings.Contains(got, "http_requests_total") {
+		t.Errorf("Write() got = %q, want no gauges", got)
+	}
+}
@@ -0,0 +1,120 @@
+// Package timestamps applies a job's policy to the explicit timestamps of scraped samples, which Prometheus may
+// otherwise reject as out of order, and which defeat staleness handling.
+package timestamps
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Action is what happens to samples scraped with an explicit timestamp.
+type Action string
+
+const (
+	// Keep passes timestamped samples through unchanged.
+	Keep Action = "keep"
+	// Strip removes the timestamps, so that Prometheus stamps the samples with the scrape time.
+	Strip Action = "strip"
+	// RejectOld drops the samples whose timestamp is older than the policy's MaxAge, and keeps the others.
+	RejectOld Action = "reject_old"
+)
+
+// Policy is a job's timestamp policy. The zero Policy keeps timestamps without looking at them.
+type Policy struct {
+	Action Action
+	// MaxAge is how old a timestamp may be with RejectOld.
+	MaxAge time.Duration
+}
+
+// Validate checks that the action is known and that MaxAge is set exactly when RejectOld needs it.
+func (p Policy) Validate() error {
+	switch p.Action {
+	case "", Keep, Strip:
+		if p.MaxAge != 0 {
+			return fmt.Errorf("a timestamp max age requires the %s action", RejectOld)
+		}
+	case RejectOld:
+		if p.MaxAge <= 0 {
+			return fmt.Errorf("the %s action requires a positive timestamp max age", RejectOld)
+		}
+	default:
+		return fmt.Errorf("unknown timestamp action %q, must be %s, %s or %s", p.Action, Keep, Strip, RejectOld)
+	}
+
+	return nil
+}
+
+// Counts are the timestamped samples of a scrape, by what happened to them.
+type Counts struct {
+	Kept     int
+	Stripped int
+	Rejected int
+}
+
+// errNoTimestamp is returned for sample lines without a timestamp.
+var errNoTimestamp = errors.New("no timestamp")
+
+// Apply enforces the policy on the sample lines of an exposition body, whose timestamps are in milliseconds
+// since the epoch, and counts the timestamped samples. Lines whose timestamp can't be parsed are left as they
+// are and not counted.
+func Apply(metrics string, policy Policy, now time.Time) (string, Counts) {
+	var counts Counts
+	if policy.Action == "" {
+		return metrics, counts
+	}
+
+	lines := strings.Split(metrics, "\n")
+	kept := lines[:0]
+	for _, line := range lines {
+		if line == "" || strings.HasPrefix(line, "#") {
+			kept = append(kept, line)
+			continue
+		}
+		sample, timestamp, err := split(line)
+		if err != nil {
+			kept = append(kept, line)
+			continue
+		}
+
+		switch {
+		case policy.Action == Strip:
+			counts.Stripped++
+			line = sample
+		case policy.Action == RejectOld && now.Sub(timestamp) > policy.MaxAge:
+			counts.Rejected++
+			continue
+		default:
+			counts.Kept++
+		}
+		kept = append(kept, line)
+	}
+
+	return strings.Join(kept, "\n"), counts
+}
+
+// split cuts the timestamp off a sample line, returning the line without it and the parsed timestamp.
+func split(line string) (string, time.Time, error) {
+	// The value and timestamp follow the label set, whose values may hold spaces
+	start := 0
+	if end := strings.LastIndexByte(line, '}'); end >= 0 {
+		start = end + 1
+	} else if end = strings.IndexAny(line, " \t"); end >= 0 {
+		start = end
+	}
+	fields := strings.Fields(line[start:])
+	if len(fields) != 2 { //nolint:mnd // The value and the timestamp
+		return "", time.Time{}, errNoTimestamp
+	}
+
+	millis, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil || math.IsNaN(millis) || math.IsInf(millis, 0) {
+		return "", time.Time{}, fmt.Errorf("invalid timestamp %q", fields[1])
+	}
+	sample := strings.TrimRight(line[:strings.LastIndex(line, fields[1])], " \t")
+
+	return sample, time.UnixMilli(int64(millis)), nil
+}
@@ -0,0 +1,90 @@
+package timestamps_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/canonical/metrics-k8s-proxy/internal/timestamps"
+)
+
+func TestPolicyValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  timestamps.Policy
+		wantErr bool
+	}{
+		{name: "Unset", policy: timestamps.Policy{}},
+		{name: "Keep", policy: timestamps.Policy{Action: timestamps.Keep}},
+		{name: "Strip", policy: timestamps.Policy{Action: timestamps.Strip}},
+		{name: "Reject Old", policy: timestamps.Policy{Action: timestamps.RejectOld, MaxAge: time.Minute}},
+		{name: "Reject Old Without Max Age", policy: timestamps.Policy{Action: timestamps.RejectOld}, wantErr: true},
+		{name: "Max Age Without Reject Old", policy: timestamps.Policy{Action: timestamps.Strip, MaxAge: time.Minute},
+			wantErr: true},
+		{name: "Unknown Action", policy: timestamps.Policy{Action: "clamp"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.policy.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestApply(t *testing.T) {
+	now := time.UnixMilli(1700000600000)
+	metrics := "# TYPE requests_total counter\n" +
+		"requests_total{code=\"200\",path=\"/a b\"} 5 1700000000000\n" +
+		"requests_total{code=\"500\"} 1 1700000590000\n" +
+		"requests_total{code=\"404\"} 2\n" +
+		"connections 3 1700000000000\n" +
+		"broken{code=\"200\"} 1 soon"
+
+	tests := []struct {
+		name       string
+		policy     timestamps.Policy
+		want       string
+		wantCounts timestamps.Counts
+	}{
+		{name: "Unset", policy: timestamps.Policy{}, want: metrics},
+		{
+			name:       "Keep",
+			policy:     timestamps.Policy{Action: timestamps.Keep},
+			want:       metrics,
+			wantCounts: timestamps.Counts{Kept: 3},
+		},
+		{
+			name:   "Strip",
+			policy: timestamps.Policy{Action: timestamps.Strip},
+			want: "# TYPE requests_total counter\n" +
+				"requests_total{code=\"200\",path=\"/a b\"} 5\n" +
+				"requests_total{code=\"500\"} 1\n" +
+				"requests_total{code=\"404\"} 2\n" +
+				"connections 3\n" +
+				"broken{code=\"200\"} 1 soon",
+			wantCounts: timestamps.Counts{Stripped: 3},
+		},
+		{
+			name:   "Reject Old",
+			policy: timestamps.Policy{Action: timestamps.RejectOld, MaxAge: time.Minute},
+			want: "# TYPE requests_total counter\n" +
+				"requests_total{code=\"500\"} 1 1700000590000\n" +
+				"requests_total{code=\"404\"} 2\n" +
+				"broken{code=\"200\"} 1 soon",
+			wantCounts: timestamps.Counts{Kept: 1, Rejected: 2},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, counts := timestamps.Apply(metrics, tt.policy, now)
+			if got != tt.want {
+				t.Errorf("Apply() = %q, want %q", got, tt.want)
+			}
+			if counts != tt.wantCounts {
+				t.Errorf("Apply() counts = %+v, want %+v", counts, tt.wantCounts)
+			}
+		})
+	}
+}
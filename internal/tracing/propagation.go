@@ -0,0 +1,26 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// TraceparentHeader carries the context of the span a request was sent from.
+// See https://www.w3.org/TR/trace-context/#traceparent-header.
+const TraceparentHeader = "traceparent"
+
+// propagator reads and writes the W3C Trace Context headers.
+var propagator = propagation.TraceContext{}
+
+// Extract returns a copy of ctx carrying the span context of the request's traceparent header, which the next
+// span started in ctx continues. A missing or invalid header leaves ctx as is.
+func Extract(ctx context.Context, header http.Header) context.Context {
+	return propagator.Extract(ctx, propagation.HeaderCarrier(header))
+}
+
+// Inject sets the traceparent header of an outgoing request to the span carried by ctx, if any.
+func Inject(ctx context.Context, header http.Header) {
+	propagator.Inject(ctx, propagation.HeaderCarrier(header))
+}
@@ -0,0 +1,71 @@
+package tracing_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/canonical/metrics-k8s-proxy/internal/tracing"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestExtract(t *testing.T) {
+	const (
+		traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+		spanID  = "00f067aa0ba902b7"
+	)
+	tests := []struct {
+		name        string
+		traceparent string
+		wantValid   bool
+		wantSampled bool
+	}{
+		{name: "Sampled", traceparent: "00-" + traceID + "-" + spanID + "-01", wantValid: true, wantSampled: true},
+		{name: "Not Sampled", traceparent: "00-" + traceID + "-" + spanID + "-00", wantValid: true},
+		{name: "Future Version", traceparent: "01-" + traceID + "-" + spanID + "-01-extra", wantValid: true,
+			wantSampled: true},
+		{name: "Missing"},
+		{name: "Extra Field", traceparent: "00-" + traceID + "-" + spanID + "-01-extra"},
+		{name: "Invalid Version", traceparent: "ff-" + traceID + "-" + spanID + "-01"},
+		{name: "Uppercase", traceparent: "00-4BF92F3577B34DA6A3CE929D0E0E4736-" + spanID + "-01"},
+		{name: "Zero Trace ID", traceparent: "00-00000000000000000000000000000000-" + spanID + "-01"},
+		{name: "Zero Span ID", traceparent: "00-" + traceID + "-0000000000000000-01"},
+		{name: "Short Span ID", traceparent: "00-" + traceID + "-00f067aa-01"},
+		{name: "Not Hex", traceparent: "00-" + traceID + "-" + spanID + "-zz"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			if tt.traceparent != "" {
+				header.Set(tracing.TraceparentHeader, tt.traceparent)
+			}
+			remote := trace.SpanContextFromContext(tracing.Extract(context.Background(), header))
+
+			if got := remote.TraceID().String() == traceID && remote.SpanID().String() == spanID; got != tt.wantValid {
+				t.Errorf("span context = %+v, want the header's: %v", remote, tt.wantValid)
+			}
+			if tt.wantValid && remote.IsSampled() != tt.wantSampled {
+				t.Errorf("span context sampled = %v, want %v", remote.IsSampled(), tt.wantSampled)
+			}
+		})
+	}
+}
+
+func TestInject(t *testing.T) {
+	header := http.Header{}
+	tracing.Inject(context.Background(), header)
+	if got := header.Get(tracing.TraceparentHeader); got != "" {
+		t.Errorf("traceparent = %q, want none without a span", got)
+	}
+
+	remote := trace.NewSpanContext(trace.SpanContextConfig{TraceID: trace.TraceID{0xab}, SpanID: trace.SpanID{0xcd}})
+	ctx, span := sdktrace.NewTracerProvider().Tracer(tracing.ScopeName).Start(
+		trace.ContextWithRemoteSpanContext(context.Background(), remote), "GET /metrics")
+	tracing.Inject(ctx, header)
+	want := "00-ab000000000000000000000000000000-" + span.SpanContext().SpanID().String() + "-00"
+	if got := header.Get(tracing.TraceparentHeader); got != want {
+		t.Errorf("traceparent = %q, want %q", got, want)
+	}
+}
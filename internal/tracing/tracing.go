@@ -0,0 +1,91 @@
+// Package tracing traces the proxy's scrapes with OpenTelemetry and propagates their context to the pods,
+// following the W3C Trace Context. Sampled spans are batched and exported over OTLP/HTTP.
+package tracing
+
+import (
+	"context"
+	"time"
+
+	"github.com/canonical/metrics-k8s-proxy/internal/logging"
+	"github.com/canonical/metrics-k8s-proxy/internal/selfmetrics"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ScopeName is the instrumentation scope of the proxy's spans.
+const ScopeName = "github.com/canonical/metrics-k8s-proxy"
+
+// serviceName is the service.name resource attribute of every exported span.
+const serviceName = "metrics-k8s-proxy"
+
+// maxQueue bounds the spans waiting for export, so that an unreachable collector can't make the proxy run out of
+// memory. Spans beyond it are dropped.
+const maxQueue = 4096
+
+// Span outcomes, as counted by CountingExporter.
+const (
+	spansExported = "exported"
+	spansFailed   = "failed"
+)
+
+// Provider is a tracer provider exporting the spans it samples in batches.
+type Provider struct {
+	*sdktrace.TracerProvider
+
+	interval time.Duration
+}
+
+// NewProvider returns a provider handing its sampled spans to exporter every interval, which also bounds every
+// export. Spans continuing the trace of a scraper are sampled if the scraper sampled it, and new traces are
+// sampled with the given ratio, from 0 for none to 1 for all.
+func NewProvider(exporter sdktrace.SpanExporter, interval time.Duration, ratio float64) *Provider {
+	return &Provider{
+		TracerProvider: sdktrace.NewTracerProvider(
+			sdktrace.WithBatcher(exporter,
+				sdktrace.WithBatchTimeout(interval),
+				sdktrace.WithExportTimeout(interval),
+				sdktrace.WithMaxQueueSize(maxQueue),
+			),
+			sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+			sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", serviceName))),
+		),
+		interval: interval,
+	}
+}
+
+// Run waits until ctx is cancelled, then exports the spans left within one interval and shuts the provider down.
+func (p *Provider) Run(ctx context.Context) {
+	<-ctx.Done()
+	shutdownCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), p.interval)
+	defer cancel()
+	if err := p.Shutdown(shutdownCtx); err != nil {
+		logging.FromContext(ctx).ErrorContext(ctx, "OTLP span export failed", "error", err)
+	}
+}
+
+// StartSpan starts a child of the span carried by ctx, from the same provider. If ctx carries no span, e.g.
+// because tracing is disabled or the work didn't start from a traced request, the span records nothing.
+func StartSpan(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return trace.SpanFromContext(ctx).TracerProvider().Tracer(ScopeName).Start(ctx, name, opts...)
+}
+
+// CountingExporter counts the spans exported through its SpanExporter by outcome: exported or failed.
+type CountingExporter struct {
+	sdktrace.SpanExporter
+
+	Spans func(outcome string) *selfmetrics.Counter
+}
+
+// ExportSpans exports the spans and counts them.
+func (e CountingExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	err := e.SpanExporter.ExportSpans(ctx, spans)
+	outcome := spansExported
+	if err != nil {
+		outcome = spansFailed
+	}
+	e.Spans(outcome).Add(uint64(len(spans)))
+
+	return err
+}
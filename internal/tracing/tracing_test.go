@@ -0,0 +1,85 @@
+package tracing_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/canonical/metrics-k8s-proxy/internal/selfmetrics"
+	"github.com/canonical/metrics-k8s-proxy/internal/tracing"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestProvider_Sampling(t *testing.T) {
+	remote := func(sampled bool) trace.SpanContext {
+		var flags trace.TraceFlags
+		if sampled {
+			flags = trace.FlagsSampled
+		}
+
+		return trace.NewSpanContext(trace.SpanContextConfig{
+			TraceID: trace.TraceID{1}, SpanID: trace.SpanID{2}, TraceFlags: flags, Remote: true,
+		})
+	}
+	tests := []struct {
+		name   string
+		ratio  float64
+		remote trace.SpanContext
+		want   int
+	}{
+		{name: "Every Trace", ratio: 1, want: 2},
+		{name: "No Trace", ratio: 0, want: 0},
+		{name: "Sampled By The Scraper", ratio: 0, remote: remote(true), want: 2},
+		{name: "Not Sampled By The Scraper", ratio: 1, remote: remote(false), want: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry := selfmetrics.NewRegistry()
+			spans := registry.NewCounterVec("spans_total", "Spans.", "outcome")
+			provider := tracing.NewProvider(tracing.CountingExporter{
+				SpanExporter: tracetest.NewInMemoryExporter(),
+				Spans:        func(outcome string) *selfmetrics.Counter { return spans.WithLabelValues(outcome) },
+			}, time.Hour, tt.ratio)
+
+			ctx := context.Background()
+			if tt.remote.IsValid() {
+				ctx = trace.ContextWithRemoteSpanContext(ctx, tt.remote)
+			}
+			ctx, root := provider.Tracer(tracing.ScopeName).Start(ctx, "GET /metrics")
+			_, child := tracing.StartSpan(ctx, "scrape pod")
+			child.End()
+			root.End()
+
+			// Spans are propagated whether or not they are sampled
+			if !root.SpanContext().IsValid() || child.SpanContext().TraceID() != root.SpanContext().TraceID() {
+				t.Errorf("spans = %+v and %+v, want a valid trace", root.SpanContext(), child.SpanContext())
+			}
+			if tt.remote.IsValid() && root.SpanContext().TraceID() != tt.remote.TraceID() {
+				t.Errorf("root span = %+v, want it to continue %+v", root.SpanContext(), tt.remote)
+			}
+			// The spans left are exported on shutdown
+			provider.Run(canceled())
+			if got := spans.WithLabelValues("exported").Value(); got != uint64(tt.want) {
+				t.Errorf("counted %d exported spans, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStartSpan_Untraced(t *testing.T) {
+	ctx, span := tracing.StartSpan(context.Background(), "scrape pod")
+	span.End()
+	if span.IsRecording() || trace.SpanContextFromContext(ctx).IsValid() {
+		t.Errorf("StartSpan() = %+v, want a span recording nothing without a parent", span.SpanContext())
+	}
+}
+
+// canceled returns a context that is already done.
+func canceled() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	return ctx
+}
@@ -0,0 +1,198 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Label is a single name/value pair attached to a sample.
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Sample is a single sample line of the Prometheus text exposition format.
+// Value and Timestamp are kept verbatim so that rendering a parsed sample doesn't alter them.
+type Sample struct {
+	Name      string
+	Labels    []Label
+	Value     string
+	Timestamp string
+}
+
+var (
+	errEmptyMetricName   = errors.New("empty metric name")
+	errUnterminatedLabel = errors.New("unterminated label set")
+	errMissingValue      = errors.New("missing sample value")
+)
+
+// ParseSample parses a sample line such as `http_requests_total{method="GET"} 5 1700000000000`.
+// Comment and empty lines are not samples and must be filtered out by the caller.
+func ParseSample(line string) (Sample, error) {
+	var sample Sample
+
+	line = strings.TrimSpace(line)
+	nameEnd := strings.IndexAny(line, "{ \t")
+	if nameEnd == -1 {
+		return sample, fmt.Errorf("%w: %q", errMissingValue, line)
+	}
+	if nameEnd == 0 {
+		return sample, fmt.Errorf("%w: %q", errEmptyMetricName, line)
+	}
+	sample.Name = line[:nameEnd]
+	rest := line[nameEnd:]
+
+	if strings.HasPrefix(rest, "{") {
+		labels, remainder, err := parseLabelSet(rest[1:])
+		if err != nil {
+			return sample, fmt.Errorf("%w: %q", err, line)
+		}
+		sample.Labels = labels
+		rest = remainder
+	}
+
+	fields := strings.Fields(rest)
+	switch len(fields) {
+	case 1:
+		sample.Value = fields[0]
+	case MetricPartsLength:
+		sample.Value = fields[0]
+		sample.Timestamp = fields[1]
+	default:
+		return sample, fmt.Errorf("%w: %q", errMissingValue, line)
+	}
+
+	return sample, nil
+}
+
+// parseLabelSet parses the inside of a `{...}` label set and returns the labels and the text following `}`.
+func parseLabelSet(s string) ([]Label, string, error) {
+	labels := []Label{}
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		if strings.HasPrefix(s, "}") {
+			return labels, s[1:], nil
+		}
+
+		eq := strings.IndexByte(s, '=')
+		if eq <= 0 {
+			return nil, "", errUnterminatedLabel
+		}
+		name := strings.TrimSpace(s[:eq])
+		s = strings.TrimLeft(s[eq+1:], " \t")
+		if !strings.HasPrefix(s, `"`) {
+			return nil, "", errUnterminatedLabel
+		}
+
+		value, consumed, ok := unquoteLabelValue(s[1:])
+		if !ok {
+			return nil, "", errUnterminatedLabel
+		}
+		labels = append(labels, Label{Name: name, Value: value})
+		s = s[1+consumed:]
+	}
+}
+
+// unquoteLabelValue reads an escaped label value up to its closing quote.
+// It returns the unescaped value and the number of bytes consumed, including the closing quote.
+func unquoteLabelValue(s string) (string, int, bool) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			return b.String(), i + 1, true
+		case '\\':
+			if i+1 == len(s) {
+				return "", 0, false
+			}
+			i++
+			switch s[i] {
+			case 'n':
+				b.WriteByte('\n')
+			default:
+				b.WriteByte(s[i])
+			}
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+
+	return "", 0, false
+}
+
+// String renders the sample back into the text exposition format.
+func (s Sample) String() string {
+	var b strings.Builder
+	b.WriteString(s.Name)
+	if len(s.Labels) > 0 {
+		b.WriteByte('{')
+		for i, label := range s.Labels {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(label.Name)
+			b.WriteString(`="`)
+			b.WriteString(escapeLabelValue(label.Value))
+			b.WriteByte('"')
+		}
+		b.WriteByte('}')
+	}
+	b.WriteByte(' ')
+	b.WriteString(s.Value)
+	if s.Timestamp != "" {
+		b.WriteByte(' ')
+		b.WriteString(s.Timestamp)
+	}
+
+	return b.String()
+}
+
+// Get returns the value of the named label, or an empty string if it is not set.
+// The metric name is available as `__name__`.
+func (s Sample) Get(name string) string {
+	if name == "__name__" {
+		return s.Name
+	}
+	for _, label := range s.Labels {
+		if label.Name == name {
+			return label.Value
+		}
+	}
+
+	return ""
+}
+
+// Set sets the named label, replacing an existing value in place or appending a new label.
+// Setting a label to an empty value removes it, matching Prometheus semantics.
+func (s *Sample) Set(name, value string) {
+	if name == "__name__" {
+		s.Name = value
+		return
+	}
+	if value == "" {
+		s.Del(name)
+		return
+	}
+	for i := range s.Labels {
+		if s.Labels[i].Name == name {
+			s.Labels[i].Value = value
+			return
+		}
+	}
+	s.Labels = append(s.Labels, Label{Name: name, Value: value})
+}
+
+// Del removes the named label if present.
+func (s *Sample) Del(name string) {
+	for i := range s.Labels {
+		if s.Labels[i].Name == name {
+			s.Labels = append(s.Labels[:i], s.Labels[i+1:]...)
+			return
+		}
+	}
+}
+
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
@@ -0,0 +1,105 @@
+package util_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/canonical/metrics-k8s-proxy/internal/util"
+)
+
+func TestParseSample(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		want    util.Sample
+		wantErr bool
+	}{
+		{
+			name: "sample without labels",
+			line: "http_requests_total 5",
+			want: util.Sample{Name: "http_requests_total", Value: "5"},
+		},
+		{
+			name: "sample with labels and timestamp",
+			line: "http_requests_total{method=\"GET\",code=\"200\"} 5 1700000000000",
+			want: util.Sample{
+				Name:      "http_requests_total",
+				Labels:    []util.Label{{Name: "method", Value: "GET"}, {Name: "code", Value: "200"}},
+				Value:     "5",
+				Timestamp: "1700000000000",
+			},
+		},
+		{
+			name: "escaped label value",
+			line: "errors{msg=\"say \\\"hi\\\"\\nbye\\\\\"} 1",
+			want: util.Sample{
+				Name:   "errors",
+				Labels: []util.Label{{Name: "msg", Value: "say \"hi\"\nbye\\"}},
+				Value:  "1",
+			},
+		},
+		{
+			name: "label value containing braces and commas",
+			line: "paths{path=\"/a,{b}\"} 3",
+			want: util.Sample{Name: "paths", Labels: []util.Label{{Name: "path", Value: "/a,{b}"}}, Value: "3"},
+		},
+		{
+			name:    "missing value",
+			line:    "http_requests_total",
+			wantErr: true,
+		},
+		{
+			name:    "unterminated label set",
+			line:    "http_requests_total{method=\"GET\" 5",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := util.ParseSample(tt.line)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseSample() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseSample() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSampleString(t *testing.T) {
+	lines := []string{
+		"http_requests_total 5",
+		"http_requests_total{method=\"GET\",code=\"200\"} 5 1700000000000",
+		"errors{msg=\"say \\\"hi\\\"\\nbye\\\\\"} 1",
+	}
+	for _, line := range lines {
+		sample, err := util.ParseSample(line)
+		if err != nil {
+			t.Fatalf("ParseSample(%q) error = %v", line, err)
+		}
+		if got := sample.String(); got != line {
+			t.Errorf("String() = %q, want %q", got, line)
+		}
+	}
+}
+
+func TestSampleSetAndDel(t *testing.T) {
+	sample := util.Sample{Name: "metric", Labels: []util.Label{{Name: "a", Value: "1"}}, Value: "1"}
+
+	sample.Set("a", "2")
+	sample.Set("b", "3")
+	sample.Set("__name__", "renamed")
+	if got := sample.String(); got != "renamed{a=\"2\",b=\"3\"} 1" {
+		t.Errorf("after Set got %q", got)
+	}
+
+	sample.Set("a", "")
+	sample.Del("missing")
+	if got := sample.String(); got != "renamed{b=\"3\"} 1" {
+		t.Errorf("after removal got %q", got)
+	}
+	if got := sample.Get("__name__"); got != "renamed" {
+		t.Errorf("Get(__name__) = %q, want renamed", got)
+	}
+}
@@ -0,0 +1,132 @@
+package util
+
+import (
+	"cmp"
+	"slices"
+	"strings"
+)
+
+// commentFields is the least number of fields of a HELP or TYPE comment: "#", HELP or TYPE, and the family name.
+const commentFields = 3
+
+// Comment is a HELP or TYPE comment of the exposition format.
+type Comment struct {
+	Keyword string // HELP or TYPE
+	Family  string
+	Text    string // The help text, or the family's type
+}
+
+// ParseComment parses a HELP or TYPE comment, reporting false for any other line.
+func ParseComment(line string) (Comment, bool) {
+	fields := strings.Fields(line)
+	if len(fields) < commentFields || fields[0] != "#" || (fields[1] != "HELP" && fields[1] != "TYPE") {
+		return Comment{}, false
+	}
+	// The text is the rest of the line, with its own spacing
+	text := line
+	for _, field := range fields[:commentFields] {
+		_, text, _ = strings.Cut(text, field)
+	}
+
+	return Comment{Keyword: fields[1], Family: fields[2], Text: strings.TrimLeft(text, " \t")}, true
+}
+
+// FamilySuffixes returns the suffixes of the samples of a family of the given type whose TYPE comment names it
+// without them, such as the buckets of a histogram or the total of an OpenMetrics counter. An empty type,
+// when a family's type isn't known, gets the suffixes of every type.
+func FamilySuffixes(metricType string) []string {
+	switch metricType {
+	case "counter":
+		return []string{"_total", "_created"}
+	case "histogram":
+		return []string{"_bucket", "_sum", "_count", "_created"}
+	case "gaugehistogram":
+		return []string{"_bucket", "_gcount", "_gsum"}
+	case "summary":
+		return []string{"_sum", "_count", "_created"}
+	case "info":
+		return []string{"_info"}
+	case "":
+		return []string{"_bucket", "_sum", "_count", "_total", "_created", "_gcount", "_gsum", "_info"}
+	default:
+		return nil
+	}
+}
+
+// FamilyOf returns the family of a sample name, given the type of every family with a HELP or TYPE comment:
+// the name itself if it has comments, the name without a suffix of the family's type, or else the name.
+func FamilyOf(name string, types map[string]string) string {
+	if _, exists := types[name]; exists {
+		return name
+	}
+	for _, suffix := range FamilySuffixes("") {
+		base, found := strings.CutSuffix(name, suffix)
+		if metricType, exists := types[base]; found && exists && slices.Contains(FamilySuffixes(metricType), suffix) {
+			return base
+		}
+	}
+
+	return name
+}
+
+// SortFamilies orders the lines of an exposition body by metric family name, so that the same metrics render
+// the same way whatever order the pod exposed them in. The comments and samples of a family stay together, in
+// their original order, and comments other than HELP and TYPE stay with the family they follow. Empty lines
+// are dropped, and the result has no trailing newline.
+func SortFamilies(metrics string) string {
+	lines := strings.Split(metrics, "\n")
+	types := map[string]string{}
+	for _, line := range lines {
+		comment, ok := ParseComment(line)
+		switch {
+		case !ok:
+		case comment.Keyword == "TYPE":
+			types[comment.Family] = comment.Text
+		case types[comment.Family] == "":
+			// A family with only a HELP comment has an unknown type
+			types[comment.Family] = ""
+		}
+	}
+
+	type family struct {
+		name  string
+		lines []string
+	}
+	families := []*family{}
+	byName := map[string]*family{}
+	current := ""
+	for _, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if comment, ok := ParseComment(line); ok {
+			current = comment.Family
+		} else if !strings.HasPrefix(line, "#") {
+			current = FamilyOf(sampleName(line), types)
+		}
+		f, exists := byName[current]
+		if !exists {
+			f = &family{name: current}
+			byName[current] = f
+			families = append(families, f)
+		}
+		f.lines = append(f.lines, line)
+	}
+
+	slices.SortStableFunc(families, func(a, b *family) int { return cmp.Compare(a.name, b.name) })
+	sorted := make([]string, 0, len(lines))
+	for _, f := range families {
+		sorted = append(sorted, f.lines...)
+	}
+
+	return strings.Join(sorted, "\n")
+}
+
+// sampleName returns the metric name of a sample line.
+func sampleName(line string) string {
+	if end := strings.IndexAny(line, "{ \t"); end >= 0 {
+		return line[:end]
+	}
+
+	return line
+}
@@ -0,0 +1,128 @@
+package util_test
+
+import (
+	"testing"
+
+	"github.com/canonical/metrics-k8s-proxy/internal/util"
+)
+
+func TestSortFamilies(t *testing.T) {
+	tests := []struct {
+		name    string
+		metrics string
+		want    string
+	}{
+		{
+			name: "Families",
+			metrics: "# HELP zeta_total Z.\n" +
+				"# TYPE zeta_total counter\n" +
+				"zeta_total{code=\"500\"} 1\n" +
+				"zeta_total{code=\"200\"} 2\n" +
+				"# TYPE alpha gauge\n" +
+				"alpha 3\n" +
+				"\n",
+			want: "# TYPE alpha gauge\n" +
+				"alpha 3\n" +
+				"# HELP zeta_total Z.\n" +
+				"# TYPE zeta_total counter\n" +
+				"zeta_total{code=\"500\"} 1\n" +
+				"zeta_total{code=\"200\"} 2",
+		},
+		{
+			name: "Histogram And OpenMetrics Counter",
+			metrics: "# TYPE requests counter\n" +
+				"requests_total 4\n" +
+				"# TYPE latency histogram\n" +
+				"latency_bucket{le=\"+Inf\"} 2\n" +
+				"latency_sum 0.5\n" +
+				"latency_count 2\n" +
+				"latency_seconds 7",
+			want: "# TYPE latency histogram\n" +
+				"latency_bucket{le=\"+Inf\"} 2\n" +
+				"latency_sum 0.5\n" +
+				"latency_count 2\n" +
+				"latency_seconds 7\n" +
+				"# TYPE requests counter\n" +
+				"requests_total 4",
+		},
+		{
+			name:    "Untyped And Other Comments",
+			metrics: "b 1\n# a comment about b\na{x=\"1\"} 2\nb{x=\"2\"} 3",
+			want:    "a{x=\"1\"} 2\nb 1\n# a comment about b\nb{x=\"2\"} 3",
+		},
+		{name: "Empty", metrics: "", want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := util.SortFamilies(tt.metrics); got != tt.want {
+				t.Errorf("SortFamilies() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseComment(t *testing.T) {
+	tests := []struct {
+		name   string
+		line   string
+		want   util.Comment
+		wantOK bool
+	}{
+		{
+			name:   "Help",
+			line:   "# HELP requests_total Requests,  by  code.",
+			want:   util.Comment{Keyword: "HELP", Family: "requests_total", Text: "Requests,  by  code."},
+			wantOK: true,
+		},
+		{
+			name:   "Type",
+			line:   "# TYPE latency histogram",
+			want:   util.Comment{Keyword: "TYPE", Family: "latency", Text: "histogram"},
+			wantOK: true,
+		},
+		{name: "Empty Help", line: "# HELP up", want: util.Comment{Keyword: "HELP", Family: "up"}, wantOK: true},
+		{name: "Other Comment", line: "# a comment about b"},
+		{name: "No Family", line: "# TYPE"},
+		{name: "Sample", line: "up 1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := util.ParseComment(tt.line)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("ParseComment() = %+v, %v, want %+v, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestFamilyOf(t *testing.T) {
+	types := map[string]string{
+		"requests": "counter", "latency": "histogram", "rpc": "summary", "temperature": "gauge", "build": "",
+	}
+	tests := []struct {
+		name string
+		want string
+	}{
+		{name: "requests_total", want: "requests"},
+		{name: "latency_bucket", want: "latency"},
+		{name: "latency_created", want: "latency"},
+		{name: "rpc_count", want: "rpc"},
+		// Suffixes of other types don't belong to the family
+		{name: "rpc_bucket", want: "rpc_bucket"},
+		{name: "temperature_total", want: "temperature_total"},
+		// A family with only a HELP comment may be of any type
+		{name: "build_info", want: "build"},
+		{name: "latency", want: "latency"},
+		{name: "untyped_sum", want: "untyped_sum"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := util.FamilyOf(tt.name, types); got != tt.want {
+				t.Errorf("FamilyOf() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
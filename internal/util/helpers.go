@@ -44,11 +44,11 @@ func AppendLabels(metricsData, podName, namespace string) string {
 			// Insert the pod and namespace labels within the existing labels.
 			line = strings.Replace(line, "{", fmt.Sprintf("{k8s_pod_name=\"%s\",k8s_namespace=\"%s\",", podName, namespace), 1)
 		} else {
-			// Add the labels before the value (after the metric name).
+			// Add the labels before the value (after the metric name), which may be followed by a timestamp.
 			parts := strings.Fields(line)
-			if len(parts) == MetricPartsLength {
+			if len(parts) == MetricPartsLength || len(parts) == MetricPartsLength+1 {
 				metricName := parts[0]
-				metricValue := parts[1]
+				metricValue := strings.Join(parts[1:], " ")
 				line = fmt.Sprintf("%s{k8s_pod_name=\"%s\",k8s_namespace=\"%s\"} %s", metricName, podName, namespace, metricValue)
 			}
 		}
@@ -61,9 +61,25 @@ func AppendLabels(metricsData, podName, namespace string) string {
 
 // AppendUpMetric appends the 'up' metric to the existing metrics data based on the pod's scrape status.
 func AppendUpMetric(metricsData, podName, namespace string, status int) string {
+	return AppendUpMetricWithReason(metricsData, podName, namespace, status, "")
+}
+
+// AppendUpMetricWithReason is AppendUpMetric with a reason label on the 'up' metric, unless reason is empty.
+func AppendUpMetricWithReason(metricsData, podName, namespace string, status int, reason string) string {
 	// Generate the 'up' metric based on the status
-	upMetric := fmt.Sprintf("up{k8s_pod_name=\"%s\",k8s_namespace=\"%s\"} %d\n", podName, namespace, status)
+	labels := fmt.Sprintf("k8s_pod_name=\"%s\",k8s_namespace=\"%s\"", podName, namespace)
+	if reason != "" {
+		labels += fmt.Sprintf(",reason=\"%s\"", reason)
+	}
+	upMetric := fmt.Sprintf("up{%s} %d\n", labels, status)
 
 	// Append the 'up' metric to the metrics data
 	return fmt.Sprintf("%s\n%s", metricsData, upMetric)
 }
+
+// AppendAttemptsMetric appends the 'scrape_attempts' metric, the number of requests a scrape of the pod took,
+// to metrics data ending with its 'up' metric.
+func AppendAttemptsMetric(metricsData, podName, namespace string, attempts int) string {
+	return fmt.Sprintf("%sscrape_attempts{k8s_pod_name=\"%s\",k8s_namespace=\"%s\"} %d\n",
+		metricsData, podName, namespace, attempts)
+}
@@ -68,6 +68,15 @@ func TestAppendLabels(t *testing.T) {
 			},
 			want: "http_requests_total{k8s_pod_name=\"pod1\",k8s_namespace=\"default\"} 5",
 		},
+		{
+			name: "timestamped metric without labels",
+			args: args{
+				metricsData: "http_requests_total 5 1700000000000",
+				podName:     "pod1",
+				namespace:   "default",
+			},
+			want: "http_requests_total{k8s_pod_name=\"pod1\",k8s_namespace=\"default\"} 5 1700000000000",
+		},
 		{
 			name: "metric with existing labels",
 			args: args{
@@ -163,3 +172,19 @@ func TestAppendUpMetric(t *testing.T) {
 		})
 	}
 }
+
+func TestAppendUpMetricWithReason(t *testing.T) {
+	want := "\nup{k8s_pod_name=\"pod1\",k8s_namespace=\"default\",reason=\"limit_exceeded\"} 0\n"
+	if got := util.AppendUpMetricWithReason("", "pod1", "default", 0, "limit_exceeded"); got != want {
+		t.Errorf("AppendUpMetricWithReason() = %q, want %q", got, want)
+	}
+}
+
+func TestAppendAttemptsMetric(t *testing.T) {
+	up := util.AppendUpMetric("", "pod1", "default", 1)
+	want := "\nup{k8s_pod_name=\"pod1\",k8s_namespace=\"default\"} 1\n" +
+		"scrape_attempts{k8s_pod_name=\"pod1\",k8s_namespace=\"default\"} 2\n"
+	if got := util.AppendAttemptsMetric(up, "pod1", "default", 2); got != want {
+		t.Errorf("AppendAttemptsMetric() = %q, want %q", got, want)
+	}
+}